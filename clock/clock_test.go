@@ -0,0 +1,82 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeAfter(t *testing.T) {
+	start := time.Unix(1000, 0)
+	f := NewFake(start)
+	c := f.After(time.Second)
+	f.Advance(999 * time.Millisecond)
+	select {
+	case <-c:
+		t.Fatal("After fired early")
+	default:
+	}
+	f.Advance(time.Millisecond)
+	select {
+	case at := <-c:
+		if !at.Equal(start.Add(time.Second)) {
+			t.Errorf("fired at %v, want %v", at, start.Add(time.Second))
+		}
+	default:
+		t.Fatal("After did not fire")
+	}
+	if f.Waiters() != 0 {
+		t.Errorf("expected the fired timer to be removed, %d left", f.Waiters())
+	}
+	select {
+	case <-f.After(0):
+	default:
+		t.Error("expected After(0) to fire right away")
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+	tk := f.NewTicker(time.Minute)
+	f.Advance(time.Minute)
+	<-tk.C()
+	// a ticker falling behind drops ticks
+	f.Advance(3 * time.Minute)
+	<-tk.C()
+	select {
+	case <-tk.C():
+		t.Fatal("expected the ticks missed meanwhile to be dropped")
+	default:
+	}
+	if got := f.Now(); !got.Equal(time.Unix(240, 0)) {
+		t.Errorf("Now = %v after advancing 4 minutes", got)
+	}
+	tk.Stop()
+	f.Advance(time.Hour)
+	select {
+	case <-tk.C():
+		t.Error("a stopped ticker ticked")
+	default:
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+	done := make(chan struct{})
+	go func() {
+		<-f.After(time.Second)
+		close(done)
+	}()
+	f.BlockUntil(1)
+	f.Advance(time.Second)
+	<-done
+}
+
+func TestOr(t *testing.T) {
+	if Or(nil) != Real {
+		t.Error("expected the real clock for nil")
+	}
+	f := NewFake(time.Now())
+	if Or(f) != Clock(f) {
+		t.Error("expected the given clock")
+	}
+}
@@ -8,19 +8,25 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"os/signal"
 	"strings"
-	"syscall"
 
 	"github.com/peterbourgon/ff/v4"
 	"github.com/peterbourgon/ff/v4/ffhelp"
 )
 
-var configPath string
+var (
+	configPath      string
+	testOnly        bool
+	benchmark       bool
+	effectiveConfig bool
+)
 
 func main() {
 	fs := ff.NewFlags("Bepass")
 	fs.StringVar(&configPath, 'c', "config", "./config.json", "Path to configuration file")
+	fs.BoolVar(&testOnly, 't', "test", false, "Test connectivity with the configuration and exit")
+	fs.BoolVar(&benchmark, 'b', "benchmark", false, "Measure the overhead of fragmentation with the configuration and exit")
+	fs.BoolVar(&effectiveConfig, 'e', "effective-config", false, "Print the effective configuration as JSON and exit")
 
 	err := ff.Parse(fs, os.Args[1:])
 	switch {
@@ -38,14 +44,49 @@ func main() {
 		logger.Fatal("", err)
 	}
 
-	// Run the server with the loaded configuration
-	err = core.RunServer(config, true)
+	if testOnly {
+		report := core.TestConnectivity(config)
+		fmt.Print(report)
+		if !report.OK() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if benchmark {
+		report := core.Benchmark(config)
+		fmt.Print(report)
+		if !report.OK() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if effectiveConfig {
+		in, err := core.NewInstance(config)
+		if err != nil {
+			logger.Fatal("", err)
+		}
+		defer in.Close()
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(in.EffectiveConfig()); err != nil {
+			logger.Fatal("", err)
+		}
+		return
+	}
+
+	if runService(config) {
+		return
+	}
+
+	// Run the server with the loaded configuration, it returns once an
+	// interrupt or SIGTERM shut it down
+	err = core.RunServer(config, true, nil)
 	if err != nil {
 		logger.Fatal("", err)
 	}
-
-	// Handle graceful shutdown
-	handleShutdown()
+	fmt.Println("Shutting down gracefully...")
 }
 
 func loadConfig(configPath string) (*core.Config, error) {
@@ -67,15 +108,3 @@ func loadConfig(configPath string) (*core.Config, error) {
 
 	return config, nil
 }
-
-func handleShutdown() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-
-	// Block until a signal is received.
-	<-c
-
-	// Perform cleanup or shutdown tasks here.
-	fmt.Println("Shutting down gracefully...")
-	os.Exit(0)
-}
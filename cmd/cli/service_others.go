@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import "bepass/cmd/core"
+
+// runService reports whether the process was started by a service manager and
+// ran as a service. systemd and launchd run bepass as a plain process and stop
+// it with SIGTERM, which RunServer already handles.
+func runService(*core.Config) bool {
+	return false
+}
@@ -0,0 +1,70 @@
+//go:build windows
+
+package main
+
+import (
+	"bepass/cmd/core"
+	"bepass/logger"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+const serviceName = "bepass"
+
+// service runs a core.Instance under the Windows service control manager.
+type service struct {
+	config *core.Config
+}
+
+// Execute implements svc.Handler.
+func (s *service) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	in, err := core.NewInstance(s.config)
+	if err != nil {
+		logger.Errorf("failed to create instance: %v", err)
+		return true, 1
+	}
+	if err := in.Start(); err != nil {
+		logger.Errorf("failed to start: %v", err)
+		in.Close()
+		return true, 1
+	}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- in.Wait() }()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-stopped:
+			_ = in.Stop()
+			if err != nil {
+				logger.Errorf("server stopped: %v", err)
+				return true, 1
+			}
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				_ = in.Stop()
+				return false, 0
+			}
+		}
+	}
+}
+
+// runService reports whether the process was started by the service control
+// manager and ran as a service.
+func runService(config *core.Config) bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+	if err := svc.Run(serviceName, &service{config: config}); err != nil {
+		logger.Fatal("", err)
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package core
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeTLS returns the TLS config of the listener for BindAddress with
+// ACMEEnabled: its certificate for ACMEDomains is obtained from Let's Encrypt
+// on the first handshake and renewed before it expires, kept in ACMECacheDir
+// across restarts. The domains are validated with the TLS-ALPN-01 challenge,
+// so the listener has to be reachable on port 443 of each of them.
+func acmeTLS(config *Config) (*tls.Config, error) {
+	if len(config.ACMEDomains) == 0 {
+		return nil, errors.New("ACMEEnabled without ACMEDomains")
+	}
+	if config.BindTLSCert != "" || config.BindTLSKey != "" {
+		return nil, errors.New("ACMEEnabled and BindTLSCert can not be both set")
+	}
+	dir := config.ACMECacheDir
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("no ACMECacheDir, %v", err)
+		}
+		dir = filepath.Join(cache, "bepass", "acme")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(config.ACMEDomains...),
+		Email:      config.ACMEEmail,
+		Cache:      autocert.DirCache(dir),
+	}
+	tlsConfig := &tls.Config{GetCertificate: m.GetCertificate, MinVersion: tls.VersionTLS12}
+	// the challenge protocol is only offered to the validation handshakes,
+	// whose clients ask for it, the proxy clients negotiate no protocol
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, proto := range hello.SupportedProtos {
+			if proto == acme.ALPNProto {
+				challenge := tlsConfig.Clone()
+				challenge.NextProtos = []string{acme.ALPNProto}
+				return challenge, nil
+			}
+		}
+		return nil, nil
+	}
+	return tlsConfig, nil
+}
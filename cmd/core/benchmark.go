@@ -0,0 +1,182 @@
+package core
+
+import (
+	"bepass/server"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// BenchmarkURL is the HTTPS URL Benchmark downloads, a speed test endpoint
+// serving a large enough body to measure the throughput.
+var BenchmarkURL = "https://speed.cloudflare.com/__down?bytes=10000000"
+
+// BenchmarkRounds is the number of downloads each measurement is averaged over.
+var BenchmarkRounds = 3
+
+const benchmarkTimeout = 2 * time.Minute
+
+// benchmarkRootCAs verifies the certificate of BenchmarkURL, the system roots
+// if nil.
+var benchmarkRootCAs *x509.CertPool
+
+// BenchmarkResult is the mean of the downloads made with or without
+// fragmentation.
+type BenchmarkResult struct {
+	// Handshake is the time to a TLS connection to the endpoint, the proxy
+	// dialing it and the handshake included
+	Handshake time.Duration
+	// Throughput is the download rate in bytes per second
+	Throughput float64
+	Err        error
+}
+
+// BenchmarkReport is the result of Benchmark.
+type BenchmarkReport struct {
+	Fragmented BenchmarkResult
+	Plain      BenchmarkResult
+}
+
+// OK reports whether both measurements succeeded.
+func (r BenchmarkReport) OK() bool {
+	return r.Fragmented.Err == nil && r.Plain.Err == nil
+}
+
+// HandshakeDelta returns the time fragmentation adds to the handshake.
+func (r BenchmarkReport) HandshakeDelta() time.Duration {
+	return r.Fragmented.Handshake - r.Plain.Handshake
+}
+
+// ThroughputDelta returns the change of the throughput with fragmentation,
+// as a fraction of the throughput without it.
+func (r BenchmarkReport) ThroughputDelta() float64 {
+	if r.Plain.Throughput == 0 {
+		return 0
+	}
+	return r.Fragmented.Throughput/r.Plain.Throughput - 1
+}
+
+// String formats the report as one line per measurement and one for the delta.
+func (r BenchmarkReport) String() string {
+	var b strings.Builder
+	line := func(name string, res BenchmarkResult) {
+		if res.Err != nil {
+			fmt.Fprintf(&b, "%-10s FAIL %v\n", name, res.Err)
+			return
+		}
+		fmt.Fprintf(&b, "%-10s handshake %v, %.2f MB/s\n", name, res.Handshake.Round(time.Millisecond), res.Throughput/1e6)
+	}
+	line("fragmented", r.Fragmented)
+	line("plain", r.Plain)
+	if r.OK() {
+		fmt.Fprintf(&b, "%-10s handshake %+v, throughput %+.1f%%\n", "delta",
+			r.HandshakeDelta().Round(time.Millisecond), r.ThroughputDelta()*100)
+	}
+	return b.String()
+}
+
+// Benchmark measures the overhead of fragmentation with the settings of
+// config. Like TestConnectivity it starts temporary proxies on loopback
+// ports, one splitting every ClientHello and one never doing so, and
+// downloads BenchmarkURL BenchmarkRounds times through each, reporting the
+// mean handshake time and throughput of both.
+func Benchmark(config *Config) BenchmarkReport {
+	return BenchmarkReport{
+		Fragmented: benchmarkMode(config, server.FragmentAlways),
+		Plain:      benchmarkMode(config, server.FragmentNever),
+	}
+}
+
+// benchmarkMode runs the downloads through a proxy using the fragmentation
+// mode.
+func benchmarkMode(config *Config, mode server.FragmentMode) BenchmarkResult {
+	cfg := *config
+	cfg.Fragmentation = string(mode)
+	addr, err := freeLoopbackAddr()
+	if err != nil {
+		return BenchmarkResult{Err: err}
+	}
+	cfg.BindAddress = addr
+	in, err := NewInstance(&cfg)
+	if err != nil {
+		return BenchmarkResult{Err: err}
+	}
+	defer in.Stop()
+	if err := in.Start(); err != nil {
+		return BenchmarkResult{Err: err}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), benchmarkTimeout)
+	defer cancel()
+	rounds := BenchmarkRounds
+	if rounds <= 0 {
+		rounds = 1
+	}
+	var res BenchmarkResult
+	for i := 0; i < rounds; i++ {
+		handshake, throughput, err := benchmarkDownload(ctx, addr)
+		if err != nil {
+			return BenchmarkResult{Err: err}
+		}
+		res.Handshake += handshake / time.Duration(rounds)
+		res.Throughput += throughput / float64(rounds)
+	}
+	return res
+}
+
+// benchmarkDownload downloads BenchmarkURL on a new connection through the
+// socks5 proxy at proxyAddr.
+func benchmarkDownload(ctx context.Context, proxyAddr string) (time.Duration, float64, error) {
+	d, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
+	if err != nil {
+		return 0, 0, err
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return 0, 0, errors.New("socks5 dialer does not support contexts")
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return cd.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig:   &tls.Config{RootCAs: benchmarkRootCAs},
+		DisableKeepAlives: true,
+	}}
+
+	begin := time.Now()
+	var connected time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) { connected = time.Now() },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, BenchmarkURL, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return 0, 0, err
+	}
+	elapsed := time.Since(connected)
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	return connected.Sub(begin), float64(n) / elapsed.Seconds(), nil
+}
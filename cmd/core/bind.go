@@ -0,0 +1,52 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+var (
+	// ErrBindInUse is matched by the errors of listeners whose address is
+	// already in use
+	ErrBindInUse = errors.New("address already in use")
+	// ErrBindPermission is matched by the errors of listeners not allowed to
+	// bind their address, like a privileged port
+	ErrBindPermission = errors.New("permission denied")
+)
+
+// BindError is returned by Start, Wait and RunServer when a listener could
+// not bind its address. errors.Is tells ErrBindInUse and ErrBindPermission
+// apart, and the error of the system stays reachable with errors.As.
+type BindError struct {
+	Address string
+	Err     error
+}
+
+func (e *BindError) Error() string {
+	return fmt.Sprintf("failed to listen on %s, %v", e.Address, e.Err)
+}
+
+func (e *BindError) Unwrap() error { return e.Err }
+
+// Is matches ErrBindInUse and ErrBindPermission from the cause of e.
+func (e *BindError) Is(target error) bool {
+	switch target {
+	case ErrBindInUse:
+		return errors.Is(e.Err, errAddrInUse)
+	case ErrBindPermission:
+		return errors.Is(e.Err, os.ErrPermission)
+	}
+	return false
+}
+
+// bindError wraps err in a BindError when listening on addr failed, it is
+// returned unchanged otherwise.
+func bindError(addr string, err error) error {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "listen" {
+		return &BindError{Address: addr, Err: err}
+	}
+	return err
+}
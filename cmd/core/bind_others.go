@@ -0,0 +1,8 @@
+//go:build !windows
+
+package core
+
+import "syscall"
+
+// errAddrInUse is the error of the system for an address already in use.
+var errAddrInUse error = syscall.EADDRINUSE
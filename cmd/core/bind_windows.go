@@ -0,0 +1,8 @@
+//go:build windows
+
+package core
+
+import "golang.org/x/sys/windows"
+
+// errAddrInUse is the error of the system for an address already in use.
+var errAddrInUse error = windows.WSAEADDRINUSE
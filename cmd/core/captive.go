@@ -0,0 +1,81 @@
+package core
+
+import (
+	"bepass/dialer"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// DefaultCaptivePortalURL is the probe CaptivePortalURL defaults to, the one
+// Android fetches, answering an empty 204 unless a portal is in the way.
+const DefaultCaptivePortalURL = "http://connectivitycheck.gstatic.com/generate_204"
+
+// captivePortalBody bounds what is read of the page of a portal.
+const captivePortalBody = 4 << 10
+
+// CaptivePortalError is the error of the checks failing because the network
+// holds the traffic back until its captive portal is signed in to, as the
+// hotel and airport networks do. Portal is the page to sign in on.
+type CaptivePortalError struct {
+	Portal string
+}
+
+func (e *CaptivePortalError) Error() string {
+	return fmt.Sprintf("captive portal at %s, sign in to the network first", e.Portal)
+}
+
+// DetectCaptivePortal fetches probeURL, an HTTP page answering an empty 204,
+// outside the tunnel, connected to by d, or directly if d is nil, as the
+// operating systems do: a portal intercepts the plain DNS and HTTP to send the
+// clients to its page, which no DoH query or tunnel gets through. It returns a
+// *CaptivePortalError when the probe is redirected or answered anything else,
+// and the error of the request when the network does not answer at all.
+func DetectCaptivePortal(ctx context.Context, d *dialer.Dialer, probeURL string) error {
+	if probeURL == "" {
+		probeURL = DefaultCaptivePortalURL
+	}
+	dial := (&net.Dialer{}).DialContext
+	if d != nil {
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := d.TCPDialContext(ctx, network, addr, "")
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dial,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, captivePortalBody))
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return nil
+	case resp.StatusCode == http.StatusOK && len(body) == 0:
+		// some networks turn the 204 into an empty 200 on the way
+		return nil
+	}
+	portal := probeURL
+	if location, err := resp.Location(); err == nil {
+		portal = location.String()
+	}
+	return &CaptivePortalError{Portal: portal}
+}
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"bepass/utils"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ConnectivityTestHost is the HTTPS host TestConnectivity resolves and connects to.
+var ConnectivityTestHost = "www.google.com"
+
+const connectivityTimeout = 30 * time.Second
+
+// Stage is the outcome of one step of a connectivity test.
+type Stage struct {
+	Name    string
+	Skipped bool
+	Latency time.Duration
+	Err     error
+}
+
+// Report is the result of TestConnectivity, one Stage per step of the pipeline.
+type Report struct {
+	Stages []Stage
+}
+
+// OK reports whether no stage failed.
+func (r Report) OK() bool {
+	for _, s := range r.Stages {
+		if s.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the report as one line per stage.
+func (r Report) String() string {
+	var b strings.Builder
+	for _, s := range r.Stages {
+		switch {
+		case s.Skipped:
+			fmt.Fprintf(&b, "%-8s skipped\n", s.Name)
+		case s.Err != nil:
+			fmt.Fprintf(&b, "%-8s FAIL %v (%v)\n", s.Name, s.Err, s.Latency.Round(time.Millisecond))
+		default:
+			fmt.Fprintf(&b, "%-8s ok   %v\n", s.Name, s.Latency.Round(time.Millisecond))
+		}
+	}
+	return b.String()
+}
+
+func (r *Report) run(name string, f func() error) {
+	begin := time.Now()
+	err := f()
+	r.Stages = append(r.Stages, Stage{Name: name, Latency: time.Since(begin), Err: err})
+}
+
+func (r *Report) skip(name string) {
+	r.Stages = append(r.Stages, Stage{Name: name, Skipped: true})
+}
+
+// TestConnectivity checks the pipeline described by config end to end without
+// touching a running instance. It starts a temporary proxy on a loopback port
+// and then, stage by stage: looks for a captive portal at CaptivePortalURL,
+// stopping there if one is in the way, resolves ConnectivityTestHost through
+// the configured DNS, completes a fragmented TLS handshake with the worker,
+// opens a tunnel through it, and finally completes a TLS handshake with
+// ConnectivityTestHost through the proxy. Stages that do not apply to the
+// config are skipped.
+func TestConnectivity(config *Config) Report {
+	var r Report
+
+	cfg := *config
+	var in *Instance
+	r.run("setup", func() error {
+		addr, err := freeLoopbackAddr()
+		if err != nil {
+			return err
+		}
+		cfg.BindAddress = addr
+		in, err = NewInstance(&cfg)
+		return err
+	})
+	if in == nil {
+		return r
+	}
+	defer in.Stop()
+	if err := in.Start(); err != nil {
+		r.Stages[0].Err = err
+		return r
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectivityTimeout)
+	defer cancel()
+
+	if cfg.ParanoidMode {
+		// the probe would go out in the clear
+		r.skip("portal")
+	} else {
+		r.run("portal", func() error {
+			// a probe not answered is no portal, the network may block its host
+			var portal *CaptivePortalError
+			if err := DetectCaptivePortal(ctx, in.dialer, cfg.CaptivePortalURL); errors.As(err, &portal) {
+				return err
+			}
+			return nil
+		})
+	}
+	if r.Stages[len(r.Stages)-1].Err != nil {
+		// nothing gets through before the portal is signed in to
+		return r
+	}
+
+	host := ConnectivityTestHost
+	r.run("resolve", func() error {
+		_, err := in.handler.ResolveContext(ctx, host)
+		return err
+	})
+
+	if cfg.WorkerEnabled {
+		r.run("worker", func() error {
+			u, err := url.Parse(cfg.WorkerAddress)
+			if err != nil {
+				return err
+			}
+			return tlsThroughProxy(ctx, cfg.BindAddress, u.Hostname())
+		})
+	} else {
+		r.skip("worker")
+	}
+
+	if cfg.WorkerEnabled && !cfg.WorkerDNSOnly {
+		r.run("tunnel", func() error {
+			tunnelEndpoint, err := utils.WSEndpointHelper(cfg.WorkerAddress, net.JoinHostPort(host, "443"), "tcp")
+			if err != nil {
+				return err
+			}
+			conn, err := in.tunnel.DialContext(ctx, tunnelEndpoint)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		})
+	} else {
+		r.skip("tunnel")
+	}
+
+	r.run("dial", func() error {
+		return tlsThroughProxy(ctx, cfg.BindAddress, host)
+	})
+	return r
+}
+
+// tlsThroughProxy completes a TLS handshake with host through the socks5 proxy
+// at proxyAddr. The certificate is verified, so an injected block page fails.
+func tlsThroughProxy(ctx context.Context, proxyAddr, host string) error {
+	d, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
+	if err != nil {
+		return err
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return errors.New("socks5 dialer does not support contexts")
+	}
+	conn, err := cd.DialContext(ctx, "tcp", net.JoinHostPort(host, "443"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return tls.Client(conn, &tls.Config{ServerName: host}).HandshakeContext(ctx)
+}
+
+func freeLoopbackAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
@@ -4,58 +4,332 @@ import (
 	"bepass/bufferpool"
 	"bepass/dialer"
 	"bepass/doh"
+	"bepass/endpoint"
+	"bepass/logger"
 	"bepass/resolve"
 	"bepass/server"
 	"bepass/socks5"
 	"bepass/transport"
 	"bepass/utils"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 type Config struct {
-	TLSHeaderLength        int             `mapstructure:"TLSHeaderLength"`
-	TLSPaddingEnabled      bool            `mapstructure:"TLSPaddingEnabled"`
-	TLSPaddingSize         [2]int          `mapstructure:"TLSPaddingSize"`
-	DnsCacheTTL            int             `mapstructure:"DnsCacheTTL"`
-	DnsRequestTimeout      int             `mapstructure:"DnsRequestTimeout"`
-	WorkerAddress          string          `mapstructure:"WorkerAddress"`
-	WorkerIPPortAddress    string          `mapstructure:"WorkerIPPortAddress"`
-	WorkerEnabled          bool            `mapstructure:"WorkerEnabled"`
-	WorkerDNSOnly          bool            `mapstructure:"WorkerDNSOnly"`
-	EnableLowLevelSockets  bool            `mapstructure:"EnableLowLevelSockets"`
-	EnableDNSFragmentation bool            `mapstructure:"EnableDNSFragmentation"`
-	RemoteDNSAddr          string          `mapstructure:"RemoteDNSAddr"`
-	BindAddress            string          `mapstructure:"BindAddress"`
-	UDPBindAddress         string          `mapstructure:"UDPBindAddress"`
-	ChunksLengthBeforeSni  [2]int          `mapstructure:"ChunksLengthBeforeSni"`
-	UDPReadTimeout         int             `mapstructure:"UDPReadTimeout"`
-	UDPWriteTimeout        int             `mapstructure:"UDPWriteTimeout"`
-	UDPLinkIdleTimeout     int64           `mapstructure:"UDPLinkIdleTimeout"`
-	SniChunksLength        [2]int          `mapstructure:"SniChunksLength"`
-	ChunksLengthAfterSni   [2]int          `mapstructure:"ChunksLengthAfterSni"`
-	DelayBetweenChunks     [2]int          `mapstructure:"DelayBetweenChunks"`
-	Hosts                  []resolve.Hosts `mapstructure:"Hosts"`
-	ResolveSystem          string          `mapstructure:"-"`
-	DoHClient              *doh.Client     `mapstructure:"-"`
-}
-
-var s5 *socks5.Server
-
-func RunServer(config *Config, captureCTRLC bool) error {
-	appCache := utils.NewCache(time.Duration(config.DnsCacheTTL) * time.Second)
+	TLSHeaderLength         int                  `mapstructure:"TLSHeaderLength"`
+	TLSPaddingEnabled       bool                 `mapstructure:"TLSPaddingEnabled"`
+	TLSPaddingSize          [2]int               `mapstructure:"TLSPaddingSize"`
+	ALPNProtocols           []string             `mapstructure:"ALPNProtocols"`
+	TLSFingerprint          string               `mapstructure:"TLSFingerprint"`
+	TLSMinVersion           string               `mapstructure:"TLSMinVersion"`
+	TLSMaxVersion           string               `mapstructure:"TLSMaxVersion"`
+	RandomizeSourcePort     bool                 `mapstructure:"RandomizeSourcePort"`
+	UpstreamProxy           string               `mapstructure:"UpstreamProxy"`
+	DnsCacheTTL             int                  `mapstructure:"DnsCacheTTL"`
+	DnsRequestTimeout       int                  `mapstructure:"DnsRequestTimeout"`
+	WorkerAddress           string               `mapstructure:"WorkerAddress"`
+	TunnelEndpoints         []string             `mapstructure:"TunnelEndpoints"`
+	WorkerIPPortAddress     string               `mapstructure:"WorkerIPPortAddress"`
+	WorkerEnabled           bool                 `mapstructure:"WorkerEnabled"`
+	WorkerDNSOnly           bool                 `mapstructure:"WorkerDNSOnly"`
+	WorkerHTTP2             bool                 `mapstructure:"WorkerHTTP2"`
+	WorkerMaxIdleConns      int                  `mapstructure:"WorkerMaxIdleConns"`
+	WorkerMaxConnLifetime   int                  `mapstructure:"WorkerMaxConnLifetime"`
+	WorkerIdleConnTimeout   int                  `mapstructure:"WorkerIdleConnTimeout"`
+	WorkerHandshakeTimeout  int                  `mapstructure:"WorkerHandshakeTimeout"`
+	MaxChannelsPerTunnel    int                  `mapstructure:"MaxChannelsPerTunnel"`
+	WorkerStreamMode        bool                 `mapstructure:"WorkerStreamMode"`
+	WorkerUDPTransport      string               `mapstructure:"WorkerUDPTransport"`
+	TunnelSelectionStrategy string               `mapstructure:"TunnelSelectionStrategy"`
+	WorkerIPStrategy        string               `mapstructure:"WorkerIPStrategy"`
+	WorkerWeights           map[string]float64   `mapstructure:"WorkerWeights"`
+	WorkerKeepAliveInterval int                  `mapstructure:"WorkerKeepAliveInterval"`
+	WorkerLazyStart         bool                 `mapstructure:"WorkerLazyStart"`
+	WorkerWarmStandby       bool                 `mapstructure:"WorkerWarmStandby"`
+	DebugPcapFile           string               `mapstructure:"DebugPcapFile"`
+	SharedTunnelListen      string               `mapstructure:"SharedTunnelListen"`
+	SharedTunnelSocket      string               `mapstructure:"SharedTunnelSocket"`
+	WorkerVerifyTLS         bool                 `mapstructure:"WorkerVerifyTLS"`
+	WorkerTLSHostname       string               `mapstructure:"WorkerTLSHostname"`
+	WorkerClientCert        string               `mapstructure:"WorkerClientCert"`
+	WorkerClientKey         string               `mapstructure:"WorkerClientKey"`
+	EnableLowLevelSockets   bool                 `mapstructure:"EnableLowLevelSockets"`
+	EnableDNSFragmentation  bool                 `mapstructure:"EnableDNSFragmentation"`
+	RemoteDNSAddr           string               `mapstructure:"RemoteDNSAddr"`
+	RemoteDNSFormat         string               `mapstructure:"RemoteDNSFormat"`
+	RemoteDNSPathSuffix     string               `mapstructure:"RemoteDNSPathSuffix"`
+	RemoteDNSHeaders        map[string]string    `mapstructure:"RemoteDNSHeaders"`
+	RemoteDNSFallbacks      []string             `mapstructure:"RemoteDNSFallbacks"`
+	RemoteDNSRetryRcodes    []string             `mapstructure:"RemoteDNSRetryRcodes"`
+	BootstrapDNS            string               `mapstructure:"BootstrapDNS"`
+	DoHEndpointIP           string               `mapstructure:"DoHEndpointIP"`
+	ParanoidMode            bool                 `mapstructure:"ParanoidMode"`
+	BindAddress             string               `mapstructure:"BindAddress"`
+	UDPBindAddress          string               `mapstructure:"UDPBindAddress"`
+	Listeners               []Listener           `mapstructure:"Listeners"`
+	BindTLSCert             string               `mapstructure:"BindTLSCert"`
+	BindTLSKey              string               `mapstructure:"BindTLSKey"`
+	ACMEEnabled             bool                 `mapstructure:"ACMEEnabled"`
+	ACMEDomains             []string             `mapstructure:"ACMEDomains"`
+	ACMEEmail               string               `mapstructure:"ACMEEmail"`
+	ACMECacheDir            string               `mapstructure:"ACMECacheDir"`
+	ChunksLengthBeforeSni   [2]int               `mapstructure:"ChunksLengthBeforeSni"`
+	UDPReadTimeout          int                  `mapstructure:"UDPReadTimeout"`
+	UDPWriteTimeout         int                  `mapstructure:"UDPWriteTimeout"`
+	UDPLinkIdleTimeout      int64                `mapstructure:"UDPLinkIdleTimeout"`
+	UDPRetransmitBuffer     int                  `mapstructure:"UDPRetransmitBuffer"`
+	SniChunksLength         [2]int               `mapstructure:"SniChunksLength"`
+	ChunksLengthAfterSni    [2]int               `mapstructure:"ChunksLengthAfterSni"`
+	DelayBetweenChunks      [2]int               `mapstructure:"DelayBetweenChunks"`
+	DelayBetweenChunksMicro [2]int               `mapstructure:"DelayBetweenChunksMicro"`
+	Fragmentation           string               `mapstructure:"Fragmentation"`
+	FragmentRetries         int                  `mapstructure:"FragmentRetries"`
+	FragmentRetryTimeout    int                  `mapstructure:"FragmentRetryTimeout"`
+	BlockQUIC               bool                 `mapstructure:"BlockQUIC"`
+	DisableIPv6             bool                 `mapstructure:"DisableIPv6"`
+	PreferIPv6              bool                 `mapstructure:"PreferIPv6"`
+	Hosts                   []resolve.Hosts      `mapstructure:"Hosts"`
+	WorkerBypass            []string             `mapstructure:"WorkerBypass"`
+	RouteFiles              []RouteFile          `mapstructure:"RouteFiles"`
+	DestinationRewrites     []DestinationRewrite `mapstructure:"DestinationRewrites"`
+	SNIOverrides            map[string]string    `mapstructure:"SNIOverrides"`
+	DefaultRoute            string               `mapstructure:"DefaultRoute"`
+	GFWListURL              string               `mapstructure:"GFWListURL"`
+	MaxBytesPerSecond       int                  `mapstructure:"MaxBytesPerSecond"`
+	GlobalMaxBytesPerSecond int                  `mapstructure:"GlobalMaxBytesPerSecond"`
+	WorkerProxyProtocol     int                  `mapstructure:"WorkerProxyProtocol"`
+	AcceptProxyProtocol     bool                 `mapstructure:"AcceptProxyProtocol"`
+	TCPKeepalive            utils.KeepAlive      `mapstructure:"TCPKeepalive"`
+	EnableSplice            bool                 `mapstructure:"EnableSplice"`
+	RelayBufferSize         int                  `mapstructure:"RelayBufferSize"`
+	ConnectionIdleTimeout   int                  `mapstructure:"ConnectionIdleTimeout"`
+	DnsCacheBackend         string               `mapstructure:"DnsCacheBackend"`
+	DnsCacheStaleWindow     int                  `mapstructure:"DnsCacheStaleWindow"`
+	DnsCacheJitter          int                  `mapstructure:"DnsCacheJitter"`
+	DoHQueryJitter          int                  `mapstructure:"DoHQueryJitter"`
+	DnsMinTTL               map[string]int       `mapstructure:"DnsMinTTL"`
+	DnsMaxTTL               map[string]int       `mapstructure:"DnsMaxTTL"`
+	DnsMinTTLHosts          map[string]int       `mapstructure:"DnsMinTTLHosts"`
+	StickyIPTTL             int                  `mapstructure:"StickyIPTTL"`
+	DnsQueryLog             string               `mapstructure:"DnsQueryLog"`
+	DnsRefuseANY            bool                 `mapstructure:"DnsRefuseANY"`
+	DnsInterceptUDP         bool                 `mapstructure:"DnsInterceptUDP"`
+	DnsPlainFallback        string               `mapstructure:"DnsPlainFallback"`
+	HostsURLs               []string             `mapstructure:"HostsURLs"`
+	SubscriptionURLs        []string             `mapstructure:"SubscriptionURLs"`
+	RemoteListsRefresh      int                  `mapstructure:"RemoteListsRefresh"`
+	LogPrivacy              string               `mapstructure:"LogPrivacy"`
+	LogFile                 string               `mapstructure:"LogFile"`
+	LogMaxSizeMB            int                  `mapstructure:"LogMaxSizeMB"`
+	LogMaxBackups           int                  `mapstructure:"LogMaxBackups"`
+	LogMaxAgeDays           int                  `mapstructure:"LogMaxAgeDays"`
+	RedisAddress            string               `mapstructure:"RedisAddress"`
+	RedisPassword           string               `mapstructure:"RedisPassword"`
+	RedisDB                 int                  `mapstructure:"RedisDB"`
+	NetworkMonitor          bool                 `mapstructure:"NetworkMonitor"`
+	HealthAddress           string               `mapstructure:"HealthAddress"`
+	CaptivePortalURL        string               `mapstructure:"CaptivePortalURL"`
+	ResolveSystem           string               `mapstructure:"-"`
+	DoHClient               *doh.Client          `mapstructure:"-"`
+	DialResolver            dialer.Resolver      `mapstructure:"-"`
+	DoHHTTPClient           *http.Client         `mapstructure:"-"`
+	Hooks                   *server.Hooks        `mapstructure:"-"`
+	Tracer                  server.Tracer        `mapstructure:"-"`
+	Authorize               socks5.AuthorizeFunc `mapstructure:"-"`
+
+	DialCandidateFilter dialer.DialCandidateFilter `mapstructure:"-"`
+}
+
+var current *Instance
+
+// Instance holds the components wired together from a Config.
+type Instance struct {
+	handler   *server.Server
+	dialer    *dialer.Dialer
+	tunnel    *transport.WSTunnel
+	resolver  *resolve.LocalResolver
+	endpoints *endpoint.Pool
+	workerIPs *endpoint.Pool
+	queryLog  *resolve.QueryLog
+	logFile   *logger.RotatingFile
+	effective EffectiveConfig
+	config    *Config
+	listeners []listener
+	// workerOffline is set while WorkerLazyStart waits for a worker to answer
+	workerOffline atomic.Bool
+
+	// portalMu guards the result of the last probe for a captive portal,
+	// portal, and when it was made, portalAt
+	portalMu sync.Mutex
+	portal   string
+	portalAt time.Time
+
+	mu        sync.Mutex
+	addr      net.Addr
+	srvs      []*socks5.Server
+	cancel    context.CancelFunc
+	done      chan struct{}
+	err       error
+	stopOnce  sync.Once
+	closeOnce sync.Once
+}
+
+// NewInstance wires the components described by config. Nothing is started
+// until the instance gets a socks server.
+func NewInstance(config *Config) (*Instance, error) {
+	tunnelEndpoints := make([]string, 0, len(config.TunnelEndpoints))
+	for _, entry := range config.TunnelEndpoints {
+		e, err := endpoint.ParseEndpoint(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TunnelEndpoints, %v", err)
+		}
+		tunnelEndpoints = append(tunnelEndpoints, e)
+	}
+	if config.WorkerAddress == "" && len(tunnelEndpoints) > 0 {
+		// the first endpoint stands for the worker where a single one is used
+		c := *config
+		c.WorkerAddress = tunnelEndpoints[0]
+		config = &c
+	}
+	if config.ParanoidMode {
+		var err error
+		if config, err = paranoidConfig(config); err != nil {
+			return nil, err
+		}
+	}
+
+	cacheBackend := config.DnsCacheBackend
+	if cacheBackend == "" {
+		cacheBackend = "memory"
+	}
+	var appCache utils.CacheStore
+	switch cacheBackend {
+	case "memory":
+		memCache := utils.NewCache(time.Duration(config.DnsCacheTTL) * time.Second)
+		memCache.SetStaleWindow(time.Duration(config.DnsCacheStaleWindow) * time.Second)
+		memCache.SetJitter(time.Duration(config.DnsCacheJitter) * time.Second)
+		appCache = memCache
+	case "redis":
+		password, err := utils.ResolveSecret(config.RedisPassword)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RedisPassword, %v", err)
+		}
+		appCache = utils.NewRedisCache(config.RedisAddress, password, config.RedisDB,
+			time.Duration(config.DnsCacheTTL)*time.Second)
+	default:
+		return nil, fmt.Errorf("unknown dns cache backend %q", config.DnsCacheBackend)
+	}
+
+	if err := dialer.ValidateFingerprint(config.TLSFingerprint); err != nil {
+		return nil, err
+	}
+	upstreamProxy, err := utils.ResolveSecret(config.UpstreamProxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UpstreamProxy, %v", err)
+	}
+	if err := dialer.ValidateUpstreamProxy(upstreamProxy); err != nil {
+		return nil, err
+	}
+	tlsMinVersion, err := dialer.ParseTLSVersion(config.TLSMinVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLSMinVersion, %v", err)
+	}
+	tlsMaxVersion, err := dialer.ParseTLSVersion(config.TLSMaxVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLSMaxVersion, %v", err)
+	}
+	if tlsMinVersion != 0 && tlsMaxVersion != 0 && tlsMinVersion > tlsMaxVersion {
+		return nil, fmt.Errorf("TLSMinVersion %s is above TLSMaxVersion %s", config.TLSMinVersion, config.TLSMaxVersion)
+	}
+
+	listeners_, err := listeners(config)
+	if err != nil {
+		return nil, err
+	}
+
+	logPrivacy := logger.Privacy(config.LogPrivacy)
+	if logPrivacy == "" {
+		logPrivacy = logger.PrivacyHash
+	}
+	if err := logger.SetPrivacy(logPrivacy); err != nil {
+		return nil, err
+	}
+
+	fragmentMode := server.FragmentMode(config.Fragmentation)
+	switch fragmentMode {
+	case "":
+		fragmentMode = server.FragmentAuto
+	case server.FragmentAuto, server.FragmentAlways, server.FragmentNever:
+	default:
+		return nil, fmt.Errorf("unknown fragmentation mode %q", config.Fragmentation)
+	}
+
+	relayBufferSize := config.RelayBufferSize
+	if relayBufferSize <= 0 {
+		relayBufferSize = 32 * 1024
+	}
+	relayBufferPool := bufferpool.NewPool(relayBufferSize)
+
+	routes, err := loadRoutes(config)
+	if err != nil {
+		return nil, err
+	}
 
 	var resolveSystem string
 	var dohClient *doh.Client
 
+	var queryLog *resolve.QueryLog
+	if config.DnsQueryLog != "" {
+		queryLog, err = resolve.OpenQueryLog(config.DnsQueryLog)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open dns query log, %v", err)
+		}
+	}
+
+	var capture *dialer.Capture
+	if config.DebugPcapFile != "" {
+		capture, err = dialer.OpenCapture(config.DebugPcapFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open DebugPcapFile, %v", err)
+		}
+	}
+
+	remoteDNSAddr := config.RemoteDNSAddr
+	if config.DoHEndpointIP != "" {
+		u, err := url.Parse(config.RemoteDNSAddr)
+		if err != nil || u.Hostname() == "" {
+			return nil, fmt.Errorf("DoHEndpointIP needs a DoH RemoteDNSAddr, got %q", config.RemoteDNSAddr)
+		}
+		if net.ParseIP(config.DoHEndpointIP) == nil {
+			return nil, fmt.Errorf("invalid DoHEndpointIP %q", config.DoHEndpointIP)
+		}
+		// pin the DoH server so its name is never looked up
+		u.Fragment = config.DoHEndpointIP
+		remoteDNSAddr = u.String()
+	}
 	localResolver := &resolve.LocalResolver{
-		Hosts: config.Hosts,
+		Hosts:        config.Hosts,
+		BootstrapDNS: config.BootstrapDNS,
+		DisableIPv6:  config.DisableIPv6,
+		PreferIPv6:   config.PreferIPv6,
+		HostsOnly:    config.ParanoidMode,
+	}
+	sniOverride_, err := sniOverride(config.SNIOverrides)
+	if err != nil {
+		return nil, err
 	}
 
 	dialer_ := &dialer.Dialer{
@@ -63,6 +337,19 @@ func RunServer(config *Config, captureCTRLC bool) error {
 		TLSPaddingEnabled:     config.TLSPaddingEnabled,
 		TLSPaddingSize:        config.TLSPaddingSize,
 		ProxyAddress:          fmt.Sprintf("socks5://%s", config.BindAddress),
+		TCPKeepAlive:          config.TCPKeepalive,
+		DisableIPv6:           config.DisableIPv6,
+		PreferIPv6:            config.PreferIPv6,
+		ALPNProtocols:         config.ALPNProtocols,
+		Fingerprint:           config.TLSFingerprint,
+		TLSMinVersion:         tlsMinVersion,
+		TLSMaxVersion:         tlsMaxVersion,
+		RandomizeSourcePort:   config.RandomizeSourcePort,
+		UpstreamProxy:         upstreamProxy,
+		Resolver:              config.DialResolver,
+		CandidateFilter:       config.DialCandidateFilter,
+		SNIOverride:           sniOverride_,
+		Capture:               capture,
 	}
 
 	wsTunnel := &transport.WSTunnel{
@@ -71,25 +358,142 @@ func RunServer(config *Config, captureCTRLC bool) error {
 		ReadTimeout:        config.UDPReadTimeout,
 		WriteTimeout:       config.UDPWriteTimeout,
 		LinkIdleTimeout:    config.UDPLinkIdleTimeout,
+		RetransmitBuffer:   config.UDPRetransmitBuffer,
 		EstablishedTunnels: make(map[string]*transport.EstablishedTunnel),
 		ShortClientID:      utils.ShortID(6),
+		HTTP2:              config.WorkerHTTP2,
+		MaxIdleConns:       config.WorkerMaxIdleConns,
+		MaxConnLifetime:    time.Duration(config.WorkerMaxConnLifetime) * time.Second,
+		IdleConnTimeout:    time.Duration(config.WorkerIdleConnTimeout) * time.Second,
+		HandshakeTimeout:   time.Duration(config.WorkerHandshakeTimeout) * time.Second,
+		MaxChannels:        config.MaxChannelsPerTunnel,
+		VerifyTLS:          config.WorkerVerifyTLS,
+		TLSHostname:        config.WorkerTLSHostname,
+	}
+	if config.WorkerClientCert != "" || config.WorkerClientKey != "" {
+		cert, err := dialer.LoadClientCert(config.WorkerClientCert, config.WorkerClientKey)
+		if err != nil {
+			return nil, err
+		}
+		wsTunnel.ClientCert = cert
+	}
+	if config.Hooks != nil {
+		wsTunnel.OnReconnect = config.Hooks.TunnelReconnect
+	}
+
+	selectionStrategy, err := endpoint.ParseStrategy(config.TunnelSelectionStrategy)
+	if err != nil {
+		return nil, err
+	}
+	workerIPStrategy, err := endpoint.ParseStrategy(config.WorkerIPStrategy)
+	if err != nil {
+		return nil, err
+	}
+	workerEndpoints := endpoint.NewPool(append([]string{config.WorkerAddress}, tunnelEndpoints...)...)
+	workerIPs := endpoint.NewPool(config.WorkerIPPortAddress)
+	for item, weight := range config.WorkerWeights {
+		if weight < 0 {
+			return nil, fmt.Errorf("negative weight %v for %s", weight, item)
+		}
+		workerEndpoints.SetWeight(item, weight)
+		workerIPs.SetWeight(item, weight)
+	}
+	if config.WorkerWarmStandby {
+		wsTunnel.StandbyEndpoint = standbyEndpoint(workerEndpoints)
 	}
 
 	transport_ := &transport.Transport{
 		WorkerAddress: config.WorkerAddress,
 		BindAddress:   config.BindAddress,
 		Dialer:        dialer_,
-		BufferPool:    bufferpool.NewPool(32 * 1024),
+		BufferPool:    relayBufferPool,
 		UDPBind:       config.UDPBindAddress,
 		Tunnel:        wsTunnel,
+		Endpoints:     workerEndpoints,
+		StreamMode:    config.WorkerStreamMode,
+		BlockQUIC:     config.BlockQUIC,
+
+		SelectionStrategy: selectionStrategy,
+	}
+
+	udpTransport := config.WorkerUDPTransport
+	switch udpTransport {
+	case "":
+		udpTransport = "websocket"
+	case "websocket":
+	case "masque":
+		transport_.UDPTunnel = &transport.MASQUETunnel{Tunnel: wsTunnel}
+	default:
+		return nil, fmt.Errorf("unknown worker udp transport %q", config.WorkerUDPTransport)
+	}
+
+	if config.SharedTunnelSocket != "" {
+		if config.SharedTunnelListen != "" {
+			return nil, errors.New("SharedTunnelListen and SharedTunnelSocket can not be both set")
+		}
+		shared := &transport.SharedTunnelClient{Socket: config.SharedTunnelSocket}
+		transport_.Shared = shared
+		transport_.UDPTunnel = shared
 	}
 
-	if strings.HasPrefix(config.RemoteDNSAddr, "https://") {
+	dnsFragmentation := (config.WorkerEnabled && config.WorkerDNSOnly) || config.EnableDNSFragmentation
+	plainDNSFallback := config.DnsPlainFallback
+	if plainDNSFallback != "" {
+		if _, _, err := net.SplitHostPort(plainDNSFallback); err != nil {
+			plainDNSFallback = net.JoinHostPort(plainDNSFallback, "53")
+		}
+	}
+	dohFormat, err := doh.ParseFormat(config.RemoteDNSFormat)
+	if err != nil {
+		return nil, err
+	}
+	dohHeader := make(http.Header)
+	var dohHeaderNames []string
+	for k, v := range config.RemoteDNSHeaders {
+		v, err := utils.ResolveSecret(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RemoteDNSHeaders %s, %v", k, err)
+		}
+		dohHeader.Set(k, v)
+		dohHeaderNames = append(dohHeaderNames, http.CanonicalHeaderKey(k))
+	}
+	sort.Strings(dohHeaderNames)
+	for _, fallback := range config.RemoteDNSFallbacks {
+		if !strings.HasPrefix(fallback, "https://") {
+			return nil, fmt.Errorf("invalid RemoteDNSFallbacks %q, not a DoH server", fallback)
+		}
+	}
+	dohRetryRcodes, err := retryRcodes(config.RemoteDNSRetryRcodes)
+	if err != nil {
+		return nil, err
+	}
+	minTTLHosts, err := hostTTLs(config.DnsMinTTLHosts)
+	if err != nil {
+		return nil, err
+	}
+	rewrites, err := destinationRewrites(config.DestinationRewrites)
+	if err != nil {
+		return nil, err
+	}
+	var stickyIPs *resolve.StickyIPs
+	if config.StickyIPTTL > 0 {
+		stickyIPs = &resolve.StickyIPs{TTL: time.Duration(config.StickyIPTTL) * time.Second}
+	}
+	if strings.HasPrefix(remoteDNSAddr, "https://") {
 		resolveSystem = "doh"
 		dohClient = doh.NewClient(
-			doh.WithDNSFragmentation((config.WorkerEnabled && config.WorkerDNSOnly) || config.EnableDNSFragmentation),
+			doh.WithDNSFragmentation(dnsFragmentation),
 			doh.WithDialer(dialer_),
 			doh.WithLocalResolver(localResolver),
+			doh.WithUpstream(remoteDNSAddr, doh.Upstream{
+				Format:     dohFormat,
+				PathSuffix: config.RemoteDNSPathSuffix,
+				Header:     dohHeader,
+			}),
+			doh.WithHTTPClient(config.DoHHTTPClient),
+			doh.WithFallbacks(config.RemoteDNSFallbacks...),
+			doh.WithFailoverRcodes(dohRetryRcodes...),
+			doh.WithQueryJitter(time.Duration(config.DoHQueryJitter)*time.Millisecond),
 		)
 	} else {
 		resolveSystem = "DNSCrypt"
@@ -98,66 +502,530 @@ func RunServer(config *Config, captureCTRLC bool) error {
 	chunkConfig := server.ChunkConfig{
 		BeforeSniLength: config.SniChunksLength,
 		AfterSniLength:  config.ChunksLengthAfterSni,
-		Delay:           config.DelayBetweenChunks,
+		Delay:           chunkDelayRange(config),
+		Mode:            fragmentMode,
 		TLSHeaderLength: config.TLSHeaderLength,
+		Retries:         config.FragmentRetries,
+		RetryTimeout:    time.Duration(config.FragmentRetryTimeout) * time.Second,
 	}
 
 	workerConfig := server.WorkerConfig{
-		WorkerAddress:       config.WorkerAddress,
-		WorkerIPPortAddress: config.WorkerIPPortAddress,
-		WorkerEnabled:       config.WorkerEnabled,
-		WorkerDNSOnly:       config.WorkerDNSOnly,
+		WorkerAddress:        config.WorkerAddress,
+		WorkerIPPortAddress:  config.WorkerIPPortAddress,
+		WorkerEnabled:        config.WorkerEnabled,
+		WorkerDNSOnly:        config.WorkerDNSOnly,
+		ProxyProtocolVersion: config.WorkerProxyProtocol,
+		Endpoints:            workerEndpoints,
+		WorkerIPs:            workerIPs,
+		WorkerIPStrategy:     workerIPStrategy,
 	}
 
 	serverHandler := &server.Server{
-		RemoteDNSAddr:         config.RemoteDNSAddr,
+		RemoteDNSAddr:         remoteDNSAddr,
 		Cache:                 appCache,
 		ResolveSystem:         resolveSystem,
 		DoHClient:             dohClient,
 		ChunkConfig:           chunkConfig,
 		WorkerConfig:          workerConfig,
+		Routes:                routes,
+		WorkerOnly:            config.ParanoidMode,
+		RefuseANY:             config.DnsRefuseANY,
+		PlainDNSFallback:      plainDNSFallback,
+		SplitPlainDNS:         dnsFragmentation,
 		BindAddress:           config.BindAddress,
 		EnableLowLevelSockets: config.EnableLowLevelSockets,
 		Dialer:                dialer_,
 		LocalResolver:         localResolver,
 		Transport:             transport_,
+		MaxBytesPerSecond:     config.MaxBytesPerSecond,
+		GlobalRateLimiter:     utils.NewLimiter(config.GlobalMaxBytesPerSecond),
+		EnableSplice:          config.EnableSplice,
+		BufferPool:            relayBufferPool,
+		DNSTTL:                server.TTLBounds{Min: config.DnsMinTTL, Max: config.DnsMaxTTL, Hosts: minTTLHosts},
+		QueryLog:              queryLog,
+		StickyIPs:             stickyIPs,
+		Rewrites:              rewrites,
+		Hooks:                 config.Hooks,
+		Tracer:                config.Tracer,
+		DisableIPv6:           config.DisableIPv6,
+		PreferIPv6:            config.PreferIPv6,
+		ConnectionIdleTimeout: time.Duration(config.ConnectionIdleTimeout) * time.Second,
+	}
+	if config.DnsInterceptUDP {
+		transport_.DNS = serverHandler.ServeDNS
+	}
+
+	var logFile *logger.RotatingFile
+	if config.LogFile != "" {
+		logFile, err = logger.OpenRotatingFile(config.LogFile, int64(config.LogMaxSizeMB)<<20,
+			config.LogMaxBackups, time.Duration(config.LogMaxAgeDays)*24*time.Hour)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file, %v", err)
+		}
+		logger.SetOutput(logFile)
+	}
+
+	in := &Instance{
+		handler:   serverHandler,
+		dialer:    dialer_,
+		tunnel:    wsTunnel,
+		resolver:  localResolver,
+		endpoints: workerEndpoints,
+		workerIPs: workerIPs,
+		queryLog:  queryLog,
+		logFile:   logFile,
+		config:    config,
+		listeners: listeners_,
+		effective: EffectiveConfig{
+			BindAddress:             config.BindAddress,
+			Listeners:               listenerAddresses(listeners_[1:]),
+			UDPBindAddress:          config.UDPBindAddress,
+			Chunks:                  chunkConfig,
+			TLSPaddingEnabled:       config.TLSPaddingEnabled,
+			TLSPaddingSize:          config.TLSPaddingSize,
+			TLSMinVersion:           config.TLSMinVersion,
+			TLSMaxVersion:           config.TLSMaxVersion,
+			EnableLowLevelSockets:   config.EnableLowLevelSockets,
+			RemoteDNSAddr:           remoteDNSAddr,
+			RemoteDNSFormat:         string(dohFormat),
+			RemoteDNSPathSuffix:     config.RemoteDNSPathSuffix,
+			RemoteDNSHeaders:        dohHeaderNames,
+			RemoteDNSFallbacks:      config.RemoteDNSFallbacks,
+			LogPrivacy:              string(logPrivacy),
+			ResolveSystem:           resolveSystem,
+			BootstrapDNS:            config.BootstrapDNS,
+			DoHEndpointIP:           config.DoHEndpointIP,
+			ParanoidMode:            config.ParanoidMode,
+			DNSFragmentation:        resolveSystem == "doh" && dnsFragmentation,
+			DnsCacheBackend:         cacheBackend,
+			DnsCacheTTL:             config.DnsCacheTTL,
+			DnsCacheJitter:          config.DnsCacheJitter,
+			DoHQueryJitter:          config.DoHQueryJitter,
+			DnsRefuseANY:            config.DnsRefuseANY,
+			StickyIPTTL:             config.StickyIPTTL,
+			DnsInterceptUDP:         config.DnsInterceptUDP,
+			DnsPlainFallback:        plainDNSFallback,
+			UpstreamProxy:           redactedURL(upstreamProxy),
+			WorkerEnabled:           config.WorkerEnabled,
+			WorkerDNSOnly:           config.WorkerDNSOnly,
+			WorkerHTTP2:             config.WorkerHTTP2,
+			WorkerMaxIdleConns:      config.WorkerMaxIdleConns,
+			WorkerHandshakeTimeout:  config.WorkerHandshakeTimeout,
+			MaxChannelsPerTunnel:    config.MaxChannelsPerTunnel,
+			WorkerStreamMode:        config.WorkerStreamMode,
+			WorkerUDPTransport:      udpTransport,
+			TunnelSelectionStrategy: string(selectionStrategy),
+			WorkerIPStrategy:        string(workerIPStrategy),
+			WorkerWeights:           config.WorkerWeights,
+			WorkerVerifyTLS:         config.WorkerVerifyTLS,
+			WorkerProxyProtocol:     config.WorkerProxyProtocol,
+			DefaultRoute:            string(routes.Route("")),
+			BlockQUIC:               config.BlockQUIC,
+			DisableIPv6:             config.DisableIPv6,
+			PreferIPv6:              config.PreferIPv6 && !config.DisableIPv6,
+			RelayBufferSize:         relayBufferSize,
+			EnableSplice:            config.EnableSplice && config.ConnectionIdleTimeout <= 0,
+			ConnectionIdleTimeout:   config.ConnectionIdleTimeout,
+			MaxBytesPerSecond:       config.MaxBytesPerSecond,
+			GlobalMaxBytesPerSecond: config.GlobalMaxBytesPerSecond,
+			NetworkMonitor:          config.NetworkMonitor,
+			WorkerLazyStart:         config.WorkerLazyStart,
+			WorkerWarmStandby:       config.WorkerWarmStandby,
+			DebugPcapFile:           config.DebugPcapFile,
+			SNIOverrides:            config.SNIOverrides,
+			HealthAddress:           config.HealthAddress,
+			ACMEEnabled:             config.ACMEEnabled,
+			ACMEDomains:             config.ACMEDomains,
+		},
+	}
+	serverHandler.WorkerOffline = in.workerOffline.Load
+	return in, nil
+}
+
+// newSocksServer creates the socks5 server of l that hands requests to the instance.
+func (in *Instance) newSocksServer(config *Config, l listener) *socks5.Server {
+	opts := []socks5.Option{
+		socks5.WithConnectHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
+			return in.handler.Handle(ctx, w, req, "tcp")
+		}),
+		socks5.WithProxyProtocol(l.AcceptProxyProtocol),
+		socks5.WithKeepAlive(config.TCPKeepalive),
+		socks5.WithAuthorize(l.Authorize),
+		socks5.WithAllowedClients(l.allowed),
+	}
+	if l.tls != nil {
+		opts = append(opts, socks5.WithTLS(l.tls))
+	}
+	if config.ParanoidMode {
+		opts = append(opts, socks5.WithResolver(handlerResolver{in.handler}))
+	}
+	if config.WorkerEnabled && !config.WorkerDNSOnly {
+		opts = append(opts, socks5.WithAssociateHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
+			return in.handler.Handle(ctx, w, req, "udp")
+		}))
+	}
+	return socks5.NewServer(opts...)
+}
+
+// listenerAddresses returns the bind addresses of ls.
+func listenerAddresses(ls []listener) []string {
+	addrs := make([]string, 0, len(ls))
+	for _, l := range ls {
+		addrs = append(addrs, l.BindAddress)
+	}
+	return addrs
+}
+
+// Close releases the resources held by the instance.
+func (in *Instance) Close() {
+	in.closeOnce.Do(func() {
+		in.mu.Lock()
+		cancel := in.cancel
+		in.mu.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+		_ = in.queryLog.Close()
+		_ = in.dialer.Capture.Close()
+		if in.logFile != nil {
+			logger.SetOutput(os.Stdout)
+			_ = in.logFile.Close()
+		}
+	})
+}
+
+// Start serves the instance in the background: it starts a socks server per
+// listener and the refresh of the remote lists, and returns once every server
+// is listening or one failed to. It does not touch signals or exit the
+// process, so a service manager wrapper can drive the lifecycle with Start
+// and Stop. When one server stops the others are shut down with it.
+func (in *Instance) Start() error {
+	in.mu.Lock()
+	if in.done != nil {
+		in.mu.Unlock()
+		return errors.New("instance already started")
+	}
+
+	ls, err := in.listen()
+	if err != nil {
+		in.mu.Unlock()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in.cancel = cancel
+	startRemoteHosts(ctx, in.config, in.dialer, in.resolver)
+	startSubscriptions(ctx, in.config, in.dialer, in.endpoints, in.workerIPs)
+	startGFWList(ctx, in.config, in.dialer, in.handler.Routes)
+	startKeepAlive(ctx, in.config, in.handler.Transport)
+	in.startNetworkMonitor(ctx)
+	in.startWorkerProbe(ctx)
+	err = startSharedTunnel(ctx, in.config, in.handler.Transport)
+	if err == nil {
+		err = in.startHealth(ctx)
+	}
+	if err != nil {
+		cancel()
+		for _, l := range ls {
+			_ = l.Close()
+		}
+		in.mu.Unlock()
+		return err
+	}
+
+	for _, l := range in.listeners {
+		in.srvs = append(in.srvs, in.newSocksServer(in.config, l))
+	}
+	in.done = make(chan struct{})
+	srvs, done := in.srvs, in.done
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	for i, srv := range srvs {
+		l := ls[i]
+		fmt.Println("Starting socks, http server:", l.Addr())
+		wg.Add(1)
+		go func(srv *socks5.Server) {
+			defer wg.Done()
+			err := srv.ServeListener(l)
+			errOnce.Do(func() {
+				in.err = err
+				for _, other := range srvs {
+					_ = other.Shutdown()
+				}
+			})
+		}(srv)
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(done)
+	}()
+	in.mu.Unlock()
+
+	for _, srv := range srvs {
+		select {
+		case <-srv.Ready():
+		case <-done:
+			if in.err == nil {
+				return errors.New("server stopped before listening")
+			}
+			return in.err
+		}
+	}
+	return nil
+}
+
+// listen binds the address of every listener. When the port of BindAddress
+// is 0, the port the system picked replaces it where bepass dials its own
+// proxy, and in the effective config.
+func (in *Instance) listen() ([]net.Listener, error) {
+	ls := make([]net.Listener, 0, len(in.listeners))
+	for _, l := range in.listeners {
+		nl, err := net.Listen("tcp", l.BindAddress)
+		if err != nil {
+			for _, opened := range ls {
+				_ = opened.Close()
+			}
+			return nil, bindError(l.BindAddress, err)
+		}
+		ls = append(ls, nl)
+	}
+
+	addrs := make([]string, 0, len(ls))
+	for i, l := range ls {
+		addrs = append(addrs, boundAddress(in.listeners[i].BindAddress, l.Addr()))
+	}
+	in.addr = ls[0].Addr()
+	in.dialer.ProxyAddress = fmt.Sprintf("socks5://%s", addrs[0])
+	in.tunnel.BindAddress = addrs[0]
+	in.handler.BindAddress = addrs[0]
+	in.effective.BindAddress = addrs[0]
+	in.effective.Listeners = addrs[1:]
+	return ls, nil
+}
+
+// boundAddress returns configured, a host and port, with the port of addr.
+func boundAddress(configured string, addr net.Addr) string {
+	host, _, err := net.SplitHostPort(configured)
+	_, port, err2 := net.SplitHostPort(addr.String())
+	if err != nil || err2 != nil {
+		return addr.String()
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Addr returns the address the socks server of BindAddress listens on, the
+// port the system picked when it was 0. It is nil until Start binds it.
+func (in *Instance) Addr() net.Addr {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.addr
+}
+
+// Stop shuts the socks servers down, waits for them to return and releases
+// the instance. It is safe to call more than once.
+func (in *Instance) Stop() error {
+	in.mu.Lock()
+	srvs, done := in.srvs, in.done
+	in.mu.Unlock()
+	if done == nil {
+		in.Close()
+		return nil
+	}
+
+	var err error
+	in.stopOnce.Do(func() {
+		for _, srv := range srvs {
+			if e := srv.Shutdown(); e != nil && err == nil {
+				err = e
+			}
+		}
+		<-done
+		in.Close()
+	})
+	return err
+}
+
+// Wait blocks until the socks servers stop and returns the error they stopped with.
+func (in *Instance) Wait() error {
+	in.mu.Lock()
+	done := in.done
+	in.mu.Unlock()
+	if done == nil {
+		return errors.New("instance not started")
+	}
+	<-done
+	return in.err
+}
+
+// RunServer runs an instance for config until it is shut down. With
+// captureCTRLC an interrupt or SIGTERM shuts it down and RunServer returns,
+// a SIGHUP flushes the DNS cache and reloads the listener certificates.
+// ready, if not nil, is closed once the server is listening. The readiness
+// is also reported to systemd when it started bepass as a notify service.
+func RunServer(config *Config, captureCTRLC bool, ready chan<- struct{}) error {
+	in, err := NewInstance(config)
+	if err != nil {
+		return err
+	}
+	if err := in.Start(); err != nil {
+		in.Close()
+		return err
+	}
+	current = in
+	if err := utils.SdNotify("READY=1"); err != nil {
+		logger.Errorf("failed to notify systemd: %v", err)
+	}
+	if ready != nil {
+		close(ready)
 	}
 
 	if captureCTRLC {
-		c := make(chan os.Signal)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		defer signal.Stop(c)
 		go func() {
-			<-c
-			_ = ShutDown()
-			os.Exit(0)
+			for sig := range c {
+				if sig == syscall.SIGHUP {
+					in.FlushDNS()
+					_ = in.ReloadCerts()
+					continue
+				}
+				_ = in.Stop()
+				return
+			}
 		}()
 	}
 
-	if workerConfig.WorkerEnabled && !workerConfig.WorkerDNSOnly {
-		s5 = socks5.NewServer(
-			socks5.WithConnectHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
-				return serverHandler.Handle(ctx, w, req, "tcp")
-			}),
-			socks5.WithAssociateHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
-				return serverHandler.Handle(ctx, w, req, "udp")
-			}),
-		)
-	} else {
-		s5 = socks5.NewServer(
-			socks5.WithConnectHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
-				return serverHandler.Handle(ctx, w, req, "tcp")
-			}),
-		)
+	err = in.Wait()
+	_ = in.Stop()
+	return err
+}
+
+// chunkDelayRange returns the range of the pause between chunks.
+// DelayBetweenChunksMicro is in microseconds and wins over the millisecond
+// DelayBetweenChunks when set.
+func chunkDelayRange(config *Config) [2]time.Duration {
+	if config.DelayBetweenChunksMicro != [2]int{} {
+		return [2]time.Duration{
+			time.Duration(config.DelayBetweenChunksMicro[0]) * time.Microsecond,
+			time.Duration(config.DelayBetweenChunksMicro[1]) * time.Microsecond,
+		}
+	}
+	return [2]time.Duration{
+		time.Duration(config.DelayBetweenChunks[0]) * time.Millisecond,
+		time.Duration(config.DelayBetweenChunks[1]) * time.Millisecond,
+	}
+}
+
+// startRemoteHosts keeps the hosts lists listed in HostsURLs up to date. They are
+// fetched through bepass itself, so the lists can be loaded even when their host is blocked.
+func startRemoteHosts(ctx context.Context, config *Config, d *dialer.Dialer, lr *resolve.LocalResolver) {
+	interval := time.Duration(config.RemoteListsRefresh) * time.Second
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	for _, u := range config.HostsURLs {
+		source := u
+		f := &utils.RemoteFile{
+			URL:      source,
+			Interval: interval,
+			Client:   d.MakeHTTPClient("", true),
+			OnUpdate: func(data []byte) error {
+				hosts, err := resolve.ParseHosts(data)
+				if err != nil {
+					return err
+				}
+				lr.SetRemoteHosts(source, hosts)
+				logger.Infof("loaded %d hosts from %s", len(hosts), source)
+				return nil
+			},
+		}
+		go f.Run(ctx)
 	}
+}
 
-	fmt.Println("Starting socks, http server:", config.BindAddress)
-	if err := s5.ListenAndServe("tcp", config.BindAddress); err != nil {
-		return err
+// startSubscriptions merges the worker endpoints and clean IPs published on the
+// subscription links into the pools, refreshing them periodically.
+func startSubscriptions(ctx context.Context, config *Config, d *dialer.Dialer, endpoints, ips *endpoint.Pool) {
+	interval := time.Duration(config.RemoteListsRefresh) * time.Second
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	for _, u := range config.SubscriptionURLs {
+		source := u
+		f := &utils.RemoteFile{
+			URL:      source,
+			Interval: interval,
+			Client:   d.MakeHTTPClient("", true),
+			OnUpdate: func(data []byte) error {
+				sub, err := endpoint.ParseSubscription(data)
+				if err != nil {
+					return err
+				}
+				endpoints.SetSource(source, sub.Endpoints)
+				ips.SetSource(source, sub.IPs)
+				logger.Infof("loaded %d endpoints and %d IPs from %s", len(sub.Endpoints), len(sub.IPs), source)
+				return nil
+			},
+		}
+		go f.Run(ctx)
+	}
+}
+
+// startKeepAlive pings the workers every WorkerKeepAliveInterval seconds, or
+// every 30 seconds when it is unset but the lowest-latency or weighted
+// strategy needs their round trip times.
+func startKeepAlive(ctx context.Context, config *Config, tr *transport.Transport) {
+	interval := time.Duration(config.WorkerKeepAliveInterval) * time.Second
+	if interval <= 0 {
+		if tr.SelectionStrategy != endpoint.StrategyLowestLatency && tr.SelectionStrategy != endpoint.StrategyWeighted {
+			return
+		}
+		interval = 30 * time.Second
 	}
+	if !config.WorkerEnabled || tr.Shared != nil {
+		return
+	}
+	go tr.KeepAlive(ctx, interval)
+}
 
+// startSharedTunnel serves the tunnels of tr to the other bepass processes of
+// the host on the unix socket at SharedTunnelListen, until ctx is done.
+func startSharedTunnel(ctx context.Context, config *Config, tr *transport.Transport) error {
+	if config.SharedTunnelListen == "" {
+		return nil
+	}
+	if conn, err := net.Dial("unix", config.SharedTunnelListen); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("a shared tunnel daemon already serves %s", config.SharedTunnelListen)
+	}
+	if fi, err := os.Stat(config.SharedTunnelListen); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// left over by a daemon that did not shut down cleanly
+		_ = os.Remove(config.SharedTunnelListen)
+	}
+	l, err := net.Listen("unix", config.SharedTunnelListen)
+	if err != nil {
+		return bindError(config.SharedTunnelListen, err)
+	}
+	srv := &transport.SharedTunnelServer{Transport: tr}
+	go func() {
+		if err := srv.Serve(ctx, l); err != nil {
+			logger.Errorf("shared tunnel daemon stopped: %v", err)
+		}
+	}()
 	return nil
 }
 
+// Current returns the instance started by RunServer, nil if none is running.
+func Current() *Instance {
+	return current
+}
+
+// ShutDown stops the instance started by RunServer.
 func ShutDown() error {
-	return s5.Shutdown()
+	if current == nil {
+		return nil
+	}
+	return current.Stop()
 }
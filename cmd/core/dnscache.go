@@ -0,0 +1,79 @@
+package core
+
+import (
+	"bepass/logger"
+	"bepass/resolve"
+	"bepass/server"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// FlushDNS empties the DNS cache of the instance, so the next connections
+// resolve their destinations again. With a Redis cache only the keys of
+// bepass are removed, the other instances sharing it see the flush too.
+func (in *Instance) FlushDNS() {
+	in.handler.Cache.Flush()
+	logger.Infof("dns cache flushed")
+}
+
+// ForgetDNS removes the cached answer for name.
+func (in *Instance) ForgetDNS(name string) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	in.handler.Cache.Delete(name)
+}
+
+// ExchangeDNS answers the DNS query req like a forwarding resolver would,
+// see server.Server.Exchange.
+func (in *Instance) ExchangeDNS(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return in.handler.Exchange(ctx, req)
+}
+
+// FlushDNS empties the DNS cache of the instance started by RunServer.
+func FlushDNS() {
+	if current != nil {
+		current.FlushDNS()
+	}
+}
+
+// hostTTLs parses DnsMinTTLHosts, the floors of the cached TTLs keyed by
+// hostname pattern, in the order of the patterns.
+func hostTTLs(floors map[string]int) ([]server.HostTTL, error) {
+	patterns := make([]string, 0, len(floors))
+	for p := range floors {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+	var hosts []server.HostTTL
+	for _, p := range patterns {
+		pattern, err := resolve.ParseHostPattern(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DnsMinTTLHosts pattern %q, %v", p, err)
+		}
+		hosts = append(hosts, server.HostTTL{Pattern: pattern, Min: floors[p]})
+	}
+	return hosts, nil
+}
+
+// retryRcodes parses RemoteDNSRetryRcodes, the response codes like SERVFAIL
+// on which a query goes to the next of RemoteDNSFallbacks, SERVFAIL and
+// REFUSED if unset.
+func retryRcodes(names []string) ([]int, error) {
+	if names == nil {
+		return []int{dns.RcodeServerFailure, dns.RcodeRefused}, nil
+	}
+	rcodes := make([]int, 0, len(names))
+	for _, name := range names {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("invalid RemoteDNSRetryRcodes %q", name)
+		}
+		rcodes = append(rcodes, rcode)
+	}
+	return rcodes, nil
+}
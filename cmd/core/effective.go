@@ -0,0 +1,100 @@
+package core
+
+import (
+	"bepass/server"
+	"net/url"
+)
+
+// EffectiveConfig is the configuration an Instance actually runs with, after
+// defaults are applied and the remote lists are merged in.
+type EffectiveConfig struct {
+	BindAddress             string             `json:"BindAddress"`
+	UDPBindAddress          string             `json:"UDPBindAddress"`
+	Listeners               []string           `json:"Listeners"`
+	Chunks                  server.ChunkConfig `json:"Chunks"`
+	TLSPaddingEnabled       bool               `json:"TLSPaddingEnabled"`
+	TLSPaddingSize          [2]int             `json:"TLSPaddingSize"`
+	TLSMinVersion           string             `json:"TLSMinVersion"`
+	TLSMaxVersion           string             `json:"TLSMaxVersion"`
+	EnableLowLevelSockets   bool               `json:"EnableLowLevelSockets"`
+	RemoteDNSAddr           string             `json:"RemoteDNSAddr"`
+	RemoteDNSFormat         string             `json:"RemoteDNSFormat"`
+	RemoteDNSPathSuffix     string             `json:"RemoteDNSPathSuffix"`
+	RemoteDNSHeaders        []string           `json:"RemoteDNSHeaders"`
+	RemoteDNSFallbacks      []string           `json:"RemoteDNSFallbacks"`
+	LogPrivacy              string             `json:"LogPrivacy"`
+	ResolveSystem           string             `json:"ResolveSystem"`
+	BootstrapDNS            string             `json:"BootstrapDNS"`
+	DoHEndpointIP           string             `json:"DoHEndpointIP"`
+	ParanoidMode            bool               `json:"ParanoidMode"`
+	DNSFragmentation        bool               `json:"DNSFragmentation"`
+	DnsCacheBackend         string             `json:"DnsCacheBackend"`
+	DnsCacheTTL             int                `json:"DnsCacheTTL"`
+	DnsCacheJitter          int                `json:"DnsCacheJitter"`
+	DoHQueryJitter          int                `json:"DoHQueryJitter"`
+	DnsRefuseANY            bool               `json:"DnsRefuseANY"`
+	StickyIPTTL             int                `json:"StickyIPTTL"`
+	DnsInterceptUDP         bool               `json:"DnsInterceptUDP"`
+	DnsPlainFallback        string             `json:"DnsPlainFallback"`
+	HostsRules              int                `json:"HostsRules"`
+	WorkerEnabled           bool               `json:"WorkerEnabled"`
+	WorkerDNSOnly           bool               `json:"WorkerDNSOnly"`
+	WorkerHTTP2             bool               `json:"WorkerHTTP2"`
+	WorkerMaxIdleConns      int                `json:"WorkerMaxIdleConns"`
+	WorkerHandshakeTimeout  int                `json:"WorkerHandshakeTimeout"`
+	MaxChannelsPerTunnel    int                `json:"MaxChannelsPerTunnel"`
+	WorkerStreamMode        bool               `json:"WorkerStreamMode"`
+	WorkerUDPTransport      string             `json:"WorkerUDPTransport"`
+	TunnelSelectionStrategy string             `json:"TunnelSelectionStrategy"`
+	WorkerIPStrategy        string             `json:"WorkerIPStrategy"`
+	WorkerWeights           map[string]float64 `json:"WorkerWeights"`
+	WorkerVerifyTLS         bool               `json:"WorkerVerifyTLS"`
+	WorkerProxyProtocol     int                `json:"WorkerProxyProtocol"`
+	DefaultRoute            string             `json:"DefaultRoute"`
+	RouteRules              int                `json:"RouteRules"`
+	DestinationRewrites     int                `json:"DestinationRewrites"`
+	SNIOverrides            map[string]string  `json:"SNIOverrides"`
+	HealthAddress           string             `json:"HealthAddress"`
+	ACMEEnabled             bool               `json:"ACMEEnabled"`
+	ACMEDomains             []string           `json:"ACMEDomains"`
+	BlockQUIC               bool               `json:"BlockQUIC"`
+	DisableIPv6             bool               `json:"DisableIPv6"`
+	PreferIPv6              bool               `json:"PreferIPv6"`
+	WorkerEndpoints         []string           `json:"WorkerEndpoints"`
+	WorkerIPs               []string           `json:"WorkerIPs"`
+	RelayBufferSize         int                `json:"RelayBufferSize"`
+	EnableSplice            bool               `json:"EnableSplice"`
+	UpstreamProxy           string             `json:"UpstreamProxy"`
+	ConnectionIdleTimeout   int                `json:"ConnectionIdleTimeout"`
+	MaxBytesPerSecond       int                `json:"MaxBytesPerSecond"`
+	GlobalMaxBytesPerSecond int                `json:"GlobalMaxBytesPerSecond"`
+	NetworkMonitor          bool               `json:"NetworkMonitor"`
+	WorkerLazyStart         bool               `json:"WorkerLazyStart"`
+	WorkerWarmStandby       bool               `json:"WorkerWarmStandby"`
+	DebugPcapFile           string             `json:"DebugPcapFile"`
+}
+
+// EffectiveConfig returns the configuration in use. The worker endpoints, clean
+// IPs and hosts rules include what was loaded from subscriptions and remote
+// lists so far.
+func (in *Instance) EffectiveConfig() EffectiveConfig {
+	in.mu.Lock()
+	c := in.effective
+	in.mu.Unlock()
+	c.WorkerEndpoints = in.endpoints.Items()
+	c.WorkerIPs = in.workerIPs.Items()
+	c.HostsRules = in.resolver.Len()
+	c.RouteRules = in.handler.Routes.Len()
+	c.DestinationRewrites = len(in.handler.Rewrites)
+	return c
+}
+
+// redactedURL returns address with the password of its user hidden, for the
+// effective config to be shown.
+func redactedURL(address string) string {
+	u, err := url.Parse(address)
+	if err != nil || u.User == nil {
+		return address
+	}
+	return u.Redacted()
+}
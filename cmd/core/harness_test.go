@@ -0,0 +1,781 @@
+package core
+
+import (
+	"bepass/resolve"
+	"bepass/server"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+// harness runs an instance against local stand-ins for everything it talks
+// to: a DoH server, a WebSocket worker and an HTTPS site, reached by names
+// only the harness resolves. Tests drive it with a SOCKS client.
+type harness struct {
+	in *Instance
+
+	doh    *mockDoH
+	worker *mockWorker
+	// site answers every request with siteBody
+	site *httptest.Server
+	// portal plays the captive portal probe, answering 204 until captive is
+	// set, then sending to the sign in page
+	portal  *httptest.Server
+	captive atomic.Bool
+	// probes counts the requests to portal
+	probes atomic.Int32
+
+	mu        sync.Mutex
+	fragments []server.FragmentEvent
+}
+
+const (
+	siteHost   = "site.test"
+	stickyHost = "sticky.test"
+	siteBody   = "hello from the site"
+	dohHost    = "doh.test"
+	workerHost = "worker.test"
+)
+
+// newHarness starts the stand-ins and an instance using them, configure
+// adjusts the config before the instance is created. Everything is torn
+// down with the test.
+func newHarness(t *testing.T, configure func(*Config)) *harness {
+	t.Helper()
+	h := &harness{}
+	h.site = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, siteBody)
+	}))
+	t.Cleanup(h.site.Close)
+	h.doh = newMockDoH(t, map[string]string{
+		siteHost + ".": "127.0.0.1",
+		// the first address is of the loopback network but the site is not there
+		stickyHost + ".": "127.0.0.2,127.0.0.1",
+	})
+	h.worker = newMockWorker(t, map[string]string{siteHost: "127.0.0.1"})
+	h.portal = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.probes.Add(1)
+		if h.captive.Load() {
+			http.Redirect(w, r, "http://portal.test/login", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(h.portal.Close)
+
+	config := &Config{
+		BindAddress:   "127.0.0.1:0",
+		RemoteDNSAddr: "https://" + net.JoinHostPort(dohHost, portOf(h.doh.srv)) + "/dns-query",
+		Hosts: []resolve.Hosts{
+			{Domain: dohHost, IP: "127.0.0.1"},
+		},
+		WorkerAddress:       "https://" + net.JoinHostPort(workerHost, portOf(h.worker.srv)) + "/dns-query",
+		WorkerIPPortAddress: "127.0.0.1",
+		SniChunksLength:     [2]int{1, 5},
+		CaptivePortalURL:    h.portal.URL + "/generate_204",
+		Hooks: &server.Hooks{Fragmented: func(e server.FragmentEvent) {
+			h.mu.Lock()
+			h.fragments = append(h.fragments, e)
+			h.mu.Unlock()
+		}},
+	}
+	if configure != nil {
+		configure(config)
+	}
+	in, err := NewInstance(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := in.Start(); err != nil {
+		in.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = in.Stop() })
+	h.in = in
+	return h
+}
+
+// get fetches the site through the proxy, host being sent unresolved.
+func (h *harness) get(host string) (string, error) {
+	d, err := proxy.SOCKS5("tcp", h.in.Addr().String(), nil, proxy.Direct)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+			},
+			// the site has the certificate of httptest, the SNI is still host
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Get("https://" + net.JoinHostPort(host, portOf(h.site)) + "/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// fragmentedHosts returns the SNIs of the ClientHellos sent fragmented.
+func (h *harness) fragmentedHosts() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var hosts []string
+	for _, e := range h.fragments {
+		hosts = append(hosts, e.Hostname)
+	}
+	return hosts
+}
+
+// recordsHost has the records of mockRecords on the mock DoH server.
+const recordsHost = "records.test"
+
+var mockRecords = func() []dns.RR {
+	var rrs []dns.RR
+	for _, s := range []string{
+		`records.test. 60 IN TXT "v=spf1 -all"`,
+		`records.test. 60 IN TXT "second"`,
+		`records.test. 60 IN MX 10 mail.records.test.`,
+		`records.test. 60 IN SRV 0 5 5060 sip.records.test.`,
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}()
+
+// mockDoH is a DoH server answering A queries from a fixed set of names,
+// NXDOMAIN for the others. It speaks the JSON API to queries asking for it.
+type mockDoH struct {
+	srv *httptest.Server
+	// answers has the IPv4 addresses of the names, separated by commas
+	answers map[string]string
+
+	mu      sync.Mutex
+	queries []string
+	// path and header are those of the last query
+	path   string
+	header http.Header
+	// truncateBelow truncates the answers to queries advertising a smaller
+	// EDNS0 payload size
+	truncateBelow uint16
+}
+
+func newMockDoH(t *testing.T, answers map[string]string) *mockDoH {
+	m := &mockDoH{answers: answers}
+	m.srv = httptest.NewTLSServer(http.HandlerFunc(m.serve))
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func (m *mockDoH) serve(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.path, m.header = r.URL.Path, r.Header.Clone()
+	m.mu.Unlock()
+	if r.Header.Get("Accept") == "application/dns-json" {
+		m.serveJSON(w, r)
+		return
+	}
+	data, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	req := new(dns.Msg)
+	if err != nil || req.Unpack(data) != nil || len(req.Question) != 1 {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+	q := req.Question[0]
+	// names are matched without regard to case, as DNS servers do
+	q.Name = strings.ToLower(q.Name)
+	m.mu.Lock()
+	m.queries = append(m.queries, q.Name)
+	m.mu.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	ip, ok := m.answers[q.Name]
+	m.mu.Lock()
+	truncateBelow := m.truncateBelow
+	m.mu.Unlock()
+	opt := req.IsEdns0()
+	switch {
+	case truncateBelow > 0 && (opt == nil || opt.UDPSize() < truncateBelow):
+		resp.Truncated = true
+	case q.Name == recordsHost+".":
+		for _, rr := range mockRecords {
+			if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				resp.Answer = append(resp.Answer, dns.Copy(rr))
+			}
+		}
+	case !ok:
+		resp.Rcode = dns.RcodeNameError
+	case q.Qtype == dns.TypeA:
+		for _, ip := range strings.Split(ip, ",") {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ip),
+			})
+		}
+	}
+	out, err := resp.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	_, _ = w.Write(out)
+}
+
+func (m *mockDoH) serveJSON(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	m.mu.Lock()
+	m.queries = append(m.queries, name)
+	m.mu.Unlock()
+
+	ip, ok := m.answers[name]
+	status, answer := dns.RcodeSuccess, ""
+	switch {
+	case !ok:
+		status = dns.RcodeNameError
+	case r.URL.Query().Get("type") == strconv.Itoa(int(dns.TypeA)):
+		answer = fmt.Sprintf(`{"name": %q, "type": 1, "TTL": 60, "data": %q}`, name, ip)
+	}
+	w.Header().Set("Content-Type", "application/dns-json")
+	fmt.Fprintf(w, `{"Status": %d, "RD": true, "RA": true, "Answer": [%s]}`, status, answer)
+}
+
+// asked reports whether name was queried.
+func (m *mockDoH) asked(name string) bool {
+	return m.count(name) > 0
+}
+
+// count returns the number of queries for name.
+func (m *mockDoH) count(name string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, q := range m.queries {
+		if q == dns.Fqdn(name) {
+			n++
+		}
+	}
+	return n
+}
+
+// mockWorker is a worker serving /connect like the real one: it dials the
+// host and port of the query, resolved through its own table, and relays
+// the binary messages of the WebSocket to that connection. It refuses every
+// tunnel when refuse is set.
+type mockWorker struct {
+	srv   *httptest.Server
+	hosts map[string]string
+
+	mu      sync.Mutex
+	refuse  bool
+	tunnels []string
+}
+
+func newMockWorker(t *testing.T, hosts map[string]string) *mockWorker {
+	m := &mockWorker{hosts: hosts}
+	m.srv = httptest.NewTLSServer(http.HandlerFunc(m.serve))
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func (m *mockWorker) serve(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	host, port := q.Get("host"), q.Get("port")
+	m.mu.Lock()
+	refuse := m.refuse
+	m.tunnels = append(m.tunnels, net.JoinHostPort(host, port))
+	m.mu.Unlock()
+	if _, err := strconv.Atoi(port); refuse || r.URL.Path != "/connect" || err != nil {
+		http.Error(w, "tunnel refused", http.StatusBadGateway)
+		return
+	}
+	if ip, ok := m.hosts[host]; ok {
+		host = ip
+	}
+	upstream, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	upgrader := websocket.Upgrader{}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	go func() {
+		defer ws.Close()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if _, err := upstream.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+// tunneled returns the destinations tunnels were asked for.
+func (m *mockWorker) tunneled() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.tunnels...)
+}
+
+func TestHarnessDirect(t *testing.T) {
+	h := newHarness(t, func(c *Config) { c.Fragmentation = string(server.FragmentAlways) })
+	body, err := h.get(siteHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != siteBody {
+		t.Errorf("got %q from the site", body)
+	}
+	if !h.doh.asked(siteHost) {
+		t.Error("expected the site to be resolved with DoH")
+	}
+	if got := h.fragmentedHosts(); len(got) != 1 || got[0] != siteHost {
+		t.Errorf("expected the ClientHello to the site fragmented, got %v", got)
+	}
+	if got := h.worker.tunneled(); len(got) != 0 {
+		t.Errorf("expected no tunnel with the worker disabled, got %v", got)
+	}
+}
+
+func TestHarnessWorker(t *testing.T) {
+	h := newHarness(t, func(c *Config) { c.WorkerEnabled = true })
+	body, err := h.get(siteHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != siteBody {
+		t.Errorf("got %q from the site", body)
+	}
+	// the destination is resolved with DoH, the worker is handed its IP
+	if got := h.worker.tunneled(); len(got) != 1 || got[0] != h.site.Listener.Addr().String() {
+		t.Errorf("expected one tunnel to the site, got %v", got)
+	}
+	// the tunnel is the connection fragmented, the site is reached by the worker
+	if got := h.fragmentedHosts(); len(got) != 1 || got[0] != workerHost {
+		t.Errorf("expected the ClientHello to the worker fragmented, got %v", got)
+	}
+}
+
+func TestHarnessWorkerLazyStart(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	_ = ln.Close()
+
+	// nothing listens where the worker should be, the site is reached direct
+	down := newHarness(t, func(c *Config) {
+		c.WorkerEnabled = true
+		c.WorkerLazyStart = true
+		c.WorkerAddress = "https://" + net.JoinHostPort(workerHost, closedPort) + "/dns-query"
+	})
+	body, err := down.get(siteHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != siteBody {
+		t.Errorf("got %q from the site", body)
+	}
+	if got := down.fragmentedHosts(); len(got) != 1 || got[0] != siteHost {
+		t.Errorf("expected the ClientHello to the site fragmented, got %v", got)
+	}
+	if !down.in.Stats().WorkerOffline {
+		t.Error("expected the stats to show the worker offline")
+	}
+
+	// a worker that answers is brought online
+	up := newHarness(t, func(c *Config) {
+		c.WorkerEnabled = true
+		c.WorkerLazyStart = true
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for up.in.Stats().WorkerOffline {
+		if time.Now().After(deadline) {
+			t.Fatal("worker not brought online")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := up.get(siteHost); err != nil {
+		t.Fatal(err)
+	}
+	if got := up.worker.tunneled(); len(got) != 1 {
+		t.Errorf("expected one tunnel through the worker once online, got %v", got)
+	}
+}
+
+// readyz returns the status and the Health served on /readyz.
+func (h *harness) readyz(t *testing.T) (int, Health) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.in.healthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var health Health
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, health
+}
+
+func TestHarnessHealth(t *testing.T) {
+	h := newHarness(t, nil)
+	rec := httptest.NewRecorder()
+	h.in.healthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the liveness endpoint to answer 200, got %d", rec.Code)
+	}
+	if code, health := h.readyz(t); code != http.StatusOK || !health.Ready || !health.Listening || health.WorkerRequired {
+		t.Errorf("expected the instance to be ready without a worker, got %d %+v", code, health)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	_ = ln.Close()
+	down := newHarness(t, func(c *Config) {
+		c.WorkerEnabled = true
+		c.WorkerAddress = "https://" + net.JoinHostPort(workerHost, closedPort) + "/dns-query"
+	})
+	if code, health := down.readyz(t); code != http.StatusServiceUnavailable || health.Ready || health.WorkerErr == "" || health.CaptivePortal != "" {
+		t.Errorf("expected the instance not to be ready without its worker, got %d %+v", code, health)
+	}
+	down.captive.Store(true)
+	if _, health := down.readyz(t); health.CaptivePortal != "" || down.probes.Load() != 1 {
+		t.Errorf("expected the last probe reused, got %d probes and %+v", down.probes.Load(), health)
+	}
+	// as if captivePortalInterval went by
+	down.in.portalMu.Lock()
+	down.in.portalAt = time.Time{}
+	down.in.portalMu.Unlock()
+	if _, health := down.readyz(t); health.CaptivePortal != "http://portal.test/login" {
+		t.Errorf("expected the captive portal reported, got %+v", health)
+	}
+
+	_ = h.in.Stop()
+	if _, health := h.readyz(t); health.Listening || health.Ready {
+		t.Errorf("expected a stopped instance not to be ready, got %+v", health)
+	}
+}
+
+func TestHarnessFailover(t *testing.T) {
+	h := newHarness(t, nil)
+	body, err := h.get(stickyHost)
+	if err != nil {
+		t.Fatalf("expected the second IP to be tried: %v", err)
+	}
+	if body != siteBody {
+		t.Errorf("got %q from the site", body)
+	}
+}
+
+func TestHarnessDestinationRewrite(t *testing.T) {
+	h := newHarness(t, func(c *Config) {
+		c.DestinationRewrites = []DestinationRewrite{{Match: "missing.test", Host: siteHost}}
+	})
+	body, err := h.get("missing.test")
+	if err != nil {
+		t.Fatalf("expected the destination to be rewritten to the site: %v", err)
+	}
+	if body != siteBody {
+		t.Errorf("got %q from the site", body)
+	}
+	if h.doh.asked("missing.test") || !h.doh.asked(siteHost) {
+		t.Error("expected the rewritten host to be resolved instead of the requested one")
+	}
+	if got := h.in.EffectiveConfig().DestinationRewrites; got != 1 {
+		t.Errorf("expected 1 rewrite in the effective config, got %d", got)
+	}
+}
+
+func TestHarnessStickyIPs(t *testing.T) {
+	h := newHarness(t, func(c *Config) { c.StickyIPTTL = 600 })
+	for i := 0; i < 2; i++ {
+		if _, err := h.get(stickyHost); err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+	}
+	if got := h.in.handler.StickyIPs.Order(stickyHost, []string{"127.0.0.2", "127.0.0.1"}); got[0] != "127.0.0.1" {
+		t.Errorf("expected the IP the handshake worked with to come first, got %v", got)
+	}
+	// both IPs are cached, the working one is picked among them
+	if got := h.doh.count(stickyHost); got != 1 {
+		t.Errorf("expected the hostname to be resolved once, got %d queries", got)
+	}
+}
+
+func TestHarnessUnknownHost(t *testing.T) {
+	h := newHarness(t, nil)
+	if _, err := h.get("missing.test"); err == nil {
+		t.Fatal("expected a host the DoH server does not know to fail")
+	}
+	if !h.doh.asked("missing.test") {
+		t.Error("expected the host to be looked up with DoH")
+	}
+}
+
+func TestHarnessWorkerRefused(t *testing.T) {
+	h := newHarness(t, func(c *Config) { c.WorkerEnabled = true })
+	h.worker.mu.Lock()
+	h.worker.refuse = true
+	h.worker.mu.Unlock()
+	if _, err := h.get(siteHost); err == nil {
+		t.Fatal("expected a refused tunnel to fail the connection")
+	}
+	if got := h.worker.tunneled(); len(got) == 0 {
+		t.Error("expected the worker to be asked for a tunnel")
+	}
+}
+
+func TestHarnessDoHJSON(t *testing.T) {
+	h := newHarness(t, func(c *Config) { c.RemoteDNSFormat = "json" })
+	body, err := h.get(siteHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != siteBody {
+		t.Errorf("got %q from the site", body)
+	}
+	if !h.doh.asked(siteHost) {
+		t.Error("expected the site to be resolved with the JSON API")
+	}
+	if _, err := h.get("missing.test"); err == nil {
+		t.Error("expected a host the DoH server does not know to fail")
+	}
+}
+
+func TestHarnessDoHPathAndHeaders(t *testing.T) {
+	t.Setenv("BEPASS_DOH_AUTH", "Bearer token")
+	h := newHarness(t, func(c *Config) {
+		c.RemoteDNSPathSuffix = "abc123"
+		c.RemoteDNSHeaders = map[string]string{"authorization": "env:BEPASS_DOH_AUTH"}
+	})
+	if _, err := h.get(siteHost); err != nil {
+		t.Fatal(err)
+	}
+	h.doh.mu.Lock()
+	path, auth := h.doh.path, h.doh.header.Get("Authorization")
+	h.doh.mu.Unlock()
+	if path != "/dns-query/abc123" {
+		t.Errorf("expected the profile in the path, got %s", path)
+	}
+	if auth != "Bearer token" {
+		t.Errorf("expected the configured header, got %q", auth)
+	}
+	if got := h.in.EffectiveConfig().RemoteDNSHeaders; len(got) != 1 || got[0] != "Authorization" {
+		t.Errorf("expected the header name alone in the effective config, got %v", got)
+	}
+}
+
+func TestHarnessTruncatedAnswer(t *testing.T) {
+	h := newHarness(t, nil)
+	h.doh.mu.Lock()
+	h.doh.truncateBelow = 4096
+	h.doh.mu.Unlock()
+	body, err := h.get(siteHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != siteBody {
+		t.Errorf("got %q from the site", body)
+	}
+	if got := h.doh.count(siteHost); got != 2 {
+		t.Errorf("expected the truncated query to be sent again, got %d queries", got)
+	}
+}
+
+func TestHarnessExchangeDNS(t *testing.T) {
+	h := newHarness(t, func(c *Config) {
+		c.Hosts = append(c.Hosts, resolve.Hosts{Domain: recordsHost, IP: "192.0.2.7"})
+	})
+	ctx := context.Background()
+	for qtype, want := range map[uint16]int{dns.TypeTXT: 2, dns.TypeMX: 1, dns.TypeSRV: 1, dns.TypeANY: 4} {
+		req := new(dns.Msg)
+		req.SetQuestion(recordsHost+".", qtype)
+		r, err := h.in.ExchangeDNS(ctx, req)
+		if err != nil {
+			t.Fatalf("%s query failed: %v", dns.TypeToString[qtype], err)
+		}
+		if len(r.Answer) != want {
+			t.Errorf("%s query: got %d records, want %d", dns.TypeToString[qtype], len(r.Answer), want)
+		}
+		for _, rr := range r.Answer {
+			if qtype != dns.TypeANY && rr.Header().Rrtype != qtype {
+				t.Errorf("%s query answered with %v", dns.TypeToString[qtype], rr)
+			}
+		}
+	}
+
+	// the hosts entries only answer the address queries
+	req := new(dns.Msg)
+	req.SetQuestion(recordsHost+".", dns.TypeA)
+	r, err := h.in.ExchangeDNS(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.7" {
+		t.Errorf("expected the hosts entry, got %v", r.Answer)
+	}
+	req.SetQuestion(recordsHost+".", dns.TypeAAAA)
+	if r, err = h.in.ExchangeDNS(ctx, req); err != nil || len(r.Answer) != 0 || r.Rcode != dns.RcodeSuccess {
+		t.Errorf("expected no IPv6 address for an IPv4 hosts entry, got %v, %v", r, err)
+	}
+	if h.doh.count(recordsHost) != 4 {
+		t.Errorf("expected the address queries to stay local, got %d queries", h.doh.count(recordsHost))
+	}
+}
+
+func TestHarnessExchangeDNSRelay(t *testing.T) {
+	h := newHarness(t, func(c *Config) {
+		c.Hosts = append(c.Hosts,
+			resolve.Hosts{Domain: "multi.test", IP: "192.0.2.1"},
+			resolve.Hosts{Domain: "multi.test", IP: "2001:db8::1"},
+			resolve.Hosts{Domain: "multi.test", IP: "192.0.2.2"})
+	})
+	ctx := context.Background()
+	req := new(dns.Msg)
+	req.SetQuestion("Records.TEST.", dns.TypeTXT)
+	req.Id = 4242
+	req.RecursionDesired = false
+	r, err := h.in.ExchangeDNS(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != 4242 || !r.Response || r.RecursionDesired || !r.RecursionAvailable {
+		t.Errorf("reply header does not match the query: %v", r.MsgHdr)
+	}
+	if len(r.Question) != 1 || r.Question[0].Name != "Records.TEST." {
+		t.Errorf("expected the question of the query, got %v", r.Question)
+	}
+	if len(r.Answer) != 2 {
+		t.Errorf("expected every TXT record, got %v", r.Answer)
+	}
+
+	for qtype, want := range map[uint16]int{dns.TypeA: 2, dns.TypeAAAA: 1} {
+		req.SetQuestion("multi.test.", qtype)
+		if r, err = h.in.ExchangeDNS(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != req.Id || len(r.Answer) != want {
+			t.Errorf("%s query: got id %d and %v", dns.TypeToString[qtype], r.Id, r.Answer)
+		}
+	}
+
+	// a query sent to port 53 gets a SERVFAIL with its ID when the DoH
+	// server fails
+	h.doh.srv.Close()
+	req.SetQuestion("other.test.", dns.TypeTXT)
+	query, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := h.in.handler.ServeDNS(ctx, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Unpack(reply); err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != req.Id || r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected a SERVFAIL to query %d, got %v", req.Id, r.MsgHdr)
+	}
+}
+
+func TestHarnessRefuseANY(t *testing.T) {
+	h := newHarness(t, func(c *Config) { c.DnsRefuseANY = true })
+	req := new(dns.Msg)
+	req.SetQuestion(recordsHost+".", dns.TypeANY)
+	r, err := h.in.ExchangeDNS(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeHINFO {
+		t.Errorf("expected the HINFO answer of RFC 8482, got %v", r.Answer)
+	}
+	if h.doh.asked(recordsHost) {
+		t.Error("expected the ANY query not to be forwarded")
+	}
+}
+
+func TestHarnessFlushDNS(t *testing.T) {
+	h := newHarness(t, nil)
+	if _, err := h.get(siteHost); err != nil {
+		t.Fatal(err)
+	}
+	queried := h.doh.count(siteHost)
+	if _, err := h.get(siteHost); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.doh.count(siteHost); got != queried {
+		t.Fatalf("expected the second connection to use the cache, got %d queries", got)
+	}
+	h.in.FlushDNS()
+	if _, err := h.get(siteHost); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.doh.count(siteHost); got == queried {
+		t.Fatal("expected the site to be resolved again after a flush")
+	}
+	queried = h.doh.count(siteHost)
+	h.in.ForgetDNS(siteHost)
+	if _, err := h.get(siteHost); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.doh.count(siteHost); got == queried {
+		t.Fatal("expected the site to be resolved again once forgotten")
+	}
+}
+
+// portOf returns the port srv listens on.
+func portOf(srv *httptest.Server) string {
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	return port
+}
@@ -0,0 +1,159 @@
+package core
+
+import (
+	"bepass/logger"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// healthCheckTimeout bounds each check of a readiness probe.
+const healthCheckTimeout = 5 * time.Second
+
+// captivePortalInterval is how long the result of a probe for a captive
+// portal is reused, so that a readiness endpoint polled while the worker is
+// down does not send a probe outside the tunnel on every request.
+const captivePortalInterval = time.Minute
+
+// Health is the readiness of an Instance, what the readiness endpoint of
+// HealthAddress reports.
+type Health struct {
+	Ready bool `json:"Ready"`
+	// Listening is set while every listener accepts connections
+	Listening bool `json:"Listening"`
+	// ResolverErr is why the remote DNS server did not answer, empty if it did
+	ResolverErr string `json:"ResolverErr,omitempty"`
+	// WorkerRequired is set when the connections can only go through the
+	// worker, which then has to answer for the instance to be ready
+	WorkerRequired bool `json:"WorkerRequired"`
+	// WorkerErr is why no worker answered, empty if one did or none is required
+	WorkerErr string `json:"WorkerErr,omitempty"`
+	// CaptivePortal is the page of the captive portal holding the traffic
+	// back, looked for once a check failed
+	CaptivePortal string `json:"CaptivePortal,omitempty"`
+}
+
+// Health checks the instance: its listeners are up, the remote DNS server
+// answers and, unless the connections can go direct without it, a worker
+// answers. Each check gives up after healthCheckTimeout. When the DNS server
+// or the worker does not answer, the network is probed for a captive portal,
+// which would explain it.
+func (in *Instance) Health(ctx context.Context) Health {
+	h := Health{Listening: in.listening()}
+	resolverCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	err := in.handler.CheckResolver(resolverCtx)
+	cancel()
+	if err != nil {
+		h.ResolverErr = err.Error()
+	}
+	config := in.config
+	h.WorkerRequired = config.WorkerEnabled && !config.WorkerDNSOnly && !config.WorkerLazyStart
+	if h.WorkerRequired {
+		workerCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		err := in.pingWorkers(workerCtx)
+		cancel()
+		if err != nil {
+			h.WorkerErr = err.Error()
+		}
+	}
+	if h.ResolverErr != "" || h.WorkerErr != "" {
+		h.CaptivePortal = in.captivePortal(ctx)
+	}
+	h.Ready = h.Listening && h.ResolverErr == "" && h.WorkerErr == ""
+	return h
+}
+
+// captivePortal returns the page of the captive portal of the network, logged
+// as the reason nothing gets through, "" if there is none or the probe did not
+// get an answer. The network is probed at most once every
+// captivePortalInterval, and never in ParanoidMode, the probe going out in the
+// clear and resolved by the system.
+func (in *Instance) captivePortal(ctx context.Context) string {
+	if in.config.ParanoidMode {
+		return ""
+	}
+	in.portalMu.Lock()
+	defer in.portalMu.Unlock()
+	if !in.portalAt.IsZero() && time.Since(in.portalAt) < captivePortalInterval {
+		return in.portal
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	in.portal = ""
+	var portal *CaptivePortalError
+	if err := DetectCaptivePortal(ctx, in.dialer, in.config.CaptivePortalURL); errors.As(err, &portal) {
+		logger.Errorf("%v", err)
+		in.portal = portal.Portal
+	}
+	in.portalAt = time.Now()
+	return in.portal
+}
+
+// listening reports whether the instance is started and every socks server
+// accepts connections.
+func (in *Instance) listening() bool {
+	in.mu.Lock()
+	srvs, done := in.srvs, in.done
+	in.mu.Unlock()
+	if done == nil {
+		return false
+	}
+	select {
+	case <-done:
+		return false
+	default:
+	}
+	for _, srv := range srvs {
+		select {
+		case <-srv.Ready():
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// healthHandler serves the liveness endpoint, /healthz, answering as long as
+// the process does, and the readiness endpoint, /readyz, with the Health of
+// the instance and a 503 status when it is not ready.
+func (in *Instance) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h := in.Health(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if !h.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(h)
+	})
+	return mux
+}
+
+// startHealth serves the health endpoints on HealthAddress until ctx is done.
+func (in *Instance) startHealth(ctx context.Context) error {
+	if in.config.HealthAddress == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", in.config.HealthAddress)
+	if err != nil {
+		return bindError(in.config.HealthAddress, err)
+	}
+	srv := &http.Server{Handler: in.healthHandler(), ReadHeaderTimeout: healthCheckTimeout}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("health endpoint stopped: %v", err)
+		}
+	}()
+	return nil
+}
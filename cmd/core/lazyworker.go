@@ -0,0 +1,74 @@
+package core
+
+import (
+	"bepass/logger"
+	"context"
+	"errors"
+	"time"
+)
+
+// The waits between two probes of the workers while none answers, doubled
+// after each round up to the longest, and how long a worker has to answer.
+const (
+	workerProbeInterval    = time.Second
+	workerProbeMaxInterval = 30 * time.Second
+	workerProbeTimeout     = 10 * time.Second
+)
+
+// startWorkerProbe, with WorkerLazyStart, runs the instance degraded until a
+// worker answers: the connections the worker would carry go direct, their
+// ClientHello fragmented, so bepass is usable even when the worker can not be
+// resolved or reached at startup. The workers are probed in the background and
+// the first answer brings them online for good. ParanoidMode never goes
+// direct, so it is left alone, as is a client of a shared tunnel daemon.
+func (in *Instance) startWorkerProbe(ctx context.Context) {
+	config := in.config
+	if !config.WorkerLazyStart || !config.WorkerEnabled || config.WorkerDNSOnly ||
+		config.ParanoidMode || in.handler.Transport.Shared != nil {
+		return
+	}
+	in.workerOffline.Store(true)
+	go func() {
+		interval := workerProbeInterval
+		for {
+			if in.pingWorkers(ctx) == nil {
+				in.workerOffline.Store(false)
+				logger.Infof("worker online, tunneling through it")
+				return
+			}
+			if interval == workerProbeInterval {
+				logger.Errorf("worker unreachable, connecting direct until it answers")
+				// the portal of the network is the likely culprit if there is one
+				in.captivePortal(ctx)
+			}
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return
+			}
+			if interval *= 2; interval > workerProbeMaxInterval {
+				interval = workerProbeMaxInterval
+			}
+		}
+	}()
+}
+
+// pingWorkers pings the workers until one answers, it returns the error of
+// the last one when none does.
+func (in *Instance) pingWorkers(ctx context.Context) error {
+	addrs := in.endpoints.Items()
+	if len(addrs) == 0 && in.config.WorkerAddress != "" {
+		addrs = []string{in.config.WorkerAddress}
+	}
+	err := errors.New("no worker address")
+	for _, addr := range addrs {
+		pingCtx, cancel := context.WithTimeout(ctx, workerProbeTimeout)
+		_, err = in.tunnel.Ping(pingCtx, addr)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		logger.Debugf("probe of worker %s failed: %v", logger.Redact(addr), err)
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"bepass/dialer"
+	"bepass/logger"
+	"bepass/socks5"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// Listener is an additional address the proxy listens on, speaking SOCKS and
+// HTTP like BindAddress. All listeners share the handler of the instance but
+// each has its own client settings.
+type Listener struct {
+	BindAddress string `mapstructure:"BindAddress"`
+	// AcceptProxyProtocol expects a PROXY protocol header on this listener
+	AcceptProxyProtocol bool `mapstructure:"AcceptProxyProtocol"`
+	// AllowedClients lists the IPs and CIDRs let in, all clients if empty
+	AllowedClients []string `mapstructure:"AllowedClients"`
+	// TLSCert and TLSKey, PEM files or PEM blocks, have the listener speak
+	// SOCKS and HTTP over TLS
+	TLSCert string `mapstructure:"TLSCert"`
+	TLSKey  string `mapstructure:"TLSKey"`
+	// Authorize replaces the Authorize of the config on this listener
+	Authorize socks5.AuthorizeFunc `mapstructure:"-"`
+}
+
+// listener is a Listener ready to be served.
+type listener struct {
+	Listener
+	allowed []*net.IPNet
+	tls     *tls.Config
+	// cert serves the certificate of tls, reloaded by ReloadCerts
+	cert *certReloader
+}
+
+// listeners returns the listener for BindAddress followed by the ones of
+// Listeners.
+func listeners(config *Config) ([]listener, error) {
+	main := listener{Listener: Listener{
+		BindAddress:         config.BindAddress,
+		AcceptProxyProtocol: config.AcceptProxyProtocol,
+		TLSCert:             config.BindTLSCert,
+		TLSKey:              config.BindTLSKey,
+		Authorize:           config.Authorize,
+	}}
+	var err error
+	if config.ACMEEnabled {
+		main.tls, err = acmeTLS(config)
+	} else {
+		main.tls, main.cert, err = listenerTLS(main.Listener)
+	}
+	if err != nil {
+		return nil, err
+	}
+	all := []listener{main}
+	for _, l := range config.Listeners {
+		if l.BindAddress == "" {
+			return nil, fmt.Errorf("listener without a BindAddress")
+		}
+		allowed, err := parseAllowedClients(l.AllowedClients)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AllowedClients of listener %s, %v", l.BindAddress, err)
+		}
+		tlsConfig, cert, err := listenerTLS(l)
+		if err != nil {
+			return nil, err
+		}
+		if l.Authorize == nil {
+			l.Authorize = config.Authorize
+		}
+		all = append(all, listener{Listener: l, allowed: allowed, tls: tlsConfig, cert: cert})
+	}
+	return all, nil
+}
+
+// listenerTLS returns the TLS config of l, nil if it has no certificate, and
+// the reloader of its certificate.
+func listenerTLS(l Listener) (*tls.Config, *certReloader, error) {
+	if l.TLSCert == "" && l.TLSKey == "" {
+		return nil, nil, nil
+	}
+	cert := &certReloader{listener: l.BindAddress, certFile: l.TLSCert, keyFile: l.TLSKey}
+	if err := cert.load(); err != nil {
+		return nil, nil, err
+	}
+	return &tls.Config{GetCertificate: cert.getCertificate, MinVersion: tls.VersionTLS12}, cert, nil
+}
+
+// certReloader holds the certificate of a listener, replaced when it is
+// loaded again so a renewed certificate is served without a restart. The
+// handshakes under way keep the one they started with.
+type certReloader struct {
+	listener          string
+	certFile, keyFile string
+	current           atomic.Pointer[tls.Certificate]
+}
+
+// load reads the certificate and its key. The current certificate is kept
+// if they can not be read or do not match.
+func (r *certReloader) load() error {
+	certPEM, err := dialer.ReadPEM(r.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read the certificate of listener %s, %v", r.listener, err)
+	}
+	keyPEM, err := dialer.ReadPEM(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read the key of listener %s, %v", r.listener, err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid certificate of listener %s, %v", r.listener, err)
+	}
+	r.current.Store(&cert)
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current.Load(), nil
+}
+
+// ReloadCerts reads the TLS certificates of the listeners again, after a
+// renewal. A listener whose files can not be loaded keeps its certificate,
+// the first such error is returned.
+func (in *Instance) ReloadCerts() error {
+	var firstErr error
+	for _, l := range in.listeners {
+		if l.cert == nil {
+			continue
+		}
+		if err := l.cert.load(); err != nil {
+			logger.Errorf("%v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		logger.Infof("reloaded the certificate of listener %s", l.BindAddress)
+	}
+	return firstErr
+}
+
+// parseAllowedClients parses a list of IPs and CIDRs.
+func parseAllowedClients(clients []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range clients {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
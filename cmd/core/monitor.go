@@ -0,0 +1,21 @@
+package core
+
+import (
+	"bepass/netmon"
+	"context"
+)
+
+// startNetworkMonitor watches the network with NetworkMonitor set. On a
+// change the DNS cache is flushed, as the answers may not suit the new
+// network, and the tunnels to the workers are dialed again instead of
+// waiting for their dead connections to time out.
+func (in *Instance) startNetworkMonitor(ctx context.Context) {
+	if !in.config.NetworkMonitor {
+		return
+	}
+	m := &netmon.Monitor{OnChange: func() {
+		in.FlushDNS()
+		in.tunnel.Reconnect()
+	}}
+	go m.Run(ctx)
+}
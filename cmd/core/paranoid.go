@@ -0,0 +1,79 @@
+package core
+
+import (
+	"bepass/doh"
+	"bepass/logger"
+	"bepass/route"
+	"bepass/server"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// paranoidConfig returns config with the knobs that could let a lookup or a
+// connection out of the tunnel overridden, for ParanoidMode: every connection
+// goes through the worker and nothing is resolved by the system or a plain DNS
+// server. It fails if config still leaves such a path open, the settings that
+// can not be guessed, like the worker or the IP of the DoH server, must be
+// given.
+func paranoidConfig(config *Config) (*Config, error) {
+	c := *config
+	if c.BootstrapDNS != "" {
+		logger.Warnf("paranoid mode: ignoring BootstrapDNS %s, the DoH server must be pinned", c.BootstrapDNS)
+		c.BootstrapDNS = ""
+	}
+	if c.DnsPlainFallback != "" {
+		logger.Warnf("paranoid mode: ignoring DnsPlainFallback %s, queries only go to the DoH server", c.DnsPlainFallback)
+		c.DnsPlainFallback = ""
+	}
+	if c.WorkerDNSOnly {
+		logger.Warn("paranoid mode: ignoring WorkerDNSOnly, connections go through the worker")
+		c.WorkerDNSOnly = false
+	}
+	c.WorkerEnabled = true
+
+	if c.WorkerAddress == "" && c.SharedTunnelSocket == "" {
+		return nil, errors.New("paranoid mode needs a WorkerAddress or TunnelEndpoints, connections can not go direct")
+	}
+	if len(c.WorkerBypass) > 0 {
+		return nil, errors.New("paranoid mode can not route anything direct, WorkerBypass must be empty")
+	}
+	if c.GFWListURL != "" {
+		return nil, errors.New("paranoid mode can not route anything direct, GFWListURL sends what it does not list direct")
+	}
+	if action, err := route.ParseAction(c.DefaultRoute); err == nil && action == route.Direct {
+		return nil, errors.New("paranoid mode can not route anything direct, DefaultRoute must not be direct")
+	}
+	if !strings.HasPrefix(c.RemoteDNSAddr, "https://") {
+		return nil, fmt.Errorf("paranoid mode needs a DoH RemoteDNSAddr, got %q", c.RemoteDNSAddr)
+	}
+	u, err := url.Parse(c.RemoteDNSAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RemoteDNSAddr %q, %v", c.RemoteDNSAddr, err)
+	}
+	if c.DoHEndpointIP == "" && doh.PinnedIP(u) == "" && net.ParseIP(u.Hostname()) == nil {
+		return nil, errors.New("paranoid mode needs the DoH server pinned with DoHEndpointIP, its name can not be looked up")
+	}
+	return &c, nil
+}
+
+// handlerResolver resolves the destinations of the socks server through the
+// handler, with DoH, instead of the system resolver.
+type handlerResolver struct {
+	handler *server.Server
+}
+
+func (r handlerResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ip, err := r.handler.ResolveContext(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ctx, nil, fmt.Errorf("failed to resolve %s", logger.Redact(name))
+	}
+	return ctx, parsed, nil
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"bepass/resolve"
+	"bepass/server"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// DestinationRewrite changes the destination of the connections to the
+// hostnames of Match, a domain with its subdomains or a shell expression with
+// * and ?, like "*.example.com".
+type DestinationRewrite struct {
+	Match string `mapstructure:"Match"`
+	// Port limits the rewrite to the destinations on it, 0 for any port
+	Port int `mapstructure:"Port"`
+	// Host replaces the hostname, a name or an IP, kept when empty
+	Host string `mapstructure:"Host"`
+	// ToPort replaces the port, kept when 0
+	ToPort int `mapstructure:"ToPort"`
+}
+
+// destinationRewrites parses DestinationRewrites, in order.
+func destinationRewrites(rules []DestinationRewrite) ([]server.Rewrite, error) {
+	var rewrites []server.Rewrite
+	for _, r := range rules {
+		if strings.TrimSpace(r.Match) == "" {
+			return nil, fmt.Errorf("invalid DestinationRewrites, a rewrite has no Match")
+		}
+		pattern, err := resolve.ParseHostPattern(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DestinationRewrites pattern %q, %v", r.Match, err)
+		}
+		if r.Host == "" && r.ToPort == 0 {
+			return nil, fmt.Errorf("invalid DestinationRewrites, %q rewrites neither the host nor the port", r.Match)
+		}
+		if r.Port < 0 || r.Port > 65535 || r.ToPort < 0 || r.ToPort > 65535 {
+			return nil, fmt.Errorf("invalid DestinationRewrites port of %q", r.Match)
+		}
+		host := strings.TrimSpace(r.Host)
+		if strings.ContainsAny(host, ":/") && net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid DestinationRewrites host %q, it is a hostname or an IP", r.Host)
+		}
+		rewrites = append(rewrites, server.Rewrite{Pattern: pattern, Port: r.Port, Host: host, ToPort: r.ToPort})
+	}
+	return rewrites, nil
+}
+
+// sniOverride parses SNIOverrides, the SNI to send to the hostnames of each
+// pattern, into the SNIOverride of the dialer. The longest matching pattern,
+// the most specific, wins.
+func sniOverride(overrides map[string]string) (func(host string) string, error) {
+	if len(overrides) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(overrides))
+	for k := range overrides {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	patterns := make([]resolve.HostPattern, len(keys))
+	for i, k := range keys {
+		pattern, err := resolve.ParseHostPattern(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SNIOverrides pattern %q, %v", k, err)
+		}
+		if sni := overrides[k]; sni == "" || net.ParseIP(sni) != nil {
+			return nil, fmt.Errorf("invalid SNIOverrides name %q of %q, it is a hostname", sni, k)
+		}
+		patterns[i] = pattern
+	}
+	return func(host string) string {
+		for i, p := range patterns {
+			if p.Match(host) {
+				return overrides[keys[i]]
+			}
+		}
+		return ""
+	}, nil
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"bepass/dialer"
+	"bepass/logger"
+	"bepass/route"
+	"bepass/utils"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The routing table sources that are not files.
+const (
+	workerBypassSource = "WorkerBypass"
+	gfwListSource      = "gfwlist"
+)
+
+// RouteFile is a file of routing rules: a PAC file, an AutoProxy list like
+// gfwlist or a domain list, the lists plain or base64 encoded.
+type RouteFile struct {
+	Path string `mapstructure:"Path"`
+	// Format is "pac", "autoproxy" or "list", guessed from the file when empty
+	Format string `mapstructure:"Format"`
+	// Action is the route of the domains of a list, worker when empty
+	Action string `mapstructure:"Action"`
+}
+
+// loadRoutes builds the routing table from WorkerBypass, then the
+// RouteFiles, in order, the first rule matching a hostname wins, then the
+// list at GFWListURL once it is fetched. The hostnames no rule matches take DefaultRoute, or the route
+// a PAC file ends with, or go direct with a GFWListURL and through the
+// worker otherwise. It returns nil when there is nothing to route.
+func loadRoutes(config *Config) (*route.Table, error) {
+	if len(config.WorkerBypass) == 0 && len(config.RouteFiles) == 0 &&
+		config.DefaultRoute == "" && config.GFWListURL == "" {
+		return nil, nil
+	}
+	table := &route.Table{Default: route.Worker}
+	if config.GFWListURL != "" {
+		table.Default = route.Direct
+	}
+	if err := table.SetSource(workerBypassSource, bypassRules(config.WorkerBypass)); err != nil {
+		return nil, fmt.Errorf("invalid WorkerBypass, %v", err)
+	}
+	var pacDefault route.Action
+	for _, f := range config.RouteFiles {
+		data, err := os.ReadFile(f.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read route file, %v", err)
+		}
+		var rules []route.Rule
+		switch routeFileFormat(f, data) {
+		case "pac":
+			var fallback route.Action
+			rules, fallback, err = route.ParsePAC(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s, %v", f.Path, err)
+			}
+			if pacDefault == "" {
+				pacDefault = fallback
+			}
+		case "list":
+			action := route.Worker
+			if f.Action != "" {
+				if action, err = route.ParseAction(f.Action); err != nil {
+					return nil, fmt.Errorf("invalid action of %s, %v", f.Path, err)
+				}
+			}
+			rules = route.ParseDomainList(data, action)
+		case "autoproxy":
+			if rules, err = route.ParseAutoProxy(data); err != nil {
+				return nil, fmt.Errorf("failed to parse %s, %v", f.Path, err)
+			}
+		default:
+			return nil, fmt.Errorf("unknown route file format %q", f.Format)
+		}
+		if config.ParanoidMode {
+			for _, r := range rules {
+				if r.Action == route.Direct {
+					return nil, fmt.Errorf("paranoid mode can not route anything direct, %s has the rule %s", f.Path, r)
+				}
+			}
+		}
+		if err := table.SetSource(f.Path, rules); err != nil {
+			return nil, fmt.Errorf("failed to load %s, %v", f.Path, err)
+		}
+	}
+
+	switch {
+	case config.DefaultRoute != "":
+		action, err := route.ParseAction(config.DefaultRoute)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DefaultRoute, %v", err)
+		}
+		table.Default = action
+	case pacDefault != "":
+		table.Default = pacDefault
+	}
+	if config.ParanoidMode && table.Default == route.Direct {
+		return nil, errors.New("paranoid mode can not route anything direct, the hostnames no rule matches would go direct")
+	}
+	return table, nil
+}
+
+// bypassRules routes the destinations of WorkerBypass direct: domains, with
+// their subdomains, and hostnames or IPs with * wildcards.
+func bypassRules(destinations []string) []route.Rule {
+	var rules []route.Rule
+	for _, d := range destinations {
+		d = strings.TrimSpace(d)
+		switch {
+		case d == "":
+			continue
+		case strings.Contains(d, "*"):
+			rules = append(rules, route.Rule{Kind: route.MatchGlob, Value: d, Action: route.Direct})
+		default:
+			rules = append(rules, route.Rule{Kind: route.MatchDomain, Value: strings.TrimPrefix(d, "."), Action: route.Direct})
+		}
+	}
+	return rules
+}
+
+// routeFileFormat returns the format of f, a PAC file defines FindProxyForURL
+// and an AutoProxy list has an [AutoProxy] header.
+func routeFileFormat(f RouteFile, data []byte) string {
+	switch {
+	case f.Format != "":
+		return strings.ToLower(f.Format)
+	case strings.EqualFold(filepath.Ext(f.Path), ".pac") || bytes.Contains(data, []byte("FindProxyForURL")):
+		return "pac"
+	case route.IsAutoProxy(data):
+		return "autoproxy"
+	}
+	return "list"
+}
+
+// startGFWList keeps the AutoProxy list at GFWListURL in the routing table,
+// refreshing it every RemoteListsRefresh seconds. It is fetched through
+// bepass itself, so the list can be loaded even when its host is blocked.
+func startGFWList(ctx context.Context, config *Config, d *dialer.Dialer, table *route.Table) {
+	if config.GFWListURL == "" || table == nil {
+		return
+	}
+	interval := time.Duration(config.RemoteListsRefresh) * time.Second
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	f := &utils.RemoteFile{
+		URL:      config.GFWListURL,
+		Interval: interval,
+		Client:   d.MakeHTTPClient("", true),
+		OnUpdate: func(data []byte) error {
+			rules, err := route.ParseAutoProxy(data)
+			if err != nil {
+				return err
+			}
+			if err := table.SetSource(gfwListSource, rules); err != nil {
+				return err
+			}
+			logger.Infof("loaded %d routing rules from %s", len(rules), config.GFWListURL)
+			return nil
+		},
+	}
+	go f.Run(ctx)
+}
+
+// RouteFor returns the route the connections to host would take, direct or
+// through the worker, and why: the rule that decided it and where the rule
+// comes from, or what sends everything one way. Nothing is dialed, a status
+// page can show it to check the routing rules.
+func (in *Instance) RouteFor(host string) (route.Action, string) {
+	return in.handler.RouteFor(host)
+}
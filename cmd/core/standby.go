@@ -0,0 +1,38 @@
+package core
+
+import (
+	"bepass/endpoint"
+	"net/url"
+)
+
+// standbyEndpoint returns the StandbyEndpoint of the UDP tunnels with
+// WorkerWarmStandby: the same tunnel to the worker of endpoints following
+// the one of the tunnel, with another host, so the standby survives that
+// worker going down. With a single worker there is no standby.
+func standbyEndpoint(endpoints *endpoint.Pool) func(string) string {
+	return func(tunnelEndpoint string) string {
+		u, err := url.Parse(tunnelEndpoint)
+		if err != nil {
+			return ""
+		}
+		items := endpoints.Items()
+		hosts := make([]string, len(items))
+		start := 0
+		for i, addr := range items {
+			if w, err := url.Parse(addr); err == nil {
+				hosts[i] = w.Host
+			}
+			if hosts[i] == u.Host {
+				start = i + 1
+			}
+		}
+		for i := range hosts {
+			if host := hosts[(start+i)%len(hosts)]; host != "" && host != u.Host {
+				standby := *u
+				standby.Host = host
+				return standby.String()
+			}
+		}
+		return ""
+	}
+}
@@ -0,0 +1,35 @@
+package core
+
+import (
+	"bepass/server"
+	"time"
+)
+
+// Stats are the counters and measurements of an Instance, for status pages
+// and relay pickers.
+type Stats struct {
+	Timings server.TimingStats `json:"Timings"`
+	// EndpointRTT is the last round trip time measured to each worker
+	// endpoint by the keepalive, empty unless WorkerKeepAliveInterval is set
+	// or the lowest-latency strategy is used
+	EndpointRTT map[string]time.Duration `json:"EndpointRTT"`
+	// MalformedFrames counts the frames from the worker dropped as malformed
+	MalformedFrames uint64 `json:"MalformedFrames"`
+	// TunnelChannels is the number of channels the tunnels to the worker
+	// carry, the UDP associations and the streams of WorkerStreamMode
+	TunnelChannels int `json:"TunnelChannels"`
+	// WorkerOffline is set while WorkerLazyStart runs without a worker, none
+	// having answered yet
+	WorkerOffline bool `json:"WorkerOffline"`
+}
+
+// Stats returns the current counters and measurements of the instance.
+func (in *Instance) Stats() Stats {
+	return Stats{
+		Timings:         in.handler.Timings(),
+		EndpointRTT:     in.endpoints.RTTs(),
+		MalformedFrames: in.tunnel.MalformedFrames(),
+		TunnelChannels:  in.tunnel.Channels(),
+		WorkerOffline:   in.workerOffline.Load(),
+	}
+}
@@ -156,7 +156,7 @@ func (ui *UIComponents) Connect(myWindow *fyne.Window) {
 	}
 
 	go func() {
-		err := core.RunServer(ui.coreConfig, true)
+		err := core.RunServer(ui.coreConfig, true, nil)
 		if err != nil {
 			dialog.ShowError(err, *myWindow)
 			ui.isConnected = false
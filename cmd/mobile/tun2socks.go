@@ -29,7 +29,7 @@ func StartClient(cfg string) bool {
 	if err != nil {
 		return false
 	}
-	err = bepassCore.RunServer(config, false)
+	err = bepassCore.RunServer(config, false, nil)
 	if err != nil {
 		return false
 	}
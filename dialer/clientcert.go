@@ -0,0 +1,45 @@
+// Package dialer provides utilities for creating custom HTTP clients with
+// flexible dialing options.
+package dialer
+
+import (
+	"bepass/utils"
+	"fmt"
+	"os"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// LoadClientCert loads the certificate presented to servers asking for one.
+// cert and key are either PEM blocks, paths to PEM files or references to
+// secrets holding them. An error is returned if either can not be read or the
+// key does not match the certificate.
+func LoadClientCert(cert, key string) (*tls.Certificate, error) {
+	certPEM, err := ReadPEM(cert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client certificate, %v", err)
+	}
+	keyPEM, err := ReadPEM(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client key, %v", err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate, %v", err)
+	}
+	return &pair, nil
+}
+
+// ReadPEM returns s itself if it holds a PEM block, the content of the file it names otherwise.
+// A reference to a secret, like env:NAME, is resolved with utils.ResolveSecret.
+func ReadPEM(s string) ([]byte, error) {
+	if strings.HasPrefix(s, "env:") || strings.HasPrefix(s, "file:") {
+		v, err := utils.ResolveSecret(s)
+		return []byte(v), err
+	}
+	if strings.Contains(s, "-----BEGIN") {
+		return []byte(s), nil
+	}
+	return os.ReadFile(s)
+}
@@ -2,6 +2,8 @@
 package dialer
 
 import (
+	"bepass/utils"
+	"context"
 	"net"
 )
 
@@ -10,8 +12,43 @@ type PlainTCPDial func(network, addr, hostPort string) (net.Conn, error)
 
 // Dialer is a struct that holds various options for custom dialing.
 type Dialer struct {
-	EnableLowLevelSockets bool   // Enable low-level socket operations.
-	TLSPaddingEnabled     bool   // Enable TLS padding.
-	TLSPaddingSize        [2]int // Size of TLS padding.
-	ProxyAddress          string // Address of the proxy server.
+	EnableLowLevelSockets bool            // Enable low-level socket operations.
+	TLSPaddingEnabled     bool            // Enable TLS padding.
+	TLSPaddingSize        [2]int          // Size of TLS padding.
+	ProxyAddress          string          // Address of the proxy server.
+	TCPKeepAlive          utils.KeepAlive // Keepalive settings for upstream connections.
+	DisableIPv6           bool            // Only connect over IPv4.
+	PreferIPv6            bool            // Connect to the IPv6 address of a hostname when it has one.
+	ALPNProtocols         []string        // Protocols offered in ALPN, the fingerprint's if nil.
+	Fingerprint           string          // Browser whose ClientHello is mimicked, random if empty.
+	RandomizeSourcePort   bool            // Connect from a random ephemeral port instead of the next free one.
+	Resolver              Resolver        // Looks up the hostnames dialed, the system resolver if nil.
+	TLSMinVersion         uint16          // Lowest TLS version offered in the ClientHello, the fingerprint's if 0.
+	TLSMaxVersion         uint16          // Highest TLS version offered in the ClientHello, the fingerprint's if 0.
+
+	// CandidateFilter, if set, reorders or skips the IPs of a destination
+	// before they are dialed.
+	CandidateFilter DialCandidateFilter
+	// SNIOverride, if set, returns the SNI to send in the ClientHello of a
+	// TLS connection to host in place of host, "" to keep host.
+	SNIOverride func(host string) string
+	// Capture, if set, records the writes on the direct connections to the
+	// destinations.
+	Capture *Capture
+	// UpstreamProxy, if set, is the socks5:// or http:// proxy, with its
+	// credentials in the URL if it needs them, the TCP connections go
+	// through. The destinations are still resolved by the dialer.
+	UpstreamProxy string
+}
+
+// DialCandidateFilter is handed the IPs a connection to host is about to try,
+// in order, and returns the ones to try, in the order to try them. Programs
+// embedding bepass can skip the IPs of a blocklist or put first the fastest
+// ones of their own measurements, after Dialer did its own ordering.
+type DialCandidateFilter func(host string, ips []net.IP) []net.IP
+
+// Resolver looks up the addresses of a hostname, like net.Resolver does, so
+// programs embedding bepass can have the dialer use their own DNS.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
 }
@@ -1,7 +1,11 @@
 package dialer
 
 import (
+	"context"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDialerAndTCPDial(t *testing.T) {
@@ -50,3 +54,162 @@ func TestDialerAndTCPDial(t *testing.T) {
 
 	// You can also include tests for other functions in the Dialer here.
 }
+
+func TestResolveTCPAddrIPFamily(t *testing.T) {
+	d := Dialer{DisableIPv6: true}
+	if _, err := d.lookupTCPAddr(context.Background(), "tcp", "[2001:db8::1]:443"); err == nil {
+		t.Error("expected IPv6 destinations to be refused with IPv6 disabled")
+	}
+	addr, err := d.lookupTCPAddr(context.Background(), "tcp", "127.0.0.1:443")
+	if err != nil || addr.IP.To4() == nil {
+		t.Errorf("expected the IPv4 destination, got %v, %v", addr, err)
+	}
+
+	d = Dialer{PreferIPv6: true}
+	addr, err = d.lookupTCPAddr(context.Background(), "tcp", "127.0.0.1:443")
+	if err != nil || addr.IP.To4() == nil {
+		t.Errorf("expected an IPv4 only destination to still resolve, got %v, %v", addr, err)
+	}
+}
+
+func TestTCPDialRandomizeSourcePort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	d := Dialer{RandomizeSourcePort: true}
+	ports := make(map[int]bool)
+	for i := 0; i < 5; i++ {
+		conn, err := d.TCPDial("tcp", ln.Addr().String(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := conn.LocalAddr().(*net.TCPAddr).Port
+		_ = conn.Close()
+		if port < ephemeralPortMin || port > ephemeralPortMax {
+			t.Fatalf("source port %d outside of the ephemeral range", port)
+		}
+		ports[port] = true
+	}
+	if len(ports) < 2 {
+		t.Errorf("expected different source ports, got %v", ports)
+	}
+}
+
+type staticResolver map[string][]string
+
+func (r staticResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestDialerResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	d := Dialer{Resolver: staticResolver{"upstream.internal": {"2001:db8::1", "127.0.0.1"}}}
+	conn, err := d.TCPDialContext(context.Background(), "tcp", net.JoinHostPort("upstream.internal", port), "")
+	if err != nil {
+		t.Fatalf("expected the injected resolver to be used: %v", err)
+	}
+	_ = conn.Close()
+
+	d.PreferIPv6 = true
+	addr, err := d.lookupTCPAddr(context.Background(), "tcp", "upstream.internal:443")
+	if err != nil || addr.String() != "[2001:db8::1]:443" {
+		t.Errorf("expected the IPv6 address to be preferred, got %v, %v", addr, err)
+	}
+	if _, err := d.TCPDialContext(context.Background(), "tcp", "unknown.internal:443", ""); err == nil {
+		t.Error("expected a name unknown to the resolver to fail")
+	}
+}
+
+func TestTCPDialFailover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// nothing listens on 127.0.0.2, the connection is refused
+	d := Dialer{Resolver: staticResolver{"cdn.internal": {"127.0.0.2", "127.0.0.1"}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.TCPDialContext(ctx, "tcp", net.JoinHostPort("cdn.internal", port), "")
+	if err != nil {
+		t.Fatalf("expected the second address to be tried: %v", err)
+	}
+	if got := conn.RemoteAddr().String(); got != l.Addr().String() {
+		t.Errorf("connected to %s", got)
+	}
+	_ = conn.Close()
+
+	conn, err = d.TCPDialAddrs(ctx, "tcp", "cdn.internal", []string{net.JoinHostPort("127.0.0.2", port), l.Addr().String()})
+	if err != nil {
+		t.Fatalf("expected the second address to be tried: %v", err)
+	}
+	_ = conn.Close()
+
+	if _, err := d.TCPDialAddrs(ctx, "tcp", "cdn.internal", []string{net.JoinHostPort("127.0.0.2", port), net.JoinHostPort("127.0.0.3", port)}); err == nil {
+		t.Error("expected a failure when no address accepts")
+	}
+}
+
+func TestDialCandidateFilter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	var gotHost string
+	var gotIPs []string
+	d := Dialer{
+		Resolver: staticResolver{"cdn.internal": {"127.0.0.2", "127.0.0.1"}},
+		CandidateFilter: func(host string, ips []net.IP) []net.IP {
+			gotHost = host
+			var kept []net.IP
+			for _, ip := range ips {
+				gotIPs = append(gotIPs, ip.String())
+				if !ip.Equal(net.ParseIP("127.0.0.2")) {
+					kept = append(kept, ip)
+				}
+			}
+			return kept
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.TCPDialContext(ctx, "tcp", net.JoinHostPort("cdn.internal", port), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if gotHost != "cdn.internal" || strings.Join(gotIPs, ",") != "127.0.0.2,127.0.0.1" {
+		t.Errorf("filter saw %s %v", gotHost, gotIPs)
+	}
+
+	d.CandidateFilter = func(string, []net.IP) []net.IP { return nil }
+	if _, err := d.TCPDialContext(ctx, "tcp", net.JoinHostPort("cdn.internal", port), ""); err == nil {
+		t.Error("expected a failure when every address is filtered out")
+	}
+}
@@ -0,0 +1,57 @@
+// Package dialer provides utilities for creating custom HTTP clients with
+// flexible dialing options.
+package dialer
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// fingerprints maps the names accepted by Dialer.Fingerprint to the uTLS
+// profile whose ClientHello is sent.
+var fingerprints = map[string]tls.ClientHelloID{
+	"chrome":  tls.HelloChrome_Auto,
+	"firefox": tls.HelloFirefox_Auto,
+	"edge":    tls.HelloEdge_Auto,
+	"safari":  tls.HelloSafari_Auto,
+	"ios":     tls.HelloIOS_Auto,
+	"android": tls.HelloAndroid_11_OkHttp,
+}
+
+// modernFingerprints are picked from for each dial when no fingerprint is set.
+var modernFingerprints = []tls.ClientHelloID{
+	tls.HelloChrome_Auto,
+	tls.HelloFirefox_Auto,
+	tls.HelloEdge_Auto,
+	tls.HelloSafari_Auto,
+	tls.HelloIOS_Auto,
+}
+
+// ValidateFingerprint reports an error if name is not a known fingerprint.
+// An empty name and "random" pick a modern browser at random on every dial.
+func ValidateFingerprint(name string) error {
+	if name == "" || strings.EqualFold(name, "random") {
+		return nil
+	}
+	if _, ok := fingerprints[strings.ToLower(name)]; ok {
+		return nil
+	}
+	names := make([]string, 0, len(fingerprints))
+	for n := range fingerprints {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unknown TLS fingerprint %q, expected random or one of %s", name, strings.Join(names, ", "))
+}
+
+// clientHelloID returns the profile of the next ClientHello.
+func (d *Dialer) clientHelloID() tls.ClientHelloID {
+	if id, ok := fingerprints[strings.ToLower(d.Fingerprint)]; ok {
+		return id
+	}
+	return modernFingerprints[rand.Intn(len(modernFingerprints))]
+}
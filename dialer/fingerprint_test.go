@@ -0,0 +1,35 @@
+package dialer
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFingerprints(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+	plain := func(network, addr, _ string) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+
+	for _, name := range []string{"", "random", "chrome", "Firefox", "edge", "safari", "ios", "android"} {
+		if err := ValidateFingerprint(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+			continue
+		}
+		d := &Dialer{Fingerprint: name}
+		conn, err := d.TLSDial(plain, "tcp", addr, "")
+		if err != nil {
+			t.Errorf("%q: handshake failed: %v", name, err)
+			continue
+		}
+		_ = conn.Close()
+	}
+
+	if err := ValidateFingerprint("netscape"); err == nil {
+		t.Error("expected an unknown fingerprint to be rejected")
+	}
+}
@@ -11,15 +11,21 @@ import (
 
 // MakeHTTPClient creates an HTTP client with custom dialing behavior.
 func (d *Dialer) MakeHTTPClient(hostPort string, enableProxy bool) *http.Client {
+	return d.MakeHTTPClientWithOptions(hostPort, enableProxy, TLSOptions{})
+}
+
+// MakeHTTPClientWithOptions is like MakeHTTPClient but applies opts to the TLS
+// connections it dials itself. Through the proxy the standard TLS client is used.
+func (d *Dialer) MakeHTTPClientWithOptions(hostPort string, enableProxy bool, opts TLSOptions) *http.Client {
 	transport := &http.Transport{
 		ForceAttemptHTTP2: false,
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return d.TCPDial(network, addr, hostPort)
+			return d.TCPDialContext(ctx, network, addr, hostPort)
 		},
 		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return d.TLSDial(func(network, addr, hostPort string) (net.Conn, error) {
-				return d.TCPDial(network, addr, hostPort)
-			}, network, addr, hostPort)
+			return d.TLSDialWithOptions(func(network, addr, hostPort string) (net.Conn, error) {
+				return d.TCPDialContext(ctx, network, addr, hostPort)
+			}, network, addr, hostPort, opts)
 		},
 	}
 	if enableProxy {
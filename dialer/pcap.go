@@ -0,0 +1,196 @@
+package dialer
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The pcap file header fields: the magic of microsecond timestamps, the
+// format version, the largest packet and the link type of raw IP packets.
+const (
+	pcapMagic    = 0xa1b2c3d4
+	pcapSnapLen  = 65535
+	pcapLinkRaw  = 101
+	pcapMaxChunk = pcapSnapLen - 60
+)
+
+// Capture writes the bytes written on the connections it taps to a pcap file,
+// each write as a TCP segment from the local to the remote address of its
+// connection, so the splits of the ClientHello can be inspected in
+// Wireshark. The segments are rebuilt from the writes, the kernel may still
+// split a write into several segments on the wire. A nil Capture taps
+// nothing.
+type Capture struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+// NewCapture writes the pcap header to w and returns a Capture writing the
+// segments after it.
+func NewCapture(w io.Writer) (*Capture, error) {
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkRaw)
+	if _, err := w.Write(header[:]); err != nil {
+		return nil, err
+	}
+	c := &Capture{w: w}
+	if closer, ok := w.(io.Closer); ok {
+		c.c = closer
+	}
+	return c, nil
+}
+
+// OpenCapture creates, or truncates, the pcap file at path.
+func OpenCapture(path string) (*Capture, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewCapture(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the file of the capture.
+func (c *Capture) Close() error {
+	if c == nil || c.c == nil {
+		return nil
+	}
+	return c.c.Close()
+}
+
+// Tap returns conn with its writes recorded, conn itself for a nil Capture.
+// A tapped connection is no longer a *net.TCPConn, so it is not spliced.
+func (c *Capture) Tap(conn net.Conn) net.Conn {
+	if c == nil {
+		return conn
+	}
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	remote, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if local == nil || remote == nil {
+		return conn
+	}
+	return &capturedConn{Conn: conn, capture: c, local: local, remote: remote, seq: 1}
+}
+
+// capturedConn records the writes on Conn to capture.
+type capturedConn struct {
+	net.Conn
+	capture       *Capture
+	local, remote *net.TCPAddr
+
+	mu  sync.Mutex
+	seq uint32
+}
+
+func (c *capturedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.mu.Lock()
+		for sent := b[:n]; len(sent) > 0; {
+			chunk := sent
+			if len(chunk) > pcapMaxChunk {
+				chunk = chunk[:pcapMaxChunk]
+			}
+			c.capture.writeSegment(c.local, c.remote, c.seq, chunk)
+			c.seq += uint32(len(chunk))
+			sent = sent[len(chunk):]
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the connection if it supports it.
+func (c *capturedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// writeSegment records payload as a TCP segment from src to dst. A capture
+// that can no longer be written is not worth failing the connection for, the
+// error is dropped.
+func (c *Capture) writeSegment(src, dst *net.TCPAddr, seq uint32, payload []byte) {
+	packet := tcpSegment(src, dst, seq, payload)
+	now := time.Now()
+	var record [16]byte
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, _ = c.w.Write(append(record[:], packet...))
+}
+
+// tcpSegment builds the IPv4 or IPv6 packet of a TCP segment carrying
+// payload, with the PSH and ACK flags set.
+func tcpSegment(src, dst *net.TCPAddr, seq uint32, payload []byte) []byte {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x18
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	tcp = append(tcp, payload...)
+
+	var packet, pseudo []byte
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		packet = make([]byte, 20)
+		packet[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(tcp)))
+		packet[8] = 64
+		packet[9] = 6
+		copy(packet[12:], src4)
+		copy(packet[16:], dst4)
+		binary.BigEndian.PutUint16(packet[10:], checksum(packet, 0))
+		pseudo = append(append(append([]byte{}, src4...), dst4...), 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+	} else {
+		packet = make([]byte, 40)
+		packet[0] = 6 << 4
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = 6
+		packet[7] = 64
+		copy(packet[8:], src.IP.To16())
+		copy(packet[24:], dst.IP.To16())
+		pseudo = append(append(append([]byte{}, src.IP.To16()...), dst.IP.To16()...), 0, 0, byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+	return append(packet, tcp...)
+}
+
+// sum adds up b as big endian 16 bit words.
+func sum(b []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum returns the internet checksum of b, starting from initial.
+func checksum(b []byte, initial uint32) uint16 {
+	s := initial + sum(b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
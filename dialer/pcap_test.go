@@ -0,0 +1,84 @@
+package dialer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			_, _ = conn.Read(make([]byte, 64))
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var out bytes.Buffer
+	capture, err := NewCapture(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tapped := capture.Tap(conn)
+	for _, chunk := range []string{"\x16\x03\x01", "split hello"} {
+		if _, err := tapped.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := out.Bytes()
+	if len(b) < 24 || binary.LittleEndian.Uint32(b) != pcapMagic || binary.LittleEndian.Uint32(b[20:]) != pcapLinkRaw {
+		t.Fatal("expected a pcap header of raw IP packets")
+	}
+	b = b[24:]
+	seq := uint32(1)
+	for _, want := range []string{"\x16\x03\x01", "split hello"} {
+		if len(b) < 16 {
+			t.Fatalf("expected a segment carrying %q", want)
+		}
+		n := binary.LittleEndian.Uint32(b[8:])
+		packet := b[16 : 16+n]
+		b = b[16+n:]
+		if packet[0]>>4 != 4 || packet[9] != 6 {
+			t.Fatalf("expected an IPv4 TCP packet, got %x", packet[:20])
+		}
+		if checksum(packet[:20], 0) != 0 {
+			t.Error("invalid IP header checksum")
+		}
+		tcp := packet[20:]
+		if port := int(binary.BigEndian.Uint16(tcp[2:])); port != ln.Addr().(*net.TCPAddr).Port {
+			t.Errorf("expected the segment to the listener port, got %d", port)
+		}
+		if got := binary.BigEndian.Uint32(tcp[4:]); got != seq {
+			t.Errorf("expected the sequence number %d, got %d", seq, got)
+		}
+		pseudo := append(append(append([]byte{}, packet[12:16]...), packet[16:20]...), 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+		if checksum(tcp, sum(pseudo)) != 0 {
+			t.Error("invalid TCP checksum")
+		}
+		if got := string(tcp[20:]); got != want {
+			t.Errorf("expected the payload %q, got %q", want, got)
+		}
+		seq += uint32(len(want))
+	}
+	if len(b) != 0 {
+		t.Errorf("expected one segment per write, %d bytes left", len(b))
+	}
+
+	var none *Capture
+	if none.Tap(conn) != conn {
+		t.Error("expected a nil capture to leave the connection alone")
+	}
+}
@@ -5,37 +5,248 @@ package dialer
 import (
 	"bepass/logger"
 	"bepass/protect"
+	"bepass/utils"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"runtime"
 	"strconv"
+	"syscall"
+	"time"
 )
 
 // TCPDial connects to the destination address.
 func (d *Dialer) TCPDial(network, addr, hostPort string) (*net.TCPConn, error) {
-	var (
-		tcpAddr *net.TCPAddr
-		err     error
-	)
+	return d.TCPDialContext(context.Background(), network, addr, hostPort)
+}
+
+// TCPDialContext connects to the destination address, giving up once ctx is
+// done. A hostname resolving to several addresses is reached at the first of
+// them to accept, see TCPDialAddrs.
+func (d *Dialer) TCPDialContext(ctx context.Context, network, addr, hostPort string) (*net.TCPConn, error) {
 	if hostPort != "" {
-		tcpAddr, err = net.ResolveTCPAddr(network, hostPort)
-	} else {
-		tcpAddr, err = net.ResolveTCPAddr(network, addr)
+		addr = hostPort
 	}
+	tcpAddrs, err := d.lookupTCPAddrs(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
+	host, _, _ := net.SplitHostPort(addr)
+	return d.dialTCPAddrs(ctx, host, tcpAddrs)
+}
+
+// TCPDialAddrs connects to the first of addrs, the addresses of host, to
+// accept, trying them in order, so a destination resolving to several IPs is
+// still reached when some are blocked. Every address but the last gets a
+// share of the time left before the deadline of ctx, or connectAttemptTimeout
+// without one, so an address dropping the packets does not use it all.
+func (d *Dialer) TCPDialAddrs(ctx context.Context, network, host string, addrs []string) (*net.TCPConn, error) {
+	var tcpAddrs []*net.TCPAddr
+	var err error
+	for _, addr := range addrs {
+		var resolved []*net.TCPAddr
+		if resolved, err = d.lookupTCPAddrs(ctx, network, addr); err == nil {
+			tcpAddrs = append(tcpAddrs, resolved...)
+		}
+	}
+	if len(tcpAddrs) == 0 {
+		if err == nil {
+			err = errors.New("no address to connect to")
+		}
+		return nil, err
+	}
+	return d.dialTCPAddrs(ctx, host, tcpAddrs)
+}
+
+// connectAttemptTimeout bounds the connection attempts to the addresses tried
+// before the last when ctx has no deadline.
+const connectAttemptTimeout = 10 * time.Second
+
+// minConnectAttempt is the least time an attempt gets from the deadline, as
+// net.Dialer gives its fallback addresses.
+const minConnectAttempt = 2 * time.Second
+
+// dialTCPAddrs connects to the first of addrs, the addresses of host, to
+// accept, those CandidateFilter keeps.
+func (d *Dialer) dialTCPAddrs(ctx context.Context, host string, addrs []*net.TCPAddr) (*net.TCPConn, error) {
+	if addrs = d.filterCandidates(host, addrs); len(addrs) == 0 {
+		return nil, fmt.Errorf("every address of %s was filtered out", host)
+	}
+	var err error
+	for i, addr := range addrs {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if left := len(addrs) - i; left > 1 {
+			timeout := connectAttemptTimeout
+			if deadline, ok := ctx.Deadline(); ok {
+				if timeout = time.Until(deadline) / time.Duration(left); timeout < minConnectAttempt {
+					timeout = minConnectAttempt
+				}
+			}
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		var conn *net.TCPConn
+		conn, err = d.dialTCPAddr(attemptCtx, addr)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(addrs) > 1 {
+		return nil, fmt.Errorf("none of the %d addresses accepted, %w", len(addrs), err)
+	}
+	return nil, err
+}
+
+// filterCandidates returns the addresses of addrs CandidateFilter keeps, in
+// its order. A filter may only keep the IPs it was given.
+func (d *Dialer) filterCandidates(host string, addrs []*net.TCPAddr) []*net.TCPAddr {
+	if d.CandidateFilter == nil {
+		return addrs
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	var kept []*net.TCPAddr
+	for _, ip := range d.CandidateFilter(host, ips) {
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				kept = append(kept, addr)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// dialTCPAddr connects to addr, through UpstreamProxy if set.
+func (d *Dialer) dialTCPAddr(ctx context.Context, tcpAddr *net.TCPAddr) (*net.TCPConn, error) {
+	if d.UpstreamProxy != "" {
+		return d.dialUpstream(ctx, tcpAddr)
+	}
+	return d.dialDirect(ctx, tcpAddr)
+}
+
+// dialDirect connects to addr.
+func (d *Dialer) dialDirect(ctx context.Context, tcpAddr *net.TCPAddr) (*net.TCPConn, error) {
 	if d.EnableLowLevelSockets && (runtime.GOOS == "android" || runtime.GOOS == "linux") {
 		dialer := protect.NewClientDialer()
 		conn, err := dialer.Dial("tcp", net.JoinHostPort(tcpAddr.IP.String(), strconv.Itoa(tcpAddr.Port)))
 		if err != nil {
 			return nil, err
 		}
-		return conn.(*net.TCPConn), nil
+		return d.setupConn(conn.(*net.TCPConn)), nil
+	}
+	var conn net.Conn
+	var err error
+	if d.RandomizeSourcePort {
+		conn, err = dialFromRandomPort(ctx, tcpAddr)
+	} else {
+		var nd net.Dialer
+		conn, err = nd.DialContext(ctx, "tcp", tcpAddr.String())
+	}
+	if err != nil {
+		logger.Errorf("failed to connect to %v: %v", logger.Redact(tcpAddr), err)
+		return nil, err
+	}
+	return d.setupConn(conn.(*net.TCPConn)), nil
+}
+
+// The IANA ephemeral port range (RFC 6335) random source ports are drawn from.
+const (
+	ephemeralPortMin = 49152
+	ephemeralPortMax = 65535
+	// sourcePortAttempts bounds the ports tried when the drawn ones are in use
+	sourcePortAttempts = 8
+)
+
+// dialFromRandomPort connects to addr from a random ephemeral source port
+// instead of the next one the kernel hands out, drawing again if it is taken.
+func dialFromRandomPort(ctx context.Context, addr *net.TCPAddr) (net.Conn, error) {
+	var err error
+	for i := 0; i < sourcePortAttempts; i++ {
+		port := ephemeralPortMin + rand.Intn(ephemeralPortMax-ephemeralPortMin+1)
+		nd := net.Dialer{LocalAddr: &net.TCPAddr{Port: port}}
+		var conn net.Conn
+		conn, err = nd.DialContext(ctx, "tcp", addr.String())
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+			return conn, err
+		}
+	}
+	return nil, err
+}
+
+// lookupTCPAddr returns the address lookupTCPAddrs prefers.
+func (d *Dialer) lookupTCPAddr(ctx context.Context, network, addr string) (*net.TCPAddr, error) {
+	addrs, err := d.lookupTCPAddrs(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return addrs[0], nil
+}
+
+// lookupTCPAddrs resolves addr, with Resolver or the system resolver, to the
+// addresses of the family allowed by the dialer, the preferred family first.
+func (d *Dialer) lookupTCPAddrs(ctx context.Context, network, addr string) ([]*net.TCPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
 	}
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	port, err := net.LookupPort(network, portStr)
 	if err != nil {
-		logger.Errorf("failed to connect to %v: %v", tcpAddr, err)
 		return nil, err
 	}
-	return conn, nil
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		var resolver Resolver = net.DefaultResolver
+		if d.Resolver != nil {
+			resolver = d.Resolver
+		}
+		addrs, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	ipv4Only := network == "tcp4" || d.DisableIPv6
+	var v4, v6 []*net.TCPAddr
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, &net.TCPAddr{IP: ip, Port: port})
+		} else if !ipv4Only {
+			v6 = append(v6, &net.TCPAddr{IP: ip, Port: port})
+		}
+	}
+	if network == "tcp6" {
+		v4 = nil
+	}
+	var addrs []*net.TCPAddr
+	if d.PreferIPv6 {
+		addrs = append(v6, v4...)
+	} else {
+		addrs = append(v4, v6...)
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// setupConn applies the socket options configured on the dialer.
+func (d *Dialer) setupConn(conn *net.TCPConn) *net.TCPConn {
+	if err := utils.SetKeepAlive(conn, d.TCPKeepAlive); err != nil {
+		logger.Errorf("failed to set keepalive on %v: %v", logger.Redact(conn.RemoteAddr()), err)
+	}
+	return conn
 }
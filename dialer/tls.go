@@ -3,7 +3,9 @@
 package dialer
 
 import (
+	"crypto/x509"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	tls "github.com/refraction-networking/utls"
 	"io"
@@ -115,7 +117,7 @@ func (e *FakePaddingExtension) Read(b []byte) (n int, err error) {
 }
 
 // makeTLSHelloPacketWithPadding creates a TLS hello packet with padding.
-func (d *Dialer) makeTLSHelloPacketWithPadding(plainConn net.Conn, config *tls.Config, sni string) (*tls.UConn, error) {
+func (d *Dialer) makeTLSHelloPacketWithPadding(plainConn net.Conn, config *tls.Config, sni string, alpn []string) (*tls.UConn, error) {
 	paddingMax := d.TLSPaddingSize[1]
 	paddingMin := d.TLSPaddingSize[0]
 	paddingSize := paddingMax
@@ -179,6 +181,10 @@ func (d *Dialer) makeTLSHelloPacketWithPadding(plainConn net.Conn, config *tls.C
 		},
 		GetSessionID: nil,
 	}
+	if alpn != nil {
+		setALPN(&spec, alpn)
+	}
+	d.limitVersions(&spec, config)
 	err := utlsConn.ApplyPreset(&spec)
 
 	if err != nil {
@@ -209,39 +215,184 @@ func removeProtocolFromALPN(spec *tls.ClientHelloSpec, protocol string) *tls.Cli
 	return spec
 }
 
-// TLSDial dials a TLS connection.
+// setALPN replaces the protocols offered in the ALPN extension of spec.
+func setALPN(spec *tls.ClientHelloSpec, protocols []string) *tls.ClientHelloSpec {
+	for _, ext := range spec.Extensions {
+		if alpnExt, ok := ext.(*tls.ALPNExtension); ok {
+			alpnExt.AlpnProtocols = protocols
+		}
+	}
+	return spec
+}
+
+// tlsVersions are the TLS versions a ClientHello can offer, by name.
+var tlsVersions = map[string]uint16{
+	"1.3": tls.VersionTLS13,
+	"1.2": tls.VersionTLS12,
+	"1.1": tls.VersionTLS11,
+	"1.0": tls.VersionTLS10,
+}
+
+// ParseTLSVersion returns the TLS version named like "1.2", 0 for an empty
+// name, which keeps the versions of the fingerprint.
+func ParseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	if v, ok := tlsVersions[strings.TrimPrefix(name, "TLS")]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", name)
+}
+
+// limitVersions narrows the versions offered by spec, and accepted by config,
+// to TLSMinVersion and TLSMaxVersion. TLS 1.3 is only negotiated through the
+// supported_versions extension, so the extension is added to the specs that
+// lack it when 1.3 is in the range, and keeps only the versions in the range,
+// and its GREASE value, otherwise.
+func (d *Dialer) limitVersions(spec *tls.ClientHelloSpec, config *tls.Config) {
+	if d.TLSMinVersion == 0 && d.TLSMaxVersion == 0 {
+		return
+	}
+	lowest, highest := spec.TLSVersMin, spec.TLSVersMax
+	if lowest == 0 {
+		lowest = tls.VersionTLS10
+	}
+	if highest == 0 {
+		highest = tls.VersionTLS13
+	}
+	if d.TLSMinVersion != 0 {
+		lowest = d.TLSMinVersion
+	}
+	if d.TLSMaxVersion != 0 {
+		highest = d.TLSMaxVersion
+	}
+	spec.TLSVersMin, spec.TLSVersMax = lowest, highest
+	config.MinVersion, config.MaxVersion = lowest, highest
+
+	inRange := func(v uint16) bool { return v >= lowest && v <= highest }
+	for _, ext := range spec.Extensions {
+		if versions, ok := ext.(*tls.SupportedVersionsExtension); ok {
+			versions.Versions = slices.DeleteFunc(slices.Clone(versions.Versions), func(v uint16) bool {
+				return v != tls.GREASE_PLACEHOLDER && !inRange(v)
+			})
+			return
+		}
+	}
+	if highest < tls.VersionTLS13 {
+		return
+	}
+	versions := &tls.SupportedVersionsExtension{}
+	for _, v := range []uint16{tls.VersionTLS13, tls.VersionTLS12, tls.VersionTLS11, tls.VersionTLS10} {
+		if inRange(v) {
+			versions.Versions = append(versions.Versions, v)
+		}
+	}
+	spec.Extensions = append(spec.Extensions, versions)
+}
+
+// TLSOptions tunes a single TLS dial.
+type TLSOptions struct {
+	// ALPN replaces the offered protocols, nil offers the ALPNProtocols of
+	// the dialer, or the protocols of the fingerprint, except h2
+	ALPN []string
+	// VerifyHostname, if set, verifies the server certificate against this
+	// name, which does not need to match the SNI or the dialed address
+	VerifyHostname string
+	// RootCAs verifies the certificate with VerifyHostname, the system roots if nil
+	RootCAs *x509.CertPool
+	// ClientCert is presented when the server asks for a client certificate
+	ClientCert *tls.Certificate
+}
+
+// TLSDial dials a TLS connection offering the default ALPN protocols, which never include h2.
 func (d *Dialer) TLSDial(plainDialer PlainTCPDial, network, addr, hostPort string) (net.Conn, error) {
+	return d.TLSDialWithOptions(plainDialer, network, addr, hostPort, TLSOptions{})
+}
+
+// TLSDialALPN dials a TLS connection offering the given ALPN protocols, nil
+// offers the defaults of TLSOptions.ALPN.
+func (d *Dialer) TLSDialALPN(plainDialer PlainTCPDial, network, addr, hostPort string, alpn []string) (net.Conn, error) {
+	return d.TLSDialWithOptions(plainDialer, network, addr, hostPort, TLSOptions{ALPN: alpn})
+}
+
+// defaultALPN returns the protocols offered by dials that do not choose their
+// own. h2 is left out, only the dials asking for it can speak it.
+func (d *Dialer) defaultALPN() []string {
+	if d.ALPNProtocols == nil {
+		return nil
+	}
+	alpn := slices.DeleteFunc(slices.Clone(d.ALPNProtocols), func(p string) bool { return p == "h2" })
+	if len(alpn) == 0 {
+		return nil
+	}
+	return alpn
+}
+
+// verifyHostname returns a VerifyConnection callback checking the certificate
+// chain against roots and name.
+func verifyHostname(name string, roots *x509.CertPool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       name,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return fmt.Errorf("certificate is not valid for %s, %w", name, err)
+		}
+		return nil
+	}
+}
+
+// TLSDialWithOptions dials a TLS connection tuned by opts. Certificates are not
+// verified unless opts.VerifyHostname is set.
+func (d *Dialer) TLSDialWithOptions(plainDialer PlainTCPDial, network, addr, hostPort string, opts TLSOptions) (net.Conn, error) {
+	alpn := opts.ALPN
+	if alpn == nil {
+		alpn = d.defaultALPN()
+	}
 	sni, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
+	if d.SNIOverride != nil {
+		// a fronting name sharing the IP of the host, the certificate is
+		// still verified against VerifyHostname
+		if front := d.SNIOverride(sni); front != "" {
+			sni = front
+		}
+	}
 	plainConn, err := plainDialer(network, addr, hostPort)
 	if err != nil {
 		return nil, err
 	}
 
-	var randomFingerprint tls.ClientHelloID
-
-	modernFingerprints := []tls.ClientHelloID{
-		tls.HelloChrome_Auto,
-		tls.HelloFirefox_Auto,
-		tls.HelloEdge_Auto,
-		tls.HelloSafari_Auto,
-		tls.HelloIOS_Auto,
-	}
-	randomFingerprint = modernFingerprints[rand.Intn(len(modernFingerprints))]
-
 	config := tls.Config{
 		ServerName:         sni,
 		InsecureSkipVerify: true,
 		NextProtos:         nil,
 		MinVersion:         tls.VersionTLS10,
 	}
+	if opts.VerifyHostname != "" {
+		// the default verification would check the SNI, verify the intended name instead
+		config.VerifyConnection = verifyHostname(opts.VerifyHostname, opts.RootCAs)
+	}
+	if opts.ClientCert != nil {
+		config.Certificates = []tls.Certificate{*opts.ClientCert}
+	}
 
 	var utlsClient *tls.UConn
 
 	if d.TLSPaddingEnabled {
-		utlsConn, handshakeErr := d.makeTLSHelloPacketWithPadding(plainConn, &config, sni)
+		utlsConn, handshakeErr := d.makeTLSHelloPacketWithPadding(plainConn, &config, sni, alpn)
 		if handshakeErr != nil {
 			_ = plainConn.Close()
 			fmt.Println(handshakeErr)
@@ -252,9 +403,18 @@ func (d *Dialer) TLSDial(plainDialer PlainTCPDial, network, addr, hostPort strin
 
 	utlsClient = tls.UClient(plainConn, &config, tls.HelloCustom)
 
-	spec, _ := tls.UTLSIdToSpec(randomFingerprint)
+	spec, err := tls.UTLSIdToSpec(d.clientHelloID())
+	if err != nil {
+		_ = plainConn.Close()
+		return nil, err
+	}
 
-	err = utlsClient.ApplyPreset(removeProtocolFromALPN(&spec, "h2"))
+	d.limitVersions(&spec, &config)
+	if alpn != nil {
+		err = utlsClient.ApplyPreset(setALPN(&spec, alpn))
+	} else {
+		err = utlsClient.ApplyPreset(removeProtocolFromALPN(&spec, "h2"))
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,268 @@
+package dialer
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestTLSDialVerifyHostname(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	addr := srv.Listener.Addr().String()
+
+	d := &Dialer{}
+	plain := func(network, addr, _ string) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+
+	// the httptest certificate is issued for example.com, the connection goes to 127.0.0.1
+	conn, err := d.TLSDialWithOptions(plain, "tcp", addr, "", TLSOptions{VerifyHostname: "example.com", RootCAs: roots})
+	if err != nil {
+		t.Fatalf("expected the certificate to be valid for example.com: %v", err)
+	}
+	_ = conn.Close()
+
+	_, err = d.TLSDialWithOptions(plain, "tcp", addr, "", TLSOptions{VerifyHostname: "wrong.test", RootCAs: roots})
+	if err == nil || !strings.Contains(err.Error(), "wrong.test") {
+		t.Fatalf("expected a verification error for wrong.test, got %v", err)
+	}
+}
+
+// selfSignedPEM returns a new self-signed certificate and its key, PEM encoded.
+func selfSignedPEM(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bepass client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestLoadClientCert(t *testing.T) {
+	certPEM, keyPEM := selfSignedPEM(t)
+	if _, err := LoadClientCert(certPEM, keyPEM); err != nil {
+		t.Fatalf("expected the PEM pair to load: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, []byte(certPEM), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, []byte(keyPEM), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadClientCert(certFile, keyFile); err != nil {
+		t.Fatalf("expected the pair to load from files: %v", err)
+	}
+
+	_, otherKey := selfSignedPEM(t)
+	if _, err := LoadClientCert(certPEM, otherKey); err == nil {
+		t.Error("expected a mismatched key to be rejected")
+	}
+	if _, err := LoadClientCert(filepath.Join(dir, "missing.crt"), keyFile); err == nil {
+		t.Error("expected a missing certificate file to be rejected")
+	}
+}
+
+func TestTLSDialClientCert(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	srv.TLS = &stdtls.Config{ClientAuth: stdtls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	certPEM, keyPEM := selfSignedPEM(t)
+	cert, err := LoadClientCert(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Dialer{}
+	plain := func(network, addr, _ string) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+	get := func(opts TLSOptions) (*http.Response, error) {
+		conn, err := d.TLSDialWithOptions(plain, "tcp", addr, "", opts)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+			return nil, err
+		}
+		return http.ReadResponse(bufio.NewReader(conn), nil)
+	}
+
+	resp, err := get(TLSOptions{ClientCert: cert})
+	if err != nil {
+		t.Fatalf("expected the client certificate to be accepted: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	if _, err := get(TLSOptions{}); err == nil {
+		t.Fatal("expected the server to refuse a client without certificate")
+	}
+}
+
+func TestTLSDialALPNProtocols(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	srv.TLS = &stdtls.Config{NextProtos: []string{"h2", "http/1.1", "bepass/1"}}
+	srv.StartTLS()
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	plain := func(network, addr, _ string) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+	negotiated := func(d *Dialer, alpn []string) string {
+		t.Helper()
+		conn, err := d.TLSDialALPN(plain, "tcp", addr, "", alpn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.(*tls.UConn).ConnectionState().NegotiatedProtocol
+	}
+
+	d := &Dialer{ALPNProtocols: []string{"h2", "bepass/1"}}
+	if p := negotiated(d, nil); p != "bepass/1" {
+		t.Errorf("expected the configured protocols without h2, negotiated %q", p)
+	}
+	if p := negotiated(d, []string{"h2"}); p != "h2" {
+		t.Errorf("expected an explicit ALPN to win, negotiated %q", p)
+	}
+}
+
+func TestTLSDialSNIOverride(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	srv.TLS = &stdtls.Config{GetConfigForClient: func(hello *stdtls.ClientHelloInfo) (*stdtls.Config, error) {
+		mu.Lock()
+		sent = append(sent, hello.ServerName)
+		mu.Unlock()
+		return nil, nil
+	}}
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	d := &Dialer{SNIOverride: func(host string) string {
+		if host == "real.test" {
+			return "front.test"
+		}
+		return ""
+	}}
+	plain := func(network, _, _ string) (net.Conn, error) {
+		return net.Dial(network, srv.Listener.Addr().String())
+	}
+	for _, host := range []string{"real.test", "other.test"} {
+		conn, err := d.TLSDialWithOptions(plain, "tcp", net.JoinHostPort(host, port), "", TLSOptions{VerifyHostname: "example.com", RootCAs: roots})
+		if err != nil {
+			t.Fatalf("expected the certificate to still be verified against example.com: %v", err)
+		}
+		_ = conn.Close()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(sent, ",") != "front.test,other.test" {
+		t.Errorf("expected the SNI of real.test to be replaced, sent %v", sent)
+	}
+}
+
+func TestTLSDialVersions(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	old := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	old.TLS = &stdtls.Config{MaxVersion: stdtls.VersionTLS12}
+	old.StartTLS()
+	defer old.Close()
+
+	plain := func(network, addr, _ string) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+	for _, tc := range []struct {
+		name     string
+		d        *Dialer
+		addr     string
+		expected uint16
+	}{
+		{"fingerprint up to 1.2", &Dialer{Fingerprint: "chrome", TLSMaxVersion: tls.VersionTLS12}, srv.Listener.Addr().String(), tls.VersionTLS12},
+		{"fingerprint 1.3 only", &Dialer{Fingerprint: "firefox", TLSMinVersion: tls.VersionTLS13}, srv.Listener.Addr().String(), tls.VersionTLS13},
+		{"padded 1.3 only", &Dialer{TLSPaddingEnabled: true, TLSPaddingSize: [2]int{40, 80}, TLSMinVersion: tls.VersionTLS13}, srv.Listener.Addr().String(), tls.VersionTLS13},
+		{"padded up to 1.2", &Dialer{TLSPaddingEnabled: true, TLSPaddingSize: [2]int{40, 80}, TLSMaxVersion: tls.VersionTLS12}, srv.Listener.Addr().String(), tls.VersionTLS12},
+		{"1.3 only to a 1.2 server", &Dialer{TLSMinVersion: tls.VersionTLS13}, old.Listener.Addr().String(), 0},
+	} {
+		conn, err := tc.d.TLSDial(plain, "tcp", tc.addr, "")
+		if tc.expected == 0 {
+			if err == nil {
+				_ = conn.Close()
+				t.Errorf("%s: expected the handshake to fail", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if v := conn.(*tls.UConn).ConnectionState().Version; v != tc.expected {
+			t.Errorf("%s: expected version %x, negotiated %x", tc.name, tc.expected, v)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	for name, expected := range map[string]uint16{"": 0, "1.2": tls.VersionTLS12, "TLS1.3": tls.VersionTLS13} {
+		if v, err := ParseTLSVersion(name); err != nil || v != expected {
+			t.Errorf("ParseTLSVersion(%q) = %x, %v", name, v, err)
+		}
+	}
+	if _, err := ParseTLSVersion("1.4"); err == nil {
+		t.Error("expected 1.4 to be rejected")
+	}
+}
@@ -0,0 +1,135 @@
+package dialer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// maxConnectResponse bounds the response header of an HTTP proxy to a CONNECT.
+const maxConnectResponse = 8 << 10
+
+// ValidateUpstreamProxy reports an error if address is not a proxy
+// UpstreamProxy can connect through. An empty address connects directly.
+func ValidateUpstreamProxy(address string) error {
+	if address == "" {
+		return nil
+	}
+	_, err := parseUpstreamProxy(address)
+	return err
+}
+
+// parseUpstreamProxy parses a socks5:// or http:// proxy URL with a port.
+func parseUpstreamProxy(address string) (*url.URL, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy %q, %v", address, err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q, expected socks5 or http", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("upstream proxy %q has no port", address)
+	}
+	return u, nil
+}
+
+// dialUpstream connects to target through UpstreamProxy. The connection to
+// the proxy is returned once the proxy connected it to target, the ClientHello
+// written on it is split on the way to the proxy, which sends it on in
+// segments of its own.
+func (d *Dialer) dialUpstream(ctx context.Context, target *net.TCPAddr) (*net.TCPConn, error) {
+	u, err := parseUpstreamProxy(d.UpstreamProxy)
+	if err != nil {
+		return nil, err
+	}
+	proxyAddrs, err := d.lookupTCPAddrs(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve upstream proxy, %v", err)
+	}
+	conn, err := d.dialDirect(ctx, proxyAddrs[0])
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if u.Scheme == "http" {
+		err = httpConnect(conn, u, target.String())
+	} else {
+		err = socksConnect(ctx, conn, u, target.String())
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s could not connect to %v, %v", u.Host, target, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socksConnect asks the SOCKS5 proxy of u on conn to connect to target.
+func socksConnect(ctx context.Context, conn net.Conn, u *url.URL, target string) error {
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+	d, err := proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
+	if err != nil {
+		return err
+	}
+	handshaker, ok := d.(interface {
+		DialWithConn(ctx context.Context, c net.Conn, network, address string) (net.Addr, error)
+	})
+	if !ok {
+		return errors.New("socks dialer can not reuse a connection")
+	}
+	_, err = handshaker.DialWithConn(ctx, conn, "tcp", target)
+	return err
+}
+
+// httpConnect asks the HTTP proxy of u on conn to connect to target. The
+// response is read up to its blank line only, the bytes after it belong to
+// target.
+func httpConnect(conn net.Conn, u *url.URL, target string) error {
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		return err
+	}
+	var header []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		if len(header) >= maxConnectResponse {
+			return errors.New("response header too long")
+		}
+		if _, err := conn.Read(b); err != nil {
+			return err
+		}
+		header = append(header, b[0])
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(header)), nil)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package dialer
+
+import (
+	"bepass/socks5"
+	"bepass/socks5/statute"
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// echoServer echoes what it reads on every connection.
+func echoServer(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// connectProxy is an HTTP proxy answering CONNECT for the clients
+// authenticated as user:pass.
+func connectProxy(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if user, pass, ok := (&http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}).BasicAuth(); !ok || user != "user" || pass != "pass" {
+					_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() { _, _ = io.Copy(target, conn) }()
+				_, _ = io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// socksProxy is a SOCKS5 proxy connecting to the destinations as asked.
+func socksProxy(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	srv := socks5.NewServer(socks5.WithConnectHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
+		conn, err := net.Dial("tcp", req.RawDestAddr.String())
+		if err != nil {
+			return socks5.SendReply(w, statute.RepHostUnreachable, nil)
+		}
+		defer conn.Close()
+		if err := socks5.SendReply(w, statute.RepSuccess, conn.LocalAddr()); err != nil {
+			return err
+		}
+		go func() { _, _ = io.Copy(conn, req.Reader) }()
+		_, err = io.Copy(w, conn)
+		return err
+	}))
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = srv.ServeConn(conn) }()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	target := echoServer(t)
+	httpProxy := connectProxy(t)
+	for _, proxy := range []string{
+		"socks5://" + socksProxy(t),
+		"http://user:pass@" + httpProxy,
+	} {
+		d := &Dialer{UpstreamProxy: proxy}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := d.TCPDialContext(ctx, "tcp", target.String(), "")
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", proxy, err)
+		}
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("%s: expected the echo through the proxy, got %q, %v", proxy, buf, err)
+		}
+		_ = conn.Close()
+	}
+
+	d := &Dialer{UpstreamProxy: "http://user:wrong@" + httpProxy}
+	if _, err := d.TCPDial("tcp", target.String(), ""); err == nil {
+		t.Error("expected the proxy refusing the credentials to fail the dial")
+	}
+
+	for _, bad := range []string{"ftp://proxy:21", "socks5://proxy", "://"} {
+		if ValidateUpstreamProxy(bad) == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
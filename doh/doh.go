@@ -3,12 +3,18 @@ package doh
 
 import (
 	"bepass/dialer"
+	"bepass/logger"
 	"bepass/resolve"
+	"context"
 	"encoding/base64"
 	"errors"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -19,6 +25,36 @@ type ClientOptions struct {
 	EnableDNSFragment bool                   // Enable DNS fragmentation
 	Dialer            *dialer.Dialer         // Custom dialer for HTTP requests
 	LocalResolver     *resolve.LocalResolver // Local DNS resolver
+	Upstreams         map[string]Upstream    // How the DoH servers are queried, by address
+	HTTPClient        *http.Client           // Client sending the queries instead of one from Dialer
+	Fallbacks         []string               // DoH servers asked in turn when one fails
+	FailoverRcodes    []int                  // Response codes sending the query to the next server
+	QueryJitter       time.Duration          // Longest random wait before a query is sent
+}
+
+// Upstream describes how a DoH server is queried.
+type Upstream struct {
+	// Format is the wire format of the queries, FormatMessage if empty
+	Format Format
+	// PathSuffix is appended to the path of the address, like the profile ID
+	// of NextDNS
+	PathSuffix string
+	// Header is added to every query, for the providers that authenticate
+	// their users with a token
+	Header http.Header
+}
+
+// url returns address with PathSuffix appended to its path.
+func (up Upstream) url(address string) (*url.URL, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if up.PathSuffix != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(up.PathSuffix, "/")
+		u.RawPath = ""
+	}
+	return u, nil
 }
 
 // ClientOption is a function type used for setting client options.
@@ -48,9 +84,68 @@ func WithLocalResolver(r *resolve.LocalResolver) ClientOption {
 	}
 }
 
+// WithHTTPClient has the queries sent with client instead of a client made
+// by the dialer, so its proxy, timeouts and trusted roots apply. The client
+// dials the DoH server itself: pinned IPs and the local resolver are not
+// used. With DNS fragmentation the queries still go through the proxy of the
+// dialer, which fragments them, if the transport of client is an
+// *http.Transport without a proxy of its own.
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(o *ClientOptions) error {
+		o.HTTPClient = client
+		return nil
+	}
+}
+
+// WithUpstream sets how the DoH server at address, as passed to Exchange, is
+// queried.
+func WithUpstream(address string, u Upstream) ClientOption {
+	return func(o *ClientOptions) error {
+		if o.Upstreams == nil {
+			o.Upstreams = make(map[string]Upstream)
+		}
+		o.Upstreams[address] = u
+		return nil
+	}
+}
+
+// WithFallbacks sets the DoH servers the queries go to, in order, when the
+// server asked can not be reached or its answer has a response code of
+// WithFailoverRcodes.
+func WithFallbacks(addresses ...string) ClientOption {
+	return func(o *ClientOptions) error {
+		o.Fallbacks = addresses
+		return nil
+	}
+}
+
+// WithFailoverRcodes sets the response codes, like dns.RcodeServerFailure and
+// dns.RcodeRefused, on which a query is asked again to the next fallback. A
+// server failing on one name may not be the only one that can resolve it.
+// If every server answers with one of them, the last answer is returned.
+func WithFailoverRcodes(rcodes ...int) ClientOption {
+	return func(o *ClientOptions) error {
+		o.FailoverRcodes = rcodes
+		return nil
+	}
+}
+
+// WithQueryJitter has every query wait up to d, at random, before it is sent,
+// so the queries do not follow the lookups of the clients, or one another, at
+// a timing an observer can match.
+func WithQueryJitter(d time.Duration) ClientOption {
+	return func(o *ClientOptions) error {
+		o.QueryJitter = d
+		return nil
+	}
+}
+
 // Client represents a DNS-over-HTTPS (DoH) client.
 type Client struct {
 	opt *ClientOptions
+	// httpClient is the client of WithHTTPClient, set to use the proxy when
+	// fragmenting
+	httpClient *http.Client
 }
 
 // NewClient creates a new DoH client with the provided options.
@@ -59,25 +154,89 @@ func NewClient(opts ...ClientOption) *Client {
 	for _, f := range opts {
 		f(o)
 	}
-	return &Client{
-		opt: o,
+	c := &Client{
+		opt:        o,
+		httpClient: o.HTTPClient,
+	}
+	if o.HTTPClient != nil && o.EnableDNSFragment && o.Dialer != nil {
+		c.httpClient = viaProxy(o.HTTPClient, o.Dialer)
 	}
+	return c
+}
+
+// viaProxy returns a copy of client sending its requests through the proxy
+// of d, or client itself when its proxy can not be set.
+func viaProxy(client *http.Client, d *dialer.Dialer) *http.Client {
+	t, ok := client.Transport.(*http.Transport)
+	switch {
+	case client.Transport == nil:
+		t = http.DefaultTransport.(*http.Transport)
+	case !ok || t.Proxy != nil:
+		return client
+	}
+	t = t.Clone()
+	// the proxy address is read for every request, it is only known once
+	// the proxy is listening
+	t.Proxy = func(*http.Request) (*url.URL, error) {
+		return url.Parse(d.ProxyAddress)
+	}
+	proxied := *client
+	proxied.Transport = t
+	return &proxied
 }
 
 // HTTPClient performs an HTTP GET request to the given address using the configured client.
 func (c *Client) HTTPClient(address string) ([]byte, error) {
+	return c.HTTPClientContext(context.Background(), address)
+}
+
+// PinnedIP returns the IP carried in the fragment of a DoH address, e.g.
+// "https://cloudflare-dns.com/dns-query#1.1.1.1", or an empty string. The
+// server is reached at that IP while the hostname is used for SNI, the Host
+// header and the certificate validation, so the name is never looked up.
+func PinnedIP(u *url.URL) string {
+	if net.ParseIP(u.Fragment) == nil {
+		return ""
+	}
+	return u.Fragment
+}
+
+// HTTPClientContext is like HTTPClient but aborts the request once ctx is done.
+func (c *Client) HTTPClientContext(ctx context.Context, address string) ([]byte, error) {
+	return c.get(ctx, address, nil)
+}
+
+// get fetches address, sending header with the request.
+func (c *Client) get(ctx context.Context, address string, header http.Header) ([]byte, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	pinnedIP := PinnedIP(u)
+	u.Fragment = ""
+
 	var client *http.Client
-	if c.opt.EnableDNSFragment {
+	switch {
+	case c.httpClient != nil:
+		client = c.httpClient
+	case c.opt.EnableDNSFragment:
+		// the proxy resolves the pinned IP, the standard TLS client verifies the certificate
 		client = c.opt.Dialer.MakeHTTPClient("", true)
-	} else {
-		u, err := url.Parse(address)
-		if err != nil {
-			return nil, err
-		}
+	case pinnedIP != "":
+		client = c.opt.Dialer.MakeHTTPClientWithOptions(net.JoinHostPort(pinnedIP, portOf(u)), false,
+			dialer.TLSOptions{VerifyHostname: u.Hostname()})
+	default:
 		dohIP := c.opt.LocalResolver.Resolve(u.Hostname())
-		client = c.opt.Dialer.MakeHTTPClient(dohIP+":443", false)
+		client = c.opt.Dialer.MakeHTTPClient(net.JoinHostPort(dohIP, portOf(u)), false)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		httpReq.Header[k] = v
 	}
-	resp, err := client.Get(address)
+	resp, err := client.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
@@ -97,22 +256,94 @@ func (c *Client) HTTPClient(address string) ([]byte, error) {
 
 // Exchange performs a DNS query using DoH to the specified address.
 func (c *Client) Exchange(req *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
+	return c.ExchangeContext(context.Background(), req, address)
+}
+
+// ExchangeContext is like Exchange but aborts the query once ctx is done.
+// When address fails, or answers with a response code of WithFailoverRcodes,
+// the query goes to the fallbacks in turn.
+func (c *Client) ExchangeContext(ctx context.Context, req *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
+	if err := c.jitter(ctx); err != nil {
+		return nil, 0, err
+	}
+	r, rtt, err = c.exchange(ctx, req, address)
+	var failed *dns.Msg
+	for _, fallback := range c.opt.Fallbacks {
+		if err == nil && !c.failover(r) {
+			return r, rtt, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if fallback == address {
+			continue
+		}
+		if err == nil {
+			failed = r
+			logger.Debugf("dns server %s answered %s, asking %s", logger.Redact(address), dns.RcodeToString[r.Rcode], logger.Redact(fallback))
+		} else {
+			logger.Debugf("dns query to %s failed, asking %s: %v", logger.Redact(address), logger.Redact(fallback), err)
+		}
+		address = fallback
+		r, rtt, err = c.exchange(ctx, req, address)
+	}
+	if err != nil && failed != nil {
+		return failed, rtt, nil
+	}
+	return r, rtt, err
+}
+
+// jitter waits up to QueryJitter, at random, or until ctx is done.
+func (c *Client) jitter(ctx context.Context) error {
+	if c.opt.QueryJitter <= 0 {
+		return nil
+	}
+	t := time.NewTimer(time.Duration(rand.Int63n(int64(c.opt.QueryJitter) + 1)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// failover reports whether r has a response code of WithFailoverRcodes.
+func (c *Client) failover(r *dns.Msg) bool {
+	return slices.Contains(c.opt.FailoverRcodes, r.Rcode)
+}
+
+// exchange queries the DoH server at address.
+func (c *Client) exchange(ctx context.Context, req *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
+	up := c.opt.Upstreams[address]
+	if up.Format == FormatJSON {
+		return c.exchangeJSON(ctx, req, address, up)
+	}
 	var (
 		buf, b64 []byte
 		begin    = time.Now()
 		origID   = req.Id
 	)
 
-	// Set DNS ID as zero according to RFC8484 (cache-friendly)
+	// Set DNS ID as zero according to RFC8484 (cache-friendly), the message
+	// of the caller is left as it was
 	req.Id = 0
 	buf, err = req.Pack()
+	req.Id = origID
 	if err != nil {
 		return
 	}
 	b64 = make([]byte, base64.RawURLEncoding.EncodedLen(len(buf)))
 	base64.RawURLEncoding.Encode(b64, buf)
 
-	content, err := c.HTTPClient(address + "?dns=" + string(b64))
+	u, err := up.url(address)
+	if err != nil {
+		return
+	}
+	q := u.Query()
+	q.Set("dns", string(b64))
+	u.RawQuery = q.Encode()
+	content, err := c.get(ctx, u.String(), up.Header)
 	if err != nil {
 		return
 	}
@@ -123,3 +354,36 @@ func (c *Client) Exchange(req *dns.Msg, address string) (r *dns.Msg, rtt time.Du
 	rtt = time.Since(begin)
 	return
 }
+
+// exchangeJSON queries address with the JSON API.
+func (c *Client) exchangeJSON(ctx context.Context, req *dns.Msg, address string, up Upstream) (*dns.Msg, time.Duration, error) {
+	begin := time.Now()
+	u, err := up.url(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := jsonQuery(req, u); err != nil {
+		return nil, 0, err
+	}
+	header := up.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Accept", jsonAccept)
+	content, err := c.get(ctx, u.String(), header)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := decodeJSON(req, content)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, time.Since(begin), nil
+}
+
+func portOf(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	return "443"
+}
@@ -0,0 +1,180 @@
+package doh
+
+import (
+	"bepass/dialer"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestWithHTTPClient(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		req := new(dns.Msg)
+		if err != nil || req.Unpack(data) != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		out, _ := resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(out)
+	}))
+	defer srv.Close()
+
+	// the client of httptest trusts the server, one made by the dialer would not
+	c := NewClient(WithHTTPClient(srv.Client()))
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	r, _, err := c.Exchange(req, srv.URL+"/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("unexpected answer %v", r.Answer)
+	}
+}
+
+func TestExchangeKeepsEDNS0(t *testing.T) {
+	var got *dns.Msg
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		got = new(dns.Msg)
+		if err := got.Unpack(data); err != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(got)
+		resp.AuthenticatedData = true
+		resp.Answer = []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")},
+			&dns.RRSIG{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60},
+				TypeCovered: dns.TypeA, Algorithm: dns.ECDSAP256SHA256, Labels: 2, SignerName: "example.com.", Signature: "dGVzdA=="},
+		}
+		resp.SetEdns0(1232, true)
+		out, _ := resp.Pack()
+		_, _ = w.Write(out)
+	}))
+	defer srv.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+	id := req.Id
+	r, _, err := NewClient(WithHTTPClient(srv.Client())).Exchange(req, srv.URL+"/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Id != id {
+		t.Errorf("the ID of the query was changed to %d", req.Id)
+	}
+	if opt := got.IsEdns0(); opt == nil || !opt.Do() || opt.UDPSize() != 4096 || len(opt.Option) != 1 {
+		t.Errorf("expected the EDNS0 record to reach the server as is, got %v", opt)
+	}
+	if r.Id != id || !r.AuthenticatedData || len(r.Answer) != 2 || r.IsEdns0() == nil || !r.IsEdns0().Do() {
+		t.Errorf("expected the reply of the server with its signatures, got %v", r)
+	}
+}
+
+func TestViaProxy(t *testing.T) {
+	d := &dialer.Dialer{}
+	client := viaProxy(&http.Client{}, d)
+	d.ProxyAddress = "socks5://127.0.0.1:8085"
+	proxy, err := client.Transport.(*http.Transport).Proxy(nil)
+	if err != nil || proxy.String() != d.ProxyAddress {
+		t.Errorf("expected the proxy of the dialer, got %v, %v", proxy, err)
+	}
+
+	own := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: "proxy.example:3128"})}}
+	if viaProxy(own, d) != own {
+		t.Error("expected a client with its own proxy to be kept")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	asked := make(map[string]int)
+	var mu sync.Mutex
+	server := func(name string, rcode int) *httptest.Server {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			asked[name]++
+			mu.Unlock()
+			if rcode < 0 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			data, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+			req := new(dns.Msg)
+			if req.Unpack(data) != nil {
+				http.Error(w, "bad query", http.StatusBadRequest)
+				return
+			}
+			resp := new(dns.Msg)
+			resp.SetRcode(req, rcode)
+			out, _ := resp.Pack()
+			_, _ = w.Write(out)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	servfail := server("servfail", dns.RcodeServerFailure)
+	down := server("down", -1)
+	good := server("good", dns.RcodeSuccess)
+	query := func(opts ...ClientOption) (*dns.Msg, error) {
+		t.Helper()
+		// the httptest servers share their certificate
+		c := NewClient(append(opts, WithHTTPClient(servfail.Client()))...)
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		r, _, err := c.Exchange(req, servfail.URL)
+		return r, err
+	}
+
+	r, err := query(WithFallbacks(servfail.URL, down.URL, good.URL), WithFailoverRcodes(dns.RcodeServerFailure, dns.RcodeRefused))
+	if err != nil || r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected the answer of the last fallback, got %v, %v", r, err)
+	}
+	if asked["servfail"] != 1 || asked["down"] != 1 || asked["good"] != 1 {
+		t.Errorf("expected every server asked once, got %v", asked)
+	}
+
+	r, err = query(WithFallbacks(good.URL))
+	if err != nil || r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL returned without failover rcodes, got %v, %v", r, err)
+	}
+
+	r, err = query(WithFallbacks(down.URL), WithFailoverRcodes(dns.RcodeServerFailure))
+	if err != nil || r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected the SERVFAIL answer when the fallbacks fail, got %v, %v", r, err)
+	}
+}
+
+func TestQueryJitter(t *testing.T) {
+	c := NewClient(WithQueryJitter(time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	begin := time.Now()
+	if _, _, err := c.ExchangeContext(ctx, req, "https://127.0.0.1:1/dns-query"); err != context.DeadlineExceeded {
+		t.Errorf("expected the wait to end with the context, got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("expected the wait cut short by the context, took %v", elapsed)
+	}
+}
@@ -0,0 +1,126 @@
+package doh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// Format is the wire format of the queries to a DoH server.
+type Format string
+
+const (
+	// FormatMessage sends DNS messages, as RFC 8484 specifies
+	FormatMessage Format = "message"
+	// FormatJSON uses the JSON API of Google and Cloudflare, the query in the
+	// URL and the answer in JSON
+	FormatJSON Format = "json"
+)
+
+// ParseFormat checks s is a known format, FormatMessage if empty.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case "":
+		return FormatMessage, nil
+	case FormatMessage, FormatJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown DoH format %q", s)
+}
+
+// jsonAccept is the media type of the JSON API.
+const jsonAccept = "application/dns-json"
+
+var errJSONNoQuestion = errors.New("DoH JSON query without a question")
+
+// jsonResponse is the answer of the JSON API.
+type jsonResponse struct {
+	Status     int
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Answer     []jsonRecord
+	Authority  []jsonRecord
+	Additional []jsonRecord
+}
+
+type jsonRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// jsonQuery puts the question of req in the query of u, with the DNSSEC
+// bits and the client subnet of its EDNS0 record, the only options the
+// JSON API takes.
+func jsonQuery(req *dns.Msg, u *url.URL) error {
+	if len(req.Question) == 0 {
+		return errJSONNoQuestion
+	}
+	q := u.Query()
+	q.Set("name", req.Question[0].Name)
+	q.Set("type", strconv.Itoa(int(req.Question[0].Qtype)))
+	if req.CheckingDisabled {
+		q.Set("cd", "1")
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		if opt.Do() {
+			q.Set("do", "1")
+		}
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				q.Set("edns_client_subnet", fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask))
+			}
+		}
+	}
+	u.RawQuery = q.Encode()
+	return nil
+}
+
+// decodeJSON turns an answer of the JSON API into the reply to req. Records
+// whose data can not be parsed are dropped. The reply has an EDNS0 record
+// when req has one, with its DO bit, as the DNSSEC records were asked for.
+func decodeJSON(req *dns.Msg, content []byte) (*dns.Msg, error) {
+	var resp jsonResponse
+	if err := json.Unmarshal(content, &resp); err != nil {
+		return nil, fmt.Errorf("invalid DoH JSON answer, %v", err)
+	}
+	r := new(dns.Msg)
+	r.SetReply(req)
+	r.Rcode = resp.Status
+	r.Truncated = resp.TC
+	r.RecursionDesired = resp.RD
+	r.RecursionAvailable = resp.RA
+	r.AuthenticatedData = resp.AD
+	r.CheckingDisabled = resp.CD
+	r.Answer = jsonRecords(resp.Answer)
+	r.Ns = jsonRecords(resp.Authority)
+	r.Extra = jsonRecords(resp.Additional)
+	if opt := req.IsEdns0(); opt != nil {
+		r.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return r, nil
+}
+
+func jsonRecords(records []jsonRecord) []dns.RR {
+	var rrs []dns.RR
+	for _, rec := range records {
+		typ, ok := dns.TypeToString[rec.Type]
+		if !ok || rec.Type == dns.TypeOPT {
+			continue
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(rec.Name), rec.TTL, typ, rec.Data))
+		if err != nil || rr == nil {
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
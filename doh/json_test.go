@@ -0,0 +1,115 @@
+package doh
+
+import (
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestJSONQuery(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeAAAA)
+	u, err := url.Parse("https://dns.google/resolve#8.8.8.8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jsonQuery(req, u); err != nil {
+		t.Fatal(err)
+	}
+	if q := u.Query(); q.Get("name") != "example.com." || q.Get("type") != "28" {
+		t.Errorf("unexpected query %q", u.RawQuery)
+	}
+	if u.Fragment != "8.8.8.8" {
+		t.Errorf("expected the pinned IP to be kept, got %s", u)
+	}
+
+	req.SetEdns0(1232, true)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("198.51.100.0"),
+	})
+	u, _ = url.Parse("https://dns.google/resolve")
+	if err := jsonQuery(req, u); err != nil {
+		t.Fatal(err)
+	}
+	if q := u.Query(); q.Get("do") != "1" || q.Get("edns_client_subnet") != "198.51.100.0/24" {
+		t.Errorf("expected the EDNS0 record in the query, got %q", u.RawQuery)
+	}
+}
+
+func TestUpstreamURL(t *testing.T) {
+	for address, want := range map[string]string{
+		"https://dns.nextdns.io":                "https://dns.nextdns.io/abc123",
+		"https://dns.nextdns.io/":               "https://dns.nextdns.io/abc123",
+		"https://doh.example/dns-query#1.1.1.1": "https://doh.example/dns-query/abc123#1.1.1.1",
+	} {
+		u, err := Upstream{PathSuffix: "/abc123"}.url(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.String() != want {
+			t.Errorf("url(%s) = %s, want %s", address, u, want)
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	r, err := decodeJSON(req, []byte(`{
+		"Status": 0, "TC": false, "RD": true, "RA": true, "AD": true,
+		"Question": [{"name": "www.example.com.", "type": 1}],
+		"Answer": [
+			{"name": "www.example.com.", "type": 5, "TTL": 300, "data": "example.com."},
+			{"name": "example.com", "type": 1, "TTL": 60, "data": "93.184.216.34"},
+			{"name": "example.com.", "type": 16, "TTL": 60, "data": "\"v=spf1 -all\""},
+			{"name": "example.com.", "type": 1, "TTL": 60, "data": "not an ip"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != req.Id || !r.Response || !r.AuthenticatedData || r.Rcode != dns.RcodeSuccess {
+		t.Errorf("unexpected header %+v", r.MsgHdr)
+	}
+	if len(r.Answer) != 3 {
+		t.Fatalf("got %d records, want 3: %v", len(r.Answer), r.Answer)
+	}
+	a, ok := r.Answer[1].(*dns.A)
+	if !ok || a.A.String() != "93.184.216.34" || a.Hdr.Name != "example.com." || a.Hdr.Ttl != 60 {
+		t.Errorf("unexpected A record %v", r.Answer[1])
+	}
+	if txt, ok := r.Answer[2].(*dns.TXT); !ok || len(txt.Txt) != 1 || txt.Txt[0] != "v=spf1 -all" {
+		t.Errorf("unexpected TXT record %v", r.Answer[2])
+	}
+
+	req.SetEdns0(1232, true)
+	signed, err := decodeJSON(req, []byte(`{
+		"Status": 0, "AD": true,
+		"Answer": [
+			{"name": "example.com.", "type": 1, "TTL": 60, "data": "93.184.216.34"},
+			{"name": "example.com.", "type": 46, "TTL": 60, "data": "a 13 2 60 20301231000000 20200101000000 12345 example.com. dGVzdA=="}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signed.Answer) != 2 {
+		t.Fatalf("expected the signature to be kept, got %v", signed.Answer)
+	}
+	if _, ok := signed.Answer[1].(*dns.RRSIG); !ok {
+		t.Errorf("expected an RRSIG, got %v", signed.Answer[1])
+	}
+	if opt := signed.IsEdns0(); opt == nil || !opt.Do() {
+		t.Error("expected the reply to carry the DO bit of the query")
+	}
+
+	nx, err := decodeJSON(req, []byte(`{"Status": 3}`))
+	if err != nil || nx.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got %v, %v", nx, err)
+	}
+	if _, err := decodeJSON(req, []byte("<html>")); err == nil {
+		t.Error("expected an error for an answer that is not JSON")
+	}
+}
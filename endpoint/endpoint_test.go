@@ -0,0 +1,129 @@
+package endpoint
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const subscriptionText = `# community endpoints
+https://one.workers.dev/dns-query
+wss://two.workers.dev/dns-query
+
+104.17.196.93:2096
+2606:4700::6810:84e5
+`
+
+func TestParseSubscription(t *testing.T) {
+	want := &Subscription{
+		Endpoints: []string{"https://one.workers.dev/dns-query", "https://two.workers.dev/dns-query"},
+		IPs:       []string{"104.17.196.93:2096", "2606:4700::6810:84e5"},
+	}
+	for name, data := range map[string]string{
+		"plain":  subscriptionText,
+		"base64": base64.StdEncoding.EncodeToString([]byte(subscriptionText)),
+		"raw":    base64.RawURLEncoding.EncodeToString([]byte(subscriptionText)),
+	} {
+		got, err := ParseSubscription([]byte(data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+
+	if _, err := ParseSubscription([]byte("vless://not-supported")); err == nil {
+		t.Error("expected an error for an unknown entry")
+	}
+}
+
+func TestPoolSources(t *testing.T) {
+	p := NewPool("a", "b")
+	p.SetSource("sub", []string{"b", "c"})
+	if got := p.Items(); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("Items = %v", got)
+	}
+	p.SetSource("sub", []string{"d"})
+	if got := p.Items(); !reflect.DeepEqual(got, []string{"a", "b", "d"}) {
+		t.Fatalf("Items after refresh = %v", got)
+	}
+
+	var seen []string
+	for i := 0; i < 4; i++ {
+		item, _ := p.Next()
+		seen = append(seen, item)
+	}
+	if !reflect.DeepEqual(seen, []string{"a", "b", "d", "a"}) {
+		t.Fatalf("Next order = %v", seen)
+	}
+
+	var empty *Pool
+	if _, ok := empty.Next(); ok {
+		t.Fatal("nil pool should be empty")
+	}
+}
+
+func TestPoolPick(t *testing.T) {
+	p := NewPool("a", "b", "c")
+	if got, _ := p.Pick(StrategyLowestLatency, ""); got != "a" {
+		t.Errorf("expected round-robin before any measurement, got %s", got)
+	}
+	p.SetRTT("a", 80*time.Millisecond)
+	p.SetRTT("b", 20*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if got, _ := p.Pick(StrategyLowestLatency, ""); got != "b" {
+			t.Fatalf("expected the fastest address, got %s", got)
+		}
+	}
+	p.SetRTT("b", 0)
+	if got, _ := p.Pick(StrategyLowestLatency, ""); got != "a" {
+		t.Errorf("expected the failed address to be skipped, got %s", got)
+	}
+
+	first, _ := p.Pick(StrategySticky, "example.com")
+	for i := 0; i < 5; i++ {
+		if got, _ := p.Pick(StrategySticky, "example.com"); got != first {
+			t.Fatalf("expected %s for the same destination, got %s", first, got)
+		}
+	}
+
+	if _, err := ParseStrategy("fastest"); err == nil {
+		t.Error("expected an unknown strategy to be rejected")
+	}
+}
+
+func TestPoolWeighted(t *testing.T) {
+	p := NewPool("a", "b", "c")
+	p.SetWeight("a", 8)
+	counts := func() map[string]int {
+		n := make(map[string]int)
+		for i := 0; i < 3000; i++ {
+			item, _ := p.Pick(StrategyWeighted, "")
+			n[item]++
+		}
+		return n
+	}
+	n := counts()
+	if n["a"] < 4*n["b"] || n["b"] == 0 || n["c"] == 0 {
+		t.Fatalf("expected the heavier address to be preferred while the others are still tried, got %v", n)
+	}
+
+	p.SetWeight("a", 0)
+	p.SetRTT("a", 200*time.Millisecond)
+	p.SetRTT("b", 10*time.Millisecond)
+	p.SetRTT("c", 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		p.SetRTT("c", 0)
+	}
+	n = counts()
+	if n["b"] < 4*n["a"] || n["b"] < 4*n["c"] || n["a"] == 0 || n["c"] == 0 {
+		t.Fatalf("expected the fast and reliable address to be preferred, got %v", n)
+	}
+
+	var empty *Pool
+	if _, ok := empty.Pick(StrategyWeighted, ""); ok {
+		t.Fatal("nil pool should be empty")
+	}
+}
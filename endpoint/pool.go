@@ -0,0 +1,249 @@
+// Package endpoint manages the worker endpoints and clean IPs bepass tunnels
+// through, which may come from the config file as well as from subscriptions.
+package endpoint
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pool is a concurrency-safe list of addresses gathered from several sources.
+// Each source can be replaced at runtime without affecting the others.
+type Pool struct {
+	mu      sync.RWMutex
+	order   []string
+	sources map[string][]string
+	items   []string
+	next    atomic.Uint32
+	// rtt holds the last round trip time measured to each address
+	rtt map[string]time.Duration
+	// failures counts the failed measurements of each address since its last
+	// successful one
+	failures map[string]int
+	// weights holds the weights set for StrategyWeighted, 1 if unset
+	weights map[string]float64
+}
+
+// The least share of its weight an address keeps under StrategyWeighted,
+// however slow it measured, and the most failures halving it, so that every
+// address is still tried now and then and can recover.
+const (
+	minSpeedShare = 0.05
+	maxFailures   = 4
+)
+
+// NewPool returns a pool holding items under the "config" source.
+func NewPool(items ...string) *Pool {
+	p := &Pool{}
+	p.SetSource("config", items)
+	return p
+}
+
+// SetSource replaces the addresses provided by source.
+func (p *Pool) SetSource(source string, items []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sources == nil {
+		p.sources = make(map[string][]string)
+	}
+	if _, ok := p.sources[source]; !ok {
+		p.order = append(p.order, source)
+	}
+	p.sources[source] = items
+
+	seen := make(map[string]bool)
+	p.items = p.items[:0:0]
+	for _, s := range p.order {
+		for _, item := range p.sources[s] {
+			if item != "" && !seen[item] {
+				seen[item] = true
+				p.items = append(p.items, item)
+			}
+		}
+	}
+}
+
+// Items returns a copy of all addresses in the pool, without duplicates.
+func (p *Pool) Items() []string {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]string(nil), p.items...)
+}
+
+// Len returns the number of addresses in the pool.
+func (p *Pool) Len() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.items)
+}
+
+// Next returns the addresses in the pool round-robin. It reports false if the pool is empty.
+func (p *Pool) Next() (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.items) == 0 {
+		return "", false
+	}
+	i := p.next.Add(1) - 1
+	return p.items[int(i%uint32(len(p.items)))], true
+}
+
+// SetRTT records the round trip time measured to item, 0 forgets it after a
+// failed measurement, which is counted against item by StrategyWeighted.
+func (p *Pool) SetRTT(item string, rtt time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rtt <= 0 {
+		delete(p.rtt, item)
+		if p.failures == nil {
+			p.failures = make(map[string]int)
+		}
+		if p.failures[item] < maxFailures {
+			p.failures[item]++
+		}
+		return
+	}
+	if p.rtt == nil {
+		p.rtt = make(map[string]time.Duration)
+	}
+	p.rtt[item] = rtt
+	delete(p.failures, item)
+}
+
+// SetWeight sets how often StrategyWeighted takes item compared to the other
+// addresses, all of which weigh 1 unless set. A weight of 0 or less resets
+// item to 1. The weight is kept when item leaves the pool and comes back.
+func (p *Pool) SetWeight(item string, weight float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if weight <= 0 {
+		delete(p.weights, item)
+		return
+	}
+	if p.weights == nil {
+		p.weights = make(map[string]float64)
+	}
+	p.weights[item] = weight
+}
+
+// RTT returns the last round trip time measured to item, false if there is none.
+func (p *Pool) RTT(item string) (time.Duration, bool) {
+	if p == nil {
+		return 0, false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	rtt, ok := p.rtt[item]
+	return rtt, ok
+}
+
+// Pick returns an address of the pool chosen with strategy. key identifies
+// the destination for StrategySticky. It reports false if the pool is empty.
+func (p *Pool) Pick(strategy Strategy, key string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	switch strategy {
+	case StrategyLowestLatency:
+		p.mu.RLock()
+		var best string
+		var bestRTT time.Duration
+		for _, item := range p.items {
+			if rtt, ok := p.rtt[item]; ok && (best == "" || rtt < bestRTT) {
+				best, bestRTT = item, rtt
+			}
+		}
+		p.mu.RUnlock()
+		if best != "" {
+			return best, true
+		}
+		// nothing measured yet
+	case StrategySticky:
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		if len(p.items) == 0 {
+			return "", false
+		}
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return p.items[int(h.Sum32()%uint32(len(p.items)))], true
+	case StrategyWeighted:
+		if item, ok := p.pickWeighted(); ok {
+			return item, true
+		}
+	}
+	return p.Next()
+}
+
+// pickWeighted takes an address at random in proportion to its weight,
+// scaled by how its round trip time compares to the fastest one measured and
+// halved for each failure since its last success. An address not measured
+// yet keeps its whole weight, for it to be tried.
+func (p *Pool) pickWeighted() (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.items) == 0 {
+		return "", false
+	}
+	var fastest time.Duration
+	for _, item := range p.items {
+		if rtt, ok := p.rtt[item]; ok && (fastest == 0 || rtt < fastest) {
+			fastest = rtt
+		}
+	}
+	weights := make([]float64, len(p.items))
+	var total float64
+	for i, item := range p.items {
+		weight, ok := p.weights[item]
+		if !ok {
+			weight = 1
+		}
+		if rtt, ok := p.rtt[item]; ok {
+			speed := float64(fastest) / float64(rtt)
+			if speed < minSpeedShare {
+				speed = minSpeedShare
+			}
+			weight *= speed
+		}
+		weight /= float64(int(1) << p.failures[item])
+		weights[i] = weight
+		total += weight
+	}
+	r := rand.Float64() * total
+	for i, weight := range weights {
+		if r < weight {
+			return p.items[i], true
+		}
+		r -= weight
+	}
+	return p.items[len(p.items)-1], true
+}
+
+// RTTs returns the last round trip time measured to each address of the pool
+// that has one.
+func (p *Pool) RTTs() map[string]time.Duration {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	rtts := make(map[string]time.Duration, len(p.rtt))
+	for _, item := range p.items {
+		if rtt, ok := p.rtt[item]; ok {
+			rtts[item] = rtt
+		}
+	}
+	return rtts
+}
@@ -0,0 +1,31 @@
+package endpoint
+
+import "fmt"
+
+// Strategy is how the tunnels are spread over the addresses of a pool.
+type Strategy string
+
+const (
+	// StrategyRoundRobin takes the addresses in turn
+	StrategyRoundRobin Strategy = "round-robin"
+	// StrategyLowestLatency takes the address with the lowest measured round
+	// trip time, the unmeasured ones are skipped once one is measured
+	StrategyLowestLatency Strategy = "lowest-latency"
+	// StrategySticky always takes the same address for a destination, as long
+	// as the pool does not change
+	StrategySticky Strategy = "sticky"
+	// StrategyWeighted takes an address at random, the faster and the more
+	// reliable ones more often, see Pool.SetWeight
+	StrategyWeighted Strategy = "weighted"
+)
+
+// ParseStrategy parses the name of a strategy, StrategyRoundRobin if empty.
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case "":
+		return StrategyRoundRobin, nil
+	case StrategyRoundRobin, StrategyLowestLatency, StrategySticky, StrategyWeighted:
+		return Strategy(s), nil
+	}
+	return "", fmt.Errorf("unknown selection strategy %q", s)
+}
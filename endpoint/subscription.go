@@ -0,0 +1,96 @@
+package endpoint
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Subscription is the content of a subscription link.
+//
+// A subscription is a text file, usually base64 encoded (standard or URL
+// alphabet, padding optional), with one entry per line. Lines starting with #
+// are comments. An entry is either a worker URL (https:// or wss://), used as a
+// tunnel endpoint, or a clean IP with an optional port, used to reach the workers:
+//
+//	# community endpoints
+//	https://example.workers.dev/dns-query
+//	104.17.196.93:2096
+//	2606:4700::6810:84e5
+type Subscription struct {
+	Endpoints []string
+	IPs       []string
+}
+
+// ParseSubscription parses the content of a subscription link.
+func ParseSubscription(data []byte) (*Subscription, error) {
+	data = bytes.TrimSpace(data)
+	if decoded, ok := decodeBase64(data); ok {
+		data = decoded
+	}
+
+	sub := &Subscription{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(entry, "https://") || strings.HasPrefix(entry, "wss://"):
+			endpoint, err := ParseEndpoint(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid endpoint on line %d: %q", line, entry)
+			}
+			sub.Endpoints = append(sub.Endpoints, endpoint)
+		case isIPEntry(entry):
+			sub.IPs = append(sub.IPs, entry)
+		default:
+			return nil, fmt.Errorf("invalid entry on line %d: %q", line, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// ParseEndpoint parses a worker endpoint, an https:// or wss:// URL, and
+// returns it with the https scheme the pools hold the endpoints with.
+func ParseEndpoint(entry string) (string, error) {
+	if !strings.HasPrefix(entry, "https://") && !strings.HasPrefix(entry, "wss://") {
+		return "", fmt.Errorf("invalid endpoint %q, expected an https:// or wss:// URL", entry)
+	}
+	u, err := url.Parse(entry)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid endpoint %q", entry)
+	}
+	if u.Scheme == "wss" {
+		u.Scheme = "https"
+	}
+	return u.String(), nil
+}
+
+func decodeBase64(data []byte) ([]byte, bool) {
+	s := strings.Join(strings.Fields(string(data)), "")
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		if decoded, err := enc.DecodeString(s); err == nil {
+			return decoded, true
+		}
+	}
+	return nil, false
+}
+
+func isIPEntry(entry string) bool {
+	if net.ParseIP(entry) != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(entry)
+	return err == nil && net.ParseIP(host) != nil
+}
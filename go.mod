@@ -15,7 +15,9 @@ require (
 	github.com/peterbourgon/ff/v4 v4.0.0-alpha.1
 	github.com/refraction-networking/utls v1.4.3
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
+	golang.org/x/crypto v0.12.0
 	golang.org/x/net v0.14.0
+	golang.org/x/sys v0.11.0
 )
 
 require (
@@ -53,11 +55,9 @@ require (
 	github.com/tevino/abool v1.2.0 // indirect
 	github.com/v2pro/plz v0.0.0-20221028024117-e5f9aec5b631 // indirect
 	github.com/yuin/goldmark v1.4.13 // indirect
-	golang.org/x/crypto v0.12.0 // indirect
 	golang.org/x/image v0.3.0 // indirect
 	golang.org/x/mobile v0.0.0-20211207041440-4e6c2922fdee // indirect
 	golang.org/x/mod v0.12.0 // indirect
-	golang.org/x/sys v0.11.0 // indirect
 	golang.org/x/text v0.12.0 // indirect
 	golang.org/x/tools v0.11.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
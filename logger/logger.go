@@ -4,10 +4,12 @@ package logger
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,9 +29,16 @@ var LevelNames = map[slog.Leveler]string{
 	LevelPanic: "PANIC",
 }
 
-var logger *slog.Logger
+var logger atomic.Pointer[slog.Logger]
 
 func init() {
+	SetOutput(os.Stdout)
+}
+
+// NewLogger returns a logger writing to w in the bepass format. With the
+// bepassDev environment variable set it logs from the trace level and adds
+// the source of each message.
+func NewLogger(w io.Writer) *slog.Logger {
 	replace := func(groups []string, a slog.Attr) slog.Attr {
 		// Format time.
 		if a.Key == slog.TimeKey && len(groups) == 0 {
@@ -59,20 +68,25 @@ func init() {
 
 	_, ok := os.LookupEnv("bepassDev")
 	if ok {
-		logger = slog.New(slog.NewTextHandler(os.Stdout,
+		return slog.New(slog.NewTextHandler(w,
 			&slog.HandlerOptions{AddSource: true, Level: LevelTrace, ReplaceAttr: replace}))
-	} else {
-		logger = slog.New(slog.NewTextHandler(os.Stdout,
-			&slog.HandlerOptions{AddSource: false, Level: slog.LevelInfo, ReplaceAttr: replace}))
 	}
+	return slog.New(slog.NewTextHandler(w,
+		&slog.HandlerOptions{AddSource: false, Level: slog.LevelInfo, ReplaceAttr: replace}))
+}
+
+// SetOutput makes the global logger write to w, stdout by default.
+func SetOutput(w io.Writer) {
+	logger.Store(NewLogger(w))
 }
 
 // GetLogger returns the global logger instance.
 func GetLogger() *slog.Logger {
-	return logger
+	return logger.Load()
 }
 
 func log(ctx context.Context, level slog.Level, msg string, args ...interface{}) {
+	logger := logger.Load()
 	if !logger.Enabled(ctx, level) {
 		return
 	}
@@ -85,6 +99,7 @@ func log(ctx context.Context, level slog.Level, msg string, args ...interface{})
 }
 
 func logf(ctx context.Context, level slog.Level, format string, args ...interface{}) {
+	logger := logger.Load()
 	if !logger.Enabled(ctx, level) {
 		return
 	}
@@ -0,0 +1,65 @@
+package logger
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+// Privacy is how Redact treats the hostnames, addresses and queries logged.
+type Privacy string
+
+const (
+	// PrivacyHash logs a keyed hash in their place, the same value gets the
+	// same hash until the process exits so connections can still be followed
+	PrivacyHash Privacy = "hash"
+	// PrivacyRedact logs a placeholder in their place
+	PrivacyRedact Privacy = "redact"
+	// PrivacyOff logs them as is
+	PrivacyOff Privacy = "off"
+)
+
+var privacy atomic.Value
+
+// hashKey keys the hashes, so they can not be matched against a list of names.
+var hashKey = func() []byte {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+}()
+
+func init() {
+	privacy.Store(PrivacyHash)
+}
+
+// SetPrivacy sets how Redact treats sensitive values, PrivacyHash by default.
+func SetPrivacy(p Privacy) error {
+	switch p {
+	case PrivacyHash, PrivacyRedact, PrivacyOff:
+		privacy.Store(p)
+		return nil
+	}
+	return fmt.Errorf("unknown log privacy %q", p)
+}
+
+// Redact returns v, a destination or a query, in the form it may be logged
+// in: as is when privacy is off or debug messages are logged, hashed or
+// replaced by a placeholder otherwise.
+func Redact(v interface{}) string {
+	s := fmt.Sprint(v)
+	p := privacy.Load().(Privacy)
+	if p == PrivacyOff || GetLogger().Enabled(context.Background(), slog.LevelDebug) {
+		return s
+	}
+	if p == PrivacyRedact {
+		return "[redacted]"
+	}
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write([]byte(s))
+	return "h:" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
@@ -0,0 +1,44 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	if GetLogger().Enabled(context.Background(), slog.LevelDebug) {
+		t.Skip("debug messages are logged, nothing is redacted")
+	}
+	defer SetPrivacy(PrivacyHash)
+
+	got := Redact("example.com")
+	if strings.Contains(got, "example") || !strings.HasPrefix(got, "h:") {
+		t.Errorf("expected a hash, got %q", got)
+	}
+	if again := Redact("example.com"); again != got {
+		t.Errorf("expected the same name to get the same hash, got %q and %q", got, again)
+	}
+	if other := Redact("example.org"); other == got {
+		t.Error("expected different names to get different hashes")
+	}
+
+	if err := SetPrivacy(PrivacyRedact); err != nil {
+		t.Fatal(err)
+	}
+	if got := Redact("example.com"); got != "[redacted]" {
+		t.Errorf("expected a placeholder, got %q", got)
+	}
+
+	if err := SetPrivacy(PrivacyOff); err != nil {
+		t.Fatal(err)
+	}
+	if got := Redact("example.com"); got != "example.com" {
+		t.Errorf("expected the name as is, got %q", got)
+	}
+
+	if err := SetPrivacy("loud"); err == nil {
+		t.Error("expected an unknown privacy to be rejected")
+	}
+}
@@ -0,0 +1,148 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultMaxSize is the size a RotatingFile is rotated at when MaxSize is 0.
+const defaultMaxSize = 100 << 20
+
+// RotatingFile is a log file rotated once it grows past MaxSize. The rotated
+// files are kept next to it as Path.1 (the most recent), Path.2 and so on.
+type RotatingFile struct {
+	// Path is the file written to
+	Path string
+	// MaxSize is the size in bytes the file is rotated at, defaultMaxSize if 0
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept, all if 0
+	MaxBackups int
+	// MaxAge removes the rotated files older than it, none if 0
+	MaxAge time.Duration
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens the log file at path for appending, creating it and
+// its directory if needed.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int, maxAge time.Duration) (*RotatingFile, error) {
+	f := &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups, MaxAge: maxAge}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *RotatingFile) maxSize() int64 {
+	if f.MaxSize > 0 {
+		return f.MaxSize
+	}
+	return defaultMaxSize
+}
+
+// Write appends b to the file, rotating it first if b would take it past
+// MaxSize. A write larger than MaxSize still goes to a single file.
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.size+int64(len(b)) > f.maxSize() {
+		if err := f.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate %s, %v", f.Path, err)
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the rotated files, moves the current one to Path.1 and opens
+// a new one. The caller must hold mu.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	backups := f.backups()
+	for i := len(backups); i >= 1; i-- {
+		if f.MaxBackups > 0 && i >= f.MaxBackups {
+			_ = os.Remove(backups[i-1])
+			continue
+		}
+		_ = os.Rename(backups[i-1], f.backup(i+1))
+	}
+	// the file is opened again even if it could not be moved, so logging goes on
+	renameErr := os.Rename(f.Path, f.backup(1))
+	f.removeExpired()
+	if err := f.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+// backup returns the name of the ith rotated file.
+func (f *RotatingFile) backup(i int) string {
+	return f.Path + "." + strconv.Itoa(i)
+}
+
+// backups returns the rotated files in order, stopping at the first gap.
+func (f *RotatingFile) backups() []string {
+	var names []string
+	for i := 1; ; i++ {
+		if _, err := os.Stat(f.backup(i)); err != nil {
+			return names
+		}
+		names = append(names, f.backup(i))
+	}
+}
+
+// removeExpired removes the rotated files older than MaxAge, the oldest
+// ones are last so the rest stays numbered without gaps.
+func (f *RotatingFile) removeExpired() {
+	if f.MaxAge <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-f.MaxAge)
+	for _, name := range f.backups() {
+		if info, err := os.Stat(name); err == nil && info.ModTime().Before(cutoff) {
+			_ = os.Remove(name)
+		}
+	}
+}
+
+// Close closes the file, later writes fail.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,91 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "bepass.log")
+	f, err := OpenRotatingFile(path, 10, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for name, want := range expected {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s holds %q, want %q", filepath.Base(name), got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("expected only MaxBackups rotated files to be kept")
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bepass.log")
+	f, err := OpenRotatingFile(path, 10, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write([]byte(strings.Repeat("x", 10))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path+".1", old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(strings.Repeat("z", 10))); err != nil {
+		t.Fatal(err)
+	}
+	// the expired backup was shifted to .2 and removed
+	if _, err := os.Stat(path + ".2"); err == nil {
+		t.Error("expected the expired rotated file to be removed")
+	}
+	if got, _ := os.ReadFile(path + ".1"); string(got) != "y" {
+		t.Errorf("expected the recent rotated file to be kept, got %q", got)
+	}
+}
+
+func TestSetOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bepass.log")
+	f, err := OpenRotatingFile(path, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetOutput(f)
+	defer SetOutput(os.Stdout)
+	Infof("hello %s", "file")
+	_ = f.Close()
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "hello file") {
+		t.Errorf("expected the message in the log file, got %q", got)
+	}
+}
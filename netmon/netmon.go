@@ -0,0 +1,141 @@
+// Package netmon detects changes of the network the host is on, such as a
+// laptop moving to another Wi-Fi or a phone switching to cellular, so the
+// connections and lookups made on the previous network can be dropped.
+package netmon
+
+import (
+	"bepass/clock"
+	"bepass/logger"
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultInterval is how often the interfaces are polled on systems that do
+// not notify their changes.
+const DefaultInterval = 5 * time.Second
+
+// settleDelay lets a burst of notifications, an interface going down and
+// another coming up with its addresses, end before the network is compared.
+const settleDelay = time.Second
+
+var errNoNotifications = errors.New("network change notifications are not supported")
+
+// Monitor calls OnChange when the addresses of the network interfaces
+// change. It is notified by the system where it can be, netlink on Linux
+// and the routing socket on macOS, and polls the interfaces otherwise. Only
+// a change of the addresses counts, a notification leaving them as they
+// were is ignored.
+type Monitor struct {
+	// Interval is how often the interfaces are polled without system
+	// notifications, DefaultInterval if 0
+	Interval time.Duration
+	// OnChange is called, from the goroutine of Run, after every change
+	OnChange func()
+	// Clock times the polls, the real clock if nil
+	Clock clock.Clock
+
+	// watch and snapshot are replaced by tests
+	watch    func(ctx context.Context, events chan<- struct{}) error
+	snapshot func() string
+}
+
+// Run watches the network until ctx is done.
+func (m *Monitor) Run(ctx context.Context) {
+	clk := clock.Or(m.Clock)
+	watch, snapshot := m.watch, m.snapshot
+	if watch == nil {
+		watch = watchSystem
+	}
+	if snapshot == nil {
+		snapshot = interfaceAddrs
+	}
+
+	events := make(chan struct{}, 1)
+	go func() {
+		err := watch(ctx, events)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Infof("polling the network interfaces, %v", err)
+		m.poll(ctx, clk, events)
+	}()
+
+	last := snapshot()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(settleDelay):
+		}
+		select {
+		case <-events:
+		default:
+		}
+		if current := snapshot(); current != last {
+			last = current
+			logger.Infof("network changed")
+			if m.OnChange != nil {
+				m.OnChange()
+			}
+		}
+	}
+}
+
+// poll sends an event every Interval.
+func (m *Monitor) poll(ctx context.Context, clk clock.Clock, events chan<- struct{}) {
+	interval := m.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	ticker := clk.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			notify(events)
+		}
+	}
+}
+
+// notify sends an event unless one is already pending.
+func notify(events chan<- struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
+
+// interfaceAddrs lists the addresses of the interfaces that are up, loopback
+// excluded, in a stable order.
+func interfaceAddrs() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var addrs []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range ifaddrs {
+			addrs = append(addrs, iface.Name+" "+a.String())
+		}
+	}
+	sort.Strings(addrs)
+	return strings.Join(addrs, "\n")
+}
@@ -0,0 +1,9 @@
+package netmon
+
+import "golang.org/x/sys/unix"
+
+// routeSocket opens a routing socket, which gets a message for every change
+// of the interfaces, addresses and routes.
+func routeSocket() (int, error) {
+	return unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+}
@@ -0,0 +1,23 @@
+package netmon
+
+import "golang.org/x/sys/unix"
+
+// routeSocket opens a netlink socket subscribed to the changes of the links,
+// addresses and routes.
+func routeSocket() (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return -1, err
+	}
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR |
+			unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE,
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		// Android refuses it to apps
+		_ = unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package netmon
+
+import "context"
+
+// watchSystem reports that the changes are not notified, so they are polled.
+func watchSystem(context.Context, chan<- struct{}) error {
+	return errNoNotifications
+}
@@ -0,0 +1,43 @@
+//go:build linux || darwin
+
+package netmon
+
+import (
+	"context"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchSystem sends an event for every message of the routing socket, until
+// ctx is done or the socket fails.
+func watchSystem(ctx context.Context, events chan<- struct{}) error {
+	fd, err := routeSocket()
+	if err != nil {
+		return err
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return err
+	}
+	// a non-blocking file is read through the poller, so closing it ends
+	// the read below
+	f := os.NewFile(uintptr(fd), "route")
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = f.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		if _, err := f.Read(buf); err != nil {
+			return err
+		}
+		notify(events)
+	}
+}
@@ -0,0 +1,74 @@
+package netmon
+
+import (
+	"bepass/clock"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMonitorPolling(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	var mu sync.Mutex
+	addrs := "eth0 192.168.1.2/24"
+	changes := make(chan struct{}, 4)
+	m := &Monitor{
+		Interval: 5 * time.Second,
+		OnChange: func() { changes <- struct{}{} },
+		Clock:    clk,
+		watch: func(context.Context, chan<- struct{}) error {
+			return errNoNotifications
+		},
+		snapshot: func() string {
+			mu.Lock()
+			defer mu.Unlock()
+			return addrs
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// a poll finding the same addresses is not a change
+	clk.BlockUntil(1)
+	clk.Advance(5 * time.Second)
+	clk.BlockUntil(2)
+	clk.Advance(settleDelay)
+	select {
+	case <-changes:
+		t.Fatal("expected no change for the same addresses")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mu.Lock()
+	addrs = "wlan0 10.0.0.7/24"
+	mu.Unlock()
+	clk.Advance(5 * time.Second)
+	clk.BlockUntil(2)
+	clk.Advance(settleDelay)
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the new addresses to be reported")
+	}
+}
+
+func TestWatchSystem(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- watchSystem(ctx, make(chan struct{}, 1)) }()
+	cancel()
+	select {
+	case <-errCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the watch to end with its context")
+	}
+}
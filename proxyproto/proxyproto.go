@@ -0,0 +1,212 @@
+// Package proxyproto implements the HAProxy PROXY protocol (version 1 and 2)
+// used to carry the original client address across proxies and load balancers.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Supported PROXY protocol versions.
+const (
+	Version1 = 1
+	Version2 = 2
+)
+
+const (
+	v1MaxLength = 107
+	v2HeaderLen = 16
+
+	v2CmdLocal = 0x20
+	v2CmdProxy = 0x21
+
+	v2FamUnspec = 0x00
+	v2FamTCP4   = 0x11
+	v2FamTCP6   = 0x21
+)
+
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// error defined
+var (
+	ErrNoHeader          = errors.New("proxy protocol header missing")
+	ErrInvalidHeader     = errors.New("invalid proxy protocol header")
+	ErrUnsupportedFamily = errors.New("unsupported proxy protocol address family")
+)
+
+// Header builds a PROXY protocol header of the given version announcing a
+// connection from src to dst. If either address is not a TCP address, a header
+// without address information is built (UNKNOWN for v1, LOCAL for v2).
+func Header(version int, src, dst net.Addr) ([]byte, error) {
+	srcTCP, srcOk := src.(*net.TCPAddr)
+	dstTCP, dstOk := dst.(*net.TCPAddr)
+	known := srcOk && dstOk && srcTCP != nil && dstTCP != nil
+
+	switch version {
+	case Version1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP4"
+		if srcTCP.IP.To4() == nil || dstTCP.IP.To4() == nil {
+			proto = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+			proto, srcTCP.IP, dstTCP.IP, srcTCP.Port, dstTCP.Port)), nil
+	case Version2:
+		b := make([]byte, 0, v2HeaderLen+36)
+		b = append(b, v2Signature...)
+		if !known {
+			return append(b, v2CmdLocal, v2FamUnspec, 0, 0), nil
+		}
+		var srcIP, dstIP net.IP
+		fam := byte(v2FamTCP4)
+		if srcIP, dstIP = srcTCP.IP.To4(), dstTCP.IP.To4(); srcIP == nil || dstIP == nil {
+			fam = v2FamTCP6
+			srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16()
+		}
+		addrLen := 2*len(srcIP) + 4
+		b = append(b, v2CmdProxy, fam, byte(addrLen>>8), byte(addrLen))
+		b = append(b, srcIP...)
+		b = append(b, dstIP...)
+		b = binary.BigEndian.AppendUint16(b, uint16(srcTCP.Port))
+		b = binary.BigEndian.AppendUint16(b, uint16(dstTCP.Port))
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", version)
+	}
+}
+
+// WriteHeader writes a PROXY protocol header of the given version to w.
+func WriteHeader(w io.Writer, version int, src, dst net.Addr) error {
+	b, err := Header(version, src, dst)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ReadHeader reads a PROXY protocol header (v1 or v2) from r and returns the
+// announced source and destination addresses. Both are nil when the header
+// carries no address information (v1 UNKNOWN or v2 LOCAL). If r does not start
+// with a header, ErrNoHeader is returned and nothing is consumed.
+func ReadHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch b[0] {
+	case v2Signature[0]:
+		return readV2(r)
+	case 'P':
+		// HTTP methods such as PUT also start with P, so look a bit further
+		b, err = r.Peek(6)
+		if err != nil {
+			return nil, nil, err
+		}
+		if string(b) != "PROXY " {
+			return nil, nil, ErrNoHeader
+		}
+		return readV1(r)
+	default:
+		return nil, nil, ErrNoHeader
+	}
+}
+
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= v1MaxLength {
+			return nil, nil, ErrInvalidHeader
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, ErrInvalidHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrInvalidHeader
+	}
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseV1Addr(ip, port string) (*net.TCPAddr, error) {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return nil, ErrInvalidHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: parsedIP, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, v2HeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(hdr[:len(v2Signature)], v2Signature) || hdr[12]>>4 != Version2 {
+		return nil, nil, ErrInvalidHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12] == v2CmdLocal {
+		return nil, nil, nil
+	}
+	if hdr[12] != v2CmdProxy {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	var ipLen int
+	switch hdr[13] {
+	case v2FamTCP4:
+		ipLen = net.IPv4len
+	case v2FamTCP6:
+		ipLen = net.IPv6len
+	case v2FamUnspec:
+		return nil, nil, nil
+	default:
+		return nil, nil, ErrUnsupportedFamily
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, ErrInvalidHeader
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
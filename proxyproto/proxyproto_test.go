@@ -0,0 +1,132 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func readHeader(b []byte) (net.Addr, net.Addr, error) {
+	return ReadHeader(bufio.NewReader(bytes.NewReader(b)))
+}
+
+func sameAddr(a, b net.Addr) bool {
+	ta, _ := a.(*net.TCPAddr)
+	tb, _ := b.(*net.TCPAddr)
+	if ta == nil || tb == nil {
+		return ta == nil && tb == nil
+	}
+	return ta.IP.Equal(tb.IP) && ta.Port == tb.Port
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	for name, addrs := range map[string][2]*net.TCPAddr{
+		"ipv4": {{IP: net.IPv4(192, 0, 2, 1), Port: 51234}, {IP: net.IPv4(198, 51, 100, 7), Port: 443}},
+		"ipv6": {{IP: net.ParseIP("2001:db8::1"), Port: 1}, {IP: net.ParseIP("2001:db8::2"), Port: 65535}},
+	} {
+		for _, version := range []int{Version1, Version2} {
+			var buf bytes.Buffer
+			if err := WriteHeader(&buf, version, addrs[0], addrs[1]); err != nil {
+				t.Fatalf("%s v%d: %v", name, version, err)
+			}
+			buf.WriteString("payload")
+			r := bufio.NewReader(&buf)
+			src, dst, err := ReadHeader(r)
+			if err != nil {
+				t.Fatalf("%s v%d: %v", name, version, err)
+			}
+			if !sameAddr(src, addrs[0]) || !sameAddr(dst, addrs[1]) {
+				t.Errorf("%s v%d: read %v -> %v, want %v -> %v", name, version, src, dst, addrs[0], addrs[1])
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("%s v%d: expected the data after the header untouched, got %q", name, version, rest)
+			}
+		}
+	}
+
+	// without TCP addresses the headers carry none
+	for _, version := range []int{Version1, Version2} {
+		var buf bytes.Buffer
+		if err := WriteHeader(&buf, version, &net.UnixAddr{Name: "/tmp/a"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if src, dst, err := readHeader(buf.Bytes()); err != nil || src != nil || dst != nil {
+			t.Errorf("v%d: expected a header without addresses, got %v %v %v", version, src, dst, err)
+		}
+	}
+
+	if _, err := Header(3, nil, nil); err == nil {
+		t.Error("expected an unknown version to be rejected")
+	}
+}
+
+func TestReadHeaderMalformed(t *testing.T) {
+	v2, err := Header(Version2, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	badSignature := append([]byte{}, v2...)
+	badSignature[3] ^= 0xff
+	unknownFamily := append([]byte{}, v2...)
+	unknownFamily[13] = 0x31
+	shortAddresses := append(append([]byte{}, v2[:14]...), 0, 4, 192, 0, 2, 1)
+
+	for name, c := range map[string]struct {
+		header []byte
+		want   error
+	}{
+		"truncated v2 header":  {v2[:10], io.ErrUnexpectedEOF},
+		"truncated v2 payload": {v2[:len(v2)-3], io.ErrUnexpectedEOF},
+		"bad signature":        {badSignature, ErrInvalidHeader},
+		"unknown family":       {unknownFamily, ErrUnsupportedFamily},
+		"short v2 addresses":   {shortAddresses, ErrInvalidHeader},
+		"overlong v1 line":     {[]byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), ErrInvalidHeader},
+		"v1 without CRLF":      {[]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1 2\n"), io.EOF},
+		"v1 bad address":       {[]byte("PROXY TCP4 192.0.2.300 192.0.2.2 1 2\r\n"), ErrInvalidHeader},
+		"v1 bad port":          {[]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1 65536\r\n"), ErrInvalidHeader},
+		"v1 missing fields":    {[]byte("PROXY TCP4 192.0.2.1\r\n"), ErrInvalidHeader},
+		"no header":            {[]byte("PUT / HTTP/1.1\r\n"), ErrNoHeader},
+	} {
+		if _, _, err := readHeader(c.header); !errors.Is(err, c.want) {
+			t.Errorf("%s: expected %v, got %v", name, c.want, err)
+		}
+	}
+
+	// a request without a header is left to be read
+	r := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))
+	if _, _, err := ReadHeader(r); !errors.Is(err, ErrNoHeader) {
+		t.Fatalf("expected ErrNoHeader, got %v", err)
+	}
+	if line, _ := r.ReadString('\n'); line != "GET / HTTP/1.1\r\n" {
+		t.Errorf("expected nothing consumed, got %q left", line)
+	}
+}
+
+func FuzzReadHeader(f *testing.F) {
+	v1, _ := Header(Version1, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2})
+	v2, _ := Header(Version2, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2})
+	f.Add(v1)
+	f.Add(v2)
+	f.Add([]byte("PROXY UNKNOWN\r\n"))
+	f.Add([]byte{})
+	f.Add(v2Signature)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		src, dst, err := readHeader(b)
+		if err != nil || src == nil {
+			return
+		}
+		// whatever was read can be announced again
+		header, err := Header(Version2, src, dst)
+		if err != nil {
+			t.Fatalf("failed to build a header for %v -> %v: %v", src, dst, err)
+		}
+		src2, dst2, err := readHeader(header)
+		if err != nil || !sameAddr(src, src2) || !sameAddr(dst, dst2) {
+			t.Fatalf("read %v -> %v, then %v -> %v, %v", src, dst, src2, dst2, err)
+		}
+	})
+}
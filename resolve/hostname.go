@@ -0,0 +1,24 @@
+// Package resolve provides DNS resolution and host file management functionality.
+package resolve
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// NormalizeHostname returns the form of name used for matching and caching:
+// lowercase, without the trailing dot of a fully qualified name, and with
+// international labels converted to punycode (A-labels), as they appear in
+// DNS queries and in the SNI. A name IDNA rejects is only lowercased, so
+// unusual but working names still resolve.
+func NormalizeHostname(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return name
+	}
+	if ascii, err := idna.Lookup.ToASCII(name); err == nil {
+		return ascii
+	}
+	return strings.ToLower(name)
+}
@@ -0,0 +1,61 @@
+package resolve
+
+import "testing"
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"example.com", "example.com"},
+		{"Example.COM", "example.com"},
+		{"example.com.", "example.com"},
+		{"WWW.Example.Com.", "www.example.com"},
+		{"bücher.de", "xn--bcher-kva.de"},
+		{"Bücher.DE.", "xn--bcher-kva.de"},
+		{"xn--bcher-kva.de", "xn--bcher-kva.de"},
+		{"пример.рф", "xn--e1afmkfd.xn--p1ai"},
+		// rejected by IDNA but still a name some networks use
+		{"My_Host.local", "my_host.local"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeHostname(tt.in); got != tt.want {
+			t.Errorf("NormalizeHostname(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCheckHostsNormalizesDomain(t *testing.T) {
+	lr := &LocalResolver{Hosts: []Hosts{
+		{Domain: "example.com", IP: "93.184.216.34"},
+		{Domain: "xn--bcher-kva.de", IP: "192.0.2.1"},
+	}}
+	for _, domain := range []string{"EXAMPLE.com", "example.com.", "Bücher.de."} {
+		if ip := lr.CheckHosts(domain); ip == "" {
+			t.Errorf("expected %q to match a hosts entry", domain)
+		}
+	}
+}
+
+func TestCheckHostsUnicodeRules(t *testing.T) {
+	lr := &LocalResolver{Hosts: []Hosts{
+		{Domain: "Bücher.de", IP: "192.0.2.1"},
+		{Domain: "日本語.jp.", IP: "192.0.2.2"},
+	}}
+	lr.SetRemoteHosts("list", []Hosts{
+		{Domain: "пример.рф", IP: "192.0.2.3"},
+		{Domain: "موقع.وزارة-الاتصالات.مصر", IP: "192.0.2.4"},
+	})
+
+	// names as found in a ClientHello SNI or a DNS query, in punycode
+	tests := []struct{ domain, want string }{
+		{"xn--bcher-kva.de", "192.0.2.1"},
+		{"xn--wgv71a119e.jp", "192.0.2.2"},
+		{"XN--E1AFMKFD.xn--p1ai.", "192.0.2.3"},
+		{"xn--4gbrim.xn----ymcbaaajlc6dj7bxne2c.xn--wgbh1c", "192.0.2.4"},
+		{"bücher.de", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		if got := lr.CheckHosts(tt.domain); got != tt.want {
+			t.Errorf("CheckHosts(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
@@ -1,13 +1,116 @@
 // Package resolve provides DNS resolution and host file management functionality.
 package resolve
 
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+)
+
 // CheckHosts checks if a given domain exists in the local resolver's hosts file
 // and returns the corresponding IP address if found, or an empty string if not.
+// Static entries take precedence over the ones loaded from remote sources.
+// The domain and the entries are normalized, see NormalizeHostname, so rules
+// written with unicode labels match the punycode names of queries and SNIs.
 func (lr *LocalResolver) CheckHosts(domain string) string {
-	for h := range lr.Hosts {
-		if lr.Hosts[h].Domain == domain {
-			return lr.Hosts[h].IP
-		}
+	if ips := lr.LookupHosts(domain); len(ips) > 0 {
+		return ips[0]
 	}
 	return ""
 }
+
+// LookupHosts returns the IPs of every hosts entry of domain, in the order of
+// the entries, the static ones only if domain has any. A name can have both
+// an IPv4 and an IPv6 entry, or several of a family.
+func (lr *LocalResolver) LookupHosts(domain string) []string {
+	domain = NormalizeHostname(domain)
+	var ips []string
+	static := lr.staticHosts()
+	for h := range static {
+		if static[h].Domain == domain {
+			ips = append(ips, static[h].IP)
+		}
+	}
+	if len(ips) > 0 {
+		return ips
+	}
+	lr.mu.RLock()
+	defer lr.mu.RUnlock()
+	for _, hosts := range lr.remote {
+		for h := range hosts {
+			if hosts[h].Domain == domain {
+				ips = append(ips, hosts[h].IP)
+			}
+		}
+	}
+	return ips
+}
+
+// SetRemoteHosts replaces the entries loaded from source.
+func (lr *LocalResolver) SetRemoteHosts(source string, hosts []Hosts) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if lr.remote == nil {
+		lr.remote = make(map[string][]Hosts)
+	}
+	lr.remote[source] = NormalizeHosts(hosts)
+}
+
+// staticHosts returns Hosts normalized, Hosts must not change once in use.
+func (lr *LocalResolver) staticHosts() []Hosts {
+	lr.staticOnce.Do(func() { lr.static = NormalizeHosts(lr.Hosts) })
+	return lr.static
+}
+
+// NormalizeHosts returns a copy of hosts with the domains normalized.
+func NormalizeHosts(hosts []Hosts) []Hosts {
+	normalized := make([]Hosts, len(hosts))
+	for i, h := range hosts {
+		h.Domain = NormalizeHostname(h.Domain)
+		normalized[i] = h
+	}
+	return normalized
+}
+
+// Len returns the number of hosts entries, static and remote.
+func (lr *LocalResolver) Len() int {
+	lr.mu.RLock()
+	defer lr.mu.RUnlock()
+	n := len(lr.Hosts)
+	for _, hosts := range lr.remote {
+		n += len(hosts)
+	}
+	return n
+}
+
+// ParseHosts parses a hosts list, either as a JSON array in the format of the
+// Hosts config field or in the classic hosts file format ("IP domain...").
+// Lines of a hosts file that do not start with a valid IP are skipped.
+func ParseHosts(data []byte) ([]Hosts, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var hosts []Hosts
+		if err := json.Unmarshal(trimmed, &hosts); err != nil {
+			return nil, err
+		}
+		return hosts, nil
+	}
+
+	var hosts []Hosts
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			continue
+		}
+		for _, domain := range fields[1:] {
+			hosts = append(hosts, Hosts{Domain: domain, IP: fields[0]})
+		}
+	}
+	return hosts, scanner.Err()
+}
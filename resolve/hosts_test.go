@@ -0,0 +1,58 @@
+package resolve
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHosts(t *testing.T) {
+	want := []Hosts{
+		{Domain: "example.com", IP: "93.184.216.34"},
+		{Domain: "www.example.com", IP: "93.184.216.34"},
+		{Domain: "ipv6.example.com", IP: "2606:2800:220:1::"},
+	}
+
+	hostsFile := []byte(`# community list
+93.184.216.34 example.com www.example.com
+not-an-ip broken.example.com
+
+2606:2800:220:1:: ipv6.example.com # trailing comment
+`)
+	got, err := ParseHosts(hostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hosts file: got %v, want %v", got, want)
+	}
+
+	jsonList := []byte(`[
+		{"Domain": "example.com", "IP": "93.184.216.34"},
+		{"Domain": "www.example.com", "IP": "93.184.216.34"},
+		{"Domain": "ipv6.example.com", "IP": "2606:2800:220:1::"}
+	]`)
+	got, err = ParseHosts(jsonList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("json: got %v, want %v", got, want)
+	}
+}
+
+func TestRemoteHostsPrecedence(t *testing.T) {
+	lr := &LocalResolver{Hosts: []Hosts{{Domain: "example.com", IP: "10.0.0.1"}}}
+	lr.SetRemoteHosts("list", []Hosts{
+		{Domain: "example.com", IP: "10.0.0.2"},
+		{Domain: "test.com", IP: "10.0.0.3"},
+	})
+	if ip := lr.CheckHosts("example.com"); ip != "10.0.0.1" {
+		t.Errorf("static entry should win, got %s", ip)
+	}
+	if ip := lr.CheckHosts("test.com"); ip != "10.0.0.3" {
+		t.Errorf("remote entry not found, got %s", ip)
+	}
+	if n := lr.Len(); n != 3 {
+		t.Errorf("expected 3 entries, got %d", n)
+	}
+}
@@ -2,9 +2,15 @@
 package resolve
 
 import (
+	"context"
 	"net"
+	"sync"
+	"time"
 )
 
+// bootstrapTimeout bounds a lookup against the bootstrap DNS server.
+const bootstrapTimeout = 5 * time.Second
+
 // Hosts represents a domain-to-IP mapping entry in the local hosts file.
 type Hosts struct {
 	Domain string
@@ -14,6 +20,25 @@ type Hosts struct {
 // LocalResolver is a resolver that can check a local hosts file for domain-to-IP mappings.
 type LocalResolver struct {
 	Hosts []Hosts
+	// BootstrapDNS is the plain DNS server ("ip" or "ip:port") used for lookups
+	// that can not go through DoH yet, like the DoH server's own name. The
+	// system resolver is used if empty.
+	BootstrapDNS string
+	// DisableIPv6 only looks up IPv4 addresses
+	DisableIPv6 bool
+	// PreferIPv6 returns an IPv6 address when the domain has one
+	PreferIPv6 bool
+	// HostsOnly answers from the hosts entries only, the names missing from
+	// them do not resolve instead of being looked up in clear text
+	HostsOnly bool
+
+	// static holds Hosts with normalized domains, built on first use
+	static     []Hosts
+	staticOnce sync.Once
+
+	mu sync.RWMutex
+	// remote holds the entries loaded from each remote hosts source
+	remote map[string][]Hosts
 }
 
 // Resolve attempts to resolve a given domain to an IP address. It first checks
@@ -21,12 +46,59 @@ type LocalResolver struct {
 // If no mapping is found in the hosts file, it performs a DNS lookup for the domain.
 // If a DNS lookup succeeds, it returns the first IP address found; otherwise, it returns an empty string.
 func (lr *LocalResolver) Resolve(domain string) string {
+	domain = NormalizeHostname(domain)
 	if h := lr.CheckHosts(domain); h != "" {
 		return h
 	}
-	ips, _ := net.LookupIP(domain)
-	for _, ip := range ips {
+	if lr.HostsOnly {
+		// an IP literal needs no lookup
+		if net.ParseIP(domain) != nil {
+			return domain
+		}
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bootstrapTimeout)
+	defer cancel()
+	network := "ip"
+	if lr.DisableIPv6 {
+		network = "ip4"
+	}
+	ips, _ := lr.resolver().LookupIP(ctx, network, domain)
+	if ip := lr.pick(ips); ip != nil {
 		return ip.String()
 	}
 	return ""
 }
+
+// pick chooses the address to use among the ones a domain resolved to.
+func (lr *LocalResolver) pick(ips []net.IP) net.IP {
+	if lr.PreferIPv6 && !lr.DisableIPv6 {
+		for _, ip := range ips {
+			if ip.To4() == nil {
+				return ip
+			}
+		}
+	}
+	for _, ip := range ips {
+		return ip
+	}
+	return nil
+}
+
+// resolver returns the resolver used for lookups missing from the hosts entries.
+func (lr *LocalResolver) resolver() *net.Resolver {
+	if lr.BootstrapDNS == "" {
+		return net.DefaultResolver
+	}
+	server := lr.BootstrapDNS
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
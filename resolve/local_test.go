@@ -0,0 +1,107 @@
+package resolve
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBootstrapDNS(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 10.1.2.3")
+			m.Answer = append(m.Answer, rr)
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	lr := &LocalResolver{
+		Hosts:        []Hosts{{Domain: "pinned.example", IP: "10.9.9.9"}},
+		BootstrapDNS: pc.LocalAddr().String(),
+	}
+	if ip := lr.Resolve("doh.example"); ip != "10.1.2.3" {
+		t.Errorf("expected the bootstrap answer, got %q", ip)
+	}
+	if ip := lr.Resolve("pinned.example"); ip != "10.9.9.9" {
+		t.Errorf("expected the hosts entry to win, got %q", ip)
+	}
+}
+
+func TestResolveIPFamily(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aaaaQueries atomic.Int32
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch r.Question[0].Qtype {
+		case dns.TypeA:
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 10.1.2.3")
+			m.Answer = append(m.Answer, rr)
+		case dns.TypeAAAA:
+			aaaaQueries.Add(1)
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN AAAA 2001:db8::1")
+			m.Answer = append(m.Answer, rr)
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	lr := &LocalResolver{BootstrapDNS: pc.LocalAddr().String(), PreferIPv6: true}
+	if ip := lr.Resolve("dual.example"); ip != "2001:db8::1" {
+		t.Errorf("expected the IPv6 address to be preferred, got %q", ip)
+	}
+
+	lr.DisableIPv6 = true
+	aaaaQueries.Store(0)
+	if ip := lr.Resolve("dual.example"); ip != "10.1.2.3" {
+		t.Errorf("expected the IPv4 address, got %q", ip)
+	}
+	if n := aaaaQueries.Load(); n != 0 {
+		t.Errorf("expected no AAAA lookup with IPv6 disabled, got %d", n)
+	}
+}
+
+func TestHostsOnly(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries atomic.Int32
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	lr := &LocalResolver{
+		Hosts:        []Hosts{{Domain: "pinned.example", IP: "10.9.9.9"}},
+		BootstrapDNS: pc.LocalAddr().String(),
+		HostsOnly:    true,
+	}
+	if ip := lr.Resolve("pinned.example"); ip != "10.9.9.9" {
+		t.Errorf("expected the hosts entry, got %q", ip)
+	}
+	if ip := lr.Resolve("doh.example"); ip != "" {
+		t.Errorf("expected no answer, got %q", ip)
+	}
+	if n := queries.Load(); n != 0 {
+		t.Errorf("expected no lookup, got %d queries", n)
+	}
+}
@@ -0,0 +1,52 @@
+package resolve
+
+import (
+	"regexp"
+	"strings"
+)
+
+// HostPattern matches hostnames: a domain matches itself and its subdomains,
+// a pattern with * or ? wildcards is a shell expression on the whole name.
+type HostPattern struct {
+	domain string
+	re     *regexp.Regexp
+}
+
+// ParseHostPattern parses a pattern, "example.com", ".example.com" and
+// "*.cdn?.net" for instance.
+func ParseHostPattern(s string) (HostPattern, error) {
+	s = strings.TrimSpace(s)
+	if strings.ContainsAny(s, "*?") {
+		re, err := GlobRegexp(s)
+		return HostPattern{re: re}, err
+	}
+	return HostPattern{domain: NormalizeHostname(strings.TrimPrefix(s, "."))}, nil
+}
+
+// Match reports whether the pattern matches host.
+func (p HostPattern) Match(host string) bool {
+	host = NormalizeHostname(host)
+	if p.re != nil {
+		return p.re.MatchString(host)
+	}
+	return p.domain != "" && (host == p.domain || strings.HasSuffix(host, "."+p.domain))
+}
+
+// GlobRegexp compiles a shell expression on hostnames, in which * and ? also
+// match dots, into a regular expression matching the lowercase names.
+func GlobRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range strings.ToLower(glob) {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
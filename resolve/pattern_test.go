@@ -0,0 +1,29 @@
+package resolve
+
+import "testing"
+
+func TestHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "www.Example.com.", true},
+		{".example.com", "a.example.com", true},
+		{"example.com", "notexample.com", false},
+		{"bücher.de", "xn--bcher-kva.de", true},
+		{"*.cdn?.net", "img.cdn1.net", true},
+		{"*.cdn?.net", "img.cdn12.net", false},
+		{"*.cdn?.net", "cdn1.net", false},
+		{"", "example.com", false},
+	}
+	for _, tt := range tests {
+		p, err := ParseHostPattern(tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Match(tt.host); got != tt.want {
+			t.Errorf("%q.Match(%q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
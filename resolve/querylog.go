@@ -0,0 +1,95 @@
+// Package resolve provides DNS resolution and host file management functionality.
+package resolve
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Query sources reported in the query log.
+const (
+	SourceCache     = "cache"
+	SourceHosts     = "hosts"
+	SourceWorker    = "worker"
+	SourceSystem    = "system"
+	SourceBootstrap = "bootstrap"
+	SourceDoH       = "doh"
+	SourceDNSCrypt  = "dnscrypt"
+	SourcePlainDNS  = "plain"
+	// SourceRefused is a query answered without asking, ANY refused per RFC 8482
+	SourceRefused = "refused"
+)
+
+// QueryLogEntry describes a single DNS lookup.
+type QueryLogEntry struct {
+	Time    time.Time `json:"time"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Answer  string    `json:"answer,omitempty"`
+	Source  string    `json:"source,omitempty"`
+	Latency float64   `json:"latency_ms"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// QueryLog writes one JSON object per line for every DNS lookup, so the log can
+// be filtered with tools like jq. A nil *QueryLog discards everything, which
+// keeps the log opt-in: it records every name a client visits.
+type QueryLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	c   io.Closer
+}
+
+// NewQueryLog returns a QueryLog writing to w.
+func NewQueryLog(w io.Writer) *QueryLog {
+	l := &QueryLog{enc: json.NewEncoder(w)}
+	if c, ok := w.(io.Closer); ok {
+		l.c = c
+	}
+	return l
+}
+
+// OpenQueryLog appends to the file at path, creating it if needed. The path
+// "-" writes to stdout.
+func OpenQueryLog(path string) (*QueryLog, error) {
+	if path == "-" {
+		return &QueryLog{enc: json.NewEncoder(os.Stdout)}, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueryLog(f), nil
+}
+
+// Log records a lookup of name that started at begin.
+func (l *QueryLog) Log(begin time.Time, name, qtype, answer, source string, err error) {
+	if l == nil {
+		return
+	}
+	e := QueryLogEntry{
+		Time:    begin,
+		Name:    name,
+		Type:    qtype,
+		Answer:  answer,
+		Source:  source,
+		Latency: float64(time.Since(begin).Microseconds()) / 1000,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	l.mu.Lock()
+	_ = l.enc.Encode(e)
+	l.mu.Unlock()
+}
+
+// Close closes the underlying file.
+func (l *QueryLog) Close() error {
+	if l == nil || l.c == nil {
+		return nil
+	}
+	return l.c.Close()
+}
@@ -0,0 +1,35 @@
+package resolve
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQueryLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewQueryLog(&buf)
+	l.Log(time.Now(), "example.com", "A", "93.184.216.34", SourceDoH, nil)
+	l.Log(time.Now(), "invalid.example", "A", "", SourceDoH, errors.New("no answer"))
+
+	dec := json.NewDecoder(&buf)
+	var ok, failed QueryLogEntry
+	if err := dec.Decode(&ok); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&failed); err != nil {
+		t.Fatal(err)
+	}
+	if ok.Name != "example.com" || ok.Answer != "93.184.216.34" || ok.Source != SourceDoH || ok.Error != "" {
+		t.Errorf("unexpected entry %+v", ok)
+	}
+	if failed.Error != "no answer" {
+		t.Errorf("unexpected entry %+v", failed)
+	}
+
+	// a nil log is the disabled state and must be safe to use
+	var disabled *QueryLog
+	disabled.Log(time.Now(), "example.com", "A", "", SourceCache, nil)
+}
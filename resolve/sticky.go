@@ -0,0 +1,113 @@
+package resolve
+
+import (
+	"bepass/clock"
+	"sync"
+	"time"
+)
+
+// StickyIPs remembers, per hostname, the IP a handshake last succeeded with
+// and the IPs one last failed with, so the connections to a hostname
+// resolving to many IPs, some blocked, stick to one that works. What is
+// remembered is forgotten after TTL, and the IPs are then tried again in
+// the order of the answers. A nil StickyIPs remembers nothing.
+type StickyIPs struct {
+	TTL time.Duration
+	// Clock is the real clock if nil
+	Clock clock.Clock
+
+	mu    sync.Mutex
+	hosts map[string]*stickyHost
+}
+
+// stickyHost is what is remembered of a hostname.
+type stickyHost struct {
+	good   string
+	goodAt time.Time
+	failed map[string]time.Time
+}
+
+// Pick returns the IP of ips to connect to host with, the first of Order.
+func (s *StickyIPs) Pick(host string, ips []string) string {
+	if len(ips) == 0 {
+		return ""
+	}
+	return s.Order(host, ips)[0]
+}
+
+// Order returns ips in the order to try them to connect to host: the one that
+// last worked if it is among them, then the others in their order, those that
+// failed lately last.
+func (s *StickyIPs) Order(host string, ips []string) []string {
+	if s == nil || len(ips) < 2 {
+		return ips
+	}
+	host = NormalizeHostname(host)
+	now := clock.Or(s.Clock).Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.hosts[host]
+	if h == nil {
+		return ips
+	}
+	good := ""
+	if h.good != "" && now.Sub(h.goodAt) < s.TTL {
+		good = h.good
+	}
+	ordered := make([]string, 0, len(ips))
+	var failed []string
+	for _, ip := range ips {
+		switch at, ok := h.failed[ip]; {
+		case ip == good:
+			ordered = append([]string{ip}, ordered...)
+		case ok && now.Sub(at) < s.TTL:
+			failed = append(failed, ip)
+		default:
+			ordered = append(ordered, ip)
+		}
+	}
+	return append(ordered, failed...)
+}
+
+// Succeeded records that a handshake with host at ip succeeded.
+func (s *StickyIPs) Succeeded(host, ip string) {
+	if s == nil {
+		return
+	}
+	h := s.host(host)
+	defer s.mu.Unlock()
+	h.good, h.goodAt = ip, clock.Or(s.Clock).Now()
+	delete(h.failed, ip)
+}
+
+// Failed records that a connection to host at ip failed, the IP is avoided
+// for TTL.
+func (s *StickyIPs) Failed(host, ip string) {
+	if s == nil {
+		return
+	}
+	h := s.host(host)
+	defer s.mu.Unlock()
+	if h.good == ip {
+		h.good = ""
+	}
+	if h.failed == nil {
+		h.failed = make(map[string]time.Time)
+	}
+	h.failed[ip] = clock.Or(s.Clock).Now()
+}
+
+// host returns what is remembered of host with s.mu held.
+func (s *StickyIPs) host(host string) *stickyHost {
+	host = NormalizeHostname(host)
+	s.mu.Lock()
+	if s.hosts == nil {
+		s.hosts = make(map[string]*stickyHost)
+	}
+	h := s.hosts[host]
+	if h == nil {
+		h = &stickyHost{}
+		s.hosts[host] = h
+	}
+	return h
+}
@@ -0,0 +1,41 @@
+package resolve
+
+import (
+	"bepass/clock"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStickyIPs(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	s := &StickyIPs{TTL: time.Minute, Clock: fake}
+	ips := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	if got := s.Pick("cdn.example", ips); got != "192.0.2.1" {
+		t.Errorf("expected the first IP of a new host, got %s", got)
+	}
+
+	s.Failed("cdn.example", "192.0.2.1")
+	if got := s.Pick("cdn.example", ips); got != "192.0.2.2" {
+		t.Errorf("expected the failed IP to be avoided, got %s", got)
+	}
+	s.Succeeded("CDN.example.", "192.0.2.3")
+	if got := s.Pick("cdn.example", []string{"192.0.2.2", "192.0.2.3"}); got != "192.0.2.3" {
+		t.Errorf("expected the IP that worked, got %s", got)
+	}
+	if got := strings.Join(s.Order("cdn.example", ips), ","); got != "192.0.2.3,192.0.2.2,192.0.2.1" {
+		t.Errorf("expected the IP that worked first and the failed one last, got %s", got)
+	}
+
+	// after TTL the choice is made again in the order of the answers
+	fake.Advance(time.Minute)
+	if got := s.Pick("cdn.example", ips); got != "192.0.2.1" {
+		t.Errorf("expected the first IP once TTL passed, got %s", got)
+	}
+
+	var none *StickyIPs
+	none.Failed("cdn.example", "192.0.2.1")
+	if got := none.Pick("cdn.example", ips); got != "192.0.2.1" {
+		t.Errorf("nil StickyIPs Pick = %s", got)
+	}
+}
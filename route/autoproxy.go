@@ -0,0 +1,97 @@
+package route
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+)
+
+var errNoAutoProxyRules = errors.New("no rule found in the AutoProxy list")
+
+// ParseAutoProxy parses a list of AutoProxy rules, the format of gfwlist,
+// base64 encoded or not. The matching hostnames go through the worker, but
+// rules starting with @@, the exceptions, go direct and come first, as an
+// exception wins over any other rule.
+//
+// Only hostnames are seen by bepass, so a rule is reduced to its host part:
+// ||example.com matches the domain and its subdomains, |http://example.com
+// the hostname only, and a keyword such as .example.com/path the domain.
+// Wildcards in the host are kept. Regular expression rules, written against
+// the whole URL, are skipped.
+func ParseAutoProxy(data []byte) ([]Rule, error) {
+	data = decodeBase64(bytes.TrimSpace(data))
+	var proxied, exceptions []Rule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		action := Worker
+		if strings.HasPrefix(line, "@@") {
+			action = Direct
+			line = line[2:]
+		}
+		r, ok := autoProxyRule(line)
+		if !ok {
+			continue
+		}
+		r.Action = action
+		if action == Direct {
+			exceptions = append(exceptions, r)
+		} else {
+			proxied = append(proxied, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(proxied)+len(exceptions) == 0 {
+		return nil, errNoAutoProxyRules
+	}
+	return append(exceptions, proxied...), nil
+}
+
+// IsAutoProxy reports whether data is an AutoProxy list, which starts with
+// an [AutoProxy x.y] header.
+func IsAutoProxy(data []byte) bool {
+	return bytes.HasPrefix(decodeBase64(bytes.TrimSpace(data)), []byte("[AutoProxy"))
+}
+
+// autoProxyRule turns an AutoProxy rule, without its @@, into a rule on
+// hostnames.
+func autoProxyRule(line string) (Rule, bool) {
+	if strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		return Rule{}, false
+	}
+	kind := MatchDomain
+	switch {
+	case strings.HasPrefix(line, "||"):
+		line = line[2:]
+	case strings.HasPrefix(line, "|"):
+		line = line[1:]
+		kind = MatchExact
+	}
+	if i := strings.Index(line, "://"); i >= 0 {
+		line = line[i+3:]
+	}
+	if i := strings.IndexAny(line, "/^|?#"); i >= 0 {
+		line = line[:i]
+	}
+	if i := strings.IndexByte(line, ':'); i >= 0 && !strings.Contains(line[i+1:], ":") {
+		line = line[:i]
+	}
+	line = strings.TrimPrefix(line, ".")
+	if strings.Trim(line, "*.") == "" {
+		return Rule{}, false
+	}
+	if strings.Contains(line, "*") {
+		if kind == MatchDomain && !strings.HasPrefix(line, "*") {
+			line = "*" + line
+		}
+		return Rule{Kind: MatchGlob, Value: line}, true
+	}
+	return Rule{Kind: kind, Value: line}, true
+}
@@ -0,0 +1,44 @@
+package route
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"strings"
+)
+
+// ParseDomainList parses a list of domains sent to action, one per line.
+// An entry matches the domain and its subdomains, a leading "*." or "." is
+// dropped. Lines starting with # or ! are comments. The list may be base64
+// encoded, with the standard or URL alphabet and padding optional.
+func ParseDomainList(data []byte, action Action) []Rule {
+	data = decodeBase64(bytes.TrimSpace(data))
+	var rules []Rule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || entry[0] == '#' || entry[0] == '!' {
+			continue
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if entry != "" {
+			rules = append(rules, Rule{Kind: MatchDomain, Value: entry, Action: action})
+		}
+	}
+	return rules
+}
+
+// decodeBase64 returns data decoded if it is base64 as a whole, data itself
+// otherwise.
+func decodeBase64(data []byte) []byte {
+	compact := bytes.Join(bytes.Fields(data), nil)
+	if len(compact) == 0 {
+		return data
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := enc.DecodeString(string(compact)); err == nil {
+			return decoded
+		}
+	}
+	return data
+}
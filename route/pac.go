@@ -0,0 +1,104 @@
+package route
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// A PAC file is JavaScript, which bepass does not run. ParsePAC reads the
+// decisions of the usual FindProxyForURL bodies instead: if statements whose
+// condition ORs host tests and that return a proxy string, the return ending
+// the function, and the domain objects ({"example.com": 1, ...}) emitted by
+// the PAC generators, whose domains are proxied.
+var (
+	pacComment    = regexp.MustCompile(`(?s)/\*.*?\*/|//[^\n]*`)
+	pacIf         = regexp.MustCompile(`(?s)if\s*\((.*?)\)\s*\{?\s*return\s+(?:"([^"]*)"|'([^']*)'|(\w+))\s*;?\s*\}?`)
+	pacReturn     = regexp.MustCompile(`return\s+(?:"([^"]*)"|'([^']*)'|(\w+))`)
+	pacVar        = regexp.MustCompile(`(?:var|let|const)\s+(\w+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	pacDomainsObj = regexp.MustCompile(`(?s)\{(\s*["'][^"']+["']\s*:\s*\d+\s*,?)+\s*\}`)
+	pacDomainKey  = regexp.MustCompile(`["']([^"']+)["']\s*:`)
+
+	pacDomainIs = regexp.MustCompile(`^dnsDomainIs\(\s*host\s*,\s*["']([^"']+)["']\s*\)$`)
+	pacShExp    = regexp.MustCompile(`^shExpMatch\(\s*host\s*,\s*["']([^"']+)["']\s*\)$`)
+	pacHostIs   = regexp.MustCompile(`^(?:host\s*===?\s*["']([^"']+)["']|["']([^"']+)["']\s*===?\s*host|localHostOrDomainIs\(\s*host\s*,\s*["']([^"']+)["']\s*\))$`)
+)
+
+var errNoPACRules = errors.New("no rule found in the PAC file")
+
+// ParsePAC reads the rules of a PAC file, see above, and the route of the
+// hostnames they do not match, empty if the file has no final return.
+// Conditions with other tests are skipped.
+func ParsePAC(data []byte) ([]Rule, Action, error) {
+	src := pacComment.ReplaceAllString(string(data), "")
+	vars := make(map[string]string)
+	for _, m := range pacVar.FindAllStringSubmatch(src, -1) {
+		vars[m[1]] = m[2] + m[3]
+	}
+	result := func(quoted, single, name string) Action {
+		if name != "" {
+			quoted = vars[name]
+		}
+		return pacAction(quoted + single)
+	}
+
+	var rules []Rule
+	for _, m := range pacIf.FindAllStringSubmatch(src, -1) {
+		action := result(m[2], m[3], m[4])
+		if action == "" || strings.Contains(m[1], "&&") {
+			continue
+		}
+		for _, term := range strings.Split(m[1], "||") {
+			if r, ok := pacRule(strings.TrimSpace(term)); ok {
+				r.Action = action
+				rules = append(rules, r)
+			}
+		}
+	}
+	for _, obj := range pacDomainsObj.FindAllString(src, -1) {
+		for _, m := range pacDomainKey.FindAllStringSubmatch(obj, -1) {
+			rules = append(rules, Rule{Kind: MatchDomain, Value: strings.TrimPrefix(m[1], "."), Action: Worker})
+		}
+	}
+
+	var fallback Action
+	rest := pacIf.ReplaceAllString(src, "")
+	if all := pacReturn.FindAllStringSubmatch(rest, -1); len(all) > 0 {
+		m := all[len(all)-1]
+		fallback = result(m[1], m[2], m[3])
+	}
+	if len(rules) == 0 && fallback == "" {
+		return nil, "", errNoPACRules
+	}
+	return rules, fallback, nil
+}
+
+// pacRule turns a host test of a PAC condition into a rule.
+func pacRule(term string) (Rule, bool) {
+	for strings.HasPrefix(term, "(") && strings.HasSuffix(term, ")") {
+		term = strings.TrimSpace(term[1 : len(term)-1])
+	}
+	if m := pacDomainIs.FindStringSubmatch(term); m != nil {
+		return Rule{Kind: MatchDomain, Value: strings.TrimPrefix(m[1], ".")}, true
+	}
+	if m := pacShExp.FindStringSubmatch(term); m != nil {
+		return Rule{Kind: MatchGlob, Value: m[1]}, true
+	}
+	if m := pacHostIs.FindStringSubmatch(term); m != nil {
+		return Rule{Kind: MatchExact, Value: m[1] + m[2] + m[3]}, true
+	}
+	return Rule{}, false
+}
+
+// pacAction maps the result of FindProxyForURL to a route: DIRECT goes
+// direct, a proxy goes through the worker, whatever the proxy address.
+func pacAction(result string) Action {
+	first := strings.ToUpper(strings.TrimSpace(strings.SplitN(result, ";", 2)[0]))
+	switch {
+	case first == "DIRECT":
+		return Direct
+	case strings.HasPrefix(first, "PROXY"), strings.HasPrefix(first, "SOCKS"), strings.HasPrefix(first, "HTTPS"):
+		return Worker
+	}
+	return ""
+}
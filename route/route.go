@@ -0,0 +1,198 @@
+// Package route decides which connections go through the worker and which
+// go direct, from rules loaded from the config, domain lists and PAC files.
+package route
+
+import (
+	"bepass/resolve"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Action is where a connection is sent.
+type Action string
+
+const (
+	// Direct connects to the destination, with the ClientHello fragmented
+	Direct Action = "direct"
+	// Worker tunnels the connection through the worker
+	Worker Action = "worker"
+)
+
+// ParseAction parses the name of an action.
+func ParseAction(s string) (Action, error) {
+	switch Action(s) {
+	case Direct, Worker:
+		return Action(s), nil
+	}
+	return "", fmt.Errorf("unknown route %q", s)
+}
+
+// MatchKind is how the value of a Rule is compared to a hostname.
+type MatchKind int
+
+const (
+	// MatchDomain matches the domain and its subdomains
+	MatchDomain MatchKind = iota
+	// MatchExact matches the hostname only
+	MatchExact
+	// MatchGlob matches a shell expression, * and ? also match dots
+	MatchGlob
+	// MatchKeyword matches the hostnames containing the value
+	MatchKeyword
+	// MatchRegexp matches a regular expression
+	MatchRegexp
+)
+
+// kindNames name the match kinds in the reasons of Explain.
+var kindNames = map[MatchKind]string{
+	MatchDomain:  "domain",
+	MatchExact:   "exact",
+	MatchGlob:    "glob",
+	MatchKeyword: "keyword",
+	MatchRegexp:  "regexp",
+}
+
+// Rule sends the hostnames it matches to Action.
+type Rule struct {
+	Kind   MatchKind
+	Value  string
+	Action Action
+
+	re *regexp.Regexp
+}
+
+// compile normalizes the value of r and prepares its matcher.
+func (r Rule) compile() (Rule, error) {
+	var err error
+	switch r.Kind {
+	case MatchDomain, MatchExact:
+		r.Value = resolve.NormalizeHostname(r.Value)
+	case MatchGlob:
+		r.Value = strings.ToLower(r.Value)
+		r.re, err = resolve.GlobRegexp(r.Value)
+	case MatchKeyword:
+		r.Value = strings.ToLower(r.Value)
+	case MatchRegexp:
+		r.re, err = regexp.Compile(r.Value)
+	}
+	return r, err
+}
+
+// String returns the kind and the value of r, like domain:example.com.
+func (r Rule) String() string {
+	return kindNames[r.Kind] + ":" + r.Value
+}
+
+// matches reports whether r matches host, a normalized hostname.
+func (r Rule) matches(host string) bool {
+	switch r.Kind {
+	case MatchDomain:
+		return host == r.Value || strings.HasSuffix(host, "."+r.Value)
+	case MatchExact:
+		return host == r.Value
+	case MatchKeyword:
+		return strings.Contains(host, r.Value)
+	case MatchGlob, MatchRegexp:
+		return r.re != nil && r.re.MatchString(host)
+	}
+	return false
+}
+
+// Table is the routing table: the first rule matching a hostname decides
+// its route, Default does when none does. Rules come from several sources,
+// each can be replaced at runtime without affecting the others, and are
+// tried in the order the sources were first set.
+type Table struct {
+	// Default is the route of the hostnames no rule matches
+	Default Action
+
+	mu      sync.RWMutex
+	order   []string
+	sources map[string][]Rule
+}
+
+// SetSource replaces the rules of source.
+func (t *Table) SetSource(source string, rules []Rule) error {
+	compiled := make([]Rule, 0, len(rules))
+	for _, r := range rules {
+		c, err := r.compile()
+		if err != nil {
+			return fmt.Errorf("invalid rule %q, %v", r.Value, err)
+		}
+		compiled = append(compiled, c)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sources == nil {
+		t.sources = make(map[string][]Rule)
+	}
+	if _, ok := t.sources[source]; !ok {
+		t.order = append(t.order, source)
+	}
+	t.sources[source] = compiled
+	return nil
+}
+
+// Match returns the action of the first rule matching host, false if none does.
+func (t *Table) Match(host string) (Action, bool) {
+	r, _, ok := t.lookup(host)
+	return r.Action, ok
+}
+
+// lookup returns the first rule matching host and its source, false if none
+// does.
+func (t *Table) lookup(host string) (Rule, string, bool) {
+	if t == nil || host == "" {
+		return Rule{}, "", false
+	}
+	host = resolve.NormalizeHostname(host)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, source := range t.order {
+		for _, r := range t.sources[source] {
+			if r.matches(host) {
+				return r, source, true
+			}
+		}
+	}
+	return Rule{}, "", false
+}
+
+// Route returns the route of host, an empty Action for a nil table.
+func (t *Table) Route(host string) Action {
+	if t == nil {
+		return ""
+	}
+	if action, ok := t.Match(host); ok {
+		return action
+	}
+	return t.Default
+}
+
+// Explain returns the route of host like Route does, and why: the rule that
+// matched it and its source, or the default route.
+func (t *Table) Explain(host string) (Action, string) {
+	if t == nil {
+		return "", ""
+	}
+	if r, source, ok := t.lookup(host); ok {
+		return r.Action, fmt.Sprintf("rule %s of %s", r, source)
+	}
+	return t.Default, "default route"
+}
+
+// Len returns the number of rules of all sources.
+func (t *Table) Len() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := 0
+	for _, rules := range t.sources {
+		n += len(rules)
+	}
+	return n
+}
@@ -0,0 +1,188 @@
+package route
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+const domainList = `# blocked
+! also a comment
+example.com
+*.blocked.org
+.cdn.net
+`
+
+func TestParseDomainList(t *testing.T) {
+	for name, data := range map[string]string{
+		"plain":  domainList,
+		"base64": base64.StdEncoding.EncodeToString([]byte(domainList)),
+	} {
+		rules := ParseDomainList([]byte(data), Worker)
+		if len(rules) != 3 {
+			t.Fatalf("%s: got %d rules, want 3", name, len(rules))
+		}
+		var table Table
+		table.Default = Direct
+		if err := table.SetSource("list", rules); err != nil {
+			t.Fatal(err)
+		}
+		for host, want := range map[string]Action{
+			"example.com":     Worker,
+			"www.Example.com": Worker,
+			"a.blocked.org":   Worker,
+			"cdn.net":         Worker,
+			"notexample.com":  Direct,
+		} {
+			if got := table.Route(host); got != want {
+				t.Errorf("%s: Route(%s) = %s, want %s", name, host, got, want)
+			}
+		}
+	}
+}
+
+const pacFile = `
+var proxy = "SOCKS5 127.0.0.1:8085; DIRECT";
+var domains = {
+  "twitter.com": 1,
+  "youtube.com": 1
+};
+
+function FindProxyForURL(url, host) {
+  // local names
+  if (isPlainHostName(host) || host == "intranet.local")
+    return "DIRECT";
+  if (dnsDomainIs(host, ".blocked.org") || shExpMatch(host, "*.cdn?.net")) {
+    return proxy;
+  }
+  if (isInNet(host, "10.0.0.0", "255.0.0.0") && dnsDomainIs(host, "x.com")) {
+    return "PROXY 1.2.3.4:80";
+  }
+  /* the rest goes direct */
+  return "DIRECT";
+}
+`
+
+func TestParsePAC(t *testing.T) {
+	rules, fallback, err := ParsePAC([]byte(pacFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fallback != Direct {
+		t.Errorf("fallback = %q, want direct", fallback)
+	}
+	table := Table{Default: fallback}
+	if err := table.SetSource("pac", rules); err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]Action{
+		"intranet.local":  Direct,
+		"www.blocked.org": Worker,
+		"img.cdn1.net":    Worker,
+		"img.cdn12.net":   Direct,
+		"m.youtube.com":   Worker,
+		"twitter.com":     Worker,
+		"x.com":           Direct,
+		"example.com":     Direct,
+	} {
+		if got := table.Route(host); got != want {
+			t.Errorf("Route(%s) = %s, want %s", host, got, want)
+		}
+	}
+
+	if _, _, err := ParsePAC([]byte("function FindProxyForURL(url, host) { return eval(x); }")); err == nil {
+		t.Error("expected an error for a PAC file without rules")
+	}
+}
+
+func TestTableSources(t *testing.T) {
+	table := Table{Default: Worker}
+	if err := table.SetSource("first", []Rule{{Kind: MatchKeyword, Value: "google", Action: Direct}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.SetSource("second", []Rule{{Kind: MatchDomain, Value: "google.com", Action: Worker}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := table.Route("google.com"); got != Direct {
+		t.Errorf("Route(google.com) = %s, the first source must win", got)
+	}
+	if err := table.SetSource("first", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := table.Route("google.com"); got != Worker {
+		t.Errorf("Route(google.com) = %s after the first source was emptied", got)
+	}
+	if table.Len() != 1 {
+		t.Errorf("Len = %d, want 1", table.Len())
+	}
+	if err := table.SetSource("bad", []Rule{{Kind: MatchRegexp, Value: "("}}); err == nil {
+		t.Error("expected an error for an invalid regexp")
+	}
+
+	var none *Table
+	if got := none.Route("google.com"); got != "" {
+		t.Errorf("nil table Route = %q", got)
+	}
+}
+
+func TestTableExplain(t *testing.T) {
+	table := Table{Default: Worker}
+	if err := table.SetSource("bypass", []Rule{{Kind: MatchDomain, Value: "Example.com", Action: Direct}}); err != nil {
+		t.Fatal(err)
+	}
+	if action, reason := table.Explain("www.example.com"); action != Direct || reason != "rule domain:example.com of bypass" {
+		t.Errorf("Explain(www.example.com) = %s, %q", action, reason)
+	}
+	if action, reason := table.Explain("other.org"); action != Worker || reason != "default route" {
+		t.Errorf("Explain(other.org) = %s, %q", action, reason)
+	}
+}
+
+const autoProxyList = `[AutoProxy 0.2.9]
+! Checksum: abc
+||blocked.org
+|https://exact.example.com/path
+.keyword.net/search
+*.wild.io
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+@@||cn.blocked.org
+||1.2.3.4
+`
+
+func TestParseAutoProxy(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(autoProxyList))
+	if !IsAutoProxy([]byte(encoded)) || IsAutoProxy([]byte(domainList)) {
+		t.Fatal("IsAutoProxy does not tell the lists apart")
+	}
+	rules, err := ParseAutoProxy([]byte(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 6 {
+		t.Fatalf("got %d rules, want 6: %+v", len(rules), rules)
+	}
+	table := Table{Default: Direct}
+	if err := table.SetSource("gfwlist", rules); err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]Action{
+		"www.blocked.org":   Worker,
+		"cn.blocked.org":    Direct,
+		"a.cn.blocked.org":  Direct,
+		"exact.example.com": Worker,
+		"www.example.com":   Direct,
+		"keyword.net":       Worker,
+		"img.keyword.net":   Worker,
+		"a.b.wild.io":       Worker,
+		"foo.blogspot.com":  Direct,
+		"1.2.3.4":           Worker,
+		"example.org":       Direct,
+	} {
+		if got := table.Route(host); got != want {
+			t.Errorf("Route(%s) = %s, want %s", host, got, want)
+		}
+	}
+
+	if _, err := ParseAutoProxy([]byte("[AutoProxy 0.2.9]\n! empty\n")); err == nil {
+		t.Error("expected an error for a list without rules")
+	}
+}
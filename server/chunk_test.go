@@ -0,0 +1,26 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzSNIChunking(f *testing.F) {
+	f.Add([]byte("\x16\x03\x01\x00\x10example.com\x00\x00"), []byte("example.com"), 1, 5)
+	f.Add([]byte("no host in here"), []byte("example.com"), 2, 2)
+	f.Add([]byte("example.com"), []byte("example.com"), 0, 0)
+	f.Fuzz(func(t *testing.T, data, host []byte, minLen, maxLen int) {
+		if len(host) == 0 || minLen < 0 || maxLen < 0 || minLen > 64 || maxLen > 64 {
+			return
+		}
+		s := &Server{ChunkConfig: ChunkConfig{
+			BeforeSniLength: [2]int{minLen, maxLen},
+			AfterSniLength:  [2]int{minLen, maxLen},
+		}}
+		var out bytes.Buffer
+		s.sendSplitChunks(&out, s.getChunkedPackets(data, host))
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("chunks do not reassemble to the original packet: %q != %q", out.Bytes(), data)
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"bepass/bufferpool"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// benchmarkCopy simulates many short-lived connections each relaying a small response.
+func benchmarkCopy(b *testing.B, s *Server) {
+	payload := bytes.Repeat([]byte{'x'}, 4*1024)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			// Hide ReadFrom/WriteTo so the copy goes through the relay buffer
+			src := struct{ io.Reader }{bytes.NewReader(payload)}
+			dst := struct{ io.Writer }{io.Discard}
+			if err := s.Copy(src, dst); err != nil {
+				b.Fatalf("copy failed: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkCopyWithoutPool(b *testing.B) {
+	benchmarkCopy(b, &Server{})
+}
+
+func BenchmarkCopyWithPool(b *testing.B) {
+	benchmarkCopy(b, &Server{BufferPool: bufferpool.NewPool(32 * 1024)})
+}
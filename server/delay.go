@@ -0,0 +1,38 @@
+package server
+
+import (
+	"math/rand"
+	"runtime"
+	"time"
+)
+
+// spinThreshold is the longest delay waited by spinning instead of sleeping.
+// The OS timer may overshoot by about that much (more on windows), which would
+// swamp microsecond delays but hardly matters to longer ones.
+const spinThreshold = 2 * time.Millisecond
+
+// chunkDelay draws the delay before the next chunk uniformly from the closed
+// range [r[0], r[1]]. A range with r[1] <= r[0] always gives r[0].
+func chunkDelay(r [2]time.Duration) time.Duration {
+	if r[1] <= r[0] {
+		return r[0]
+	}
+	return r[0] + time.Duration(rand.Int63n(int64(r[1]-r[0])+1))
+}
+
+// preciseSleep waits for d. A delay under spinThreshold is spun for
+// microsecond accuracy, so it keeps a CPU busy for its whole length, longer
+// ones just sleep.
+func preciseSleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	if d >= spinThreshold {
+		time.Sleep(d)
+		return
+	}
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		runtime.Gosched()
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChunkDelay(t *testing.T) {
+	if d := chunkDelay([2]time.Duration{50 * time.Microsecond, 0}); d != 50*time.Microsecond {
+		t.Errorf("expected the lower bound for an empty range, got %v", d)
+	}
+	r := [2]time.Duration{10, 12}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 1000; i++ {
+		d := chunkDelay(r)
+		if d < r[0] || d > r[1] {
+			t.Fatalf("delay %v outside of %v", d, r)
+		}
+		seen[d] = true
+	}
+	if !seen[r[0]] || !seen[r[1]] {
+		t.Errorf("expected both ends of the range to be drawn, got %v", seen)
+	}
+}
+
+func TestPreciseSleep(t *testing.T) {
+	for _, d := range []time.Duration{200 * time.Microsecond, 3 * time.Millisecond} {
+		start := time.Now()
+		preciseSleep(d)
+		if elapsed := time.Since(start); elapsed < d {
+			t.Errorf("slept %v, expected at least %v", elapsed, d)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bepass/logger"
+	"bepass/resolve"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var errNoQuestion = errors.New("dns query without a question")
+
+// Exchange answers the DNS query req for a client. Address queries for a
+// name of the hosts entries are answered from them. Every other query, of
+// any type including ANY unless RefuseANY is set, goes to the remote DNS
+// server and its reply is returned whole, with the ID, the question and the
+// RD and CD flags of req, so stub resolvers accept it as the reply to their
+// query.
+func (s *Server) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) == 0 {
+		return nil, errNoQuestion
+	}
+	q := req.Question[0]
+	begin := time.Now()
+	source := resolve.SourceDNSCrypt
+	if s.ResolveSystem == "doh" {
+		source = resolve.SourceDoH
+	}
+
+	var r *dns.Msg
+	var err error
+	switch {
+	case q.Qtype == dns.TypeANY && s.RefuseANY:
+		r = refuseANY(req)
+		source = resolve.SourceRefused
+	case isAddressQuery(q):
+		if ips := s.LocalResolver.LookupHosts(q.Name); len(ips) > 0 {
+			r = hostsAnswer(req, ips)
+			source = resolve.SourceHosts
+			break
+		}
+		fallthrough
+	default:
+		r, err = s.exchange(ctx, req)
+		if err != nil && s.PlainDNSFallback != "" {
+			logger.Debugf("dns query for %s failed, asking %s, %v", logger.Redact(q.Name), s.PlainDNSFallback, err)
+			r, err = s.exchangePlain(ctx, req)
+			source = resolve.SourcePlainDNS
+		}
+		if err == nil {
+			relayReply(req, r)
+		}
+	}
+	answer := ""
+	if err == nil && len(r.Answer) > 0 {
+		answer = rrData(r.Answer[0])
+	}
+	s.QueryLog.Log(begin, resolve.NormalizeHostname(q.Name), dns.TypeToString[q.Qtype], answer, source, err)
+	return r, err
+}
+
+// CheckResolver reports whether the remote DNS server answers, asking it for
+// the name servers of the root zone. The query skips the hosts entries, the
+// cache and the query log.
+func (s *Server) CheckResolver(ctx context.Context) error {
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeNS)
+	_, err := s.exchange(ctx, req)
+	return err
+}
+
+// plainDNSTimeout is how long a query to PlainDNSFallback can take when ctx
+// has no deadline.
+const plainDNSTimeout = 10 * time.Second
+
+// exchangePlain sends req to PlainDNSFallback over TCP, where a query can be
+// split in several segments, unlike in a UDP datagram. With SplitPlainDNS the
+// name is written apart from the rest of the query, itself in writes of the
+// ChunkConfig lengths, for the middleboxes matching the names in the queries.
+func (s *Server) exchangePlain(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, plainDNSTimeout)
+		defer cancel()
+	}
+	query, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// through the Dialer, for the protected sockets and UpstreamProxy
+	conn, err := s.Dialer.TCPDialContext(ctx, "tcp", s.PlainDNSFallback, "")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	// RFC 1035, section 4.2.2: the message is prefixed with its length
+	framed := append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)
+	if s.SplitPlainDNS {
+		// a failed write shows as a failed read of the reply
+		s.sendSplitChunks(conn, s.getChunkedPackets(framed, queryName(query)))
+	} else if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	dc := &dns.Conn{Conn: conn}
+	return dc.ReadMsg()
+}
+
+// queryName returns the name of the question of query, in wire format, nil
+// if it has none.
+func queryName(query []byte) []byte {
+	const headerLen = 12
+	for i := headerLen; i < len(query); {
+		n := int(query[i])
+		if n == 0 {
+			if i == headerLen {
+				return nil
+			}
+			return query[headerLen:i]
+		}
+		i += 1 + n
+	}
+	return nil
+}
+
+// isAddressQuery reports whether q asks for the IPv4 or IPv6 addresses of a
+// name, the only queries the hosts entries answer.
+func isAddressQuery(q dns.Question) bool {
+	return q.Qclass == dns.ClassINET && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA)
+}
+
+// hostsTTL is the TTL of the answers made from the hosts entries.
+const hostsTTL = 60
+
+// hostsAnswer answers req with the ips of its family, no record if none is.
+func hostsAnswer(req *dns.Msg, ips []string) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(req)
+	r.RecursionAvailable = true
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: hostsTTL}
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		switch {
+		case ip == nil:
+		case q.Qtype == dns.TypeA && ip.To4() != nil:
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+		case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return r
+}
+
+// relayReply makes r, the reply of the remote DNS server, the reply to req.
+// The upstream query may have had another ID, DoH clients send 0, or a name
+// of another case, and the recursion bits are those of bepass, which
+// recurses for its clients whatever they ask.
+func relayReply(req, r *dns.Msg) {
+	r.Id = req.Id
+	r.Response = true
+	r.Opcode = req.Opcode
+	r.RecursionDesired = req.RecursionDesired
+	r.RecursionAvailable = true
+	r.CheckingDisabled = req.CheckingDisabled
+	r.Question = req.Question
+}
+
+// refuseANY answers an ANY query the way RFC 8482 suggests, with a single
+// HINFO record, instead of forwarding it.
+func refuseANY(req *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(req)
+	r.RecursionAvailable = true
+	r.Answer = []dns.RR{&dns.HINFO{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: hostsTTL},
+		Cpu: "RFC8482",
+	}}
+	return r
+}
+
+// rrData returns the data of rr, its text without the header.
+func rrData(rr dns.RR) string {
+	return strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))
+}
+
+// ServeDNS answers the DNS query in wire format with Exchange, for the
+// queries clients send to port 53. A failed exchange is answered SERVFAIL,
+// and a reply too large for the client is truncated to the size it
+// advertised, 512 bytes without EDNS0, so it asks again over TCP.
+func (s *Server) ServeDNS(ctx context.Context, query []byte) ([]byte, error) {
+	req := new(dns.Msg)
+	if err := req.Unpack(query); err != nil {
+		return nil, err
+	}
+	r, err := s.Exchange(ctx, req)
+	switch {
+	case err == errNoQuestion:
+		r = new(dns.Msg)
+		r.SetRcode(req, dns.RcodeFormatError)
+	case err != nil:
+		logger.Debugf("dns query for %s failed, %v", logger.Redact(req.Question[0].Name), err)
+		r = new(dns.Msg)
+		r.SetRcode(req, dns.RcodeServerFailure)
+		r.RecursionAvailable = true
+	}
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	r.Truncate(size)
+	return r.Pack()
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bepass/dialer"
+	"bepass/resolve"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPlainDNSFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	reads := make(chan int, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var framed []byte
+		n := 0
+		buf := make([]byte, 512)
+		for len(framed) < 2 || len(framed) < 2+int(binary.BigEndian.Uint16(framed)) {
+			read, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			framed = append(framed, buf[:read]...)
+			n++
+		}
+		reads <- n
+		req := new(dns.Msg)
+		if err := req.Unpack(framed[2:]); err != nil {
+			return
+		}
+		r := new(dns.Msg)
+		r.SetReply(req)
+		r.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(192, 0, 2, 1)}}
+		packed, _ := r.Pack()
+		_, _ = conn.Write(append([]byte{byte(len(packed) >> 8), byte(len(packed))}, packed...))
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	s := &Server{
+		// no DNSCrypt server answers there
+		RemoteDNSAddr:    "sdns://invalid",
+		PlainDNSFallback: ln.Addr().String(),
+		SplitPlainDNS:    true,
+		Dialer:           &dialer.Dialer{},
+		LocalResolver:    &resolve.LocalResolver{},
+		ChunkConfig: ChunkConfig{BeforeSniLength: [2]int{1, 3}, AfterSniLength: [2]int{1, 3},
+			Delay: [2]time.Duration{2 * time.Millisecond, 2 * time.Millisecond}},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("blocked.example.", dns.TypeA)
+	r, err := s.Exchange(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Id != req.Id {
+		t.Fatalf("expected the answer of the fallback, got %v", r)
+	}
+	if n := <-reads; n < 4 {
+		t.Errorf("expected the query in several segments, read it in %d", n)
+	}
+	if name := queryName(mustPack(t, req)); string(name) != "\x07blocked\x07example" {
+		t.Errorf("queryName = %q", name)
+	}
+}
+
+func mustPack(t *testing.T, m *dns.Msg) []byte {
+	t.Helper()
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
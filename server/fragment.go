@@ -0,0 +1,34 @@
+package server
+
+// FragmentMode selects the first packets that are split into chunks.
+type FragmentMode string
+
+const (
+	// FragmentAuto splits only first packets that look like a TLS ClientHello,
+	// anything else is sent unmodified
+	FragmentAuto FragmentMode = "auto"
+	// FragmentAlways splits every first packet
+	FragmentAlways FragmentMode = "always"
+	// FragmentNever sends every first packet unmodified
+	FragmentNever FragmentMode = "never"
+)
+
+// shouldFragment reports whether the first packet of a connection is split
+// into chunks. An empty Mode is FragmentAuto.
+func (c ChunkConfig) shouldFragment(firstPacket []byte) bool {
+	switch c.Mode {
+	case FragmentAlways:
+		return true
+	case FragmentNever:
+		return false
+	default:
+		return looksLikeClientHello(firstPacket)
+	}
+}
+
+// looksLikeClientHello reports whether b starts with a TLS handshake record
+// carrying a ClientHello.
+func looksLikeClientHello(b []byte) bool {
+	// content type, version major and minor, length, handshake type
+	return len(b) >= 6 && b[0] == 0x16 && b[1] == 0x03 && b[5] == 0x01
+}
@@ -0,0 +1,29 @@
+package server
+
+import "testing"
+
+func TestShouldFragment(t *testing.T) {
+	hello := []byte("\x16\x03\x01\x00\xf0\x01\x00\x00\xec\x03\x03")
+	plain := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	appData := []byte("\x17\x03\x03\x00\x20encrypted")
+
+	tests := []struct {
+		mode  FragmentMode
+		data  []byte
+		split bool
+	}{
+		{"", hello, true},
+		{FragmentAuto, hello, true},
+		{FragmentAuto, plain, false},
+		{FragmentAuto, appData, false},
+		{FragmentAuto, hello[:4], false},
+		{FragmentAlways, plain, true},
+		{FragmentNever, hello, false},
+	}
+	for _, tt := range tests {
+		c := ChunkConfig{Mode: tt.mode}
+		if got := c.shouldFragment(tt.data); got != tt.split {
+			t.Errorf("mode %q on %q: got %v, want %v", tt.mode, tt.data, got, tt.split)
+		}
+	}
+}
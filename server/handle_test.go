@@ -0,0 +1,415 @@
+package server
+
+import (
+	"bepass/dialer"
+	"bepass/endpoint"
+	"bepass/socks5"
+	"bepass/socks5/statute"
+	"bepass/utils"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startEchoServer answers every connection by echoing what it receives.
+func startEchoServer(t *testing.T) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestHandleRelaysAndRecordsTiming(t *testing.T) {
+	upstream := startEchoServer(t)
+	s := &Server{Dialer: &dialer.Dialer{}}
+
+	client, proxy := net.Pipe()
+	defer client.Close()
+
+	dest := statute.AddrSpec{IP: upstream.IP, Port: upstream.Port}
+	req := &socks5.Request{RawDestAddr: &dest, Reader: proxy}
+	req.DstAddr = dest
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Handle(context.Background(), proxy, req, "tcp")
+		proxy.Close()
+	}()
+
+	// success reply: version, reply, reserved, ipv4 address type, address and port
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != statute.RepSuccess {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+
+	msg := []byte("hello upstream")
+	if _, err := client.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len(msg))
+	if _, err := io.ReadFull(client, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != string(msg) {
+		t.Fatalf("got %q, want %q", echo, msg)
+	}
+	client.Close()
+	<-done
+
+	stats := s.Timings()
+	if stats.Connections != 1 {
+		t.Fatalf("recorded %d connections, want 1", stats.Connections)
+	}
+	if stats.Total.Connect <= 0 || stats.Total.FirstByte <= 0 {
+		t.Errorf("expected connect and first byte timings, got %s", stats.Total)
+	}
+}
+
+func TestHandleFiresHooks(t *testing.T) {
+	upstream := startEchoServer(t)
+	var opened, closed []ConnectionEvent
+	s := &Server{Dialer: &dialer.Dialer{}, Hooks: &Hooks{
+		ConnectionOpened: func(e ConnectionEvent) { opened = append(opened, e) },
+		ConnectionClosed: func(e ConnectionEvent) { closed = append(closed, e) },
+	}}
+
+	client, proxy := net.Pipe()
+	defer client.Close()
+
+	dest := statute.AddrSpec{IP: upstream.IP, Port: upstream.Port}
+	req := &socks5.Request{RawDestAddr: &dest, Reader: proxy}
+	req.DstAddr = dest
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Handle(context.Background(), proxy, req, "tcp")
+		proxy.Close()
+	}()
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("hello upstream")
+	if _, err := client.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len(msg))
+	if _, err := io.ReadFull(client, echo); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	<-done
+
+	if len(opened) != 1 || len(closed) != 1 {
+		t.Fatalf("expected one open and one close event, got %d and %d", len(opened), len(closed))
+	}
+	if opened[0].Address != upstream.String() {
+		t.Errorf("opened event has address %q, want %q", opened[0].Address, upstream)
+	}
+	e := closed[0]
+	if e.BytesSent != int64(len(msg)) || e.BytesReceived != int64(len(msg)) {
+		t.Errorf("expected %d bytes each way, got sent=%d received=%d", len(msg), e.BytesSent, e.BytesReceived)
+	}
+	if e.Duration <= 0 {
+		t.Errorf("expected a duration, got %v", e.Duration)
+	}
+}
+
+// handleReply runs Handle for a connection to dest and returns the reply.
+func handleReply(t *testing.T, s *Server, dest *net.TCPAddr) []byte {
+	t.Helper()
+	client, proxy := net.Pipe()
+	defer client.Close()
+
+	addr := statute.AddrSpec{IP: dest.IP, Port: dest.Port}
+	req := &socks5.Request{RawDestAddr: &addr, Reader: proxy}
+	req.DstAddr = addr
+	go func() {
+		_ = s.Handle(context.Background(), proxy, req, "tcp")
+		proxy.Close()
+	}()
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestHandleReplyBindAddress(t *testing.T) {
+	upstream := startEchoServer(t)
+	reply := handleReply(t, &Server{Dialer: &dialer.Dialer{}}, upstream)
+	if reply[1] != statute.RepSuccess {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	ip, port := net.IP(reply[4:8]), int(reply[8])<<8|int(reply[9])
+	if !ip.Equal(upstream.IP) || port == 0 {
+		t.Errorf("expected the local address of the upstream connection, got %s:%d", ip, port)
+	}
+
+	// nothing listens on a closed listener's port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+	if reply := handleReply(t, &Server{Dialer: &dialer.Dialer{}}, closed); reply[1] == statute.RepSuccess {
+		t.Errorf("expected a failure reply when the destination can not be reached, got %v", reply)
+	}
+}
+
+func TestHandleMeasuresWorkerIP(t *testing.T) {
+	upstream := startEchoServer(t)
+	ips := endpoint.NewPool("127.0.0.1")
+	s := &Server{
+		Dialer: &dialer.Dialer{},
+		WorkerConfig: WorkerConfig{
+			WorkerAddress:    "https://worker.example/dns-query",
+			WorkerEnabled:    true,
+			WorkerIPs:        ips,
+			WorkerIPStrategy: endpoint.StrategyWeighted,
+		},
+	}
+	client, proxy := net.Pipe()
+	defer client.Close()
+	addr := statute.AddrSpec{FQDN: "worker.example", Port: upstream.Port}
+	req := &socks5.Request{RawDestAddr: &addr, Reader: proxy}
+	req.DstAddr = addr
+	go func() {
+		_ = s.Handle(context.Background(), proxy, req, "tcp")
+		proxy.Close()
+	}()
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != statute.RepSuccess {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	if _, ok := ips.RTT("127.0.0.1"); !ok {
+		t.Error("expected the connect time to the clean IP to be recorded")
+	}
+}
+
+// clientHello captures the first flight a crypto/tls client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		_ = conn.Handshake()
+		_ = client.Close()
+	}()
+	buf := make([]byte, 16*1024)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read client hello: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestHandleRetriesSplitHello(t *testing.T) {
+	hello := clientHello(t, "blocked.example")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			n := accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				if _, err := io.ReadFull(conn, make([]byte, len(hello))); err != nil {
+					return
+				}
+				// the censor kills the first connection
+				if n == 1 {
+					return
+				}
+				_, _ = conn.Write([]byte("server hello"))
+			}()
+		}
+	}()
+
+	var attempts []int
+	s := &Server{
+		Dialer:      &dialer.Dialer{},
+		ChunkConfig: ChunkConfig{BeforeSniLength: [2]int{1, 5}, AfterSniLength: [2]int{1, 5}, Retries: 2, RetryTimeout: time.Second},
+		Hooks:       &Hooks{Fragmented: func(e FragmentEvent) { attempts = append(attempts, e.Attempt) }},
+	}
+	upstream := ln.Addr().(*net.TCPAddr)
+	client, proxy := net.Pipe()
+	defer client.Close()
+	dest := statute.AddrSpec{IP: upstream.IP, Port: upstream.Port}
+	req := &socks5.Request{RawDestAddr: &dest, Reader: proxy}
+	req.DstAddr = dest
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Handle(context.Background(), proxy, req, "tcp")
+		proxy.Close()
+	}()
+
+	if _, err := io.ReadFull(client, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	answer := make([]byte, len("server hello"))
+	if _, err := io.ReadFull(client, answer); err != nil {
+		t.Fatalf("expected the retried hello to be answered: %v", err)
+	}
+	client.Close()
+	<-done
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("expected 2 connections, got %d", n)
+	}
+	if len(attempts) != 2 || attempts[1] != 1 {
+		t.Errorf("expected the hello split twice, got attempts %v", attempts)
+	}
+}
+
+// recordingTracer keeps the spans it started.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name  string
+	attrs map[string]interface{}
+	ended bool
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	span := &recordedSpan{name: name, attrs: make(map[string]interface{})}
+	for _, a := range attrs {
+		span.attrs[a.Key] = a.Value
+	}
+	t.spans = append(t.spans, span)
+	return ctx, &recordingSpan{t, span}
+}
+
+type recordingSpan struct {
+	t    *recordingTracer
+	span *recordedSpan
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Attribute) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	for _, a := range attrs {
+		s.span.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordingSpan) RecordError(error) {}
+
+func (s *recordingSpan) End() {
+	s.t.mu.Lock()
+	s.span.ended = true
+	s.t.mu.Unlock()
+}
+
+func TestHandleTraces(t *testing.T) {
+	upstream := startEchoServer(t)
+	tracer := &recordingTracer{}
+	s := &Server{Dialer: &dialer.Dialer{}, Tracer: tracer, ChunkConfig: ChunkConfig{BeforeSniLength: [2]int{1, 5}, AfterSniLength: [2]int{1, 5}}}
+
+	client, proxy := net.Pipe()
+	defer client.Close()
+	dest := statute.AddrSpec{IP: upstream.IP, Port: upstream.Port}
+	req := &socks5.Request{RawDestAddr: &dest, Reader: proxy}
+	req.DstAddr = dest
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Handle(context.Background(), proxy, req, "tcp")
+		proxy.Close()
+	}()
+
+	if _, err := io.ReadFull(client, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	hello := clientHello(t, "traced.example")
+	if _, err := client.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, len(hello))); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	<-done
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	var names []string
+	for _, span := range tracer.spans {
+		names = append(names, span.name)
+		if !span.ended {
+			t.Errorf("span %s was not ended", span.name)
+		}
+	}
+	if want := []string{"connection", "resolve", "dial", "handshake", "relay"}; !slices.Equal(names, want) {
+		t.Fatalf("got spans %v, want %v", names, want)
+	}
+	root := tracer.spans[0].attrs
+	if root["destination"] != dest.String() || root["route"] != "direct" || root["sni"] != "traced.example" || root["fragment.attempts"] != 1 {
+		t.Errorf("unexpected connection attributes %v", root)
+	}
+}
+
+func TestRateLimitPerDirection(t *testing.T) {
+	s := &Server{MaxBytesPerSecond: 1000, GlobalRateLimiter: utils.NewLimiter(5000)}
+	r, w := s.rateLimit(context.Background(), strings.NewReader(""), io.Discard)
+	upload, ok := r.(*utils.RateLimitedReader)
+	if !ok {
+		t.Fatalf("expected a rate limited reader, got %T", r)
+	}
+	download, ok := w.(*utils.RateLimitedWriter)
+	if !ok {
+		t.Fatalf("expected a rate limited writer, got %T", w)
+	}
+	if len(upload.Limiters) != 2 || len(download.Limiters) != 2 {
+		t.Fatalf("expected the per-connection and global limiters, got %d and %d", len(upload.Limiters), len(download.Limiters))
+	}
+	if upload.Limiters[0] == download.Limiters[0] {
+		t.Error("expected uploads and downloads to have their own per-connection budget")
+	}
+	if upload.Limiters[1] != s.GlobalRateLimiter || download.Limiters[1] != s.GlobalRateLimiter {
+		t.Error("expected both directions to share the global limiter")
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import "time"
+
+// Hooks are optional callbacks fired on server events, so embedders can
+// instrument the server without parsing its logs. They are called on the
+// goroutine handling the connection and must return quickly, anything slow
+// belongs on another goroutine. A nil Hooks or a nil func is skipped.
+type Hooks struct {
+	// ConnectionOpened is called once the destination of a connection is
+	// connected, directly or through the worker
+	ConnectionOpened func(ConnectionEvent)
+	// ConnectionClosed is called when an opened connection ends, with the
+	// bytes relayed and how long it lasted
+	ConnectionClosed func(ConnectionEvent)
+	// Resolved is called after every lookup of a destination
+	Resolved func(ResolveEvent)
+	// Fragmented is called after the first packet of a connection was sent
+	// split into chunks
+	Fragmented func(FragmentEvent)
+	// TunnelReconnect is called when a dropped UDP tunnel to the worker is
+	// connected again
+	TunnelReconnect func(endpoint string)
+}
+
+// ConnectionEvent describes a proxied TCP connection.
+type ConnectionEvent struct {
+	// Destination is the address requested by the client
+	Destination string
+	// Address is the resolved address connected to, empty through the worker
+	Address string
+	// Worker is set when the connection goes through the worker
+	Worker bool
+	// BytesSent and BytesReceived count the bytes relayed to and from upstream,
+	// they are only set on close
+	BytesSent     int64
+	BytesReceived int64
+	// Duration is how long the connection was open, only set on close
+	Duration time.Duration
+	// Err is why the connection ended, nil on a clean close
+	Err error
+}
+
+// ResolveEvent describes a lookup.
+type ResolveEvent struct {
+	Name     string
+	IP       string
+	Source   string
+	Duration time.Duration
+	Err      error
+}
+
+// FragmentEvent describes a first packet sent in chunks.
+type FragmentEvent struct {
+	Destination string
+	// Hostname is the SNI the packet was split around, empty if none was found
+	Hostname string
+	// Chunks is the number of writes the packet was sent in
+	Chunks int
+	// Attempt counts the retries of the packet on new connections, 0 for the
+	// first send
+	Attempt int
+}
+
+func (h *Hooks) connectionOpened(e ConnectionEvent) {
+	if h != nil && h.ConnectionOpened != nil {
+		h.ConnectionOpened(e)
+	}
+}
+
+func (h *Hooks) connectionClosed(e ConnectionEvent) {
+	if h != nil && h.ConnectionClosed != nil {
+		h.ConnectionClosed(e)
+	}
+}
+
+func (h *Hooks) resolved(e ResolveEvent) {
+	if h != nil && h.Resolved != nil {
+		h.Resolved(e)
+	}
+}
+
+func (h *Hooks) fragmented(e FragmentEvent) {
+	if h != nil && h.Fragmented != nil {
+		h.Fragmented(e)
+	}
+}
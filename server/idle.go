@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// errIdleTimeout ends a relay that carried no data for ConnectionIdleTimeout.
+var errIdleTimeout = errors.New("connection idle timeout")
+
+// idleTracker records when data last flowed through a relay, in either
+// direction. The copy loops report to it rather than the connections being
+// wrapped, so the sockets can still be spliced.
+type idleTracker struct {
+	// last is when data last flowed, in unix nanoseconds
+	last atomic.Int64
+}
+
+func newIdleTracker() *idleTracker {
+	t := &idleTracker{}
+	t.touch()
+	return t
+}
+
+// touch records that data flowed, a nil tracker ignores it.
+func (t *idleTracker) touch() {
+	if t != nil {
+		t.last.Store(time.Now().UnixNano())
+	}
+}
+
+// idleFor returns how long no data has flowed.
+func (t *idleTracker) idleFor() time.Duration {
+	return time.Since(time.Unix(0, t.last.Load()))
+}
+
+// idleReader touches idle on every read that returned data.
+type idleReader struct {
+	io.Reader
+	idle *idleTracker
+}
+
+// Read reads from the underlying reader.
+func (r idleReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.idle.touch()
+	}
+	return n, err
+}
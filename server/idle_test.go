@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayIdleTimeout(t *testing.T) {
+	s := &Server{ConnectionIdleTimeout: 50 * time.Millisecond}
+	client, clientPeer := net.Pipe()
+	upstream, upstreamPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer upstreamPeer.Close()
+	go func() { _, _ = io.Copy(io.Discard, clientPeer) }()
+
+	// upstream keeps talking for a while, then goes quiet
+	busy := 150 * time.Millisecond
+	go func() {
+		for end := time.Now().Add(busy); time.Now().Before(end); {
+			if _, err := upstreamPeer.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	begin := time.Now()
+	err := s.relay(client, upstream, client, &relayStats{})
+	if !errors.Is(err, errIdleTimeout) {
+		t.Fatalf("expected an idle timeout, got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed < busy {
+		t.Errorf("relay gave up after %v while data was still flowing", elapsed)
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"bepass/logger"
+	"bepass/resolve"
+	"bepass/socks5"
+	"bepass/socks5/statute"
+	"net"
+)
+
+// Rewrite changes the destination of the connections to the hostnames
+// Pattern matches, on Port or any port when 0, before they are routed and
+// dialed: the hostname becomes Host unless it is empty, an IP or a name, and
+// the port ToPort unless it is 0. A blocked API host can so be sent to a
+// mirror, or a destination forced to port 443.
+type Rewrite struct {
+	Pattern resolve.HostPattern
+	Port    int
+	Host    string
+	ToPort  int
+}
+
+// rewriteDestination applies the first of Rewrites matching the destination
+// of req.
+func (s *Server) rewriteDestination(req *socks5.Request) {
+	dst := req.RawDestAddr
+	host := dst.FQDN
+	if host == "" {
+		host = dst.IP.String()
+	}
+	for _, r := range s.Rewrites {
+		if (r.Port != 0 && r.Port != dst.Port) || !r.Pattern.Match(host) {
+			continue
+		}
+		from := dst.String()
+		if r.Host != "" {
+			if ip := net.ParseIP(r.Host); ip != nil {
+				dst.FQDN, dst.IP = "", ip
+				dst.AddrType = statute.ATYPIPv6
+				if ip.To4() != nil {
+					dst.AddrType = statute.ATYPIPv4
+				}
+			} else {
+				dst.FQDN, dst.IP = resolve.NormalizeHostname(r.Host), nil
+				dst.AddrType = statute.ATYPDomain
+			}
+		}
+		if r.ToPort != 0 {
+			dst.Port = r.ToPort
+		}
+		logger.Debugf("rewrote destination %s to %s", logger.Redact(from), logger.Redact(dst.String()))
+		return
+	}
+}
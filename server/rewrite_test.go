@@ -0,0 +1,50 @@
+package server
+
+import (
+	"bepass/resolve"
+	"bepass/socks5"
+	"bepass/socks5/statute"
+	"net"
+	"testing"
+)
+
+func TestRewriteDestination(t *testing.T) {
+	pattern := func(s string) resolve.HostPattern {
+		p, err := resolve.ParseHostPattern(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	s := &Server{Rewrites: []Rewrite{
+		{Pattern: pattern("api.blocked.test"), Host: "mirror.test"},
+		{Pattern: pattern("*.cdn.test"), Port: 80, ToPort: 443},
+		{Pattern: pattern("pinned.test"), Host: "192.0.2.7", ToPort: 8443},
+	}}
+	tests := []struct {
+		fqdn string
+		port int
+		want string
+	}{
+		{"api.blocked.test", 443, "mirror.test:443"},
+		{"v2.api.blocked.test", 8080, "mirror.test:8080"},
+		{"img.cdn.test", 80, "img.cdn.test:443"},
+		{"img.cdn.test", 8080, "img.cdn.test:8080"},
+		{"pinned.test", 443, "192.0.2.7:8443"},
+		{"other.test", 443, "other.test:443"},
+	}
+	for _, tt := range tests {
+		req := &socks5.Request{RawDestAddr: &statute.AddrSpec{FQDN: tt.fqdn, Port: tt.port, AddrType: statute.ATYPDomain}}
+		s.rewriteDestination(req)
+		if got := req.RawDestAddr.String(); got != tt.want {
+			t.Errorf("%s:%d rewritten to %s, want %s", tt.fqdn, tt.port, got, tt.want)
+		}
+	}
+
+	req := &socks5.Request{RawDestAddr: &statute.AddrSpec{IP: net.ParseIP("192.0.2.1"), Port: 80, AddrType: statute.ATYPIPv4}}
+	s.Rewrites = []Rewrite{{Pattern: pattern("192.0.2.1"), Host: "site.test"}}
+	s.rewriteDestination(req)
+	if got := req.RawDestAddr.String(); got != "site.test:80" || req.RawDestAddr.AddrType != statute.ATYPDomain {
+		t.Errorf("expected an IP destination to be rewritten to a name, got %s", got)
+	}
+}
@@ -1,15 +1,20 @@
 package server
 
 import (
+	"bepass/bufferpool"
 	"bepass/dialer"
 	"bepass/doh"
+	"bepass/endpoint"
 	"bepass/logger"
+	"bepass/proxyproto"
 	"bepass/resolve"
+	"bepass/route"
 	"bepass/sni"
 	"bepass/socks5"
 	"bepass/socks5/statute"
 	"bepass/transport"
 	"bepass/utils"
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
@@ -19,6 +24,8 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ameshkov/dnscrypt/v2"
@@ -31,20 +38,42 @@ type ChunkConfig struct {
 	TLSHeaderLength int
 	BeforeSniLength [2]int
 	AfterSniLength  [2]int
-	Delay           [2]int
+	// Delay is the range the pause after each chunk is drawn from, uniformly
+	// and both ends included
+	Delay [2]time.Duration
+	// Mode selects the connections whose first packet is split, FragmentAuto if empty
+	Mode FragmentMode
+	// Retries is the number of times a split ClientHello the server resets or
+	// leaves unanswered is sent again on a new connection, split anew with
+	// lengths and delays drawn again from their ranges
+	Retries int
+	// RetryTimeout is how long the answer to a split ClientHello is waited
+	// for before retrying, defaultRetryTimeout if 0
+	RetryTimeout time.Duration
 }
 
+// defaultRetryTimeout is the RetryTimeout used when it is not set.
+const defaultRetryTimeout = 5 * time.Second
+
 // WorkerConfig Constants for cloudflare worker.
 type WorkerConfig struct {
 	WorkerAddress       string
 	WorkerIPPortAddress string
 	WorkerEnabled       bool
 	WorkerDNSOnly       bool
+	// ProxyProtocolVersion emits a PROXY protocol header (1 or 2) on connections to the worker, 0 disables it
+	ProxyProtocolVersion int
+	// Endpoints are all worker addresses in use, including the ones from subscriptions
+	Endpoints *endpoint.Pool
+	// WorkerIPs are the clean IPs used to reach the workers, WorkerIPPortAddress is used if empty
+	WorkerIPs *endpoint.Pool
+	// WorkerIPStrategy is how the connections are spread over WorkerIPs, round-robin if empty
+	WorkerIPStrategy endpoint.Strategy
 }
 
 type Server struct {
 	RemoteDNSAddr         string
-	Cache                 *utils.Cache
+	Cache                 utils.CacheStore
 	ResolveSystem         string
 	DoHClient             *doh.Client
 	ChunkConfig           ChunkConfig
@@ -54,6 +83,61 @@ type Server struct {
 	EnableLowLevelSockets bool
 	LocalResolver         *resolve.LocalResolver
 	Transport             *transport.Transport
+	// MaxBytesPerSecond caps the throughput of a single proxied connection in each direction, 0 means unlimited
+	MaxBytesPerSecond int
+	// GlobalRateLimiter is shared by every connection and both directions to cap the total throughput, nil means unlimited
+	GlobalRateLimiter *utils.Limiter
+	// EnableSplice relays data between two plain TCP sockets with splice(2) on
+	// linux, the client side once the buffer its request was read through is
+	// drained. The rate limits and the pcap capture hide the sockets, the relay
+	// copies through a buffer then
+	EnableSplice bool
+	// BufferPool provides the buffers used by the relay copy loops
+	BufferPool bufferpool.BufPool
+	// DNSTTL clamps the TTL of resolved answers before they are cached
+	DNSTTL TTLBounds
+	// QueryLog records every lookup when set, nil disables it
+	QueryLog *resolve.QueryLog
+	// DisableIPv6 never looks up AAAA records
+	DisableIPv6 bool
+	// PreferIPv6 looks up AAAA records first and falls back to A records
+	PreferIPv6 bool
+	// Hooks are called on connection and lookup events, nil disables them
+	Hooks *Hooks
+	// Tracer, if set, records a span per connection with children for the
+	// resolve, dial, handshake and relay stages
+	Tracer Tracer
+	// ConnectionIdleTimeout closes a proxied TCP connection once no data has
+	// flowed in either direction for that long, 0 never does
+	ConnectionIdleTimeout time.Duration
+	// Routes, if set, sends the hostnames it routes direct around the worker,
+	// the others go through it
+	Routes *route.Table
+	// RefuseANY answers the ANY queries of Exchange with the HINFO record of
+	// RFC 8482 instead of forwarding them
+	RefuseANY bool
+	// WorkerOffline, if set, reports whether the worker is not reachable
+	// yet, the connections it would carry then go direct
+	WorkerOffline func() bool
+	// WorkerOnly carries every connection but the ones to the worker itself
+	// through the worker, whatever Routes say and even while the worker is
+	// offline, for ParanoidMode
+	WorkerOnly bool
+	// StickyIPs, if set, has the direct connections to a hostname resolving
+	// to several IPs stick to the one a handshake last worked with
+	StickyIPs *resolve.StickyIPs
+	// Rewrites change the destinations of the connections before they are
+	// routed, the first matching one applies
+	Rewrites []Rewrite
+	// PlainDNSFallback, if set, is the plain DNS server, as host:port, the
+	// queries of Exchange are sent to over TCP when the remote DNS server
+	// fails
+	PlainDNSFallback string
+	// SplitPlainDNS writes the queries to PlainDNSFallback in writes of the
+	// ChunkConfig lengths, the queried name apart, as a ClientHello is split
+	SplitPlainDNS bool
+
+	timings timingCounters
 }
 
 // extractHostnameOrChangeHTTPHostHeader This function extracts the tls sni or http
@@ -89,13 +173,18 @@ func (s *Server) getChunkedPackets(data []byte, host []byte) map[int][]byte {
 	return chunks
 }
 
-func (s *Server) sendSplitChunks(dst io.Writer, chunks map[int][]byte) {
+// sendSplitChunks writes chunks to dst split in writes of the configured
+// lengths and reports how many writes it took.
+func (s *Server) sendSplitChunks(dst io.Writer, chunks map[int][]byte) int {
 	chunkLengthMin, chunkLengthMax := s.ChunkConfig.BeforeSniLength[0], s.ChunkConfig.BeforeSniLength[1]
 	if len(chunks) > 1 {
 		chunkLengthMin, chunkLengthMax = s.ChunkConfig.AfterSniLength[0], s.ChunkConfig.AfterSniLength[1]
 	}
 
-	for _, chunk := range chunks {
+	writes := 0
+	// chunks is keyed by position, ranging over the map would send them out of order
+	for i := 0; i < len(chunks); i++ {
+		chunk := chunks[i]
 		position := 0
 
 		for position < len(chunk) {
@@ -106,35 +195,106 @@ func (s *Server) sendSplitChunks(dst io.Writer, chunks map[int][]byte) {
 				chunkLength = chunkLengthMin
 			}
 
-			if chunkLength > len(chunk)-position {
+			if chunkLength <= 0 || chunkLength > len(chunk)-position {
 				chunkLength = len(chunk) - position
 			}
 
-			var delay int
-			if s.ChunkConfig.Delay[1]-s.ChunkConfig.Delay[0] > 0 {
-				delay = rand.Intn(s.ChunkConfig.Delay[1]-s.ChunkConfig.Delay[0]) + s.ChunkConfig.Delay[0]
-			} else {
-				delay = s.ChunkConfig.Delay[0]
-			}
+			delay := chunkDelay(s.ChunkConfig.Delay)
 
 			_, errWrite := dst.Write(chunk[position : position+chunkLength])
 			if errWrite != nil {
-				return
+				return writes
 			}
+			writes++
 
 			position += chunkLength
-			time.Sleep(time.Duration(delay) * time.Millisecond)
+			preciseSleep(delay)
 		}
 	}
+	return writes
 }
 
 // Handle handles the SOCKS5 request and forwards traffic to the destination.
-func (s *Server) Handle(ctx context.Context, w io.Writer, req *socks5.Request, network string) error {
+// Resolving, dialing and relaying are all abandoned once ctx is done.
+func (s *Server) Handle(ctx context.Context, w io.Writer, req *socks5.Request, network string) (retErr error) {
 	if s.WorkerConfig.WorkerEnabled && !s.WorkerConfig.WorkerDNSOnly && network == "udp" {
-		return s.Transport.TunnelUDP(w, req)
+		return s.Transport.TunnelUDP(ctx, w, req)
+	}
+
+	// clients may send mixed case, a trailing dot or unicode labels, none of
+	// which should defeat the hosts rules or the cache
+	if req.RawDestAddr.FQDN != "" {
+		req.RawDestAddr.FQDN = resolve.NormalizeHostname(req.RawDestAddr.FQDN)
+	}
+	if network == "tcp" {
+		s.rewriteDestination(req)
+	}
+
+	req.Reader, w = s.rateLimit(ctx, req.Reader, w)
+
+	via := route.Direct
+	if s.worker(req) {
+		via = route.Worker
+	}
+	ctx, span := s.startSpan(ctx, "connection",
+		Attribute{Key: "destination", Value: req.RawDestAddr.String()},
+		Attribute{Key: "route", Value: string(via)})
+	defer func() { endSpan(span, retErr) }()
+
+	var timing Timing
+	var stats relayStats
+	var connectedAt, helloSentAt time.Time
+	opened := ConnectionEvent{Destination: req.RawDestAddr.String()}
+	defer func() {
+		if !connectedAt.IsZero() {
+			closed := opened
+			closed.BytesSent = stats.sent.Load()
+			closed.BytesReceived = stats.received.Load()
+			closed.Duration = time.Since(connectedAt)
+			closed.Err = retErr
+			s.Hooks.connectionClosed(closed)
+		}
+		if at := stats.firstByteAt.Load(); at != 0 {
+			timing.FirstByte = time.Unix(0, at).Sub(connectedAt)
+			if !helloSentAt.IsZero() {
+				timing.TLSHandshake = time.Unix(0, at).Sub(helloSentAt)
+			}
+		}
+		s.timings.add(timing)
+		logger.Debugf("%s timing %s", req.RawDestAddr, timing)
+	}()
+
+	begin := time.Now()
+	addrs, err := s.resolveDestination(ctx, req)
+	timing.Resolve = time.Since(begin)
+	if err != nil {
+		if err := socks5.SendReply(w, statute.RepHostUnreachable, nil); err != nil {
+			logger.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("resolve %s failed after %v, %w", req.RawDestAddr, timing.Resolve, err)
 	}
+	IPPort := addrs[0]
 
-	if err := socks5.SendReply(w, statute.RepSuccess, nil); err != nil {
+	// The reply carries the address the upstream connection is bound to, so
+	// it is sent once connected. A dpi ip is not worth connecting to, the
+	// destination is resolved again from the hostname in the first packet,
+	// which the client only sends after the reply.
+	var conn net.Conn
+	dpi := strings.Contains(IPPort, "10.10.3")
+	if !dpi {
+		conn, IPPort, err = s.connect(ctx, w, req, addrs, &timing)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+	}
+	// through the worker the upstream connection is the worker's, the address
+	// the client reached bepass on is the closest there is
+	bindAddr := req.LocalAddr
+	if conn != nil && !s.worker(req) {
+		bindAddr = conn.LocalAddr()
+	}
+	if err := socks5.SendReply(w, statute.RepSuccess, bindAddr); err != nil {
 		logger.Errorf("failed to send reply: %v", err)
 		return err
 	}
@@ -148,40 +308,52 @@ func (s *Server) Handle(ctx context.Context, w io.Writer, req *socks5.Request, n
 	hostname, firstPacketData, isHTTP, err := s.extractHostnameOrChangeHTTPHostHeader(firstPacket[:read])
 
 	if hostname != nil {
-		logger.Infof("Hostname %s", string(hostname))
+		logger.Infof("Hostname %s", logger.Redact(string(hostname)))
 	}
 
-	IPPort, err := s.resolveDestination(ctx, req)
-	if err != nil {
-		return err
-	}
-
-	// if user has a faulty dns, and it returns dpi ip,
-	// we resolve destination based on extracted tls sni or http hostname
-	if hostname != nil && strings.Contains(IPPort, "10.10.3") {
-		logger.Infof("%s is dpi ip extracting destination host from packets...", IPPort)
-		req.RawDestAddr.FQDN = string(hostname)
-		IPPort, err = s.resolveDestination(ctx, req)
+	if dpi {
+		// if user has a faulty dns, and it returns dpi ip,
+		// we resolve destination based on extracted tls sni or http hostname
+		if hostname == nil {
+			return fmt.Errorf("%s is dpi ip and the first packet carries no hostname", IPPort)
+		}
+		logger.Infof("%s is dpi ip extracting destination host from packets...", logger.Redact(IPPort))
+		req.RawDestAddr.FQDN = resolve.NormalizeHostname(string(hostname))
+		addrs, err = s.resolveDestination(ctx, req)
+		timing.Resolve = time.Since(begin)
 		if err != nil {
 			// if destination resolved to dpi and we cant resolve to actual destination
 			// it's pointless to connect to dpi
 			logger.Infof("system was unable to extract destination host from packets!")
+			return fmt.Errorf("resolve %s failed after %v, %w", req.RawDestAddr, timing.Resolve, err)
+		}
+		// the reply is already sent, a failure can only close the connection
+		conn, IPPort, err = s.connect(ctx, io.Discard, req, addrs, &timing)
+		if err != nil {
 			return err
 		}
+		defer conn.Close()
 	}
+	// unblock the relay when the connection or the server goes away
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
 
-	if s.WorkerConfig.WorkerEnabled &&
-		!s.WorkerConfig.WorkerDNSOnly &&
-		(!strings.Contains(s.WorkerConfig.WorkerAddress, req.DstAddr.FQDN) || strings.TrimSpace(req.DstAddr.FQDN) == "") {
+	connectedAt = time.Now()
+	if s.worker(req) {
+		opened.Worker = true
+		s.Hooks.connectionOpened(opened)
 		req.Reader = &utils.BufferedReader{
 			FirstPacketData: firstPacketData,
 			BufReader:       req.Reader,
 			FirstTime:       true,
 		}
-		return s.Transport.TunnelTCP(w, req)
+		return s.tracedRelay(ctx, req.Reader, conn, w, &stats)
 	}
+	opened.Address = IPPort
+	s.Hooks.connectionOpened(opened)
 
 	firstPacketChunks := make(map[int][]byte)
+	fragment := s.ChunkConfig.shouldFragment(firstPacketData)
 
 	if isHTTP || err != nil || hostname == nil {
 		firstPacketChunks[0] = firstPacketData
@@ -189,86 +361,590 @@ func (s *Server) Handle(ctx context.Context, w io.Writer, req *socks5.Request, n
 		firstPacketChunks = s.getChunkedPackets(firstPacketData, hostname)
 	}
 
-	logger.Infof("Dialing %s...", IPPort)
+	// writing first packet
+	isHello := hostname != nil && !isHTTP
+	span.SetAttributes(Attribute{Key: "sni", Value: string(hostname)}, Attribute{Key: "fragment", Value: fragment})
+	if isHello {
+		// the handshake ends with the first byte from upstream
+		_, handshake := s.startSpan(ctx, "handshake")
+		var once sync.Once
+		endHandshake := func() { once.Do(handshake.End) }
+		stats.firstByte = func() {
+			endHandshake()
+			s.handshakeDone(req, IPPort, true)
+		}
+		defer endHandshake()
+		defer func() {
+			if stats.firstByteAt.Load() == 0 {
+				s.handshakeDone(req, IPPort, false)
+			}
+		}()
+	}
+	if fragment {
+		retries := 0
+		if isHello {
+			retries = s.ChunkConfig.Retries
+		}
+		for attempt := 0; ; attempt++ {
+			if isHello {
+				helloSentAt = time.Now()
+			}
+			writes := s.sendSplitChunks(conn, firstPacketChunks)
+			s.Hooks.fragmented(FragmentEvent{Destination: opened.Destination, Hostname: string(hostname), Chunks: writes, Attempt: attempt})
+			span.SetAttributes(
+				Attribute{Key: "fragment.mode", Value: string(s.ChunkConfig.Mode)},
+				Attribute{Key: "fragment.chunks", Value: writes},
+				Attribute{Key: "fragment.attempts", Value: attempt + 1})
+			// the last attempt is left to the relay
+			if attempt >= retries {
+				break
+			}
+			answered, err := s.awaitAnswer(conn, w, &stats)
+			if err != nil {
+				return err
+			}
+			if answered {
+				break
+			}
+			logger.Infof("no answer to the split ClientHello from %s, retrying with a new split", logger.Redact(IPPort))
+			_ = conn.Close()
+			// the next IPs of the destination, if it has any, are tried first
+			s.handshakeDone(req, IPPort, false)
+			if conn, IPPort, err = s.connect(ctx, io.Discard, req, nextFirst(addrs, IPPort), &timing); err != nil {
+				return err
+			}
+			defer conn.Close()
+		}
+	} else {
+		if isHello {
+			helloSentAt = time.Now()
+		}
+		if _, err := conn.Write(firstPacketData); err != nil {
+			return err
+		}
+	}
+	stats.sent.Add(int64(len(firstPacketData)))
 
-	conn, err := s.Dialer.TCPDial("tcp", "", IPPort)
+	return s.tracedRelay(ctx, req.Reader, conn, w, &stats)
+}
+
+// worker reports whether req is carried through the worker, the hostnames
+// routed direct by Routes are not, nor anything while the worker is offline.
+func (s *Server) worker(req *socks5.Request) bool {
+	via, _ := s.route(strings.TrimSpace(req.DstAddr.FQDN), destinationHost(req))
+	return via == route.Worker
+}
+
+// RouteFor returns the route the TCP connections to host would take and why,
+// without connecting anywhere, so the routing rules can be checked. host is
+// taken as it is routed, after DestinationRewrites.
+func (s *Server) RouteFor(host string) (route.Action, string) {
+	host = resolve.NormalizeHostname(strings.TrimSpace(host))
+	return s.route(host, host)
+}
+
+// route returns the route of the connections to host, asked for as fqdn, and
+// why.
+func (s *Server) route(fqdn, host string) (route.Action, string) {
+	switch {
+	case !s.WorkerConfig.WorkerEnabled:
+		return route.Direct, "worker disabled"
+	case s.WorkerConfig.WorkerDNSOnly:
+		return route.Direct, "worker only resolves DNS"
+	case s.isWorkerHost(fqdn):
+		return route.Direct, "worker host"
+	}
+	if s.WorkerOnly {
+		return route.Worker, "paranoid mode"
+	}
+	via, reason := s.Routes.Explain(host)
+	if via == route.Direct {
+		return route.Direct, reason
+	}
+	if s.WorkerOffline != nil && s.WorkerOffline() {
+		return route.Direct, "worker offline"
+	}
+	if reason == "" {
+		reason = "worker enabled"
+	}
+	return route.Worker, reason
+}
+
+// handshakeDone records with StickyIPs whether the direct handshake with the
+// hostname of req at IPPort worked, so the next connections try a failed IP
+// last.
+func (s *Server) handshakeDone(req *socks5.Request, IPPort string, ok bool) {
+	fqdn := req.RawDestAddr.FQDN
+	if s.StickyIPs == nil || fqdn == "" || s.worker(req) {
+		return
+	}
+	ip, _, err := net.SplitHostPort(IPPort)
 	if err != nil {
-		return err
+		return
+	}
+	if ok {
+		s.StickyIPs.Succeeded(fqdn, ip)
+		return
+	}
+	s.StickyIPs.Failed(fqdn, ip)
+}
+
+// nextFirst returns addrs starting after failed, which goes last.
+func nextFirst(addrs []string, failed string) []string {
+	for i, addr := range addrs {
+		if addr == failed {
+			return append(append([]string{}, addrs[i+1:]...), addrs[:i+1]...)
+		}
+	}
+	return addrs
+}
+
+// destinationHost returns the hostname req asked for, its IP if it has none.
+func destinationHost(req *socks5.Request) string {
+	if req.RawDestAddr.FQDN != "" {
+		return req.RawDestAddr.FQDN
+	}
+	if req.RawDestAddr.IP != nil {
+		return req.RawDestAddr.IP.String()
+	}
+	return ""
+}
+
+// connect opens the upstream connection of req, a tunnel through the worker
+// or a TCP connection to the first of addrs, the addresses of the
+// destination, to accept, and returns the address connected to. Failures are
+// replied to the client on w.
+func (s *Server) connect(ctx context.Context, w io.Writer, req *socks5.Request, addrs []string, timing *Timing) (net.Conn, string, error) {
+	ctx, span := s.startSpan(ctx, "dial")
+	conn, err := s.dial(ctx, w, req, addrs, timing)
+	if err != nil {
+		endSpan(span, err)
+		for _, addr := range addrs {
+			s.handshakeDone(req, addr, false)
+		}
+		return nil, "", err
+	}
+	IPPort := addrs[0]
+	if !s.worker(req) {
+		IPPort = conn.RemoteAddr().String()
+	}
+	span.SetAttributes(Attribute{Key: "address", Value: IPPort})
+	endSpan(span, nil)
+	return conn, IPPort, nil
+}
+
+// dial is connect without the span.
+func (s *Server) dial(ctx context.Context, w io.Writer, req *socks5.Request, addrs []string, timing *Timing) (net.Conn, error) {
+	if s.worker(req) {
+		begin := time.Now()
+		// the transport replies to the client itself on failure
+		conn, err := s.Transport.DialTCP(ctx, w, req)
+		timing.Connect = time.Since(begin)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel to %s failed after %v, %w", req.RawDestAddr, timing.Connect, err)
+		}
+		return conn, nil
+	}
+
+	logger.Infof("Dialing %s...", logger.Redact(addrs[0]))
+
+	begin := time.Now()
+	conn, err := s.Dialer.TCPDialAddrs(ctx, "tcp", destinationHost(req), addrs)
+	timing.Connect = time.Since(begin)
+	if err != nil {
+		s.workerIPDone(req, addrs[0], 0)
+		if err := socks5.SendReply(w, socks5.ReplyCode(err), nil); err != nil {
+			logger.Errorf("failed to send reply: %v", err)
+		}
+		return nil, fmt.Errorf("connect to %s failed after %v, %w", addrs[0], timing.Connect, err)
 	}
-	defer conn.Close()
+	s.workerIPDone(req, conn.RemoteAddr().String(), timing.Connect)
 
 	if err := conn.SetNoDelay(true); err != nil {
+		_ = conn.Close()
 		logger.Errorf("failed to set NODELAY option: %v", err)
-		return err
+		return nil, err
 	}
 
-	// writing first packet
-	s.sendSplitChunks(conn, firstPacketChunks)
+	if s.WorkerConfig.ProxyProtocolVersion != 0 && s.isWorkerHost(req.RawDestAddr.FQDN) {
+		err := proxyproto.WriteHeader(conn, s.WorkerConfig.ProxyProtocolVersion, req.RemoteAddr, conn.RemoteAddr())
+		if err != nil {
+			_ = conn.Close()
+			logger.Errorf("failed to write proxy protocol header: %v", err)
+			return nil, err
+		}
+	}
+	return s.Dialer.Capture.Tap(conn), nil
+}
 
-	// Start proxying
+// relayStats is filled in by relay while the connection is open.
+type relayStats struct {
+	// firstByteAt is when the first upstream byte arrived, in unix nanoseconds
+	firstByteAt atomic.Int64
+	sent        atomic.Int64
+	received    atomic.Int64
+	// firstByte, if set, is called once the first upstream byte arrived
+	firstByte func()
+}
+
+// setFirstByte records that the first upstream byte arrived, unless it
+// already did.
+func (r *relayStats) setFirstByte() {
+	if r.firstByteAt.CompareAndSwap(0, time.Now().UnixNano()) && r.firstByte != nil {
+		r.firstByte()
+	}
+}
+
+// tracedRelay is relay recorded as a "relay" span.
+func (s *Server) tracedRelay(ctx context.Context, client io.Reader, upstream net.Conn, w io.Writer, stats *relayStats) error {
+	_, span := s.startSpan(ctx, "relay")
+	err := s.relay(client, upstream, w, stats)
+	span.SetAttributes(
+		Attribute{Key: "bytes.sent", Value: int(stats.sent.Load())},
+		Attribute{Key: "bytes.received", Value: int(stats.received.Load())})
+	endSpan(span, err)
+	return err
+}
+
+// relay copies data between the client and upstream until both directions are
+// done or one fails, or until nothing flowed for ConnectionIdleTimeout.
+func (s *Server) relay(client io.Reader, upstream net.Conn, w io.Writer, stats *relayStats) error {
+	var idle *idleTracker
+	var idleTimer *time.Timer
+	var idleC <-chan time.Time
+	if s.ConnectionIdleTimeout > 0 {
+		idle = newIdleTracker()
+		idleTimer = time.NewTimer(s.ConnectionIdleTimeout)
+		defer idleTimer.Stop()
+		idleC = idleTimer.C
+	}
 	errCh := make(chan error, 2)
-	go func() { errCh <- s.Copy(req.Reader, conn) }()
-	go func() { errCh <- s.Copy(conn, w) }()
+	go func() {
+		n, err := s.copyCount(client, upstream, idle)
+		stats.sent.Add(n)
+		errCh <- err
+	}()
+	go func() {
+		// the first read is done by hand so the rest of the copy can still use splice
+		buf := s.getBuffer()
+		n, err := upstream.Read(buf)
+		// awaitAnswer may have seen the first byte already
+		stats.setFirstByte()
+		var werr error
+		if n > 0 {
+			idle.touch()
+			var m int
+			m, werr = w.Write(buf[:n])
+			stats.received.Add(int64(m))
+		}
+		s.putBuffer(buf)
+		if werr != nil {
+			errCh <- werr
+			return
+		}
+		if err != nil {
+			if err == io.EOF {
+				if cw, ok := w.(closeWriter); ok {
+					_ = cw.CloseWrite()
+				}
+				err = nil
+			}
+			errCh <- err
+			return
+		}
+		copied, err := s.copyCount(upstream, w, idle)
+		stats.received.Add(copied)
+		errCh <- err
+	}()
 	// Wait
-	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			// return from this function closes target (and conn).
-			return e
+	for done := 0; done < 2; {
+		select {
+		case e := <-errCh:
+			if e != nil {
+				// return from this function closes target (and conn).
+				return e
+			}
+			done++
+		case <-idleC:
+			// data flowed meanwhile, check again when it would be idle for long enough
+			left := s.ConnectionIdleTimeout - idle.idleFor()
+			if left <= 0 {
+				return errIdleTimeout
+			}
+			idleTimer.Reset(left)
 		}
 	}
 	return nil
 }
 
-func (s *Server) Copy(reader io.Reader, writer io.Writer) error {
-	buf := make([]byte, 32*1024)
+// awaitAnswer waits up to RetryTimeout for the first bytes from upstream and
+// writes them to w. It reports false if the server reset the connection or
+// stayed silent, the split was likely caught.
+func (s *Server) awaitAnswer(upstream net.Conn, w io.Writer, stats *relayStats) (bool, error) {
+	timeout := s.ChunkConfig.RetryTimeout
+	if timeout <= 0 {
+		timeout = defaultRetryTimeout
+	}
+	if err := upstream.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return false, err
+	}
+	buf := s.getBuffer()
+	defer s.putBuffer(buf)
+	n, _ := upstream.Read(buf)
+	if n == 0 {
+		return false, nil
+	}
+	stats.setFirstByte()
+	if err := upstream.SetReadDeadline(time.Time{}); err != nil {
+		return false, err
+	}
+	m, err := w.Write(buf[:n])
+	stats.received.Add(int64(m))
+	return true, err
+}
+
+// Timings returns the stage timings summed over all handled connections.
+func (s *Server) Timings() TimingStats {
+	return s.timings.snapshot()
+}
+
+// rateLimit wraps the client side of a connection with the per-connection and global throughput limits.
+// Uploads and downloads get a per-connection limiter each, so a busy download
+// does not eat into the upload budget, while the global limiter covers both.
+func (s *Server) rateLimit(ctx context.Context, r io.Reader, w io.Writer) (io.Reader, io.Writer) {
+	return utils.NewRateLimitedReader(ctx, r, utils.NewLimiter(s.MaxBytesPerSecond), s.GlobalRateLimiter),
+		utils.NewRateLimitedWriter(ctx, w, utils.NewLimiter(s.MaxBytesPerSecond), s.GlobalRateLimiter)
+}
 
-	_, err := io.CopyBuffer(writer, reader, buf[:cap(buf)])
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Copy copies data from reader to writer. Once reader is drained the writer is
+// half-closed, so the peer sees EOF while the other direction keeps flowing.
+func (s *Server) Copy(reader io.Reader, writer io.Writer) error {
+	_, err := s.copyCount(reader, writer, nil)
 	return err
 }
 
-func (s *Server) resolveDestination(ctx context.Context, req *socks5.Request) (string, error) {
+// copyCount is Copy reporting the number of bytes copied, and to idle, if not
+// nil, when data flows.
+func (s *Server) copyCount(reader io.Reader, writer io.Writer, idle *idleTracker) (int64, error) {
+	var buffered int64
+	if s.EnableSplice {
+		dst, dstOk := writer.(*net.TCPConn)
+		if bc, ok := reader.(*socks5.BufferedConn); ok && dstOk {
+			// the client side, spliced from its connection once its buffer is drained
+			if conn, ok := bc.Conn.(*net.TCPConn); ok {
+				n, err := drainBuffered(bc.Reader, dst)
+				if n > 0 {
+					idle.touch()
+				}
+				if err != nil {
+					return n, err
+				}
+				buffered, reader = n, conn
+			}
+		}
+		if src, srcOk := reader.(*net.TCPConn); srcOk && dstOk {
+			if n, handled, err := splice(dst, src, idle.touch); handled {
+				if err != nil {
+					return buffered + n, err
+				}
+				_ = dst.CloseWrite()
+				return buffered + n, nil
+			}
+		}
+	}
+
+	buf := s.getBuffer()
+	defer s.putBuffer(buf)
+
+	if idle != nil {
+		reader = idleReader{Reader: reader, idle: idle}
+	}
+	n, err := io.CopyBuffer(writer, reader, buf)
+	n += buffered
+	if err != nil {
+		return n, err
+	}
+	if cw, ok := writer.(closeWriter); ok {
+		_ = cw.CloseWrite()
+	}
+	return n, nil
+}
+
+// drainBuffered writes what r holds in its buffer to w, without reading any
+// more, so the connection r reads can be read directly after it.
+func drainBuffered(r *bufio.Reader, w io.Writer) (int64, error) {
+	b, _ := r.Peek(r.Buffered())
+	n, err := w.Write(b)
+	_, _ = r.Discard(n)
+	return int64(n), err
+}
+
+// getBuffer returns a relay buffer, taken from the pool when there is one.
+func (s *Server) getBuffer() []byte {
+	if s.BufferPool == nil {
+		return make([]byte, 32*1024)
+	}
+	buf := s.BufferPool.Get()
+	return buf[:cap(buf)]
+}
+
+func (s *Server) putBuffer(buf []byte) {
+	if s.BufferPool != nil {
+		s.BufferPool.Put(buf)
+	}
+}
+
+// isWorkerHost reports whether fqdn is the host of one of the configured workers.
+func (s *Server) isWorkerHost(fqdn string) bool {
+	if !s.WorkerConfig.WorkerEnabled || fqdn == "" {
+		return false
+	}
+	if strings.Contains(s.WorkerConfig.WorkerAddress, fqdn) {
+		return true
+	}
+	for _, addr := range s.WorkerConfig.Endpoints.Items() {
+		if strings.Contains(addr, fqdn) {
+			return true
+		}
+	}
+	return false
+}
+
+// workerIP returns the clean IP used to reach the workers for fqdn.
+func (s *Server) workerIP(fqdn string) (string, error) {
+	addr, ok := s.WorkerConfig.WorkerIPs.Pick(s.WorkerConfig.WorkerIPStrategy, fqdn)
+	if !ok {
+		addr = s.WorkerConfig.WorkerIPPortAddress
+	}
+	if net.ParseIP(addr) != nil {
+		return addr, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return host, nil
+}
+
+// workerIPDone records with WorkerIPs how long connecting to the worker on
+// IPPort took, 0 if it failed, for the weighted and lowest-latency strategies
+// to prefer the faster clean IPs.
+func (s *Server) workerIPDone(req *socks5.Request, IPPort string, connect time.Duration) {
+	if !s.isWorkerHost(req.RawDestAddr.FQDN) {
+		return
+	}
+	ip, _, err := net.SplitHostPort(IPPort)
+	if err != nil {
+		return
+	}
+	for _, item := range s.WorkerConfig.WorkerIPs.Items() {
+		host, _, err := net.SplitHostPort(item)
+		if err != nil {
+			host = item
+		}
+		if host == ip {
+			s.WorkerConfig.WorkerIPs.SetRTT(item, connect)
+			return
+		}
+	}
+}
+
+// resolveDestination returns the addresses to connect to for req, in the
+// order to try them, recorded as a "resolve" span.
+func (s *Server) resolveDestination(ctx context.Context, req *socks5.Request) ([]string, error) {
+	ctx, span := s.startSpan(ctx, "resolve")
+	addrs, err := s.lookupDestination(ctx, req)
+	if err == nil {
+		span.SetAttributes(Attribute{Key: "address", Value: addrs[0]})
+	}
+	endSpan(span, err)
+	return addrs, err
+}
+
+func (s *Server) lookupDestination(ctx context.Context, req *socks5.Request) ([]string, error) {
 	dest := req.RawDestAddr
+	port := strconv.Itoa(dest.Port)
 
 	if dest.FQDN != "" {
-		ip, err := s.Resolve(dest.FQDN)
+		ips, err := s.resolveIPs(ctx, dest.FQDN)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		dest.IP = net.ParseIP(ip)
-		logger.Infof("resolved %s to %s", req.RawDestAddr, dest)
-	} else {
-		logger.Infof("skipping resolution for %s", req.RawDestAddr)
+		dest.IP = net.ParseIP(ips[0])
+		logger.Infof("resolved %s to %s", logger.Redact(req.RawDestAddr), logger.Redact(dest))
+		addrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(net.ParseIP(ip).String(), port))
+		}
+		return addrs, nil
 	}
-
-	addr := net.JoinHostPort(dest.IP.String(), strconv.Itoa(dest.Port))
-	return addr, nil
+	logger.Infof("skipping resolution for %s", logger.Redact(req.RawDestAddr))
+	return []string{net.JoinHostPort(dest.IP.String(), port)}, nil
 }
 
 // Resolve resolves the FQDN to an IP address using the specified resolution mechanism.
 func (s *Server) Resolve(fqdn string) (string, error) {
-	if s.WorkerConfig.WorkerEnabled &&
-		strings.Contains(s.WorkerConfig.WorkerAddress, fqdn) {
-		dh, _, err := net.SplitHostPort(s.WorkerConfig.WorkerIPPortAddress)
-		if strings.Contains(dh, ":") {
-			// its ipv6
-			dh = "[" + dh + "]"
-		}
+	return s.ResolveContext(context.Background(), fqdn)
+}
+
+// ResolveContext is like Resolve but gives up once ctx is done.
+func (s *Server) ResolveContext(ctx context.Context, fqdn string) (string, error) {
+	ips, err := s.resolveIPs(ctx, fqdn)
+	if err != nil {
+		return "", err
+	}
+	return ips[0], nil
+}
+
+// resolveIPs returns the IPs of fqdn in the order to try them, the one
+// ResolveContext returns first.
+func (s *Server) resolveIPs(ctx context.Context, fqdn string) ([]string, error) {
+	fqdn = resolve.NormalizeHostname(fqdn)
+	begin := time.Now()
+	ips, source, err := s.resolve(ctx, fqdn)
+	ip := ""
+	if err == nil {
+		ip = ips[0]
+	}
+	s.Hooks.resolved(ResolveEvent{Name: fqdn, IP: ip, Source: source, Duration: time.Since(begin), Err: err})
+	qtype := "A"
+	if strings.Contains(ip, ":") {
+		qtype = "AAAA"
+	}
+	s.QueryLog.Log(begin, fqdn, qtype, ip, source, err)
+	return ips, err
+}
+
+// resolve does the actual lookup and reports where the answer came from.
+func (s *Server) resolve(ctx context.Context, fqdn string) ([]string, string, error) {
+	if s.isWorkerHost(fqdn) {
+		ip, err := s.workerIP(fqdn)
 		if err != nil {
-			return "", err
+			return nil, "", err
 		}
-		return dh, nil
+		return []string{ip}, resolve.SourceWorker, nil
 	}
 
-	if h := s.LocalResolver.CheckHosts(fqdn); h != "" {
-		return h, nil
+	if ips := s.LocalResolver.LookupHosts(fqdn); len(ips) > 0 {
+		return s.StickyIPs.Order(fqdn, ips), resolve.SourceHosts, nil
 	}
 
 	if s.ResolveSystem == "doh" {
 		u, err := url.Parse(s.RemoteDNSAddr)
 		if err == nil {
 			if u.Hostname() == fqdn {
-				return s.LocalResolver.Resolve(u.Hostname()), nil
+				if ip := doh.PinnedIP(u); ip != "" {
+					return []string{ip}, resolve.SourceHosts, nil
+				}
+				source := resolve.SourceSystem
+				if s.LocalResolver.BootstrapDNS != "" {
+					source = resolve.SourceBootstrap
+				}
+				return []string{s.LocalResolver.Resolve(u.Hostname())}, source, nil
 			}
 		}
 	}
@@ -278,65 +954,142 @@ func (s *Server) Resolve(fqdn string) (string, error) {
 		fqdn += "."
 	}
 
-	// Check the cache for fqdn
+	// Check the cache for fqdn, the IPs are separated by commas
 	if cachedValue, _ := s.Cache.Get(fqdn); cachedValue != nil {
-		logger.Infof("using cached value for %s", fqdn)
-		return cachedValue.(string), nil
+		logger.Infof("using cached value for %s", logger.Redact(fqdn))
+		return s.StickyIPs.Order(fqdn, strings.Split(cachedValue.(string), ",")), resolve.SourceCache, nil
 	}
 
+	qtypes := []uint16{dns.TypeA}
+	if s.PreferIPv6 && !s.DisableIPv6 {
+		qtypes = []uint16{dns.TypeAAAA, dns.TypeA}
+	}
+	var ips []string
+	var source string
+	var err error
+	for _, qtype := range qtypes {
+		ips, source, err = s.lookup(ctx, fqdn, qtype)
+		if err == nil {
+			return ips, source, nil
+		}
+	}
+	return nil, source, err
+}
+
+// ednsPayloadSize is the UDP payload size advertised with EDNS0, the size
+// recommended since the DNS flag day 2020 to avoid fragmented answers.
+const ednsPayloadSize = 1232
+
+// lookup asks the remote DNS server for the qtype records of fqdn and caches
+// the answer. It returns every address of the answer.
+func (s *Server) lookup(ctx context.Context, fqdn string, qtype uint16) ([]string, string, error) {
 	// Build request message
 	req := dns.Msg{}
 	req.Id = dns.Id()
 	req.RecursionDesired = true
 	req.Question = []dns.Question{{
 		Name:   fqdn,
-		Qtype:  dns.TypeA,
+		Qtype:  qtype,
 		Qclass: dns.ClassINET,
 	}}
+	req.SetEdns0(ednsPayloadSize, false)
 
-	// Determine which DNS resolution mechanism to use
-	var exchange *dns.Msg
-	var err error
-	switch s.ResolveSystem {
-	case "doh":
-		exchange, err = s.resolveDNSWithDOH(&req)
-	default:
-		exchange, err = s.resolveDNSWithDNSCrypt(&req)
+	source := resolve.SourceDNSCrypt
+	if s.ResolveSystem == "doh" {
+		source = resolve.SourceDoH
+	}
+	exchange, err := s.exchange(ctx, &req)
+	if err == nil && exchange.Truncated {
+		// the answer did not fit, ask again allowing the largest message
+		logger.Infof("truncated answer for %s, asking again", logger.Redact(fqdn))
+		req.IsEdns0().SetUDPSize(dns.MaxMsgSize)
+		exchange, err = s.exchange(ctx, &req)
 	}
 	if err != nil {
-		return "", err
+		return nil, source, err
+	}
+	if len(exchange.Answer) == 0 {
+		if exchange.Truncated {
+			return nil, source, fmt.Errorf("truncated answer")
+		}
+		return nil, source, fmt.Errorf("no answer")
 	}
 	// Parse answer and store in cache
 	answer := exchange.Answer[0]
-	logger.Infof("resolved %s to %s", fqdn, strings.Replace(answer.String(), "\t", " ", -1))
+	logger.Infof("resolved %s to %s", logger.Redact(fqdn), logger.Redact(strings.Replace(answer.String(), "\t", " ", -1)))
+	if ips, records := answerIPs(exchange, qtype); len(ips) > 0 {
+		s.cacheAnswer(fqdn, ips, records[0])
+		return s.StickyIPs.Order(fqdn, ips), source, nil
+	}
 	record := strings.Fields(answer.String())
 	if record[3] == "CNAME" {
-		ip, err := s.Resolve(record[4])
+		ips, _, err := s.resolve(ctx, record[4])
 		if err != nil {
-			return "", err
+			return nil, source, err
 		}
-		s.Cache.Set(fqdn, ip)
-		return ip, nil
+		s.cacheAnswer(fqdn, ips, answer)
+		return ips, source, nil
 	}
-	ip := record[4]
-	s.Cache.Set(fqdn, ip)
-	return ip, nil
+	ips := []string{record[4]}
+	s.cacheAnswer(fqdn, ips, answer)
+	return ips, source, nil
+}
+
+// answerIPs returns the addresses of the qtype records of r, those of the
+// names its CNAMEs lead to included, and the records.
+func answerIPs(r *dns.Msg, qtype uint16) ([]string, []dns.RR) {
+	var ips []string
+	var records []dns.RR
+	for _, rr := range r.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if qtype == dns.TypeA {
+				ips, records = append(ips, rr.A.String()), append(records, rr)
+			}
+		case *dns.AAAA:
+			if qtype == dns.TypeAAAA {
+				ips, records = append(ips, rr.AAAA.String()), append(records, rr)
+			}
+		}
+	}
+	return ips, records
+}
+
+// cacheAnswer caches ips for fqdn, separated by commas, honoring the TTL
+// bounds configured for the answer's type and for fqdn. An answer whose TTL
+// stays 0 is not cached, and drops what was cached for fqdn before.
+func (s *Server) cacheAnswer(fqdn string, ips []string, answer dns.RR) {
+	value := strings.Join(ips, ",")
+	if ttl, ok := s.DNSTTL.clamp(fqdn, answer); ok {
+		if ttl <= 0 {
+			s.Cache.Delete(fqdn)
+			return
+		}
+		s.Cache.SetWithExpiration(fqdn, value, ttl)
+		return
+	}
+	s.Cache.Set(fqdn, value)
+}
+
+// exchange sends req with the configured DNS resolution mechanism.
+func (s *Server) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if s.ResolveSystem == "doh" {
+		return s.resolveDNSWithDOH(ctx, req)
+	}
+	return s.resolveDNSWithDNSCrypt(req)
 }
 
 // resolveDNSWithDOH resolves DNS using DNS-over-HTTP (DoH) client.
-func (s *Server) resolveDNSWithDOH(req *dns.Msg) (*dns.Msg, error) {
+func (s *Server) resolveDNSWithDOH(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
 	dnsAddr := s.RemoteDNSAddr
 	if s.WorkerConfig.WorkerEnabled && s.WorkerConfig.WorkerDNSOnly {
 		dnsAddr = s.WorkerConfig.WorkerAddress
 	}
 
-	exchange, _, err := s.DoHClient.Exchange(req, dnsAddr)
+	exchange, _, err := s.DoHClient.ExchangeContext(ctx, req, dnsAddr)
 	if err != nil {
 		return nil, err
 	}
-	if len(exchange.Answer) == 0 {
-		return nil, fmt.Errorf("no answer")
-	}
 	return exchange, nil
 }
 
@@ -353,8 +1106,5 @@ func (s *Server) resolveDNSWithDNSCrypt(req *dns.Msg) (*dns.Msg, error) {
 	if err != nil {
 		return nil, err
 	}
-	if len(exchange.Answer) == 0 {
-		return nil, fmt.Errorf("no answer")
-	}
 	return exchange, nil
 }
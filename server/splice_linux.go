@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+const (
+	spliceMove     = 0x1
+	spliceNonblock = 0x2
+	maxSpliceSize  = 1 << 20
+)
+
+// splice moves data from src to dst through a kernel pipe without copying it
+// into userspace, calling progress each time data is moved. It reports false
+// if the zero-copy path could not be set up.
+func splice(dst, src *net.TCPConn, progress func()) (int64, bool, error) {
+	srcRaw, err := src.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	dstRaw, err := dst.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	var pipe [2]int
+	if err := syscall.Pipe2(pipe[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+
+	var written int64
+	for {
+		// socket -> pipe
+		var n int64
+		var spliceErr error
+		err := srcRaw.Read(func(fd uintptr) bool {
+			n, spliceErr = syscall.Splice(int(fd), nil, pipe[1], nil, maxSpliceSize, spliceMove|spliceNonblock)
+			return spliceErr != syscall.EAGAIN
+		})
+		if err != nil {
+			return written, true, err
+		}
+		if spliceErr != nil {
+			return written, true, spliceErr
+		}
+		if n == 0 {
+			// EOF
+			return written, true, nil
+		}
+
+		// pipe -> socket
+		for n > 0 {
+			var m int64
+			err := dstRaw.Write(func(fd uintptr) bool {
+				m, spliceErr = syscall.Splice(pipe[0], nil, int(fd), nil, int(n), spliceMove|spliceNonblock)
+				return spliceErr != syscall.EAGAIN
+			})
+			if err != nil {
+				return written, true, err
+			}
+			if spliceErr != nil {
+				return written, true, spliceErr
+			}
+			n -= m
+			written += m
+		}
+		progress()
+	}
+}
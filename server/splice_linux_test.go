@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bepass/dialer"
+	"bepass/socks5"
+	"bepass/socks5/statute"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const relayPayloadSize = 16 * 1024 * 1024
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(b testing.TB) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatalf("dial failed: %v", err)
+	}
+	server := <-accepted
+	if server == nil {
+		b.Fatalf("accept failed")
+	}
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestRelaySpliceIdleTimeout(t *testing.T) {
+	s := &Server{EnableSplice: true, ConnectionIdleTimeout: 50 * time.Millisecond}
+	clientPeer, client := tcpPair(t)
+	upstream, upstreamPeer := tcpPair(t)
+	defer clientPeer.Close()
+	defer client.Close()
+	defer upstream.Close()
+	defer upstreamPeer.Close()
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, clientPeer)
+		received <- n
+	}()
+
+	// the spliced data keeps the relay alive until upstream goes quiet
+	busy := 150 * time.Millisecond
+	go func() {
+		for end := time.Now().Add(busy); time.Now().Before(end); {
+			if _, err := upstreamPeer.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	begin := time.Now()
+	err := s.relay(client, upstream, client, &relayStats{})
+	if !errors.Is(err, errIdleTimeout) {
+		t.Fatalf("expected an idle timeout, got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed < busy {
+		t.Errorf("relay gave up after %v while data was still flowing", elapsed)
+	}
+	_ = client.Close()
+	if n := <-received; n == 0 {
+		t.Error("expected the data to reach the client")
+	}
+}
+
+func benchmarkRelay(b *testing.B, relay func(dst, src *net.TCPConn) error) {
+	payload := make([]byte, 64*1024)
+	b.SetBytes(relayPayloadSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		sender, src := tcpPair(b)
+		dst, receiver := tcpPair(b)
+
+		go func() {
+			for sent := 0; sent < relayPayloadSize; sent += len(payload) {
+				if _, err := sender.Write(payload); err != nil {
+					break
+				}
+			}
+			_ = sender.CloseWrite()
+		}()
+		done := make(chan int64, 1)
+		go func() {
+			n, _ := io.Copy(io.Discard, receiver)
+			done <- n
+		}()
+
+		if err := relay(dst, src); err != nil {
+			b.Fatalf("relay failed: %v", err)
+		}
+		if n := <-done; n != relayPayloadSize {
+			b.Fatalf("expected %d bytes, got %d", relayPayloadSize, n)
+		}
+
+		for _, c := range []*net.TCPConn{sender, src, dst, receiver} {
+			_ = c.Close()
+		}
+	}
+}
+
+func BenchmarkRelayBuffered(b *testing.B) {
+	s := &Server{}
+	benchmarkRelay(b, func(dst, src *net.TCPConn) error {
+		// Hide ReadFrom/WriteTo so the copy goes through the userspace buffer
+		err := s.Copy(struct{ io.Reader }{src}, struct{ io.Writer }{dst})
+		_ = dst.CloseWrite()
+		return err
+	})
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	s := &Server{EnableSplice: true}
+	benchmarkRelay(b, func(dst, src *net.TCPConn) error {
+		return s.Copy(src, dst)
+	})
+}
+
+// socksProxy serves s on a loopback SOCKS5 listener.
+func socksProxy(b *testing.B, s *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("listen failed: %v", err)
+	}
+	b.Cleanup(func() { _ = ln.Close() })
+	proxy := socks5.NewServer(socks5.WithConnectHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
+		return s.Handle(ctx, w, req, "tcp")
+	}))
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = proxy.ServeConn(conn) }()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// socksConnect opens a connection to target through the SOCKS5 proxy.
+func socksConnect(b *testing.B, proxy string, target *net.TCPAddr) *net.TCPConn {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		b.Fatalf("dial failed: %v", err)
+	}
+	port := []byte{byte(target.Port >> 8), byte(target.Port)}
+	req := append(append([]byte{5, 1, 0, 5, 1, 0, 1}, target.IP.To4()...), port...)
+	if _, err := conn.Write(req); err != nil {
+		b.Fatalf("socks request failed: %v", err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[3] != statute.RepSuccess {
+		b.Fatalf("socks connect failed: %v %v", reply, err)
+	}
+	return conn.(*net.TCPConn)
+}
+
+// benchmarkHandle relays relayPayloadSize bytes each way through Handle, the
+// path the proxied connections take.
+func benchmarkHandle(b *testing.B, s *Server) {
+	s.Dialer = &dialer.Dialer{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+	payload := make([]byte, 64*1024)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if n, _ := io.Copy(io.Discard, conn); n != relayPayloadSize {
+					return
+				}
+				for sent := 0; sent < relayPayloadSize; sent += len(payload) {
+					if _, err := conn.Write(payload); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	proxy := socksProxy(b, s)
+	target := ln.Addr().(*net.TCPAddr)
+
+	b.SetBytes(2 * relayPayloadSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn := socksConnect(b, proxy, target)
+		for sent := 0; sent < relayPayloadSize; sent += len(payload) {
+			if _, err := conn.Write(payload); err != nil {
+				b.Fatalf("upload failed: %v", err)
+			}
+		}
+		_ = conn.CloseWrite()
+		if n, _ := io.Copy(io.Discard, conn); n != relayPayloadSize {
+			b.Fatalf("expected %d bytes back, got %d", relayPayloadSize, n)
+		}
+		_ = conn.Close()
+	}
+}
+
+func BenchmarkHandleBuffered(b *testing.B) {
+	benchmarkHandle(b, &Server{})
+}
+
+func BenchmarkHandleSplice(b *testing.B) {
+	benchmarkHandle(b, &Server{EnableSplice: true})
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+// splice is only available on linux, the caller falls back to a buffered copy.
+func splice(_, _ *net.TCPConn, _ func()) (int64, bool, error) {
+	return 0, false, nil
+}
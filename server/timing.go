@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Timing records how long each stage of a proxied connection took. A zero
+// stage was not reached or does not apply to the connection.
+type Timing struct {
+	// Resolve is the lookup of the destination
+	Resolve time.Duration
+	// Connect is the TCP dial to the destination or the tunnel setup through the worker
+	Connect time.Duration
+	// TLSHandshake is the time from sending the ClientHello until the server
+	// answered, which is where a censor usually interferes
+	TLSHandshake time.Duration
+	// FirstByte is the time from connecting until the first byte from upstream
+	FirstByte time.Duration
+}
+
+func (t Timing) String() string {
+	return fmt.Sprintf("resolve=%v connect=%v tls=%v first-byte=%v",
+		t.Resolve.Round(time.Microsecond), t.Connect.Round(time.Microsecond),
+		t.TLSHandshake.Round(time.Microsecond), t.FirstByte.Round(time.Microsecond))
+}
+
+// TimingStats sums the stage timings of all connections handled so far.
+type TimingStats struct {
+	Connections uint64
+	Total       Timing
+}
+
+// Average returns the mean duration of each stage.
+func (s TimingStats) Average() Timing {
+	if s.Connections == 0 {
+		return Timing{}
+	}
+	n := time.Duration(s.Connections)
+	return Timing{
+		Resolve:      s.Total.Resolve / n,
+		Connect:      s.Total.Connect / n,
+		TLSHandshake: s.Total.TLSHandshake / n,
+		FirstByte:    s.Total.FirstByte / n,
+	}
+}
+
+type timingCounters struct {
+	connections  atomic.Uint64
+	resolve      atomic.Int64
+	connect      atomic.Int64
+	tlsHandshake atomic.Int64
+	firstByte    atomic.Int64
+}
+
+func (c *timingCounters) add(t Timing) {
+	c.connections.Add(1)
+	c.resolve.Add(int64(t.Resolve))
+	c.connect.Add(int64(t.Connect))
+	c.tlsHandshake.Add(int64(t.TLSHandshake))
+	c.firstByte.Add(int64(t.FirstByte))
+}
+
+func (c *timingCounters) snapshot() TimingStats {
+	return TimingStats{
+		Connections: c.connections.Load(),
+		Total: Timing{
+			Resolve:      time.Duration(c.resolve.Load()),
+			Connect:      time.Duration(c.connect.Load()),
+			TLSHandshake: time.Duration(c.tlsHandshake.Load()),
+			FirstByte:    time.Duration(c.firstByte.Load()),
+		},
+	}
+}
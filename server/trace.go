@@ -0,0 +1,49 @@
+package server
+
+import "context"
+
+// Tracer starts the spans recorded for each connection: a "connection" span
+// with "resolve", "dial", "handshake" and "relay" children. It has the shape
+// of an OpenTelemetry tracer, so an adapter to one takes a few lines, without
+// bepass depending on the SDK. The parent of a span is carried by ctx.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Attribute is a key and value recorded on a span. Value is a string, an int
+// or a bool.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// noopSpan is the span handed out when no Tracer is set.
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+// startSpan starts a span with the Tracer of the server, a no-op one if it
+// has none.
+func (s *Server) startSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	if s.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return s.Tracer.Start(ctx, name, attrs...)
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
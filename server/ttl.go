@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bepass/resolve"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TTLBounds clamps the TTL of upstream answers before they are cached. Both
+// maps are keyed by record type ("A", "AAAA", "CNAME", ...) and hold seconds;
+// the "*" key applies to every type without its own entry. Hosts raises the
+// floor for the hostnames of its patterns, whatever the type, so a known good
+// IP of a worker or a destination sticks even when upstream answers with a
+// tiny TTL; such a floor wins over Max.
+type TTLBounds struct {
+	Min   map[string]int
+	Max   map[string]int
+	Hosts []HostTTL
+}
+
+// HostTTL is the floor, in seconds, of the TTL of the answers cached for the
+// hostnames Pattern matches.
+type HostTTL struct {
+	Pattern resolve.HostPattern
+	Min     int
+}
+
+// hostMin returns the highest floor of the patterns matching host.
+func (b TTLBounds) hostMin(host string) (int, bool) {
+	minTTL, ok := 0, false
+	for _, h := range b.Hosts {
+		if h.Pattern.Match(host) && (!ok || h.Min > minTTL) {
+			minTTL, ok = h.Min, true
+		}
+	}
+	return minTTL, ok
+}
+
+func (b TTLBounds) lookup(m map[string]int, rrType string) (int, bool) {
+	if v, ok := m[rrType]; ok {
+		return v, true
+	}
+	v, ok := m["*"]
+	return v, ok
+}
+
+// clamp returns how long the answer rr to a query for host should be cached.
+// It reports false when no bound applies to rr's type or to host, so the
+// cache's default expiration is kept. A zero duration means the answer must
+// not be cached at all, which the caches would take as never expiring.
+func (b TTLBounds) clamp(host string, rr dns.RR) (time.Duration, bool) {
+	rrType := dns.TypeToString[rr.Header().Rrtype]
+	minTTL, hasMin := b.lookup(b.Min, rrType)
+	maxTTL, hasMax := b.lookup(b.Max, rrType)
+	hostTTL, hasHost := b.hostMin(host)
+	if !hasMin && !hasMax && !hasHost {
+		return 0, false
+	}
+	ttl := int(rr.Header().Ttl)
+	if hasMin && ttl < minTTL {
+		ttl = minTTL
+	}
+	if hasMax && maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if hasHost && ttl < hostTTL {
+		ttl = hostTTL
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	return time.Duration(ttl) * time.Second, true
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bepass/resolve"
+	"bepass/utils"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTTLBoundsClamp(t *testing.T) {
+	bounds := TTLBounds{
+		Min: map[string]int{"A": 60},
+		Max: map[string]int{"*": 300, "AAAA": 30},
+	}
+	tests := []struct {
+		record string
+		want   time.Duration
+		ok     bool
+	}{
+		{"example.com. 10 IN A 93.184.216.34", 60 * time.Second, true},
+		{"example.com. 120 IN A 93.184.216.34", 120 * time.Second, true},
+		{"example.com. 3600 IN A 93.184.216.34", 300 * time.Second, true},
+		{"example.com. 120 IN AAAA 2606:2800:220:1::", 30 * time.Second, true},
+		{"www.example.com. 1000 IN CNAME example.com.", 300 * time.Second, true},
+	}
+	for _, tt := range tests {
+		rr, err := dns.NewRR(tt.record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := bounds.clamp("example.com", rr)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("clamp(%q) = %v, %v, want %v, %v", tt.record, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	rr, _ := dns.NewRR("example.com. 10 IN A 93.184.216.34")
+	if _, ok := (TTLBounds{}).clamp("example.com", rr); ok {
+		t.Error("expected no clamping without bounds")
+	}
+}
+
+func TestTTLBoundsHosts(t *testing.T) {
+	worker, err := resolve.ParseHostPattern("workers.dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdn, err := resolve.ParseHostPattern("*.cdn?.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounds := TTLBounds{
+		Max:   map[string]int{"*": 300},
+		Hosts: []HostTTL{{Pattern: worker, Min: 600}, {Pattern: cdn, Min: 120}, {Pattern: cdn, Min: 60}},
+	}
+	rr, _ := dns.NewRR("example.com. 5 IN A 93.184.216.34")
+	tests := []struct {
+		host string
+		want time.Duration
+	}{
+		{"my.workers.dev", 600 * time.Second},
+		{"Img.CDN1.net.", 120 * time.Second},
+		{"img.cdn12.net", 5 * time.Second},
+		{"example.com", 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got, ok := bounds.clamp(tt.host, rr); got != tt.want || !ok {
+			t.Errorf("clamp(%s) = %v, %v, want %v", tt.host, got, ok, tt.want)
+		}
+	}
+	if _, ok := (TTLBounds{Hosts: bounds.Hosts}).clamp("example.com", rr); ok {
+		t.Error("expected no clamping of a host no pattern matches")
+	}
+}
+
+func TestCacheAnswerZeroTTL(t *testing.T) {
+	s := &Server{
+		Cache:  utils.NewCache(time.Minute),
+		DNSTTL: TTLBounds{Max: map[string]int{"*": 300}},
+	}
+	rr, _ := dns.NewRR("example.com. 0 IN A 93.184.216.34")
+	if got, ok := s.DNSTTL.clamp("example.com", rr); got != 0 || !ok {
+		t.Fatalf("clamp = %v, %v, want 0, true", got, ok)
+	}
+
+	// an answer meant for failover must not stick, nor leave an older one behind
+	s.Cache.Set("example.com", "192.0.2.1")
+	s.cacheAnswer("example.com", []string{"93.184.216.34"}, rr)
+	if v, found := s.Cache.Get("example.com"); found {
+		t.Errorf("expected a TTL 0 answer not to be cached, got %v", v)
+	}
+
+	rr, _ = dns.NewRR("example.com. 60 IN A 93.184.216.34")
+	s.cacheAnswer("example.com", []string{"93.184.216.34"}, rr)
+	if v, found := s.Cache.Get("example.com"); !found || v != "93.184.216.34" {
+		t.Errorf("expected the answer cached, got %v, %v", v, found)
+	}
+}
@@ -0,0 +1,52 @@
+package sni
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// clientHello captures the first flight a crypto/tls client sends for serverName.
+func clientHello(t testing.TB, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		_ = conn.Handshake()
+		_ = client.Close()
+	}()
+
+	buf := make([]byte, 16*1024)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read client hello: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestReadClientHello(t *testing.T) {
+	hello, err := ReadClientHello(bytes.NewReader(clientHello(t, "example.com")))
+	if err != nil {
+		t.Fatalf("ReadClientHello failed: %v", err)
+	}
+	if hello.ServerName != "example.com" {
+		t.Errorf("Expected server name example.com, got %q", hello.ServerName)
+	}
+}
+
+func FuzzParseClientHello(f *testing.F) {
+	hello := clientHello(f, "example.com")
+	f.Add(hello)
+	f.Add(hello[:len(hello)/2])
+	f.Add(clientHello(f, "xn--mgbh0fb.xn--kgbechtv"))
+	f.Add([]byte{0x16, 0x03, 0x01, 0x00, 0x00})
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		hello, err := ReadClientHello(bytes.NewReader(b))
+		if err == nil && hello == nil {
+			t.Fatalf("nil hello without an error")
+		}
+	})
+}
@@ -6,12 +6,15 @@ package socks5
 import (
 	"bepass/logger"
 	"bepass/socks5/statute"
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"syscall"
 )
 
 // AddressRewriter is used to rewrite a destination transparently
@@ -37,6 +40,14 @@ type Request struct {
 	RawDestAddr *statute.AddrSpec
 }
 
+// BufferedConn is the Reader of the requests ServeConn serves: Conn read
+// through the buffer the request was parsed from. Once Buffered is drained,
+// Conn can be read directly, which lets the relay splice from it.
+type BufferedConn struct {
+	*bufio.Reader
+	Conn net.Conn
+}
+
 // ParseRequest creates a new Request from the TCP connection
 func ParseRequest(bufConn io.Reader) (*Request, error) {
 	hd, err := statute.ParseRequest(bufConn)
@@ -51,7 +62,7 @@ func ParseRequest(bufConn io.Reader) (*Request, error) {
 }
 
 // handleRequest is used for request processing after authentication
-func (sf *Server) handleRequest(write io.Writer, req *Request) error {
+func (sf *Server) handleRequest(ctx context.Context, write io.Writer, req *Request) error {
 	// I disabled this part because client shouldn't resolve destination
 	/*var err error
 
@@ -84,7 +95,18 @@ func (sf *Server) handleRequest(write io.Writer, req *Request) error {
 		return fmt.Errorf("bind to %v blocked by rules", req.RawDestAddr)
 	}*/
 
-	ctx := context.Background()
+	if sf.authorize != nil {
+		host := req.RawDestAddr.FQDN
+		if host == "" {
+			host = req.RawDestAddr.IP.String()
+		}
+		if err := sf.authorize(req.RemoteAddr, host, uint16(req.RawDestAddr.Port)); err != nil {
+			if err := SendReply(write, statute.RepRuleFailure, nil); err != nil {
+				return fmt.Errorf("failed to send reply, %v", err)
+			}
+			return fmt.Errorf("request to %v not authorized, %v", req.RawDestAddr, err)
+		}
+	}
 
 	// Switch on the command
 	switch req.Command {
@@ -122,14 +144,7 @@ func (sf *Server) handleConnect(ctx context.Context, writer io.Writer, request *
 	}
 	target, err := dial(ctx, "tcp", request.DestAddr.String())
 	if err != nil {
-		msg := err.Error()
-		resp := statute.RepHostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = statute.RepConnectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = statute.RepNetworkUnreachable
-		}
-		if err := SendReply(writer, resp, nil); err != nil {
+		if err := SendReply(writer, ReplyCode(err), nil); err != nil {
 			return fmt.Errorf("failed to send reply, %v", err)
 		}
 		return fmt.Errorf("connect to %v failed, %v", request.RawDestAddr, err)
@@ -196,21 +211,14 @@ func (sf *Server) handleAssociate(ctx context.Context, writer io.Writer, request
 
 	target, err := dial(ctx, "udp", request.DestAddr.String())
 	if err != nil {
-		msg := err.Error()
-		resp := statute.RepHostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = statute.RepConnectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = statute.RepNetworkUnreachable
-		}
-		if err := SendReply(writer, resp, nil); err != nil {
+		if err := SendReply(writer, ReplyCode(err), nil); err != nil {
 			return fmt.Errorf("failed to send reply, %v", err)
 		}
 		return fmt.Errorf("connect to %v failed, %v", request.RawDestAddr, err)
 	}
 	defer target.Close()
 
-	bindLn, err := net.ListenUDP("udp", nil)
+	bindLn, err := net.ListenUDP("udp", &net.UDPAddr{IP: sf.bindIP})
 	if err != nil {
 		if err := SendReply(writer, statute.RepServerFailure, nil); err != nil {
 			return fmt.Errorf("failed to send reply, %v", err)
@@ -219,9 +227,9 @@ func (sf *Server) handleAssociate(ctx context.Context, writer io.Writer, request
 	}
 	//defer bindLn.Close()
 
-	logger.Info("", "target addr ", target.RemoteAddr(), " listen addr: ", bindLn.LocalAddr())
+	logger.Info("", "target addr ", logger.Redact(target.RemoteAddr()), " listen addr: ", bindLn.LocalAddr())
 	// send BND.ADDR and BND.PORT, client used
-	if err = SendReply(writer, statute.RepSuccess, bindLn.LocalAddr()); err != nil {
+	if err = SendReply(writer, statute.RepSuccess, ReplyAddr(bindLn.LocalAddr(), request.LocalAddr)); err != nil {
 		return fmt.Errorf("failed to send reply, %v", err)
 	}
 
@@ -269,7 +277,7 @@ func (sf *Server) handleAssociate(ctx context.Context, writer io.Writer, request
 							if err == io.EOF {
 								return
 							}
-							logger.Errorf("read data from remote %s failed, %v", target.RemoteAddr().String(), err)
+							logger.Errorf("read data from remote %s failed, %v", logger.Redact(target.RemoteAddr()), err)
 							return
 						}
 
@@ -292,7 +300,7 @@ func (sf *Server) handleAssociate(ctx context.Context, writer io.Writer, request
 			}
 
 			if _, err := target.Write(pk.Data); err != nil {
-				logger.Errorf("write data to remote %s failed, %v", target.RemoteAddr().String(), err)
+				logger.Errorf("write data to remote %s failed, %v", logger.Redact(target.RemoteAddr()), err)
 				return
 			}
 		}
@@ -315,6 +323,55 @@ func (sf *Server) handleAssociate(ctx context.Context, writer io.Writer, request
 	}
 }
 
+// ReplyAddr returns the address to put in a reply for a socket bound to bound.
+// A socket listening on all interfaces has no address the client can use, the
+// IP of local, the end of the client connection on the server, is used instead.
+func ReplyAddr(bound, local net.Addr) net.Addr {
+	udpAddr, ok := bound.(*net.UDPAddr)
+	if !ok || (udpAddr.IP != nil && !udpAddr.IP.IsUnspecified()) {
+		return bound
+	}
+	localTCP, ok := local.(*net.TCPAddr)
+	if !ok {
+		return bound
+	}
+	return &net.UDPAddr{IP: localTCP.IP, Port: udpAddr.Port, Zone: localTCP.Zone}
+}
+
+// ReplyCode returns the reply of RFC 1928 telling a client why connecting to
+// its destination failed with err: the connection was refused, the network
+// or the host is unreachable, or the attempt timed out, which is reported as
+// an expired TTL. A hostname that does not resolve is an unreachable host, as
+// is any other failure.
+func ReplyCode(err error) uint8 {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return statute.RepSuccess
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return statute.RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return statute.RepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return statute.RepHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, syscall.ETIMEDOUT),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return statute.RepTTLExpired
+	}
+	// the errors of some platforms and dialers only tell in their message
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "refused"):
+		return statute.RepConnectionRefused
+	case strings.Contains(msg, "network is unreachable"), strings.Contains(msg, "unreachable network"):
+		return statute.RepNetworkUnreachable
+	case strings.Contains(msg, "timed out"), strings.Contains(msg, "timeout"):
+		return statute.RepTTLExpired
+	}
+	return statute.RepHostUnreachable
+}
+
 // SendReply is used to send a reply message
 // rep: reply status see statute's statute file
 func SendReply(w io.Writer, rep uint8, bindAddr net.Addr) error {
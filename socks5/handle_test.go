@@ -0,0 +1,150 @@
+package socks5
+
+import (
+	"bepass/socks5/statute"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// connectReply runs a CONNECT to example.com:port through srv and returns the
+// reply code.
+func connectReply(t *testing.T, srv *Server, port uint16) byte {
+	t.Helper()
+	client, conn := net.Pipe()
+	defer client.Close()
+	go func() { _ = srv.ServeConn(conn) }()
+	return socksConnect(t, client, port)
+}
+
+// socksConnect runs a CONNECT to example.com:port over client and returns the
+// reply code.
+func socksConnect(t *testing.T, client net.Conn, port uint16) byte {
+	t.Helper()
+	if _, err := client.Write([]byte{statute.VersionSocks5, 1, statute.MethodNoAuth}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(client, method); err != nil {
+		t.Fatal(err)
+	}
+	host := "example.com"
+	req := []byte{statute.VersionSocks5, statute.CommandConnect, 0, statute.ATYPDomain, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := client.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[1]
+}
+
+func TestWithAuthorize(t *testing.T) {
+	var gotHost string
+	var gotPort uint16
+	srv := NewServer(
+		WithAuthorize(func(clientAddr net.Addr, dstHost string, dstPort uint16) error {
+			gotHost, gotPort = dstHost, dstPort
+			if dstPort == 25 {
+				return errors.New("smtp is not allowed")
+			}
+			return nil
+		}),
+		WithConnectHandle(func(_ context.Context, w io.Writer, _ *Request) error {
+			return SendReply(w, statute.RepSuccess, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+		}),
+	)
+
+	if rep := connectReply(t, srv, 25); rep != statute.RepRuleFailure {
+		t.Errorf("expected a rule failure for a denied destination, got %d", rep)
+	}
+	if gotHost != "example.com" || gotPort != 25 {
+		t.Errorf("expected the callback to get example.com:25, got %s:%d", gotHost, gotPort)
+	}
+	if rep := connectReply(t, srv, 443); rep != statute.RepSuccess {
+		t.Errorf("expected an allowed destination to reach the handler, got %d", rep)
+	}
+}
+
+func TestReplyAddr(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080}
+	got := ReplyAddr(&net.UDPAddr{IP: net.IPv4zero, Port: 5353}, local).(*net.UDPAddr)
+	if !got.IP.Equal(local.IP) || got.Port != 5353 {
+		t.Errorf("expected the unspecified address to be replaced, got %v", got)
+	}
+	bound := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 5353}
+	if got := ReplyAddr(bound, local); got != bound {
+		t.Errorf("expected a specific address to be kept, got %v", got)
+	}
+}
+
+// addrConn is a net.Conn with fixed addresses.
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestWithAllowedClients(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	srv := NewServer(WithAllowedClients([]*net.IPNet{lan}))
+	local := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 1080}
+	tests := []struct {
+		remote net.IP
+		want   bool
+	}{
+		{net.IPv4(192, 168, 1, 20), true},
+		{net.IPv4(10, 0, 0, 1), false},
+		// the host itself, like the HTTP proxy of the server
+		{net.IPv4(127, 0, 0, 1), true},
+		{net.IPv4(192, 168, 1, 5), true},
+	}
+	for _, tt := range tests {
+		conn := addrConn{local: local, remote: &net.TCPAddr{IP: tt.remote, Port: 40000}}
+		if got := srv.clientAllowed(conn); got != tt.want {
+			t.Errorf("clientAllowed(%v) = %v, want %v", tt.remote, got, tt.want)
+		}
+	}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	if err := srv.ServeConn(addrConn{Conn: conn, local: local, remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}}); err == nil {
+		t.Error("expected a connection from outside the allowed clients to be refused")
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	dialErr := func(errno syscall.Errno) error {
+		return fmt.Errorf("connect failed, %w", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)})
+	}
+	tests := []struct {
+		err  error
+		want uint8
+	}{
+		{nil, statute.RepSuccess},
+		{dialErr(syscall.ECONNREFUSED), statute.RepConnectionRefused},
+		{dialErr(syscall.ENETUNREACH), statute.RepNetworkUnreachable},
+		{dialErr(syscall.EHOSTUNREACH), statute.RepHostUnreachable},
+		{dialErr(syscall.ETIMEDOUT), statute.RepTTLExpired},
+		{fmt.Errorf("tunnel failed, %w", context.DeadlineExceeded), statute.RepTTLExpired},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, statute.RepHostUnreachable},
+		// the chain lost, only the message tells
+		{errors.New("connect failed, dial tcp: connection refused"), statute.RepConnectionRefused},
+		{errors.New("something else"), statute.RepHostUnreachable},
+	}
+	for _, tt := range tests {
+		if got := ReplyCode(tt.err); got != tt.want {
+			t.Errorf("ReplyCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
@@ -6,7 +6,9 @@ package socks5
 
 import (
 	"bepass/bufferpool"
+	"bepass/utils"
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
 )
@@ -73,6 +75,38 @@ func WithBindIP(ip net.IP) Option {
 	}
 }
 
+// AuthorizeFunc decides whether the client at clientAddr may reach
+// dstHost:dstPort, a non-nil error denies the request.
+type AuthorizeFunc func(clientAddr net.Addr, dstHost string, dstPort uint16) error
+
+// WithAuthorize sets a callback deciding, for every request, whether the client
+// may reach the destination. A denied request gets a rule failure reply. It
+// runs after authentication, so it can be combined with WithCredential for
+// per-user policies.
+func WithAuthorize(authorize AuthorizeFunc) Option {
+	return func(s *Server) {
+		s.authorize = authorize
+	}
+}
+
+// WithAllowedClients only lets in clients whose address is in one of nets.
+// Connections from the host bepass runs on are always let in, the HTTP proxy
+// of the server goes through them. All clients are let in if nets is empty.
+func WithAllowedClients(nets []*net.IPNet) Option {
+	return func(s *Server) {
+		s.allowedClients = nets
+	}
+}
+
+// WithTLS makes the server terminate TLS with config on every accepted
+// connection, SOCKS and HTTP requests are then read from inside it. A PROXY
+// protocol header is still expected before the TLS handshake.
+func WithTLS(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
 // WithDial allows users to provide a custom dial function for outgoing connections.
 func WithDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
 	return func(s *Server) {
@@ -107,3 +141,19 @@ func WithAssociateHandle(h func(ctx context.Context, writer io.Writer, request *
 		s.userAssociateHandle = h
 	}
 }
+
+// WithProxyProtocol makes the server expect a PROXY protocol (v1 or v2) header at the
+// start of every non-loopback connection and use the announced client address as the
+// remote address.
+func WithProxyProtocol(enabled bool) Option {
+	return func(s *Server) {
+		s.acceptProxyProtocol = enabled
+	}
+}
+
+// WithKeepAlive sets the TCP keepalive settings applied to accepted client connections.
+func WithKeepAlive(ka utils.KeepAlive) Option {
+	return func(s *Server) {
+		s.keepAlive = ka
+	}
+}
@@ -5,16 +5,17 @@ package socks5
 
 import (
 	"bepass/bufferpool"
+	"bepass/proxyproto"
+	"bepass/utils"
 	"bufio"
-	"bytes"
 	"context"
-	"encoding/binary"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"strconv"
+	"sync"
 
 	"golang.org/x/net/proxy"
 
@@ -52,6 +53,12 @@ type Server struct {
 	rewriter AddressRewriter
 	// bindIP is used for bind or udp associate
 	bindIP net.IP
+	// authorize, if set, is asked whether a request may proceed
+	authorize AuthorizeFunc
+	// allowedClients, if not empty, are the networks clients may connect from
+	allowedClients []*net.IPNet
+	// tlsConfig, if set, is used to terminate TLS on accepted connections
+	tlsConfig *tls.Config
 	// Optional function for dialing out
 	dial func(ctx context.Context, network, addr string) (net.Conn, error)
 	// buffer pool
@@ -62,10 +69,21 @@ type Server struct {
 	userConnectHandle   func(ctx context.Context, writer io.Writer, request *Request) error
 	userBindHandle      func(ctx context.Context, writer io.Writer, request *Request) error
 	userAssociateHandle func(ctx context.Context, writer io.Writer, request *Request) error
-	done                chan bool
 	listen              net.Listener
 	httpProxyBindAddr   string
 	bindAddress         string
+	// acceptProxyProtocol requires every incoming connection to start with a
+	// PROXY protocol header, used when running behind a load balancer
+	acceptProxyProtocol bool
+	// keepAlive is applied to accepted client connections
+	keepAlive utils.KeepAlive
+	// ctx is the parent of every connection context, cancelled on Shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+	// ready is closed once the listener is up
+	ready chan struct{}
+	// mu guards listen, which is set by ListenAndServe and closed by Shutdown
+	mu sync.Mutex
 }
 
 // NewServer creates a new Server
@@ -79,6 +97,8 @@ func NewServer(opts ...Option) *Server {
 			return net.Dial(net_, addr)
 		},
 	}
+	srv.ctx, srv.cancel = context.WithCancel(context.Background())
+	srv.ready = make(chan struct{})
 
 	for _, opt := range opts {
 		opt(srv)
@@ -97,14 +117,29 @@ func NewServer(opts ...Option) *Server {
 
 // ListenAndServe is used to create a listener and serve on it
 func (sf *Server) ListenAndServe(network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return sf.ServeListener(l)
+}
+
+// ServeListener serves on l, already bound, like ListenAndServe does on the
+// listener it creates. l is closed when the server is shut down.
+func (sf *Server) ServeListener(l net.Listener) error {
 	prx := goproxy.NewProxyHttpServer()
 	prx.Verbose = true
 
-	sf.bindAddress = addr
+	sf.bindAddress = l.Addr().String()
 
 	// Create a custom dialer with DialContext
-	dialer, err := proxy.SOCKS5(network, sf.bindAddress, nil, proxy.Direct)
+	var forward proxy.Dialer = proxy.Direct
+	if sf.tlsConfig != nil {
+		forward = tlsSelfDialer{}
+	}
+	dialer, err := proxy.SOCKS5(l.Addr().Network(), sf.bindAddress, nil, forward)
 	if err != nil {
+		_ = l.Close()
 		return err
 	}
 
@@ -116,12 +151,13 @@ func (sf *Server) ListenAndServe(network, addr string) error {
 	// Find a random port and listen to it
 	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
+		_ = l.Close()
 		return err
 	}
 
 	sf.httpProxyBindAddr = listener.Addr().String()
 
-	errorChan := make(chan error)
+	errorChan := make(chan error, 2)
 
 	go func() {
 		err := http.Serve(listener, prx)
@@ -131,17 +167,40 @@ func (sf *Server) ListenAndServe(network, addr string) error {
 		}
 	}()
 
+	sf.mu.Lock()
+	if sf.ctx.Err() != nil {
+		// shut down before the listener was up
+		sf.mu.Unlock()
+		_ = l.Close()
+		_ = listener.Close()
+		return nil
+	}
+	sf.listen = l
+	sf.mu.Unlock()
+	close(sf.ready)
+
 	go func() {
-		l, err := net.Listen(network, addr)
-		sf.listen = l
-		if err != nil {
-			errorChan <- err
-			return
-		}
 		errorChan <- sf.Serve()
 	}()
 
-	return <-errorChan
+	err = <-errorChan
+	_ = listener.Close()
+	return err
+}
+
+// Addr returns the address the server listens on, nil until it is listening.
+func (sf *Server) Addr() net.Addr {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.listen == nil {
+		return nil
+	}
+	return sf.listen.Addr()
+}
+
+// Ready returns a channel that is closed once ListenAndServe is accepting connections.
+func (sf *Server) Ready() <-chan struct{} {
+	return sf.ready
 }
 
 // Serve is used to serve internet from a listener
@@ -149,13 +208,16 @@ func (sf *Server) Serve() error {
 	for {
 		conn, err := sf.listen.Accept()
 		if err != nil {
-			select {
-			case <-sf.done:
+			if sf.ctx.Err() != nil {
 				logger.Info("Shutting socks5 server done")
 				return nil
-			default:
-				logger.Errorf("Accept failed: %v", err)
-				return err
+			}
+			logger.Errorf("Accept failed: %v", err)
+			return err
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			if err := utils.SetKeepAlive(tcpConn, sf.keepAlive); err != nil {
+				logger.Errorf("failed to set keepalive: %v", err)
 			}
 		}
 		sf.goFunc(func() {
@@ -166,11 +228,16 @@ func (sf *Server) Serve() error {
 	}
 }
 
-// Shutdown gracefully stops the SOCKS5 server. It closes the listener and waits
-// for all active connections to complete. This function blocks until the server
-// is completely shut down.
+// Shutdown stops the SOCKS5 server. It closes the listener and cancels the
+// context of every active connection, so in-flight resolves, dials and relays
+// are torn down instead of outliving the server.
 func (sf *Server) Shutdown() error {
-	go func() { sf.done <- true }() // Shutting down the socks5 proxy
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.cancel()
+	if sf.listen == nil {
+		return nil
+	}
 	err := sf.listen.Close()
 	if err != nil {
 		return err
@@ -178,12 +245,37 @@ func (sf *Server) Shutdown() error {
 	return nil
 }
 
-// ServeConn is used to serve a single connection.
+// ServeConn is used to serve a single connection. The context handed to the
+// request handlers is cancelled when the connection ends or the server shuts down.
 func (sf *Server) ServeConn(conn net.Conn) error {
 	defer conn.Close()
 
+	ctx, cancel := context.WithCancel(sf.ctx)
+	defer cancel()
+
 	bufConn := bufio.NewReader(conn)
 
+	if sf.acceptProxyProtocol {
+		src, _, err := proxyproto.ReadHeader(bufConn)
+		switch {
+		case errors.Is(err, proxyproto.ErrNoHeader) && isLoopback(conn.RemoteAddr()):
+			// bepass' own http proxy and tunnels dial the listener directly
+		case err != nil:
+			return fmt.Errorf("failed to read proxy protocol header, %w", err)
+		case src != nil:
+			conn = &proxiedConn{Conn: conn, remoteAddr: src}
+		}
+	}
+
+	if !sf.clientAllowed(conn) {
+		return fmt.Errorf("client %s is not allowed", conn.RemoteAddr())
+	}
+	if sf.tlsConfig != nil {
+		// the reader may already hold the start of the handshake
+		tlsConn := tls.Server(&bufferedConn{Conn: conn, r: bufConn}, sf.tlsConfig)
+		conn, bufConn = tlsConn, bufio.NewReader(tlsConn)
+	}
+
 	b, err := bufConn.Peek(1)
 	if err != nil {
 		return err
@@ -191,14 +283,81 @@ func (sf *Server) ServeConn(conn net.Conn) error {
 
 	switch b[0] {
 	case statute.VersionSocks5:
-		return sf.handleSocksRequest(conn, bufConn)
+		return sf.handleSocksRequest(ctx, conn, bufConn)
 	case statute.VersionSocks4:
-		return sf.handleSocks4Request(conn, bufConn)
+		return sf.handleSocks4Request(ctx, conn, bufConn)
 	default:
 		return sf.handleHTTPRequest(conn, bufConn)
 	}
 }
 
+// proxiedConn reports the client address announced by a PROXY protocol header
+// instead of the address of the load balancer.
+type proxiedConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+// RemoteAddr returns the original client address.
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// CloseWrite half-closes the underlying connection if it supports it.
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// bufferedConn reads from r, a reader buffering the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// tlsSelfDialer dials the TLS listener of the server for its own HTTP proxy.
+// The certificate is not checked, the connection does not leave the host.
+type tlsSelfDialer struct{}
+
+func (tlsSelfDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Client(conn, &tls.Config{InsecureSkipVerify: true}), nil
+}
+
+// clientAllowed reports whether the client of conn is in allowedClients.
+func (sf *Server) clientAllowed(conn net.Conn) bool {
+	if len(sf.allowedClients) == 0 {
+		return true
+	}
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); remote.IP.IsLoopback() || ok && remote.IP.Equal(local.IP) {
+		return true
+	}
+	for _, n := range sf.allowedClients {
+		if n.Contains(remote.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLoopback(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
+
 func (sf *Server) handleHTTPRequest(conn net.Conn, bufConn *bufio.Reader) error {
 	// redirect http to socks5
 	dstConn, err := net.Dial(sf.listen.Addr().Network(), sf.httpProxyBindAddr)
@@ -226,7 +385,7 @@ func (sf *Server) handleHTTPRequest(conn net.Conn, bufConn *bufio.Reader) error
 	return <-errChan
 }
 
-func (sf *Server) handleSocksRequest(conn net.Conn, bufConn *bufio.Reader) error {
+func (sf *Server) handleSocksRequest(ctx context.Context, conn net.Conn, bufConn *bufio.Reader) error {
 	var authContext *AuthContext
 
 	mr, err := statute.ParseMethodRequest(bufConn)
@@ -267,83 +426,9 @@ func (sf *Server) handleSocksRequest(conn net.Conn, bufConn *bufio.Reader) error
 	request.AuthContext = authContext
 	request.LocalAddr = conn.LocalAddr()
 	request.RemoteAddr = conn.RemoteAddr()
+	request.Reader = &BufferedConn{Reader: bufConn, Conn: conn}
 	// Process the client request
-	return sf.handleRequest(conn, request)
-}
-
-func readAsString(r io.Reader) (string, error) {
-	var buff bytes.Buffer
-	var b [1]byte
-	for {
-		if _, err := io.ReadFull(r, b[:]); err != nil {
-			return "", err
-		}
-		if b[0] == 0 {
-			break
-		}
-		buff.Write(b[:])
-	}
-	return buff.String(), nil
-}
-
-func (sf *Server) handleSocks4Request(conn net.Conn, bufConn *bufio.Reader) error {
-	var cddstportdstip [1 + 1 + 2 + 4]byte
-	var destination = ""
-	var dstHost = ""
-	if _, err := io.ReadFull(bufConn, cddstportdstip[:]); err != nil {
-		return err
-	}
-	command := cddstportdstip[1]
-	dstPort := binary.BigEndian.Uint16(cddstportdstip[2:4])
-	var dstIP net.IP = cddstportdstip[4:] // Change dstIp to dstIP
-	if command != uint8(1) {
-		return fmt.Errorf("command %d is not supported", command)
-	}
-	destination = net.JoinHostPort(dstIP.String(), strconv.Itoa(int(dstPort)))
-	// Skip USERID
-	if _, err := readAsString(bufConn); err != nil {
-		return err
-	}
-	// SOCKS4a
-	if dstIP[0] == 0 && dstIP[1] == 0 && dstIP[2] == 0 && dstIP[3] != 0 { // Change dstIp to dstIP
-		var err error
-		dstHost, err = readAsString(bufConn)
-		if err != nil {
-			return err
-		}
-	}
-
-	if dstHost != "" {
-		destination = net.JoinHostPort(dstHost, strconv.Itoa(int(dstPort)))
-	}
-
-	if _, err := conn.Write([]byte{0, 90, 0, 0, 0, 0, 0, 0}); err != nil {
-		return err
-	}
-
-	d, err := proxy.SOCKS5("tcp", sf.bindAddress, nil, proxy.Direct)
-	if err != nil {
-		return err
-	}
-	dstConn, err := d.Dial("tcp", destination)
-
-	if err != nil {
-		return err
-	}
-	var errCh = make(chan error, 2)
-	go func() {
-		_, err := io.Copy(dstConn, bufConn)
-		errCh <- err
-	}()
-	go func() {
-		_, err := io.Copy(conn, dstConn)
-		errCh <- err
-	}()
-	err = <-errCh
-	if err != nil {
-		return err
-	}
-	return <-errCh
+	return sf.handleRequest(ctx, conn, request)
 }
 
 // authenticate is used to handle connection authentication
@@ -0,0 +1,158 @@
+package socks5
+
+import (
+	"bepass/socks5/statute"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// SOCKS4 reply codes.
+const (
+	socks4Granted  = byte(90)
+	socks4Rejected = byte(91)
+)
+
+// maxSocks4Field bounds the user ID and the SOCKS4a hostname, read up to their
+// NUL, so a client never sending it can not grow them without end.
+const maxSocks4Field = 255
+
+// handleSocks4Request serves a SOCKS4 or SOCKS4a CONNECT. The request is
+// handed to the same handlers as a SOCKS5 one, their SOCKS5 reply translated
+// to SOCKS4. SOCKS4 has no authentication, so it is refused when the server
+// requires one.
+func (sf *Server) handleSocks4Request(ctx context.Context, conn net.Conn, bufConn *bufio.Reader) error {
+	var header [1 + 1 + 2 + 4]byte
+	if _, err := io.ReadFull(bufConn, header[:]); err != nil {
+		return err
+	}
+	command := header[1]
+	dst := statute.AddrSpec{
+		IP:       net.IPv4(header[4], header[5], header[6], header[7]),
+		Port:     int(binary.BigEndian.Uint16(header[2:4])),
+		AddrType: statute.ATYPIPv4,
+	}
+	userID, err := readAsString(bufConn, maxSocks4Field)
+	if err != nil {
+		return socks4Refuse(conn, fmt.Errorf("invalid socks4 user id, %w", err))
+	}
+	// SOCKS4a, the IP is 0.0.0.x and the hostname follows the user ID
+	if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+		if dst.FQDN, err = readAsString(bufConn, maxSocks4Field); err != nil {
+			return socks4Refuse(conn, fmt.Errorf("invalid socks4a hostname, %w", err))
+		}
+		dst.IP, dst.AddrType = nil, statute.ATYPDomain
+	}
+
+	if command != statute.CommandConnect {
+		if err := sendSocks4Reply(conn, socks4Rejected); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("unsupported socks4 command[%d]", command)
+	}
+	if !sf.noAuth() {
+		if err := sendSocks4Reply(conn, socks4Rejected); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("socks4 request refused, authentication is required")
+	}
+
+	request := &Request{
+		Request: statute.Request{
+			Version: statute.VersionSocks4,
+			Command: statute.CommandConnect,
+			DstAddr: dst,
+		},
+		AuthContext: &AuthContext{statute.MethodNoAuth, map[string]string{"UserID": userID}},
+		LocalAddr:   conn.LocalAddr(),
+		RemoteAddr:  conn.RemoteAddr(),
+		Reader:      &BufferedConn{Reader: bufConn, Conn: conn},
+	}
+	request.RawDestAddr = &request.Request.DstAddr
+	request.DestAddr = request.RawDestAddr
+	return sf.handleRequest(ctx, &socks4Writer{Conn: conn}, request)
+}
+
+// noAuth reports whether the server accepts clients without authentication.
+func (sf *Server) noAuth() bool {
+	for _, auth := range sf.authMethods {
+		if auth.GetCode() == statute.MethodNoAuth {
+			return true
+		}
+	}
+	return false
+}
+
+func sendSocks4Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socks4Writer translates the SOCKS5 reply of a handler, the first write, to
+// a SOCKS4 reply and passes the data relayed after it through.
+type socks4Writer struct {
+	net.Conn
+	replied bool
+}
+
+func (w *socks4Writer) Write(b []byte) (int, error) {
+	if w.replied {
+		return w.Conn.Write(b)
+	}
+	w.replied = true
+	code := socks4Rejected
+	if len(b) > 1 && b[0] == statute.VersionSocks5 && b[1] == statute.RepSuccess {
+		code = socks4Granted
+	}
+	if err := sendSocks4Reply(w.Conn, code); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// CloseWrite half-closes the underlying connection if it supports it.
+func (w *socks4Writer) CloseWrite() error {
+	if cw, ok := w.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// errSocks4FieldTooLong is the error of a user ID or hostname longer than
+// maxSocks4Field.
+var errSocks4FieldTooLong = errors.New("field too long")
+
+// socks4Refuse replies socks4Rejected to a field longer than maxSocks4Field
+// and returns err. A read error gets no reply, the connection failed.
+func socks4Refuse(conn net.Conn, err error) error {
+	if errors.Is(err, errSocks4FieldTooLong) {
+		if err := sendSocks4Reply(conn, socks4Rejected); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+	}
+	return err
+}
+
+// readAsString reads a NUL terminated string of at most limit bytes.
+func readAsString(r io.Reader, limit int) (string, error) {
+	var buff bytes.Buffer
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			break
+		}
+		if buff.Len() == limit {
+			return "", errSocks4FieldTooLong
+		}
+		buff.Write(b[:])
+	}
+	return buff.String(), nil
+}
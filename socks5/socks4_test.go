@@ -0,0 +1,70 @@
+package socks5
+
+import (
+	"bepass/socks5/statute"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// socks4Reply sends req to srv and returns the reply code.
+func socks4Reply(t *testing.T, srv *Server, req []byte) byte {
+	t.Helper()
+	client, conn := net.Pipe()
+	defer client.Close()
+	go func() { _ = srv.ServeConn(conn) }()
+	// a request refused before it is read whole is not read any further
+	go func() { _, _ = client.Write(req) }()
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[1]
+}
+
+func TestSocks4Connect(t *testing.T) {
+	var got string
+	srv := NewServer(
+		WithConnectHandle(func(_ context.Context, w io.Writer, req *Request) error {
+			got = req.RawDestAddr.String()
+			if req.RawDestAddr.Port == 25 {
+				return SendReply(w, statute.RepConnectionRefused, nil)
+			}
+			return SendReply(w, statute.RepSuccess, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+		}),
+	)
+
+	socks4 := []byte{statute.VersionSocks4, statute.CommandConnect, 1, 187, 192, 0, 2, 1, 'u', 0}
+	if rep := socks4Reply(t, srv, socks4); rep != socks4Granted || got != "192.0.2.1:443" {
+		t.Errorf("expected a granted SOCKS4 CONNECT to 192.0.2.1:443, got %d to %s", rep, got)
+	}
+	socks4a := append([]byte{statute.VersionSocks4, statute.CommandConnect, 0, 25, 0, 0, 0, 1, 0}, "example.com\x00"...)
+	if rep := socks4Reply(t, srv, socks4a); rep != socks4Rejected || got != "example.com:25" {
+		t.Errorf("expected a rejected SOCKS4a CONNECT to example.com:25, got %d to %s", rep, got)
+	}
+	bind := []byte{statute.VersionSocks4, statute.CommandBind, 1, 187, 192, 0, 2, 1, 0}
+	if rep := socks4Reply(t, srv, bind); rep != socks4Rejected {
+		t.Errorf("expected BIND to be rejected, got %d", rep)
+	}
+
+	longID := append([]byte{statute.VersionSocks4, statute.CommandConnect, 1, 187, 192, 0, 2, 1}, strings.Repeat("u", 4096)...)
+	if rep := socks4Reply(t, srv, longID); rep != socks4Rejected {
+		t.Errorf("expected an overlong user id to be rejected, got %d", rep)
+	}
+	longHost := append([]byte{statute.VersionSocks4, statute.CommandConnect, 1, 187, 0, 0, 0, 1, 0}, strings.Repeat("a", 256)...)
+	if rep := socks4Reply(t, srv, append(longHost, 0)); rep != socks4Rejected {
+		t.Errorf("expected an overlong SOCKS4a hostname to be rejected, got %d", rep)
+	}
+	got = ""
+	maxHost := append([]byte{statute.VersionSocks4, statute.CommandConnect, 1, 187, 0, 0, 0, 1, 0}, strings.Repeat("a", 255)...)
+	if rep := socks4Reply(t, srv, append(maxHost, 0)); rep != socks4Granted || got != strings.Repeat("a", 255)+":443" {
+		t.Errorf("expected a hostname of 255 bytes to be accepted, got %d to %s", rep, got)
+	}
+
+	authSrv := NewServer(WithCredential(StaticCredentials{"user": "pass"}))
+	if rep := socks4Reply(t, authSrv, socks4); rep != socks4Rejected {
+		t.Errorf("expected SOCKS4 to be refused when authentication is required, got %d", rep)
+	}
+}
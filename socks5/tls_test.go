@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"bepass/socks5/statute"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedCert returns a certificate for localhost.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestWithTLS(t *testing.T) {
+	cert := selfSignedCert(t)
+	srv := NewServer(
+		WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		WithConnectHandle(func(_ context.Context, w io.Writer, _ *Request) error {
+			return SendReply(w, statute.RepSuccess, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+		}),
+	)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go func() { _ = srv.ServeConn(conn) }()
+
+	roots := x509.NewCertPool()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots.AddCert(leaf)
+	tlsClient := tls.Client(client, &tls.Config{ServerName: "localhost", RootCAs: roots})
+	if rep := socksConnect(t, tlsClient, 443); rep != statute.RepSuccess {
+		t.Errorf("expected a successful CONNECT over TLS, got %d", rep)
+	}
+	if !tlsClient.ConnectionState().HandshakeComplete {
+		t.Error("expected the request to go over TLS")
+	}
+}
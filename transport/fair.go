@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// channelQueueLen is the number of packets a channel can have waiting for the
+// tunnel, the ones past it are dropped as a full socket buffer would.
+const channelQueueLen = 64
+
+// fairQueue holds the packets of the channels of a tunnel on their way to its
+// connection, served in turn one packet per channel, so a channel sending at
+// a high rate does not hold back the others sharing the tunnel.
+type fairQueue struct {
+	mu      sync.Mutex
+	pending map[uint16][]UDPPacket
+	// ready lists the channels with pending packets, in the order they are served
+	ready []uint16
+	// wake is signaled when a packet is pushed
+	wake chan struct{}
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{pending: make(map[uint16][]UDPPacket), wake: make(chan struct{}, 1)}
+}
+
+// push queues pkt behind the packets of its channel. It returns false, pkt
+// dropped, when the channel already has channelQueueLen packets waiting.
+func (q *fairQueue) push(pkt UDPPacket) bool {
+	q.mu.Lock()
+	queue := q.pending[pkt.Channel]
+	if len(queue) >= channelQueueLen {
+		q.mu.Unlock()
+		return false
+	}
+	if len(queue) == 0 {
+		q.ready = append(q.ready, pkt.Channel)
+	}
+	q.pending[pkt.Channel] = append(queue, pkt)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pop returns the oldest packet of the channel whose turn it is, the channel
+// then waits behind the others if it has more. It waits for a packet until
+// ctx is done.
+func (q *fairQueue) pop(ctx context.Context) (UDPPacket, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.ready) > 0 {
+			channel := q.ready[0]
+			q.ready = q.ready[1:]
+			queue := q.pending[channel]
+			pkt := queue[0]
+			if len(queue) == 1 {
+				delete(q.pending, channel)
+			} else {
+				q.pending[channel] = queue[1:]
+				q.ready = append(q.ready, channel)
+			}
+			q.mu.Unlock()
+			return pkt, true
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.wake:
+		case <-ctx.Done():
+			return UDPPacket{}, false
+		}
+	}
+}
+
+// drop discards the packets waiting on channel.
+func (q *fairQueue) drop(channel uint16) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[channel]; !ok {
+		return
+	}
+	delete(q.pending, channel)
+	q.ready = slices.DeleteFunc(q.ready, func(c uint16) bool { return c == channel })
+}
@@ -0,0 +1,56 @@
+package transport
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFairQueue(t *testing.T) {
+	q := newFairQueue()
+	for i := 0; i < 3; i++ {
+		q.push(UDPPacket{Channel: 1, Data: []byte{byte(i)}})
+	}
+	q.push(UDPPacket{Channel: 2})
+	q.push(UDPPacket{Channel: 3})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var order []uint16
+	for i := 0; i < 5; i++ {
+		pkt, ok := q.pop(ctx)
+		if !ok {
+			t.Fatal("expected a pending packet")
+		}
+		order = append(order, pkt.Channel)
+	}
+	// the channels take turns, the busy one does not drain first
+	want := []uint16{1, 2, 3, 1, 1}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("expected the channels served in the order %v, got %v", want, order)
+		}
+	}
+
+	for i := 0; i < channelQueueLen; i++ {
+		if !q.push(UDPPacket{Channel: 1}) {
+			t.Fatalf("packet %d dropped before the queue filled", i)
+		}
+	}
+	if q.push(UDPPacket{Channel: 1}) {
+		t.Error("expected a packet past the queue length to be dropped")
+	}
+	if !q.push(UDPPacket{Channel: 2}) {
+		t.Error("a full channel should not hold back another")
+	}
+	q.drop(1)
+	if pkt, _ := q.pop(ctx); pkt.Channel != 2 {
+		t.Errorf("expected the packets of a dropped channel discarded, got one of channel %d", pkt.Channel)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, ok := q.pop(ctx); ok {
+		t.Error("expected no packet from an empty queue")
+	}
+}
@@ -0,0 +1,96 @@
+// Package transport provides WebSocket tunneling functionality.
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// frameHeaderLen is the size of the channel ID that prefixes every frame received from the tunnel.
+const frameHeaderLen = 2
+
+var errShortFrame = errors.New("tunnel frame shorter than its header")
+
+// encodeFrame builds a tunnel frame: the client ID, the big endian channel ID and the payload.
+func encodeFrame(clientID string, pkt UDPPacket) []byte {
+	frame := make([]byte, 0, len(clientID)+2+len(pkt.Data))
+	frame = append(frame, clientID...)
+	frame = binary.BigEndian.AppendUint16(frame, pkt.Channel)
+	return append(frame, pkt.Data...)
+}
+
+// writeFrame writes a whole tunnel frame to w. A short write would desync the
+// channel framing on the tunnel, so it is reported as io.ErrShortWrite.
+func writeFrame(w io.Writer, clientID string, pkt UDPPacket) error {
+	frame := encodeFrame(clientID, pkt)
+	n, err := w.Write(frame)
+	if err != nil {
+		return err
+	}
+	if n != len(frame) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// parseFrame decodes a frame received from the tunnel into its channel ID and payload.
+func parseFrame(b []byte) (UDPPacket, error) {
+	if len(b) < frameHeaderLen {
+		return UDPPacket{}, errShortFrame
+	}
+	return UDPPacket{
+		Channel: binary.BigEndian.Uint16(b[:frameHeaderLen]),
+		Data:    b[frameHeaderLen:],
+	}, nil
+}
+
+// Stream frame types. On a stream tunnel every frame carries one of them after
+// the channel ID, so several TCP streams can share one WebSocket.
+const (
+	// streamOpen asks the worker to connect the channel to the host:port in the
+	// payload, the worker answers with an empty streamOpen once connected
+	streamOpen byte = iota + 1
+	// streamData carries stream bytes
+	streamData
+	// streamClose closes the channel, the payload is an optional error message
+	streamClose
+)
+
+// streamFrameHeaderLen is the size of the channel ID and frame type that
+// prefix every stream frame received from the tunnel.
+const streamFrameHeaderLen = frameHeaderLen + 1
+
+// streamFrame is a decoded stream tunnel frame.
+type streamFrame struct {
+	Channel uint16
+	Type    byte
+	Data    []byte
+}
+
+// encodeStreamFrame builds a stream tunnel frame: the client ID, the big endian
+// channel ID, the frame type and the payload.
+func encodeStreamFrame(clientID string, f streamFrame) []byte {
+	frame := make([]byte, 0, len(clientID)+streamFrameHeaderLen+len(f.Data))
+	frame = append(frame, clientID...)
+	frame = binary.BigEndian.AppendUint16(frame, f.Channel)
+	frame = append(frame, f.Type)
+	return append(frame, f.Data...)
+}
+
+// parseStreamFrame decodes a stream frame received from the tunnel.
+func parseStreamFrame(b []byte) (streamFrame, error) {
+	if len(b) < streamFrameHeaderLen {
+		return streamFrame{}, errShortFrame
+	}
+	f := streamFrame{
+		Channel: binary.BigEndian.Uint16(b[:frameHeaderLen]),
+		Type:    b[frameHeaderLen],
+		Data:    b[streamFrameHeaderLen:],
+	}
+	if f.Type < streamOpen || f.Type > streamClose {
+		return streamFrame{}, fmt.Errorf("unknown stream frame type %d", f.Type)
+	}
+	return f, nil
+}
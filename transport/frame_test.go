@@ -0,0 +1,97 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// shortWriter accepts at most limit bytes per write without reporting an error.
+type shortWriter struct {
+	limit int
+	buf   bytes.Buffer
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		p = p[:w.limit]
+	}
+	return w.buf.Write(p)
+}
+
+func TestWriteFrame(t *testing.T) {
+	pkt := UDPPacket{Channel: 0x0102, Data: []byte("payload")}
+
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, "abcdef", pkt); err != nil {
+		t.Fatalf("writeFrame failed: %v", err)
+	}
+	expected := append([]byte("abcdef\x01\x02"), pkt.Data...)
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("Expected frame %q, got %q", expected, buf.Bytes())
+	}
+}
+
+func TestWriteFrameShortWrite(t *testing.T) {
+	w := &shortWriter{limit: 4}
+	err := writeFrame(w, "abcdef", UDPPacket{Channel: 1, Data: []byte("payload")})
+	if !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("Expected io.ErrShortWrite, got %v", err)
+	}
+}
+
+func TestParseFrame(t *testing.T) {
+	if _, err := parseFrame([]byte{0x01}); err == nil {
+		t.Errorf("Expected an error for a frame shorter than the header")
+	}
+
+	pkt, err := parseFrame([]byte{0x00, 0x07, 'h', 'i'})
+	if err != nil {
+		t.Fatalf("parseFrame failed: %v", err)
+	}
+	if pkt.Channel != 7 || string(pkt.Data) != "hi" {
+		t.Errorf("Expected channel 7 with data \"hi\", got %d with %q", pkt.Channel, pkt.Data)
+	}
+}
+
+func FuzzParseTunnelFrame(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x00})
+	f.Add([]byte{0x00, 0x01})
+	f.Add([]byte{0xff, 0xff, 'd', 'a', 't', 'a'})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		pkt, err := parseFrame(b)
+		if err != nil {
+			if len(b) >= frameHeaderLen {
+				t.Fatalf("unexpected error for %d byte frame: %v", len(b), err)
+			}
+			return
+		}
+		if len(pkt.Data) != len(b)-frameHeaderLen {
+			t.Fatalf("expected %d bytes of payload, got %d", len(b)-frameHeaderLen, len(pkt.Data))
+		}
+	})
+}
+
+func TestStreamFrame(t *testing.T) {
+	frame := encodeStreamFrame("abcdef", streamFrame{Channel: 0x0102, Type: streamData, Data: []byte("hi")})
+	if expected := []byte("abcdef\x01\x02\x02hi"); !bytes.Equal(frame, expected) {
+		t.Errorf("Expected frame %q, got %q", expected, frame)
+	}
+
+	f, err := parseStreamFrame(frame[len("abcdef"):])
+	if err != nil {
+		t.Fatalf("parseStreamFrame failed: %v", err)
+	}
+	if f.Channel != 0x0102 || f.Type != streamData || string(f.Data) != "hi" {
+		t.Errorf("Unexpected stream frame %+v", f)
+	}
+
+	if _, err := parseStreamFrame([]byte{0x00, 0x01}); err == nil {
+		t.Errorf("Expected an error for a frame shorter than the header")
+	}
+	if _, err := parseStreamFrame([]byte{0x00, 0x01, 0x09}); err == nil {
+		t.Errorf("Expected an error for an unknown frame type")
+	}
+}
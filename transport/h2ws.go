@@ -0,0 +1,921 @@
+// Package transport provides WebSocket tunneling functionality.
+package transport
+
+import (
+	"bepass/logger"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// settingEnableConnectProtocol is SETTINGS_ENABLE_CONNECT_PROTOCOL from RFC 8441.
+const settingEnableConnectProtocol http2.SettingID = 0x8
+
+const (
+	h2InitialWindowSize = 65535
+	h2WindowUpdateSize  = 16 * 1024
+	// h2MaxStreamID is the last client stream identifier, a session running out
+	// of identifiers is not reused
+	h2MaxStreamID = 1<<31 - 1
+	// h2ValidateAfter is how long a pooled session can sit idle before it is
+	// pinged ahead of being reused, a censor may have silently dropped it
+	h2ValidateAfter = time.Second
+	// h2PingTimeout is how long the validation ping waits for its answer
+	h2PingTimeout = 2 * time.Second
+)
+
+var (
+	errNoH2              = errors.New("server did not negotiate h2")
+	errNoExtendedConnect = errors.New("server does not support extended CONNECT")
+	errH2StreamClosed    = errors.New("http2 stream closed")
+	errH2SessionClosed   = errors.New("http2 connection closed")
+)
+
+// h2Session is an HTTP/2 connection carrying WebSocket streams opened with
+// extended CONNECT requests (RFC 8441).
+type h2Session struct {
+	conn   net.Conn
+	framer *http2.Framer
+	// expires is when the session stops taking new streams, zero for never
+	expires time.Time
+	// onIdle is called when the last stream of the session ends, the session
+	// is closed if nil
+	onIdle func()
+
+	// wmu serializes frame writes and guards the header encoder
+	wmu  sync.Mutex
+	hbuf bytes.Buffer
+	henc *hpack.Encoder
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// streams holds the open streams by identifier
+	streams map[uint32]*h2Conn
+	// active counts the open streams and the callers about to open one
+	active        int
+	nextStreamID  uint32
+	connWindow    int32
+	initialWindow int32
+	maxFrameSize  uint32
+	maxStreams    uint32
+	goAway        bool
+	err           error
+	// idleSince is when the last stream ended, zero while streams are open
+	idleSince time.Time
+	// pings holds the pings waiting for their acknowledgement
+	pings map[[8]byte]chan struct{}
+}
+
+// newH2Session sends the HTTP/2 preface over conn and waits for the server
+// settings. It fails with errNoExtendedConnect if the server can not carry
+// WebSockets over HTTP/2.
+func newH2Session(ctx context.Context, conn net.Conn) (*h2Session, error) {
+	s := &h2Session{
+		conn:          conn,
+		framer:        http2.NewFramer(conn, conn),
+		streams:       make(map[uint32]*h2Conn),
+		nextStreamID:  1,
+		connWindow:    h2InitialWindowSize,
+		initialWindow: h2InitialWindowSize,
+		maxFrameSize:  16384,
+		maxStreams:    math.MaxUint32,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.henc = hpack.NewEncoder(&s.hbuf)
+	s.framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		return nil, err
+	}
+	if err := s.framer.WriteSettings(http2.Setting{ID: http2.SettingEnablePush, Val: 0}); err != nil {
+		return nil, err
+	}
+
+	for {
+		f, err := s.framer.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		sf, ok := f.(*http2.SettingsFrame)
+		if !ok || sf.IsAck() {
+			continue
+		}
+		if v, ok := sf.Value(settingEnableConnectProtocol); !ok || v != 1 {
+			return nil, errNoExtendedConnect
+		}
+		s.applySettings(sf)
+		if err := s.framer.WriteSettingsAck(); err != nil {
+			return nil, err
+		}
+		go s.readLoop()
+		return s, nil
+	}
+}
+
+// reusable reports whether new streams can still be opened on the session.
+// The caller must hold s.mu.
+func (s *h2Session) reusable() bool {
+	return s.err == nil && !s.goAway && s.nextStreamID < h2MaxStreamID &&
+		(s.expires.IsZero() || time.Now().Before(s.expires))
+}
+
+// acquire reserves a stream of the session for the caller, who must then
+// open it or give it back with release. It also returns how long the session
+// had been idle.
+func (s *h2Session) acquire() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.reusable() || uint32(s.active) >= s.maxStreams {
+		return 0, false
+	}
+	var idleFor time.Duration
+	if s.active == 0 && !s.idleSince.IsZero() {
+		idleFor = time.Since(s.idleSince)
+	}
+	s.active++
+	s.idleSince = time.Time{}
+	return idleFor, true
+}
+
+// release gives back a stream reserved with acquire.
+func (s *h2Session) release() {
+	s.mu.Lock()
+	s.active--
+	idle := s.active == 0
+	if idle {
+		s.idleSince = time.Now()
+	}
+	s.mu.Unlock()
+	if !idle {
+		return
+	}
+	if s.onIdle != nil {
+		s.onIdle()
+	} else {
+		_ = s.Close()
+	}
+}
+
+// idle reports whether the session has no open or reserved stream.
+func (s *h2Session) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active == 0
+}
+
+// idleFor returns how long the session has had no stream, 0 if it has some.
+func (s *h2Session) idleFor() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active > 0 || s.idleSince.IsZero() {
+		return 0
+	}
+	return time.Since(s.idleSince)
+}
+
+// ping sends a PING frame and waits for its acknowledgement, telling whether
+// the connection is still alive.
+func (s *h2Session) ping(ctx context.Context) error {
+	var data [8]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		return err
+	}
+	ack := make(chan struct{})
+	s.mu.Lock()
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		return err
+	}
+	if s.pings == nil {
+		s.pings = make(map[[8]byte]chan struct{})
+	}
+	s.pings[data] = ack
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, data)
+		s.mu.Unlock()
+	}()
+
+	s.wmu.Lock()
+	err := s.framer.WritePing(false, data)
+	s.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, h2PingTimeout)
+	defer cancel()
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("http2 ping: %v", ctx.Err())
+	}
+}
+
+// Close closes the connection, failing the streams still open.
+func (s *h2Session) Close() error {
+	s.fail(errH2SessionClosed)
+	return s.conn.Close()
+}
+
+// fail records why the connection ended and wakes up every stream.
+func (s *h2Session) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	for _, st := range s.streams {
+		st.setReadErr(s.err)
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// openStream sends the extended CONNECT request for protocol on a stream
+// reserved with acquire and waits for the response. The reservation is given
+// back if the stream can not be opened.
+func (s *h2Session) openStream(ctx context.Context, protocol, authority, path string, header http.Header) (*h2Conn, http.Header, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		s.release()
+		return nil, nil, err
+	}
+	st := &h2Conn{
+		s:        s,
+		id:       s.nextStreamID,
+		window:   s.initialWindow,
+		response: make(chan *http2.MetaHeadersFrame, 1),
+	}
+	s.nextStreamID += 2
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	s.wmu.Lock()
+	s.hbuf.Reset()
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: http.MethodConnect},
+		{Name: ":protocol", Value: protocol},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: authority},
+		{Name: ":path", Value: path},
+	}
+	for k, vs := range header {
+		switch k = strings.ToLower(k); k {
+		// hop-by-hop and HTTP/1.1 only upgrade headers must not be sent over HTTP/2
+		case "host", "connection", "upgrade", "sec-websocket-key", "keep-alive", "proxy-connection", "transfer-encoding":
+			continue
+		}
+		for _, v := range vs {
+			fields = append(fields, hpack.HeaderField{Name: k, Value: v})
+		}
+	}
+	for _, f := range fields {
+		_ = s.henc.WriteField(f)
+	}
+	err := s.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      st.id,
+		BlockFragment: s.hbuf.Bytes(),
+		EndHeaders:    true,
+	})
+	s.wmu.Unlock()
+	if err != nil {
+		s.fail(err)
+		_ = st.Close()
+		return nil, nil, err
+	}
+
+	select {
+	case hf := <-st.response:
+		if hf == nil {
+			err := st.err()
+			_ = st.Close()
+			return nil, nil, err
+		}
+		if status := hf.PseudoValue("status"); status != "200" {
+			_ = st.Close()
+			return nil, nil, fmt.Errorf("extended CONNECT failed with status %s", status)
+		}
+		respHeader := make(http.Header)
+		for _, f := range hf.RegularFields() {
+			respHeader.Add(f.Name, f.Value)
+		}
+		return st, respHeader, nil
+	case <-ctx.Done():
+		_ = st.Close()
+		return nil, nil, ctx.Err()
+	}
+}
+
+func (s *h2Session) applySettings(sf *http2.SettingsFrame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = sf.ForeachSetting(func(setting http2.Setting) error {
+		switch setting.ID {
+		case http2.SettingInitialWindowSize:
+			delta := int32(setting.Val) - s.initialWindow
+			s.initialWindow = int32(setting.Val)
+			for _, st := range s.streams {
+				st.window += delta
+			}
+		case http2.SettingMaxFrameSize:
+			s.maxFrameSize = setting.Val
+		case http2.SettingMaxConcurrentStreams:
+			s.maxStreams = setting.Val
+		}
+		return nil
+	})
+	s.cond.Broadcast()
+}
+
+// handleControl processes the frames that are not stream data.
+func (s *h2Session) handleControl(f http2.Frame) error {
+	switch f := f.(type) {
+	case *http2.SettingsFrame:
+		if f.IsAck() {
+			return nil
+		}
+		s.applySettings(f)
+		s.wmu.Lock()
+		defer s.wmu.Unlock()
+		return s.framer.WriteSettingsAck()
+	case *http2.PingFrame:
+		if f.IsAck() {
+			s.mu.Lock()
+			if ack, ok := s.pings[f.Data]; ok {
+				close(ack)
+				delete(s.pings, f.Data)
+			}
+			s.mu.Unlock()
+			return nil
+		}
+		s.wmu.Lock()
+		defer s.wmu.Unlock()
+		return s.framer.WritePing(true, f.Data)
+	case *http2.WindowUpdateFrame:
+		s.mu.Lock()
+		if f.StreamID == 0 {
+			s.connWindow += int32(f.Increment)
+		} else if st, ok := s.streams[f.StreamID]; ok {
+			st.window += int32(f.Increment)
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	case *http2.RSTStreamFrame:
+		s.mu.Lock()
+		if st, ok := s.streams[f.StreamID]; ok {
+			st.setReadErr(fmt.Errorf("http2 stream reset: %v", f.ErrCode))
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	case *http2.GoAwayFrame:
+		// streams the server did not process are failed, the others run to
+		// their end but no new stream is opened
+		s.mu.Lock()
+		s.goAway = true
+		for id, st := range s.streams {
+			if id > f.LastStreamID {
+				st.setReadErr(fmt.Errorf("http2 connection closed by peer: %v", f.ErrCode))
+			}
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *h2Session) readLoop() {
+	// the connection window is given back as soon as data is received, each
+	// stream has its own window bounding what it buffers
+	connUnacked := 0
+	for {
+		f, err := s.framer.ReadFrame()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		switch f := f.(type) {
+		case *http2.DataFrame:
+			s.mu.Lock()
+			st, ok := s.streams[f.StreamID]
+			if ok {
+				st.readBuf.Write(f.Data())
+				if f.StreamEnded() {
+					st.setReadErr(io.EOF)
+				}
+				s.cond.Broadcast()
+			}
+			s.mu.Unlock()
+			// padding is never handed to Read, so give its window back right away
+			if padding := int(f.Header().Length) - len(f.Data()); ok && padding > 0 {
+				s.writeWindowUpdate(f.StreamID, padding)
+			}
+			connUnacked += int(f.Header().Length)
+			if connUnacked >= h2WindowUpdateSize {
+				s.writeWindowUpdate(0, connUnacked)
+				connUnacked = 0
+			}
+		case *http2.MetaHeadersFrame:
+			s.mu.Lock()
+			if st, ok := s.streams[f.StreamID]; ok {
+				if !st.responded {
+					st.responded = true
+					st.response <- f
+				} else if f.StreamEnded() {
+					st.setReadErr(io.EOF)
+				}
+				s.cond.Broadcast()
+			}
+			s.mu.Unlock()
+		default:
+			if err := s.handleControl(f); err != nil {
+				s.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func (s *h2Session) writeWindowUpdate(streamID uint32, n int) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	_ = s.framer.WriteWindowUpdate(streamID, uint32(n))
+}
+
+// h2Conn is a WebSocket stream of an h2Session, used as a net.Conn
+// transporting the raw WebSocket bytes.
+type h2Conn struct {
+	s  *h2Session
+	id uint32
+	// response receives the answer to the extended CONNECT request, or nil if
+	// the stream failed before it
+	response chan *http2.MetaHeadersFrame
+
+	// the fields below are guarded by s.mu
+	responded     bool
+	readBuf       bytes.Buffer
+	readErr       error
+	unacked       int
+	window        int32
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// setReadErr ends the stream with err. The caller must hold s.mu.
+func (c *h2Conn) setReadErr(err error) {
+	if c.readErr == nil {
+		c.readErr = err
+	}
+	if !c.responded {
+		c.responded = true
+		c.response <- nil
+	}
+}
+
+func (c *h2Conn) err() error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	if c.readErr == nil || c.readErr == io.EOF {
+		return errH2StreamClosed
+	}
+	return c.readErr
+}
+
+// Read reads the stream data.
+func (c *h2Conn) Read(b []byte) (int, error) {
+	s := c.s
+	s.mu.Lock()
+	for c.readBuf.Len() == 0 && c.readErr == nil && !c.closed {
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			s.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.cond.Wait()
+	}
+	if c.readBuf.Len() == 0 {
+		err := c.readErr
+		if c.closed {
+			err = errH2StreamClosed
+		}
+		s.mu.Unlock()
+		return 0, err
+	}
+	n, _ := c.readBuf.Read(b)
+	c.unacked += n
+	update := 0
+	if c.unacked >= h2WindowUpdateSize || c.readBuf.Len() == 0 {
+		update, c.unacked = c.unacked, 0
+	}
+	ended := c.readErr != nil
+	s.mu.Unlock()
+
+	if update > 0 && !ended {
+		s.writeWindowUpdate(c.id, update)
+	}
+	return n, nil
+}
+
+// Write sends b as DATA frames, honoring the flow control windows of the peer.
+func (c *h2Conn) Write(b []byte) (int, error) {
+	s := c.s
+	written := 0
+	for written < len(b) {
+		s.mu.Lock()
+		for (s.connWindow <= 0 || c.window <= 0) && c.readErr == nil && !c.closed {
+			if !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline) {
+				s.mu.Unlock()
+				return written, os.ErrDeadlineExceeded
+			}
+			s.cond.Wait()
+		}
+		if c.closed || (c.readErr != nil && c.readErr != io.EOF) {
+			err := c.readErr
+			if c.closed || err == nil {
+				err = errH2StreamClosed
+			}
+			s.mu.Unlock()
+			return written, err
+		}
+		n := len(b) - written
+		for _, limit := range []int{int(s.connWindow), int(c.window), int(s.maxFrameSize)} {
+			if limit < n {
+				n = limit
+			}
+		}
+		s.connWindow -= int32(n)
+		c.window -= int32(n)
+		s.mu.Unlock()
+
+		s.wmu.Lock()
+		err := s.framer.WriteData(c.id, false, b[written:written+n])
+		s.wmu.Unlock()
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close resets the stream. The connection is closed, or kept for later
+// streams if pooled, once it has no stream left.
+func (c *h2Conn) Close() error {
+	s := c.s
+	s.mu.Lock()
+	if c.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	delete(s.streams, c.id)
+	sessionErr := s.err
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if sessionErr == nil {
+		s.wmu.Lock()
+		_ = s.framer.WriteRSTStream(c.id, http2.ErrCodeCancel)
+		s.wmu.Unlock()
+	}
+	s.release()
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (c *h2Conn) LocalAddr() net.Addr { return c.s.conn.LocalAddr() }
+
+// RemoteAddr returns the remote network address.
+func (c *h2Conn) RemoteAddr() net.Addr { return c.s.conn.RemoteAddr() }
+
+// SetDeadline sets the read and write deadlines of the stream.
+func (c *h2Conn) SetDeadline(t time.Time) error {
+	c.setDeadlines(&t, &t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for future and pending Read calls.
+func (c *h2Conn) SetReadDeadline(t time.Time) error {
+	c.setDeadlines(&t, nil)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future and pending Write calls.
+func (c *h2Conn) SetWriteDeadline(t time.Time) error {
+	c.setDeadlines(nil, &t)
+	return nil
+}
+
+func (c *h2Conn) setDeadlines(read, write *time.Time) {
+	s := c.s
+	s.mu.Lock()
+	var t time.Time
+	if read != nil {
+		c.readDeadline, t = *read, *read
+	}
+	if write != nil {
+		c.writeDeadline, t = *write, *write
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if !t.IsZero() {
+		time.AfterFunc(time.Until(t), func() {
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		})
+	}
+}
+
+// h2Pool keeps HTTP/2 connections to the workers open, so a new WebSocket to
+// a worker is opened as a stream of an existing connection instead of costing
+// a TLS handshake.
+type h2Pool struct {
+	// maxIdle is the number of connections without streams kept per address,
+	// 0 disables pooling
+	maxIdle int
+	// maxLifetime is how long a connection takes new streams, 0 for no limit
+	maxLifetime time.Duration
+	// idleTimeout is how long a connection without streams is kept, 0 for no
+	// limit
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string][]*h2Session
+}
+
+// get returns a session to addr with a stream reserved for the caller,
+// reusing a pooled session if one has room or starting one over a
+// connection from dial. A session idle for a while is pinged first, so a
+// connection that died silently is not handed out.
+func (p *h2Pool) get(ctx context.Context, addr string, dial func(context.Context) (net.Conn, error)) (*h2Session, error) {
+	for p.maxIdle > 0 {
+		s, idleFor := p.acquire(addr)
+		if s == nil {
+			break
+		}
+		if idleFor < h2ValidateAfter {
+			return s, nil
+		}
+		err := s.ping(ctx)
+		if err == nil {
+			return s, nil
+		}
+		if ctx.Err() != nil {
+			s.release()
+			return nil, ctx.Err()
+		}
+		logger.Errorf("pooled http2 connection to %s is dead: %v", addr, err)
+		s.fail(err)
+		s.release()
+	}
+
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newH2Session(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	s.acquire()
+	if p.maxIdle <= 0 {
+		return s, nil
+	}
+	if p.maxLifetime > 0 {
+		s.expires = time.Now().Add(p.maxLifetime)
+	}
+	s.onIdle = func() { p.idle(addr, s) }
+	p.mu.Lock()
+	if p.sessions == nil {
+		p.sessions = make(map[string][]*h2Session)
+	}
+	p.sessions[addr] = append(p.sessions[addr], s)
+	p.mu.Unlock()
+	return s, nil
+}
+
+// acquire reserves a stream of a pooled session to addr, dropping the idle
+// sessions that can not be reused. It returns nil if no session has room.
+func (p *h2Pool) acquire(addr string) (*h2Session, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range append([]*h2Session(nil), p.sessions[addr]...) {
+		if p.idleTimeout > 0 && s.idleFor() >= p.idleTimeout {
+			p.remove(addr, s)
+			continue
+		}
+		if idleFor, ok := s.acquire(); ok {
+			return s, idleFor
+		}
+		if s.idle() {
+			// an idle session that can not take streams is dead or expired
+			p.remove(addr, s)
+		}
+	}
+	return nil, 0
+}
+
+// idle is called when s has no stream left. It is kept for later streams
+// unless it can not take new streams or enough idle sessions are kept, and
+// closed once idle for idleTimeout.
+func (p *h2Pool) idle(addr string, s *h2Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !s.idle() {
+		// reused meanwhile
+		return
+	}
+	s.mu.Lock()
+	keep := s.reusable()
+	s.mu.Unlock()
+	if keep {
+		idle := 0
+		for _, other := range p.sessions[addr] {
+			if other != s && other.idle() {
+				idle++
+			}
+		}
+		keep = idle < p.maxIdle
+	}
+	if !keep {
+		p.remove(addr, s)
+		return
+	}
+	if p.idleTimeout > 0 {
+		time.AfterFunc(p.idleTimeout, func() { p.reap(addr, s) })
+	}
+}
+
+// reap closes s if it has been idle for idleTimeout.
+func (p *h2Pool) reap(addr string, s *h2Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s.idleFor() >= p.idleTimeout {
+		p.remove(addr, s)
+	}
+}
+
+// closeAll closes every pooled session, the streams they carry included.
+func (p *h2Pool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, sessions := range p.sessions {
+		for _, s := range sessions {
+			_ = s.Close()
+		}
+		delete(p.sessions, addr)
+	}
+}
+
+// remove closes s and drops it from the pool. The caller must hold p.mu.
+func (p *h2Pool) remove(addr string, s *h2Session) {
+	sessions := p.sessions[addr]
+	for i, other := range sessions {
+		if other == s {
+			p.sessions[addr] = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(p.sessions[addr]) == 0 {
+		delete(p.sessions, addr)
+	}
+	_ = s.Close()
+}
+
+// upgradeShim lets gorilla/websocket run over an h2Session. gorilla writes an
+// HTTP/1.1 upgrade request; the shim turns it into an extended CONNECT
+// request and answers with the 101 response gorilla expects, so gorilla keeps
+// doing the WebSocket framing on top of the HTTP/2 stream.
+type upgradeShim struct {
+	conn net.Conn
+	// session has a stream reserved for the shim until it is opened
+	session *h2Session
+	stream  *h2Conn
+	ctx     context.Context
+	reqBuf  bytes.Buffer
+	resp    *bytes.Reader
+}
+
+func newUpgradeShim(ctx context.Context, session *h2Session) *upgradeShim {
+	return &upgradeShim{conn: session.conn, session: session, ctx: ctx}
+}
+
+// Write intercepts the upgrade request, later writes go to the stream.
+func (s *upgradeShim) Write(b []byte) (int, error) {
+	if s.stream != nil {
+		return s.stream.Write(b)
+	}
+	if s.session == nil {
+		return 0, errH2StreamClosed
+	}
+	s.reqBuf.Write(b)
+	if !bytes.Contains(s.reqBuf.Bytes(), []byte("\r\n\r\n")) {
+		return len(b), nil
+	}
+	req, err := http.ReadRequest(bufio.NewReader(&s.reqBuf))
+	if err != nil {
+		return 0, err
+	}
+	session := s.session
+	s.session = nil
+	stream, respHeader, err := session.openStream(s.ctx, "websocket", req.Host, req.URL.RequestURI(), req.Header)
+	if err != nil {
+		return 0, err
+	}
+
+	var resp bytes.Buffer
+	resp.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&resp, "Sec-WebSocket-Accept: %s\r\n", websocketAccept(req.Header.Get("Sec-WebSocket-Key")))
+	if p := respHeader.Get("Sec-WebSocket-Protocol"); p != "" {
+		fmt.Fprintf(&resp, "Sec-WebSocket-Protocol: %s\r\n", p)
+	}
+	resp.WriteString("\r\n")
+	s.resp = bytes.NewReader(resp.Bytes())
+	s.stream = stream
+	return len(b), nil
+}
+
+// Read returns the synthesized upgrade response first, then the stream data.
+func (s *upgradeShim) Read(b []byte) (int, error) {
+	if s.resp != nil && s.resp.Len() > 0 {
+		return s.resp.Read(b)
+	}
+	if s.stream == nil {
+		return 0, errors.New("read before the websocket upgrade request")
+	}
+	return s.stream.Read(b)
+}
+
+// Close closes the stream, or gives back the reserved one if it was never opened.
+func (s *upgradeShim) Close() error {
+	if s.stream != nil {
+		return s.stream.Close()
+	}
+	if s.session != nil {
+		s.session.release()
+		s.session = nil
+	}
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (s *upgradeShim) LocalAddr() net.Addr { return s.conn.LocalAddr() }
+
+// RemoteAddr returns the remote network address.
+func (s *upgradeShim) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+// SetDeadline sets the deadlines of the stream, it is a no-op before the upgrade.
+func (s *upgradeShim) SetDeadline(t time.Time) error {
+	if s.stream == nil {
+		return nil
+	}
+	return s.stream.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the stream, it is a no-op before the upgrade.
+func (s *upgradeShim) SetReadDeadline(t time.Time) error {
+	if s.stream == nil {
+		return nil
+	}
+	return s.stream.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the stream, it is a no-op before the upgrade.
+func (s *upgradeShim) SetWriteDeadline(t time.Time) error {
+	if s.stream == nil {
+		return nil
+	}
+	return s.stream.SetWriteDeadline(t)
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
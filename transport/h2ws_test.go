@@ -0,0 +1,366 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// fakeH2 is an HTTP/2 server answering extended CONNECT requests. It replies
+// to the first client WebSocket frame of a stream with a "pong" frame, and
+// echoes the data of connect-udp streams.
+type fakeH2 struct {
+	addr     string
+	headers  chan map[string]string
+	payloads chan []byte
+	// accepted counts the connections
+	accepted atomic.Int32
+	// silent stops answering pings, like a connection dropped by a middlebox
+	silent atomic.Bool
+}
+
+func fakeH2Server(t *testing.T, extendedConnect bool) *fakeH2 {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	srv := &fakeH2{
+		addr:     l.Addr().String(),
+		headers:  make(chan map[string]string, 8),
+		payloads: make(chan []byte, 8),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			srv.accepted.Add(1)
+			go srv.serve(conn, extendedConnect)
+		}
+	}()
+	return srv
+}
+
+func (srv *fakeH2) serve(conn net.Conn, extendedConnect bool) {
+	defer conn.Close()
+
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		return
+	}
+	fr := http2.NewFramer(conn, conn)
+	// the x/net meta headers decoder rejects the :protocol pseudo header
+	dec := hpack.NewDecoder(4096, nil)
+	var settings []http2.Setting
+	if extendedConnect {
+		settings = append(settings, http2.Setting{ID: settingEnableConnectProtocol, Val: 1})
+	}
+	if err := fr.WriteSettings(settings...); err != nil {
+		return
+	}
+
+	wsFrames := make(map[uint32][]byte)
+	protocols := make(map[uint32]string)
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch f := f.(type) {
+		case *http2.HeadersFrame:
+			fields, err := dec.DecodeFull(f.HeaderBlockFragment())
+			if err != nil {
+				return
+			}
+			h := make(map[string]string)
+			for _, hf := range fields {
+				h[hf.Name] = hf.Value
+			}
+			srv.headers <- h
+			protocols[f.StreamID] = h[":protocol"]
+
+			var buf bytes.Buffer
+			enc := hpack.NewEncoder(&buf)
+			_ = enc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+			_ = fr.WriteHeaders(http2.HeadersFrameParam{StreamID: f.StreamID, BlockFragment: buf.Bytes(), EndHeaders: true})
+		case *http2.DataFrame:
+			if protocols[f.StreamID] == "connect-udp" {
+				// echo the capsules
+				_ = fr.WriteData(f.StreamID, false, f.Data())
+				continue
+			}
+			wsFrame := append(wsFrames[f.StreamID], f.Data()...)
+			wsFrames[f.StreamID] = wsFrame
+			if len(wsFrame) < 2 || len(wsFrame) < 6+int(wsFrame[1]&0x7f) {
+				continue
+			}
+			// client frames are masked
+			n := int(wsFrame[1] & 0x7f)
+			mask, payload := wsFrame[2:6], wsFrame[6:6+n]
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+			srv.payloads <- payload
+			delete(wsFrames, f.StreamID)
+			_ = fr.WriteData(f.StreamID, false, []byte{0x82, 4, 'p', 'o', 'n', 'g'})
+		case *http2.PingFrame:
+			if !f.IsAck() && !srv.silent.Load() {
+				_ = fr.WritePing(true, f.Data)
+			}
+		}
+	}
+}
+
+func dialShim(ctx context.Context, pool *h2Pool, addr string) (*websocket.Conn, error) {
+	d := websocket.Dialer{
+		NetDialTLSContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			session, err := pool.get(ctx, addr, func(context.Context) (net.Conn, error) {
+				return net.Dial(network, addr)
+			})
+			if err != nil {
+				return nil, err
+			}
+			return newUpgradeShim(ctx, session), nil
+		},
+	}
+	conn, _, err := d.DialContext(ctx, "wss://worker.example.com/tunnel?ep=1.1.1.1:53", nil)
+	return conn, err
+}
+
+func TestWebSocketOverHTTP2(t *testing.T) {
+	srv := fakeH2Server(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := dialShim(ctx, &h2Pool{}, srv.addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	h := <-srv.headers
+	expected := map[string]string{
+		":method":    "CONNECT",
+		":protocol":  "websocket",
+		":scheme":    "https",
+		":authority": "worker.example.com",
+		":path":      "/tunnel?ep=1.1.1.1:53",
+	}
+	for k, v := range expected {
+		if h[k] != v {
+			t.Errorf("expected %s %q, got %q", k, v, h[k])
+		}
+	}
+	for _, k := range []string{"connection", "upgrade", "sec-websocket-key", "host"} {
+		if _, ok := h[k]; ok {
+			t.Errorf("unexpected header %s sent over http2", k)
+		}
+	}
+	if h["sec-websocket-version"] != "13" {
+		t.Errorf("expected sec-websocket-version 13, got %q", h["sec-websocket-version"])
+	}
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("ping")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if p := <-srv.payloads; string(p) != "ping" {
+		t.Errorf("expected server to receive ping, got %q", p)
+	}
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(msg) != "pong" {
+		t.Errorf("expected pong, got %q", msg)
+	}
+}
+
+func TestWebSocketOverHTTP2Unsupported(t *testing.T) {
+	srv := fakeH2Server(t, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := dialShim(ctx, &h2Pool{}, srv.addr)
+	if !errors.Is(err, errNoExtendedConnect) {
+		t.Fatalf("expected errNoExtendedConnect, got %v", err)
+	}
+}
+
+// pingPong sends ping over conn and expects the pong of the fake server.
+func pingPong(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("ping")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "pong" {
+		t.Fatalf("expected pong, got %q, %v", msg, err)
+	}
+}
+
+func TestH2PoolReusesConnection(t *testing.T) {
+	srv := fakeH2Server(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pool := &h2Pool{maxIdle: 1}
+
+	// concurrent WebSockets share the connection as separate streams
+	first, err := dialShim(ctx, pool, srv.addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	second, err := dialShim(ctx, pool, srv.addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	pingPong(t, first)
+	pingPong(t, second)
+	_ = first.Close()
+	_ = second.Close()
+
+	// the idle connection is kept for the next WebSocket
+	third, err := dialShim(ctx, pool, srv.addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	pingPong(t, third)
+	_ = third.Close()
+	if n := srv.accepted.Load(); n != 1 {
+		t.Errorf("expected a single pooled connection, got %d", n)
+	}
+}
+
+func TestH2PoolMaxLifetime(t *testing.T) {
+	srv := fakeH2Server(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pool := &h2Pool{maxIdle: 1, maxLifetime: time.Nanosecond}
+
+	for i := 0; i < 2; i++ {
+		conn, err := dialShim(ctx, pool, srv.addr)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		pingPong(t, conn)
+		_ = conn.Close()
+	}
+	if n := srv.accepted.Load(); n != 2 {
+		t.Errorf("expected an expired connection not to be reused, got %d connections", n)
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if n := len(pool.sessions[srv.addr]); n != 0 {
+		t.Errorf("expected expired connections to be dropped from the pool, %d left", n)
+	}
+}
+
+func TestH2NoPoolClosesConnection(t *testing.T) {
+	srv := fakeH2Server(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		conn, err := dialShim(ctx, &h2Pool{}, srv.addr)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		pingPong(t, conn)
+		_ = conn.Close()
+	}
+	if n := srv.accepted.Load(); n != 2 {
+		t.Errorf("expected a connection per WebSocket without pooling, got %d", n)
+	}
+}
+
+// backdateIdle makes the pooled sessions to addr look idle for a minute.
+func backdateIdle(pool *h2Pool, addr string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for _, s := range pool.sessions[addr] {
+		s.mu.Lock()
+		s.idleSince = time.Now().Add(-time.Minute)
+		s.mu.Unlock()
+	}
+}
+
+func TestH2PoolValidatesIdle(t *testing.T) {
+	srv := fakeH2Server(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pool := &h2Pool{maxIdle: 1}
+
+	conn, err := dialShim(ctx, pool, srv.addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	_ = conn.Close()
+
+	// a live idle connection answers the ping and is reused
+	backdateIdle(pool, srv.addr)
+	conn, err = dialShim(ctx, pool, srv.addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	pingPong(t, conn)
+	_ = conn.Close()
+	if n := srv.accepted.Load(); n != 1 {
+		t.Fatalf("expected the live connection to be reused, got %d connections", n)
+	}
+
+	// a silently dead one is dropped and a new connection is dialed
+	srv.silent.Store(true)
+	backdateIdle(pool, srv.addr)
+	conn, err = dialShim(ctx, pool, srv.addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	pingPong(t, conn)
+	_ = conn.Close()
+	if n := srv.accepted.Load(); n != 2 {
+		t.Errorf("expected the dead connection to be replaced, got %d connections", n)
+	}
+}
+
+func TestH2PoolIdleTimeout(t *testing.T) {
+	srv := fakeH2Server(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pool := &h2Pool{maxIdle: 1, idleTimeout: 20 * time.Millisecond}
+
+	conn, err := dialShim(ctx, pool, srv.addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	_ = conn.Close()
+	for {
+		pool.mu.Lock()
+		n := len(pool.sessions[srv.addr])
+		pool.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal("expected the idle connection to be reaped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebsocketAccept(t *testing.T) {
+	// example from RFC 6455 section 1.3
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected accept key %q", got)
+	}
+}
@@ -0,0 +1,217 @@
+package transport
+
+import (
+	"bepass/logger"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// defaultMASQUETemplate is the well-known URI template of RFC 9298.
+const defaultMASQUETemplate = "/.well-known/masque/udp/{target_host}/{target_port}/"
+
+// capsuleDatagram is the DATAGRAM capsule type of RFC 9297.
+const capsuleDatagram = 0x00
+
+// maxCapsuleLength bounds the capsules read from the proxy, a UDP payload
+// and its context ID always fit.
+const maxCapsuleLength = 1<<16 + 8
+
+var errCapsuleTooLong = errors.New("capsule too long")
+
+// MASQUETunnel carries each UDP association as a CONNECT-UDP request (RFC
+// 9298) on its own stream of an HTTP/2 connection to the worker, pooled with
+// the ones of the WebSocket tunnels. Datagrams travel as capsules (RFC 9297),
+// an HTTP request body to middleboxes, instead of the custom WebSocket framing.
+type MASQUETunnel struct {
+	// Tunnel dials the HTTP/2 connections to the worker and holds their pool
+	Tunnel *WSTunnel
+	// PathTemplate is the URI template of the proxy, with the {target_host}
+	// and {target_port} variables, defaultMASQUETemplate if empty
+	PathTemplate string
+}
+
+// BindUDP opens a CONNECT-UDP stream to destination through the worker at
+// workerAddress, see UDPTunnel. The channel number is always 0, the stream
+// carries a single association.
+func (m *MASQUETunnel) BindUDP(ctx context.Context, workerAddress, destination string, recv chan UDPPacket) (chan UDPPacket, uint16, func(), error) {
+	u, err := url.Parse(workerAddress)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	session, err := m.Tunnel.h2Session(ctx, workerHostPort(u))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return m.bind(ctx, session, u.Host, destination, recv)
+}
+
+// path expands the template for destination.
+func (m *MASQUETunnel) path(destination string) (string, error) {
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return "", err
+	}
+	template := m.PathTemplate
+	if template == "" {
+		template = defaultMASQUETemplate
+	}
+	// the colons of IPv6 addresses are escaped too (RFC 9298 section 2)
+	host = strings.ReplaceAll(url.PathEscape(host), ":", "%3A")
+	return strings.NewReplacer("{target_host}", host, "{target_port}", port).Replace(template), nil
+}
+
+// bind opens the CONNECT-UDP stream on session, which has a stream reserved.
+func (m *MASQUETunnel) bind(ctx context.Context, session *h2Session, authority, destination string, recv chan UDPPacket) (chan UDPPacket, uint16, func(), error) {
+	path, err := m.path(destination)
+	if err != nil {
+		session.release()
+		return nil, 0, nil, err
+	}
+	stream, _, err := session.openStream(ctx, "connect-udp", authority, path, http.Header{"Capsule-Protocol": {"?1"}})
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("connect-udp to %s failed, %v", destination, err)
+	}
+
+	send := make(chan UDPPacket)
+	done := make(chan struct{})
+	var once sync.Once
+	unbind := func() {
+		once.Do(func() {
+			close(done)
+			_ = stream.Close()
+		})
+	}
+	go func() {
+		var failed bool
+		for {
+			select {
+			case pkt := <-send:
+				if failed {
+					continue
+				}
+				if _, err := stream.Write(appendDatagramCapsule(nil, pkt.Data)); err != nil {
+					logger.Errorf("connect-udp to %s: %v", logger.Redact(destination), err)
+					failed = true
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		r := bufio.NewReader(stream)
+		for {
+			data, err := readDatagramCapsule(r)
+			if err != nil {
+				select {
+				case <-done:
+				default:
+					logger.Errorf("connect-udp to %s: %v", logger.Redact(destination), err)
+				}
+				return
+			}
+			select {
+			case recv <- UDPPacket{Data: data}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return send, 0, unbind, nil
+}
+
+// appendDatagramCapsule appends a DATAGRAM capsule carrying the UDP payload
+// data with context ID 0.
+func appendDatagramCapsule(b, data []byte) []byte {
+	b = appendVarint(b, capsuleDatagram)
+	b = appendVarint(b, uint64(len(data)+1))
+	b = appendVarint(b, 0)
+	return append(b, data...)
+}
+
+// readDatagramCapsule returns the UDP payload of the next DATAGRAM capsule
+// with context ID 0, skipping the other capsules.
+func readDatagramCapsule(r *bufio.Reader) ([]byte, error) {
+	for {
+		typ, err := readVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		n, err := readVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n > maxCapsuleLength {
+			return nil, errCapsuleTooLong
+		}
+		value := make([]byte, n)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		if typ != capsuleDatagram {
+			continue
+		}
+		contextID, size, ok := parseVarint(value)
+		if !ok || contextID != 0 {
+			continue
+		}
+		return value[size:], nil
+	}
+}
+
+// appendVarint appends v as a QUIC variable-length integer (RFC 9000 section 16).
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, 0x40|byte(v>>8), byte(v))
+	case v < 1<<30:
+		return append(b, 0x80|byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, 0xc0|byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// readVarint reads a QUIC variable-length integer.
+func readVarint(r io.ByteReader) (uint64, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	v := uint64(first & 0x3f)
+	for i := 1; i < 1<<(first>>6); i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// parseVarint parses the QUIC variable-length integer at the start of b and
+// returns it with its size.
+func parseVarint(b []byte) (uint64, int, bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	size := 1 << (b[0] >> 6)
+	if len(b) < size {
+		return 0, 0, false
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:size] {
+		v = v<<8 | uint64(c)
+	}
+	return v, size, true
+}
@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMASQUEBindUDP(t *testing.T) {
+	srv := fakeH2Server(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, err := (&h2Pool{}).get(ctx, srv.addr, func(context.Context) (net.Conn, error) {
+		return net.Dial("tcp", srv.addr)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &MASQUETunnel{}
+	recv := make(chan UDPPacket, 1)
+	send, _, unbind, err := m.bind(ctx, session, "worker.example.com", "[2001:db8::1]:53", recv)
+	if err != nil {
+		t.Fatalf("bind failed: %v", err)
+	}
+	defer unbind()
+
+	h := <-srv.headers
+	expected := map[string]string{
+		":method":          "CONNECT",
+		":protocol":        "connect-udp",
+		":authority":       "worker.example.com",
+		":path":            "/.well-known/masque/udp/2001%3Adb8%3A%3A1/53/",
+		"capsule-protocol": "?1",
+	}
+	for k, v := range expected {
+		if h[k] != v {
+			t.Errorf("expected %s %q, got %q", k, v, h[k])
+		}
+	}
+
+	send <- UDPPacket{Data: []byte("query")}
+	select {
+	case pkt := <-recv:
+		if string(pkt.Data) != "query" {
+			t.Errorf("expected the echoed datagram, got %q", pkt.Data)
+		}
+	case <-ctx.Done():
+		t.Fatal("no datagram received")
+	}
+}
+
+func TestDatagramCapsule(t *testing.T) {
+	var b []byte
+	// an unknown capsule is skipped
+	b = appendVarint(b, 0x2a)
+	b = appendVarint(b, 2)
+	b = append(b, 1, 2)
+	payload := bytes.Repeat([]byte{7}, 300)
+	b = appendDatagramCapsule(b, payload)
+
+	got, err := readDatagramCapsule(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("expected the payload back, got %d bytes", len(got))
+	}
+
+	for _, v := range []uint64{0, 63, 64, 16383, 16384, 1<<30 - 1, 1 << 30} {
+		got, err := readVarint(bytes.NewReader(appendVarint(nil, v)))
+		if err != nil || got != v {
+			t.Errorf("varint %d round-tripped to %d, %v", v, got, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPingTimeout bounds the wait for the pong of a WebSocket ping.
+const wsPingTimeout = 5 * time.Second
+
+// Ping measures the round trip time to the worker at workerAddress. The
+// WebSocket of the stream tunnel is pinged when it is up, so nothing new is
+// dialed. Otherwise an HTTP/2 PING is sent on a (pooled) connection when
+// HTTP2 is set and the worker supports it, or the TCP handshake through the
+// proxy is timed.
+func (w *WSTunnel) Ping(ctx context.Context, workerAddress string) (time.Duration, error) {
+	u, err := url.Parse(workerAddress)
+	if err != nil {
+		return 0, err
+	}
+	if mux := w.liveStreamMux(workerAddress); mux != nil {
+		return mux.pinger.ping(ctx)
+	}
+	addr := workerHostPort(u)
+	if _, h1Only := w.h1Only.Load(u.Host); w.HTTP2 && !h1Only {
+		session, err := w.h2Session(ctx, addr)
+		if err == nil {
+			defer session.release()
+			begin := time.Now()
+			if err := session.ping(ctx); err != nil {
+				return 0, err
+			}
+			return time.Since(begin), nil
+		}
+		if ctx.Err() != nil {
+			return 0, err
+		}
+	}
+	begin := time.Now()
+	conn, err := w.socks5TCPDial(ctx, "tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(begin)
+	_ = conn.Close()
+	return rtt, nil
+}
+
+// liveStreamMux returns the stream tunnel to workerAddress, nil if there is
+// none up.
+func (w *WSTunnel) liveStreamMux(workerAddress string) *streamMux {
+	endpoint, err := streamEndpoint(workerAddress)
+	if err != nil {
+		return nil
+	}
+	w.streamsMu.Lock()
+	mux, ok := w.streamMuxes[endpoint]
+	w.streamsMu.Unlock()
+	if !ok || mux.err() != nil {
+		return nil
+	}
+	return mux
+}
+
+// wsPinger measures the round trip time of a WebSocket with ping and pong
+// control frames. It takes over the pong handler of the connection, whose
+// reads must go on for the pongs to be seen.
+type wsPinger struct {
+	conn *websocket.Conn
+
+	mu      sync.Mutex
+	waiting map[string]chan struct{}
+}
+
+func newWSPinger(conn *websocket.Conn) *wsPinger {
+	p := &wsPinger{conn: conn, waiting: make(map[string]chan struct{})}
+	conn.SetPongHandler(func(data string) error {
+		p.mu.Lock()
+		if ack, ok := p.waiting[data]; ok {
+			close(ack)
+			delete(p.waiting, data)
+		}
+		p.mu.Unlock()
+		return nil
+	})
+	return p
+}
+
+// ping sends a ping and waits for its pong.
+func (p *wsPinger) ping(ctx context.Context) (time.Duration, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	data := hex.EncodeToString(b[:])
+	ack := make(chan struct{})
+	p.mu.Lock()
+	p.waiting[data] = ack
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.waiting, data)
+		p.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, wsPingTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	begin := time.Now()
+	if err := p.conn.WriteControl(websocket.PingMessage, []byte(data), deadline); err != nil {
+		return 0, err
+	}
+	select {
+	case <-ack:
+		return time.Since(begin), nil
+	case <-ctx.Done():
+		return 0, fmt.Errorf("websocket ping: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,31 @@
+// Package transport provides network transport functionality.
+package transport
+
+import "encoding/binary"
+
+// QUIC versions whose Initial packets are recognised (RFC 9000 and RFC 9369).
+const (
+	quicVersion1 = 0x00000001
+	quicVersion2 = 0x6b3343cf
+)
+
+// quicMinInitialSize is the size clients must pad their Initial packets to.
+const quicMinInitialSize = 1200
+
+// isQUICInitial reports whether b is a QUIC Initial packet sent by a client.
+// The Initial carries the TLS ClientHello, so its SNI is readable by anyone
+// who derives the Initial keys from the packet itself.
+func isQUICInitial(b []byte) bool {
+	// long header form and fixed bit, then the version
+	if len(b) < quicMinInitialSize || b[0]&0xc0 != 0xc0 {
+		return false
+	}
+	packetType := (b[0] >> 4) & 0x03
+	switch binary.BigEndian.Uint32(b[1:5]) {
+	case quicVersion1:
+		return packetType == 0
+	case quicVersion2:
+		return packetType == 1
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package transport
+
+import "testing"
+
+func TestIsQUICInitial(t *testing.T) {
+	packet := func(first byte, version []byte, size int) []byte {
+		b := make([]byte, size)
+		b[0] = first
+		copy(b[1:], version)
+		return b
+	}
+	v1 := []byte{0, 0, 0, 1}
+	v2 := []byte{0x6b, 0x33, 0x43, 0xcf}
+
+	tests := []struct {
+		name    string
+		packet  []byte
+		initial bool
+	}{
+		{"v1 initial", packet(0xc3, v1, 1200), true},
+		{"v2 initial", packet(0xd3, v2, 1252), true},
+		{"v1 handshake", packet(0xe3, v1, 1200), false},
+		{"v2 type 0 is 0-RTT", packet(0xc3, v2, 1200), false},
+		{"short header", packet(0x43, v1, 1200), false},
+		{"version negotiation", packet(0xc3, []byte{0, 0, 0, 0}, 1200), false},
+		{"unpadded", packet(0xc3, v1, 600), false},
+		{"dns query", []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01}, false},
+	}
+	for _, tt := range tests {
+		if got := isQUICInitial(tt.packet); got != tt.initial {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.initial)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Package transport provides WebSocket tunneling functionality.
+package transport
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultRetransmitWindow is how far back packets written before a tunnel
+// drop are considered in flight and replayed.
+const defaultRetransmitWindow = 2 * time.Second
+
+// replayablePort is the destination port of the UDP tunnels whose packets are
+// replayed. The worker can not tell a replayed packet from a new one, so only
+// DNS, whose queries can be asked twice, gets a retransmit buffer; QUIC, games
+// or media would see the packets twice.
+const replayablePort = "53"
+
+// replayable reports whether the packets of the UDP tunnel to endpoint may be
+// replayed after a reconnect.
+func replayable(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	return u.Query().Get("port") == replayablePort
+}
+
+type bufferedPacket struct {
+	seq uint64
+	at  time.Time
+	pkt UDPPacket
+}
+
+// retransmitBuffer keeps the last packets written to a tunnel, per channel, so
+// they can be sent again once the tunnel reconnects. Every packet gets a local
+// sequence number when it is buffered, only to order the replay across
+// channels. It is not sent, the worker can not tell a replayed packet from a
+// new one and may deliver both, so only the tunnels to replayablePort use it.
+type retransmitBuffer struct {
+	size   int
+	window time.Duration
+
+	mu     sync.Mutex
+	seq    uint64
+	sent   map[uint16][]bufferedPacket
+	failed []bufferedPacket
+}
+
+// newRetransmitBuffer returns a buffer keeping up to size packets per channel,
+// or nil if size is not positive. A nil buffer keeps nothing.
+func newRetransmitBuffer(size int, window time.Duration) *retransmitBuffer {
+	if size <= 0 {
+		return nil
+	}
+	if window <= 0 {
+		window = defaultRetransmitWindow
+	}
+	return &retransmitBuffer{
+		size:   size,
+		window: window,
+		sent:   make(map[uint16][]bufferedPacket),
+	}
+}
+
+// buffer copies pkt, its data usually lives in a reused read buffer.
+func (b *retransmitBuffer) buffer(pkt UDPPacket, now time.Time) bufferedPacket {
+	b.seq++
+	data := make([]byte, len(pkt.Data))
+	copy(data, pkt.Data)
+	return bufferedPacket{seq: b.seq, at: now, pkt: UDPPacket{Channel: pkt.Channel, Data: data}}
+}
+
+// sentPacket records a packet that was written to the tunnel.
+func (b *retransmitBuffer) sentPacket(pkt UDPPacket, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	packets := append(b.sent[pkt.Channel], b.buffer(pkt, now))
+	if len(packets) > b.size {
+		packets = packets[len(packets)-b.size:]
+	}
+	b.sent[pkt.Channel] = packets
+}
+
+// failedPacket records a packet that could not be written because the tunnel
+// dropped. It is always replayed, whatever its age.
+func (b *retransmitBuffer) failedPacket(pkt UDPPacket, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failed = append(b.failed, b.buffer(pkt, now))
+}
+
+// replay returns the packets to send again after a reconnect, oldest first, and
+// empties the buffer. dropped is when the previous tunnel failed.
+func (b *retransmitBuffer) replay(dropped time.Time) []UDPPacket {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	pending := b.failed
+	for _, packets := range b.sent {
+		for _, p := range packets {
+			if dropped.Sub(p.at) <= b.window {
+				pending = append(pending, p)
+			}
+		}
+	}
+	b.failed = nil
+	b.sent = make(map[uint16][]bufferedPacket)
+	b.mu.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].seq < pending[j].seq })
+	packets := make([]UDPPacket, len(pending))
+	for i, p := range pending {
+		packets[i] = p.pkt
+	}
+	return packets
+}
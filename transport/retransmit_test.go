@@ -0,0 +1,61 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetransmitBuffer(t *testing.T) {
+	b := newRetransmitBuffer(2, time.Second)
+	now := time.Now()
+
+	b.sentPacket(UDPPacket{Channel: 1, Data: []byte("old")}, now.Add(-5*time.Second))
+	data := []byte("a1")
+	b.sentPacket(UDPPacket{Channel: 1, Data: data}, now)
+	b.sentPacket(UDPPacket{Channel: 2, Data: []byte("b1")}, now)
+	b.sentPacket(UDPPacket{Channel: 1, Data: []byte("a2")}, now)
+	b.failedPacket(UDPPacket{Channel: 2, Data: []byte("b2")}, now.Add(-time.Hour))
+	// the buffered packets must not alias the caller's buffer
+	copy(data, "zz")
+
+	got := b.replay(now)
+	expected := []string{"a1", "b1", "a2", "b2"}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d packets, got %d", len(expected), len(got))
+	}
+	for i, pkt := range got {
+		if string(pkt.Data) != expected[i] {
+			t.Errorf("packet %d: expected %q, got %q", i, expected[i], pkt.Data)
+		}
+	}
+
+	if got := b.replay(now); len(got) != 0 {
+		t.Errorf("expected packets to be replayed once, got %d again", len(got))
+	}
+}
+
+func TestRetransmitBufferDisabled(t *testing.T) {
+	b := newRetransmitBuffer(0, 0)
+	if b != nil {
+		t.Fatal("expected a nil buffer")
+	}
+	b.sentPacket(UDPPacket{Channel: 1, Data: []byte("a")}, time.Now())
+	b.failedPacket(UDPPacket{Channel: 1, Data: []byte("b")}, time.Now())
+	if got := b.replay(time.Now()); got != nil {
+		t.Errorf("expected nothing to replay, got %v", got)
+	}
+}
+
+func TestReplayable(t *testing.T) {
+	for endpoint, want := range map[string]bool{
+		"wss://worker.example/connect?host=1.1.1.1&port=53&net=udp":   true,
+		"wss://worker.example/connect?host=1.1.1.1&port=443&net=udp":  false,
+		"wss://worker.example/connect?host=1.1.1.1&port=5353&net=udp": false,
+		"wss://worker.example/connect?host=1.1.1.1&net=udp":           false,
+		"://bad": false,
+	} {
+		if got := replayable(endpoint); got != want {
+			t.Errorf("replayable(%q) = %v, want %v", endpoint, got, want)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package transport
+
+import (
+	"bepass/logger"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// The shared tunnel protocol runs over a local socket, one connection per
+// tunnel. The client sends
+//
+//	version (1) | network (1) | destination length (2) | destination
+//
+// and the daemon answers with a status byte, followed by the length (2) and
+// the text of the error if it is not sharedOK. A TCP tunnel then carries the
+// stream as is, a UDP one carries datagrams as length (2) | payload.
+const (
+	sharedVersion = 1
+
+	sharedTCP = 1
+	sharedUDP = 2
+
+	sharedOK     = 0
+	sharedFailed = 1
+)
+
+// SharedTunnelServer is the shared tunnel daemon: it lets other bepass
+// processes of the host open their tunnels through Transport over a local
+// socket, so their channels are multiplexed over the tunnels of a single
+// process instead of each opening its own.
+type SharedTunnelServer struct {
+	Transport *Transport
+}
+
+// Serve accepts tunnel requests on l until ctx is done.
+func (s *SharedTunnelServer) Serve(ctx context.Context, l net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { _ = l.Close() })
+	defer stop()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(ctx, conn); err != nil {
+				logger.Errorf("shared tunnel: %v", err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves the tunnel requested on conn, until the client or the
+// tunnel closes it or ctx is done.
+func (s *SharedTunnelServer) ServeConn(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	r := bufio.NewReader(conn)
+	network, destination, err := readSharedRequest(r)
+	if err != nil {
+		return err
+	}
+	switch network {
+	case sharedTCP:
+		up, err := s.Transport.dialTunnel(ctx, destination)
+		if err != nil {
+			_ = writeSharedStatus(conn, err)
+			return err
+		}
+		defer up.Close()
+		if err := writeSharedStatus(conn, nil); err != nil {
+			return err
+		}
+		errCh := make(chan error, 2)
+		go func() { errCh <- s.Transport.Copy(r, up) }()
+		go func() { errCh <- s.Transport.Copy(up, conn) }()
+		for i := 0; i < 2; i++ {
+			if err := <-errCh; err != nil {
+				return err
+			}
+		}
+		return nil
+	case sharedUDP:
+		recv := make(chan UDPPacket)
+		send, channel, unbind, err := s.Transport.udpTunnel().BindUDP(ctx, s.Transport.workerAddress(destination), destination, recv)
+		if err != nil {
+			_ = writeSharedStatus(conn, err)
+			return err
+		}
+		defer unbind()
+		if err := writeSharedStatus(conn, nil); err != nil {
+			return err
+		}
+		go func() {
+			// the association ends with the connection of the client
+			defer cancel()
+			for {
+				data, err := readSharedDatagram(r)
+				if err != nil {
+					return
+				}
+				select {
+				case send <- UDPPacket{Channel: channel, Data: data}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		for {
+			select {
+			case pkt := <-recv:
+				if err := writeSharedDatagram(conn, pkt.Data); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	default:
+		err := fmt.Errorf("unknown network %d", network)
+		_ = writeSharedStatus(conn, err)
+		return err
+	}
+}
+
+// SharedTunnelClient opens tunnels through the shared tunnel daemon listening
+// on the unix socket at Socket. It carries UDP associations as a UDPTunnel.
+type SharedTunnelClient struct {
+	Socket string
+}
+
+// DialTCP opens a TCP tunnel to destination through the daemon.
+func (c *SharedTunnelClient) DialTCP(ctx context.Context, destination string) (net.Conn, error) {
+	return c.open(ctx, sharedTCP, destination)
+}
+
+// BindUDP opens a UDP association to destination through the daemon, which
+// picks the worker itself, see UDPTunnel.
+func (c *SharedTunnelClient) BindUDP(ctx context.Context, _, destination string, recv chan UDPPacket) (chan UDPPacket, uint16, func(), error) {
+	conn, err := c.open(ctx, sharedUDP, destination)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	send := make(chan UDPPacket)
+	done := make(chan struct{})
+	var once sync.Once
+	unbind := func() {
+		once.Do(func() {
+			close(done)
+			_ = conn.Close()
+		})
+	}
+	go func() {
+		for {
+			select {
+			case pkt := <-send:
+				// a failed write shows as a failed read below
+				_ = writeSharedDatagram(conn, pkt.Data)
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			data, err := readSharedDatagram(r)
+			if err != nil {
+				return
+			}
+			select {
+			case recv <- UDPPacket{Data: data}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return send, 0, unbind, nil
+}
+
+// open connects to the daemon and requests a tunnel to destination.
+func (c *SharedTunnelClient) open(ctx context.Context, network byte, destination string) (net.Conn, error) {
+	if len(destination) > 0xffff {
+		return nil, errors.New("destination too long")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", c.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the shared tunnel daemon, %v", err)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+
+	req := []byte{sharedVersion, network, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], uint16(len(destination)))
+	req = append(req, destination...)
+	_, err = conn.Write(req)
+	if err == nil {
+		err = readSharedStatus(conn)
+	}
+	if !stop() {
+		_ = conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func readSharedRequest(r io.Reader) (byte, string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != sharedVersion {
+		return 0, "", fmt.Errorf("unsupported shared tunnel version %d", header[0])
+	}
+	destination := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, destination); err != nil {
+		return 0, "", err
+	}
+	return header[1], string(destination), nil
+}
+
+func writeSharedStatus(w io.Writer, err error) error {
+	if err == nil {
+		_, err := w.Write([]byte{sharedOK})
+		return err
+	}
+	msg := err.Error()
+	if len(msg) > 0xffff {
+		msg = msg[:0xffff]
+	}
+	b := []byte{sharedFailed, 0, 0}
+	binary.BigEndian.PutUint16(b[1:], uint16(len(msg)))
+	_, err = w.Write(append(b, msg...))
+	return err
+}
+
+// readSharedStatus reads the answer of the daemon without reading past it.
+func readSharedStatus(r io.Reader) error {
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(r, status); err != nil {
+		return err
+	}
+	if status[0] == sharedOK {
+		return nil
+	}
+	n := make([]byte, 2)
+	if _, err := io.ReadFull(r, n); err != nil {
+		return err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(n))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return err
+	}
+	return fmt.Errorf("shared tunnel daemon: %s", msg)
+}
+
+func readSharedDatagram(r io.Reader) ([]byte, error) {
+	n := make([]byte, 2)
+	if _, err := io.ReadFull(r, n); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(n))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writeSharedDatagram(w io.Writer, data []byte) error {
+	if len(data) > 0xffff {
+		return errors.New("datagram too long")
+	}
+	b := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(b, uint16(len(data)))
+	_, err := w.Write(append(b, data...))
+	return err
+}
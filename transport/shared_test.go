@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"bepass/bufferpool"
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// echoUDPTunnel is a UDPTunnel echoing every packet back.
+type echoUDPTunnel struct {
+	destination chan string
+}
+
+func (e *echoUDPTunnel) BindUDP(ctx context.Context, _, destination string, recv chan UDPPacket) (chan UDPPacket, uint16, func(), error) {
+	e.destination <- destination
+	send := make(chan UDPPacket)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case pkt := <-send:
+				select {
+				case recv <- pkt:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return send, 7, func() { close(done) }, nil
+}
+
+// sharedDaemon serves tr on a unix socket and returns a client of it.
+func sharedDaemon(t *testing.T, tr *Transport) *SharedTunnelClient {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "bepass.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = (&SharedTunnelServer{Transport: tr}).Serve(ctx, l) }()
+	return &SharedTunnelClient{Socket: socket}
+}
+
+func TestSharedTunnelUDP(t *testing.T) {
+	echo := &echoUDPTunnel{destination: make(chan string, 1)}
+	client := sharedDaemon(t, &Transport{UDPTunnel: echo, BufferPool: bufferpool.NewPool(32 * 1024)})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	recv := make(chan UDPPacket)
+	send, _, unbind, err := client.BindUDP(ctx, "", "1.1.1.1:53", recv)
+	if err != nil {
+		t.Fatalf("bind failed: %v", err)
+	}
+	defer unbind()
+	if d := <-echo.destination; d != "1.1.1.1:53" {
+		t.Errorf("expected the daemon to bind 1.1.1.1:53, got %s", d)
+	}
+	for _, msg := range []string{"first", "second"} {
+		send <- UDPPacket{Data: []byte(msg)}
+		select {
+		case pkt := <-recv:
+			if string(pkt.Data) != msg {
+				t.Errorf("expected %q back, got %q", msg, pkt.Data)
+			}
+		case <-ctx.Done():
+			t.Fatal("no datagram back from the daemon")
+		}
+	}
+}
+
+func TestSharedTunnelTCP(t *testing.T) {
+	const workerAddress = "https://worker.example/dns-query"
+	endpoint, err := streamEndpoint(workerAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := &WSTunnel{streamMuxes: map[string]*streamMux{
+		endpoint: newStreamMux(fakeStreamWorker(t), "client", maxChannelIDs),
+	}}
+	client := sharedDaemon(t, &Transport{
+		WorkerAddress: workerAddress,
+		Tunnel:        tunnel,
+		StreamMode:    true,
+		BufferPool:    bufferpool.NewPool(32 * 1024),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := client.DialTCP(ctx, "a.example:80")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Errorf("expected the echo through the daemon, got %q, %v", got, err)
+	}
+
+	if _, err := client.DialTCP(ctx, "refused:1"); err == nil {
+		t.Error("expected the refusal of the worker to reach the client")
+	}
+}
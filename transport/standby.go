@@ -0,0 +1,132 @@
+package transport
+
+import (
+	"bepass/clock"
+	"bepass/logger"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The interval between two pings of an idle standby connection, short enough
+// for the middleboxes and the worker not to drop it, and how long a standby
+// connection that failed waits before dialing again.
+const (
+	standbyKeepAlive   = 20 * time.Second
+	standbyRedialDelay = 5 * time.Second
+)
+
+// standbyConn is the idle second connection a UDP tunnel keeps to endpoint,
+// see StandbyEndpoint. Nothing is sent on it but pings until the tunnel takes
+// it over, the worker only sets up the channels once their packets arrive.
+type standbyConn struct {
+	endpoint string
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+	// stop is closed once the connection is taken over or the tunnel ends
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// startStandby keeps a connection to endpoint open and pinged until it is
+// taken over or ctx is done, dialing it again when it fails.
+func (w *WSTunnel) startStandby(ctx context.Context, endpoint string) *standbyConn {
+	s := &standbyConn{endpoint: endpoint, stop: make(chan struct{})}
+	clk := clock.Or(w.Clock)
+	go func() {
+		for {
+			c, err := w.DialContext(ctx, endpoint)
+			if err == nil {
+				logger.Debugf("standby connection to %s up", logger.Redact(endpoint))
+				if !s.keep(ctx, clk, c) {
+					return
+				}
+			} else {
+				logger.Debugf("error dialing standby connection: %v", err)
+			}
+			select {
+			case <-clk.After(standbyRedialDelay):
+			case <-s.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// keep holds c as the standby connection and pings it. It returns true once
+// a ping fails, for the connection to be dialed again, and false once it is
+// taken over or ctx is done.
+func (s *standbyConn) keep(ctx context.Context, clk clock.Clock, c *websocket.Conn) bool {
+	s.mu.Lock()
+	select {
+	case <-s.stop:
+		s.mu.Unlock()
+		_ = c.Close()
+		return false
+	default:
+	}
+	s.conn = c
+	s.mu.Unlock()
+
+	ticker := clk.NewTicker(standbyKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-s.stop:
+			return false
+		case <-ctx.Done():
+			s.close()
+			return false
+		}
+		if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsPingTimeout)); err != nil {
+			logger.Debugf("standby connection to %s failed: %v", logger.Redact(s.endpoint), err)
+			s.mu.Lock()
+			live := s.conn == c
+			if live {
+				s.conn = nil
+			}
+			s.mu.Unlock()
+			if !live {
+				// taken over meanwhile, the tunnel finds out on its own
+				return false
+			}
+			_ = c.Close()
+			return true
+		}
+	}
+}
+
+// take returns the standby connection for the tunnel to carry its channels,
+// nil if it is not up. The standby is done with either way.
+func (s *standbyConn) take() *websocket.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.conn
+	s.conn = nil
+	s.stopOnce.Do(func() { close(s.stop) })
+	return c
+}
+
+// close drops the standby connection.
+func (s *standbyConn) close() {
+	if c := s.take(); c != nil {
+		_ = c.Close()
+	}
+}
+
+// done reports whether the standby was taken over or closed.
+func (s *standbyConn) done() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
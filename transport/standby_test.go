@@ -0,0 +1,156 @@
+package transport
+
+import (
+	"bepass/dialer"
+	"bepass/socks5"
+	"bepass/socks5/statute"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// relayProxy is a SOCKS5 proxy connecting to the destinations as asked.
+func relayProxy(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	proxy := socks5.NewServer(socks5.WithConnectHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
+		conn, err := net.Dial("tcp", req.RawDestAddr.String())
+		if err != nil {
+			return socks5.SendReply(w, statute.RepHostUnreachable, nil)
+		}
+		defer conn.Close()
+		if err := socks5.SendReply(w, statute.RepSuccess, conn.LocalAddr()); err != nil {
+			return err
+		}
+		go func() { _, _ = io.Copy(conn, req.Reader) }()
+		_, err = io.Copy(w, conn)
+		return err
+	}))
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = proxy.ServeConn(conn) }()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echoWorker plays the worker side of UDP tunnels, echoing the frames it
+// receives. The connections it accepts are sent on conns.
+func echoWorker(t *testing.T) (string, chan *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 10)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conns <- conn
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String(), conns
+}
+
+func TestWarmStandby(t *testing.T) {
+	primary, primaryConns := echoWorker(t)
+	standby, standbyConns := echoWorker(t)
+	switched := make(chan struct{}, 1)
+	tunnel := &WSTunnel{
+		BindAddress:        relayProxy(t),
+		Dialer:             &dialer.Dialer{},
+		ReadTimeout:        60,
+		WriteTimeout:       60,
+		LinkIdleTimeout:    60,
+		EstablishedTunnels: make(map[string]*EstablishedTunnel),
+		StandbyEndpoint: func(endpoint string) string {
+			if strings.Contains(endpoint, primary) {
+				return strings.Replace(endpoint, primary, standby, 1)
+			}
+			return strings.Replace(endpoint, standby, primary, 1)
+		},
+		OnReconnect: func(string) { switched <- struct{}{} },
+	}
+	endpoint := "ws://" + primary + "/connect?host=1.1.1.1&port=53&net=udp"
+	recv := make(chan UDPPacket, 1)
+	send, channel, err := tunnel.PersistentDial(endpoint, recv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Unbind(endpoint, channel)
+
+	roundTrip := func(data string) {
+		t.Helper()
+		select {
+		case send <- UDPPacket{Channel: channel, Data: []byte(data)}:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("could not send %q", data)
+		}
+		select {
+		case pkt := <-recv:
+			if string(pkt.Data) != data {
+				t.Fatalf("expected %q back, got %q", data, pkt.Data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no reply to %q", data)
+		}
+	}
+	roundTrip("first")
+	var first *websocket.Conn
+	select {
+	case first = <-primaryConns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a connection to the primary worker")
+	}
+	select {
+	case <-standbyConns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a standby connection to the other worker")
+	}
+	// let the tunnel see the upgrade answered
+	time.Sleep(50 * time.Millisecond)
+
+	// the primary drops, the channel goes on through the standby
+	_ = first.Close()
+	select {
+	case <-switched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the tunnel to switch over")
+	}
+	select {
+	case <-standbyConns:
+		t.Error("expected the standby connection to be taken over, not a new one dialed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	roundTrip("second")
+	// and the primary becomes the standby
+	select {
+	case <-primaryConns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a new standby connection to the first worker")
+	}
+}
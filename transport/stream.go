@@ -0,0 +1,386 @@
+// Package transport provides WebSocket tunneling functionality.
+package transport
+
+import (
+	"bepass/logger"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxStreamFrameData caps the payload of a single stream data frame, so one
+// busy stream does not hold the tunnel for long.
+const maxStreamFrameData = 32 * 1024
+
+// maxStreamBuffered caps the data of the worker a stream holds for its reader.
+// The stream tunnel has no flow control, so a stream whose reader falls this
+// far behind is reset rather than left to grow without bound.
+const maxStreamBuffered = 4 << 20
+
+var (
+	errStreamTunnelClosed = errors.New("stream tunnel closed")
+	errNoFreeChannel      = errors.New("no free stream channel")
+	errStreamBufferFull   = errors.New("stream reset, reader too far behind")
+)
+
+// streamEndpoint returns the WebSocket endpoint of the stream tunnel of a worker.
+func streamEndpoint(workerAddress string) (string, error) {
+	u, err := url.Parse(workerAddress)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("wss://%s/connect?net=stream", u.Host), nil
+}
+
+// DialStream opens a TCP stream to destination carried over the shared stream
+// tunnel of workerAddress. The tunnel is established on first use and reused
+// by later streams until it fails.
+func (w *WSTunnel) DialStream(ctx context.Context, workerAddress, destination string) (net.Conn, error) {
+	endpoint, err := streamEndpoint(workerAddress)
+	if err != nil {
+		return nil, err
+	}
+	mux, err := w.streamMux(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return mux.open(ctx, destination)
+}
+
+func (w *WSTunnel) streamMux(ctx context.Context, endpoint string) (*streamMux, error) {
+	w.streamsMu.Lock()
+	defer w.streamsMu.Unlock()
+	if mux, ok := w.streamMuxes[endpoint]; ok && mux.err() == nil {
+		return mux, nil
+	}
+
+	logger.Infof("connecting stream tunnel to %s", endpoint)
+	conn, err := w.DialContext(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if w.streamMuxes == nil {
+		w.streamMuxes = make(map[string]*streamMux)
+	}
+	mux := newStreamMux(conn, w.ShortClientID, w.maxChannels())
+	w.streamMuxes[endpoint] = mux
+	return mux, nil
+}
+
+// streamMux multiplexes TCP streams over a single WebSocket.
+type streamMux struct {
+	conn     *websocket.Conn
+	clientID string
+	pinger   *wsPinger
+
+	wmu sync.Mutex
+
+	mu       sync.Mutex
+	streams  map[uint16]*tunnelStream
+	next     uint16
+	closeErr error
+	// maxStreams caps the streams open at once
+	maxStreams int
+}
+
+func newStreamMux(conn *websocket.Conn, clientID string, maxStreams int) *streamMux {
+	m := &streamMux{
+		conn:       conn,
+		clientID:   clientID,
+		pinger:     newWSPinger(conn),
+		streams:    make(map[uint16]*tunnelStream),
+		maxStreams: maxStreams,
+	}
+	go m.readLoop()
+	return m
+}
+
+func (m *streamMux) err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closeErr
+}
+
+// open asks the worker to connect a new channel to destination and waits for
+// its answer.
+func (m *streamMux) open(ctx context.Context, destination string) (*tunnelStream, error) {
+	m.mu.Lock()
+	if m.closeErr != nil {
+		m.mu.Unlock()
+		return nil, m.closeErr
+	}
+	if len(m.streams) >= m.maxStreams {
+		m.mu.Unlock()
+		return nil, ErrTooManyChannels
+	}
+	channel, ok := m.freeChannel()
+	if !ok {
+		m.mu.Unlock()
+		return nil, errNoFreeChannel
+	}
+	s := newTunnelStream(m, channel)
+	m.streams[channel] = s
+	m.mu.Unlock()
+
+	if err := m.write(streamFrame{Channel: channel, Type: streamOpen, Data: []byte(destination)}); err != nil {
+		m.remove(channel)
+		return nil, err
+	}
+	select {
+	case err := <-s.opened:
+		if err != nil {
+			m.remove(channel)
+			return nil, err
+		}
+		return s, nil
+	case <-ctx.Done():
+		_ = s.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// freeChannel picks the next unused channel ID, 0 is never used. m.mu must be held.
+func (m *streamMux) freeChannel() (uint16, bool) {
+	for i := 0; i < 1<<16; i++ {
+		m.next++
+		if m.next == 0 {
+			continue
+		}
+		if _, ok := m.streams[m.next]; !ok {
+			return m.next, true
+		}
+	}
+	return 0, false
+}
+
+// len returns the number of open streams.
+func (m *streamMux) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.streams)
+}
+
+func (m *streamMux) remove(channel uint16) {
+	m.mu.Lock()
+	delete(m.streams, channel)
+	m.mu.Unlock()
+}
+
+func (m *streamMux) write(f streamFrame) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	return m.conn.WriteMessage(websocket.BinaryMessage, encodeStreamFrame(m.clientID, f))
+}
+
+func (m *streamMux) readLoop() {
+	var err error
+	for {
+		var b []byte
+		_, b, err = m.conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		f, perr := parseStreamFrame(b)
+		if perr != nil {
+			logger.Errorf("dropping malformed stream frame: %v", perr)
+			continue
+		}
+		m.mu.Lock()
+		s, ok := m.streams[f.Channel]
+		m.mu.Unlock()
+		if !ok {
+			continue
+		}
+		switch f.Type {
+		case streamOpen:
+			s.setOpened(nil)
+		case streamData:
+			if !s.push(f.Data) {
+				logger.Errorf("resetting stream %d, more than %d bytes unread", f.Channel, maxStreamBuffered)
+				s.reset(errStreamBufferFull)
+				m.remove(f.Channel)
+				_ = m.write(streamFrame{Channel: f.Channel, Type: streamClose})
+			}
+		case streamClose:
+			var cerr error = io.EOF
+			if len(f.Data) > 0 {
+				cerr = fmt.Errorf("stream closed by worker: %s", f.Data)
+			}
+			s.setOpened(cerr)
+			s.closeRead(cerr)
+			m.remove(f.Channel)
+		}
+	}
+
+	logger.Errorf("stream tunnel closed: %v", err)
+	m.mu.Lock()
+	m.closeErr = errStreamTunnelClosed
+	streams := m.streams
+	m.streams = make(map[uint16]*tunnelStream)
+	m.mu.Unlock()
+	for _, s := range streams {
+		s.setOpened(errStreamTunnelClosed)
+		s.closeRead(errStreamTunnelClosed)
+	}
+	_ = m.conn.Close()
+}
+
+// tunnelStream is a single TCP stream carried by a streamMux.
+type tunnelStream struct {
+	mux     *streamMux
+	channel uint16
+
+	opened   chan error
+	openOnce sync.Once
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	buf          bytes.Buffer
+	readErr      error
+	readDeadline time.Time
+	closed       bool
+}
+
+func newTunnelStream(mux *streamMux, channel uint16) *tunnelStream {
+	s := &tunnelStream{
+		mux:     mux,
+		channel: channel,
+		opened:  make(chan error, 1),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *tunnelStream) setOpened(err error) {
+	s.openOnce.Do(func() { s.opened <- err })
+}
+
+// push queues b for Read. It reports false, leaving b out, when that would
+// put more than maxStreamBuffered bytes in the buffer.
+func (s *tunnelStream) push(b []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf.Len()+len(b) > maxStreamBuffered {
+		return false
+	}
+	s.buf.Write(b)
+	s.cond.Broadcast()
+	return true
+}
+
+// reset drops the buffered data and fails the reads with err.
+func (s *tunnelStream) reset(err error) {
+	s.mu.Lock()
+	s.buf = bytes.Buffer{}
+	if s.readErr == nil {
+		s.readErr = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *tunnelStream) closeRead(err error) {
+	s.mu.Lock()
+	if s.readErr == nil {
+		s.readErr = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Read reads stream data sent by the worker.
+func (s *tunnelStream) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.buf.Len() == 0 && s.readErr == nil && !s.closed {
+		if !s.readDeadline.IsZero() && !time.Now().Before(s.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.cond.Wait()
+	}
+	if s.buf.Len() > 0 {
+		return s.buf.Read(b)
+	}
+	if s.closed {
+		return 0, net.ErrClosed
+	}
+	return 0, s.readErr
+}
+
+// Write sends b to the worker, split in frames of at most maxStreamFrameData bytes.
+func (s *tunnelStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+
+	written := 0
+	for written < len(b) {
+		n := len(b) - written
+		if n > maxStreamFrameData {
+			n = maxStreamFrameData
+		}
+		if err := s.mux.write(streamFrame{Channel: s.channel, Type: streamData, Data: b[written : written+n]}); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close closes the stream, the tunnel stays open for the other streams.
+func (s *tunnelStream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.mux.remove(s.channel)
+	if s.mux.err() != nil {
+		return nil
+	}
+	return s.mux.write(streamFrame{Channel: s.channel, Type: streamClose})
+}
+
+// LocalAddr returns the local address of the tunnel.
+func (s *tunnelStream) LocalAddr() net.Addr { return s.mux.conn.LocalAddr() }
+
+// RemoteAddr returns the remote address of the tunnel.
+func (s *tunnelStream) RemoteAddr() net.Addr { return s.mux.conn.RemoteAddr() }
+
+// SetDeadline sets the read deadline, writes go straight to the shared tunnel.
+func (s *tunnelStream) SetDeadline(t time.Time) error { return s.SetReadDeadline(t) }
+
+// SetReadDeadline sets the deadline for future and pending Read calls.
+func (s *tunnelStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if !t.IsZero() {
+		time.AfterFunc(time.Until(t), func() {
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		})
+	}
+	return nil
+}
+
+// SetWriteDeadline is a no-op, the shared tunnel can not have per stream write deadlines.
+func (s *tunnelStream) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,285 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeStreamWorker plays the worker side of a stream tunnel: it accepts
+// every stream except to "refused:1", and echoes the data it receives.
+func fakeStreamWorker(t *testing.T) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			// strip the client ID
+			f, err := parseStreamFrame(b[len("client"):])
+			if err != nil {
+				t.Errorf("worker received a malformed frame: %v", err)
+				return
+			}
+			reply := streamFrame{Channel: f.Channel, Type: f.Type}
+			switch f.Type {
+			case streamOpen:
+				if string(f.Data) == "refused:1" {
+					reply = streamFrame{Channel: f.Channel, Type: streamClose, Data: []byte("connection refused")}
+				}
+			case streamData:
+				reply.Data = f.Data
+			case streamClose:
+				continue
+			}
+			b = encodeStreamFrame("", reply)
+			if err := conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestStreamMux(t *testing.T) {
+	mux := newStreamMux(fakeStreamWorker(t), "client", maxChannelIDs)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a, err := mux.open(ctx, "a.example:80")
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	b, err := mux.open(ctx, "b.example:80")
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if a.channel == b.channel {
+		t.Fatalf("streams share channel %d", a.channel)
+	}
+
+	for _, s := range []*tunnelStream{a, b} {
+		msg := strings.Repeat("x", maxStreamFrameData+10)
+		if _, err := s.Write([]byte(msg)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(s, got); err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if string(got) != msg {
+			t.Errorf("echo mismatch on channel %d", s.channel)
+		}
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if _, err := a.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected read on a closed stream to fail")
+	}
+	if _, err := b.Write([]byte("still open")); err != nil {
+		t.Errorf("closing one stream broke the other: %v", err)
+	}
+}
+
+func TestStreamMuxRefused(t *testing.T) {
+	mux := newStreamMux(fakeStreamWorker(t), "client", maxChannelIDs)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := mux.open(ctx, "refused:1")
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("expected the worker error, got %v", err)
+	}
+	mux.mu.Lock()
+	n := len(mux.streams)
+	mux.mu.Unlock()
+	if n != 0 {
+		t.Errorf("expected the refused stream to be removed, %d left", n)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	mux := newStreamMux(fakeStreamWorker(t), "client", maxChannelIDs)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := mux.open(ctx, "a.example:80")
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	reset := make(chan struct{})
+	w := &WSTunnel{
+		EstablishedTunnels: map[string]*EstablishedTunnel{"udp": {reset: reset}},
+		streamMuxes:        map[string]*streamMux{"stream": mux},
+	}
+
+	w.Reconnect()
+	select {
+	case <-reset:
+	default:
+		t.Error("expected the UDP tunnel connection to be reset")
+	}
+	if len(w.streamMuxes) != 0 {
+		t.Error("expected the stream tunnel to be dropped")
+	}
+	if _, err := s.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the streams of the dropped tunnel to fail")
+	}
+	// a tunnel between two connections has nothing to reset
+	w.Reconnect()
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	mux := newStreamMux(fakeStreamWorker(t), "client", maxChannelIDs)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := mux.open(ctx, "a.example:80")
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer s.Close()
+	_ = s.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := s.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected a deadline error")
+	}
+}
+
+func TestPingStreamTunnel(t *testing.T) {
+	mux := newStreamMux(fakeStreamWorker(t), "client", maxChannelIDs)
+	w := &WSTunnel{streamMuxes: map[string]*streamMux{"wss://worker.example/connect?net=stream": mux}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rtt, err := w.Ping(ctx, "https://worker.example/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 {
+		t.Errorf("expected a round trip time, got %v", rtt)
+	}
+}
+
+func TestStreamMuxMaxStreams(t *testing.T) {
+	mux := newStreamMux(fakeStreamWorker(t), "client", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a, err := mux.open(ctx, "a.example:80")
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if _, err := mux.open(ctx, "b.example:80"); !errors.Is(err, ErrTooManyChannels) {
+		t.Fatalf("expected a stream past the cap to be rejected, got %v", err)
+	}
+	_ = a.Close()
+	b, err := mux.open(ctx, "b.example:80")
+	if err != nil {
+		t.Fatalf("expected a stream once one is closed: %v", err)
+	}
+	_ = b.Close()
+}
+
+// floodStreamWorker accepts every stream and sends it data until the stream
+// is closed, which it reports on closed.
+func floodStreamWorker(t *testing.T, closed chan<- uint16) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		f, err := parseStreamFrame(b[len("client"):])
+		if err != nil || f.Type != streamOpen {
+			t.Errorf("expected an open frame, got %v %v", f, err)
+			return
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, encodeStreamFrame("", streamFrame{Channel: f.Channel, Type: streamOpen})); err != nil {
+			return
+		}
+		go func() {
+			data := encodeStreamFrame("", streamFrame{Channel: f.Channel, Type: streamData, Data: make([]byte, maxStreamFrameData)})
+			for i := 0; i < 2*maxStreamBuffered/maxStreamFrameData; i++ {
+				if conn.WriteMessage(websocket.BinaryMessage, data) != nil {
+					return
+				}
+			}
+		}()
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if f, err := parseStreamFrame(b[len("client"):]); err == nil && f.Type == streamClose {
+				closed <- f.Channel
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestStreamBufferCap(t *testing.T) {
+	closed := make(chan uint16, 1)
+	mux := newStreamMux(floodStreamWorker(t, closed), "client", maxChannelIDs)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := mux.open(ctx, "a.example:80")
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	// nothing reads the stream while the worker sends twice the cap
+	select {
+	case channel := <-closed:
+		if channel != s.channel {
+			t.Errorf("expected stream %d to be closed, got %d", s.channel, channel)
+		}
+	case <-ctx.Done():
+		t.Fatal("expected the stream to be reset once its buffer is full")
+	}
+	s.mu.Lock()
+	buffered := s.buf.Len()
+	s.mu.Unlock()
+	if buffered > maxStreamBuffered {
+		t.Errorf("expected at most %d bytes buffered, got %d", maxStreamBuffered, buffered)
+	}
+	if _, err := s.Read(make([]byte, 1)); !errors.Is(err, errStreamBufferFull) {
+		t.Errorf("expected the reset to fail reads, got %v", err)
+	}
+	if mux.len() != 0 {
+		t.Error("expected the reset stream to be removed")
+	}
+}
@@ -3,18 +3,30 @@ package transport
 
 import (
 	"bepass/bufferpool"
+	"bepass/clock"
 	"bepass/dialer"
+	"bepass/endpoint"
 	"bepass/logger"
 	"bepass/socks5"
 	"bepass/socks5/statute"
 	"bepass/utils"
 	"bepass/wsconnadapter"
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// datagramBufferSize fits the largest UDP datagram, so a SOCKS5 UDP packet is
+// never truncated whatever the size of the relay buffers.
+const datagramBufferSize = 64 * 1024
+
+// datagramBufferPool provides the buffers the UDP associations are read into.
+var datagramBufferPool = bufferpool.NewPool(datagramBufferSize)
+
 // UDPBind represents a UDP binding configuration.
 type UDPBind struct {
 	Source        *net.UDPAddr
@@ -39,9 +51,29 @@ type Transport struct {
 	WorkerAddress string
 	BindAddress   string
 	Dialer        *dialer.Dialer
-	BufferPool    bufferpool.BufPool
-	UDPBind       string
-	Tunnel        *WSTunnel
+	// BufferPool provides the buffers of the TCP copy loops, the UDP associations
+	// read into buffers that fit any datagram
+	BufferPool bufferpool.BufPool
+	UDPBind    string
+	Tunnel     *WSTunnel
+	// UDPTunnel carries the UDP associations, Tunnel if nil
+	UDPTunnel UDPTunnel
+	// Shared, if set, has the TCP tunnels opened by a shared tunnel daemon
+	Shared *SharedTunnelClient
+	// Endpoints holds the worker addresses to tunnel through, WorkerAddress is used if empty
+	Endpoints *endpoint.Pool
+	// SelectionStrategy is how the tunnels are spread over Endpoints,
+	// round-robin if empty
+	SelectionStrategy endpoint.Strategy
+	// StreamMode carries TCP connections as streams of a shared tunnel instead
+	// of opening a WebSocket per connection
+	StreamMode bool
+	// BlockQUIC drops QUIC Initial packets to UDP port 443, so clients fall back
+	// from HTTP/3 to TCP where the ClientHello is fragmented
+	BlockQUIC bool
+	// DNS, if set, answers the DNS queries of UDP associations, the datagrams
+	// to port 53, in place of the worker
+	DNS func(ctx context.Context, query []byte) ([]byte, error)
 }
 
 // UDPPacket represents a UDP packet.
@@ -50,35 +82,26 @@ type UDPPacket struct {
 	Data    []byte
 }
 
-// TunnelTCP handles tcp network traffic.
-func (t *Transport) TunnelTCP(w io.Writer, req *socks5.Request) error {
-	tunnelEndpoint, err := utils.WSEndpointHelper(t.WorkerAddress, req.RawDestAddr.String(), "tcp")
-	if err != nil {
-		if err := socks5.SendReply(w, statute.RepServerFailure, nil); err != nil {
-			return err
-		}
-		logger.Infof("Could not split host and port: %v\n", err)
-		return err
-	}
+// UDPTunnel carries the packets of UDP associations through a worker.
+// WSTunnel multiplexes them over a shared WebSocket, MASQUETunnel gives each
+// association a CONNECT-UDP stream.
+type UDPTunnel interface {
+	// BindUDP opens an association to destination through the worker at
+	// workerAddress. Packets sent on the returned channel, tagged with the
+	// returned channel number, go to destination and its replies are
+	// delivered to recv until unbind is called.
+	BindUDP(ctx context.Context, workerAddress, destination string, recv chan UDPPacket) (send chan UDPPacket, channel uint16, unbind func(), err error)
+}
 
-	wsConn, err := t.Tunnel.Dial(tunnelEndpoint)
+// TunnelTCP handles tcp network traffic. The tunnel is closed once ctx is done.
+func (t *Transport) TunnelTCP(ctx context.Context, w io.Writer, req *socks5.Request) error {
+	conn, err := t.DialTCP(ctx, w, req)
 	if err != nil {
-		if err := socks5.SendReply(w, statute.RepServerFailure, nil); err != nil {
-			return err
-		}
-		logger.Infof("Can not connect: %v\n", err)
 		return err
 	}
-
-	conn := wsconnadapter.New(wsConn)
 	defer conn.Close()
-
-	if err != nil {
-		return err
-	}
-
-	// flush ws stream to write
-	conn.Write([]byte{})
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
 
 	errCh := make(chan error, 2)
 	go func() { errCh <- t.Copy(req.Reader, conn) }()
@@ -94,16 +117,113 @@ func (t *Transport) TunnelTCP(w io.Writer, req *socks5.Request) error {
 	return nil
 }
 
-// Copy copies data from reader to writer.
+// DialTCP opens a tunnel through the worker to the destination of req. A
+// failure reply is sent to w if the tunnel can not be established.
+func (t *Transport) DialTCP(ctx context.Context, w io.Writer, req *socks5.Request) (net.Conn, error) {
+	conn, err := t.dialTunnel(ctx, req.RawDestAddr.String())
+	if err != nil {
+		if err := socks5.SendReply(w, statute.RepServerFailure, nil); err != nil {
+			return nil, err
+		}
+		logger.Infof("Can not connect: %v\n", err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialTunnel opens a TCP tunnel to destination, through the shared tunnel
+// daemon if Shared is set.
+func (t *Transport) dialTunnel(ctx context.Context, destination string) (net.Conn, error) {
+	if t.Shared != nil {
+		return t.Shared.DialTCP(ctx, destination)
+	}
+	workerAddress := t.workerAddress(destination)
+	if t.StreamMode {
+		return t.Tunnel.DialStream(ctx, workerAddress, destination)
+	}
+	tunnelEndpoint, err := utils.WSEndpointHelper(workerAddress, destination, "tcp")
+	if err != nil {
+		return nil, fmt.Errorf("could not split host and port, %v", err)
+	}
+	wsConn, err := t.Tunnel.DialContext(ctx, tunnelEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	conn := wsconnadapter.New(wsConn)
+	// flush ws stream to write
+	conn.Write([]byte{})
+	return conn, nil
+}
+
+// udpTunnel returns the tunnel carrying UDP associations.
+func (t *Transport) udpTunnel() UDPTunnel {
+	if t.UDPTunnel != nil {
+		return t.UDPTunnel
+	}
+	return t.Tunnel
+}
+
+// workerAddress picks the worker for a new tunnel to destination.
+func (t *Transport) workerAddress(destination string) string {
+	host := destination
+	if h, _, err := net.SplitHostPort(destination); err == nil {
+		host = h
+	}
+	if addr, ok := t.Endpoints.Pick(t.SelectionStrategy, host); ok {
+		return addr
+	}
+	return t.WorkerAddress
+}
+
+// KeepAlive pings the workers of Endpoints every interval until ctx is done,
+// recording their round trip times for the lowest-latency strategy. A worker
+// that does not answer loses its measurement, so it is avoided.
+func (t *Transport) KeepAlive(ctx context.Context, interval time.Duration) {
+	ticker := clock.Or(t.Tunnel.Clock).NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, addr := range t.Endpoints.Items() {
+			pingCtx, cancel := context.WithTimeout(ctx, interval)
+			rtt, err := t.Tunnel.Ping(pingCtx, addr)
+			cancel()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Debugf("keepalive to %s failed: %v", addr, err)
+			}
+			t.Endpoints.SetRTT(addr, rtt)
+		}
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Copy copies data from reader to writer and half-closes the writer once reader is drained.
 func (t *Transport) Copy(reader io.Reader, writer io.Writer) error {
-	buf := make([]byte, 32*1024)
+	buf := t.BufferPool.Get()
+	defer t.BufferPool.Put(buf)
 
 	_, err := io.CopyBuffer(writer, reader, buf[:cap(buf)])
-	return err
+	if err != nil {
+		return err
+	}
+	if cw, ok := writer.(closeWriter); ok {
+		_ = cw.CloseWrite()
+	}
+	return nil
 }
 
-// TunnelUDP tunnels UDP packets over WebSocket.
-func (t *Transport) TunnelUDP(w io.Writer, req *socks5.Request) error {
+// TunnelUDP tunnels UDP packets through the worker until ctx is done or the SOCKS
+// client closes the control connection, which ends the association (RFC 1928).
+func (t *Transport) TunnelUDP(ctx context.Context, w io.Writer, req *socks5.Request) error {
 	udpAddr, _ := net.ResolveUDPAddr("udp", t.UDPBind+":0") // Use _ to indicate the error is intentionally ignored
 	// connect to remote server via ws
 	bindLn, err := net.ListenUDP("udp", udpAddr)
@@ -113,27 +233,27 @@ func (t *Transport) TunnelUDP(w io.Writer, req *socks5.Request) error {
 		}
 		return fmt.Errorf("listen udp failed, %v", err)
 	}
-	fmt.Println(bindLn.LocalAddr())
-	if err := socks5.SendReply(w, statute.RepSuccess, bindLn.LocalAddr()); err != nil {
+	defer bindLn.Close()
+	if err := socks5.SendReply(w, statute.RepSuccess, socks5.ReplyAddr(bindLn.LocalAddr(), req.LocalAddr)); err != nil {
 		logger.Errorf("failed to send reply: %v", err)
 		return err
 	}
 
-	tunnelEndpoint, err := utils.WSEndpointHelper(t.WorkerAddress, req.RawDestAddr.String(), "udp")
-	if err != nil {
-		if err := socks5.SendReply(w, statute.RepServerFailure, nil); err != nil {
-			return err
-		}
-		logger.Infof("Could not split host and port: %v\n", err)
-		return err
-	}
+	assocCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the client sends nothing more on the control connection, it only closes it
+	go func() {
+		_, _ = io.Copy(io.Discard, req.Reader)
+		cancel()
+	}()
 
 	bindWriteChannel := make(chan UDPPacket)
-	tunnelWriteChannel, channelIndex, err := t.Tunnel.PersistentDial(tunnelEndpoint, bindWriteChannel)
+	tunnelWriteChannel, channelIndex, unbind, err := t.udpTunnel().BindUDP(assocCtx, t.workerAddress(req.RawDestAddr.String()), req.RawDestAddr.String(), bindWriteChannel)
 	if err != nil {
 		logger.Errorf("Unable to get or create tunnel for udpBindWriteChannel %v\r\n", err)
 		return err
 	}
+	defer unbind()
 	// make new Bind
 	udpBind := &UDPBind{
 		SocksWriter:   w,
@@ -142,12 +262,13 @@ func (t *Transport) TunnelUDP(w io.Writer, req *socks5.Request) error {
 		Destination:   req.RawDestAddr.String(),
 		RecvChan:      bindWriteChannel,
 	}
-	bufPool := t.BufferPool.Get()
-	defer t.BufferPool.Put(bufPool)
+	// source is the client address replies go to, the last one a datagram came from
+	var source atomic.Pointer[net.UDPAddr]
 	go func() {
+		buf := datagramBufferPool.Get()
+		defer datagramBufferPool.Put(buf)
 		for {
-			n, addr, err := udpBind.AssociateBind.ReadFromUDP(bufPool[:cap(bufPool)])
-			udpBind.Source = addr
+			n, addr, err := udpBind.AssociateBind.ReadFromUDP(buf[:cap(buf)])
 			if err != nil {
 				if err == io.EOF {
 					break
@@ -157,26 +278,67 @@ func (t *Transport) TunnelUDP(w io.Writer, req *socks5.Request) error {
 				}
 				break
 			}
-			pk, err := statute.ParseDatagram(bufPool[:n])
+			source.Store(addr)
+			pk, err := statute.ParseDatagram(buf[:n])
 			if err != nil {
 				continue
 			}
-			tunnelWriteChannel <- UDPPacket{
+			if t.BlockQUIC && pk.DstAddr.Port == 443 && isQUICInitial(pk.Data) {
+				logger.Debugf("dropping QUIC Initial to %s", pk.DstAddr.String())
+				continue
+			}
+			// the tunnel writes the packet after the next read reuses buf
+			data := make([]byte, len(pk.Data))
+			copy(data, pk.Data)
+			if t.DNS != nil && pk.DstAddr.Port == 53 {
+				go t.answerDNS(assocCtx, udpBind.AssociateBind, addr, pk.DstAddr.String(), data)
+				continue
+			}
+			select {
+			case tunnelWriteChannel <- UDPPacket{
 				Channel: channelIndex,
-				Data:    pk.Data,
+				Data:    data,
+			}:
+			case <-assocCtx.Done():
+				return
 			}
 		}
 	}()
 	for {
-		datagram := <-udpBind.RecvChan
+		var datagram UDPPacket
+		select {
+		case datagram = <-udpBind.RecvChan:
+		case <-assocCtx.Done():
+			// a closed control connection is the normal end of the association
+			return ctx.Err()
+		}
+		addr := source.Load()
+		if addr == nil {
+			continue
+		}
 		pkb, err := statute.NewDatagram(req.RawDestAddr.String(), datagram.Data)
 		if err != nil {
 			continue
 		}
 		proBuf := append(pkb.Header(), pkb.Data...)
-		_, err = udpBind.AssociateBind.WriteTo(proBuf, udpBind.Source)
+		_, err = udpBind.AssociateBind.WriteTo(proBuf, addr)
 		if err != nil {
 			return err
 		}
 	}
 }
+
+// answerDNS sends the reply of t.DNS to query back to the client at addr, as
+// if it came from destination.
+func (t *Transport) answerDNS(ctx context.Context, bind *net.UDPConn, addr *net.UDPAddr, destination string, query []byte) {
+	reply, err := t.DNS(ctx, query)
+	if err != nil {
+		logger.Debugf("dropping invalid dns query to %s, %v", logger.Redact(destination), err)
+		return
+	}
+	pkb, err := statute.NewDatagram(destination, reply)
+	if err != nil {
+		return
+	}
+	_, _ = bind.WriteTo(append(pkb.Header(), pkb.Data...), addr)
+}
@@ -0,0 +1,382 @@
+package transport
+
+import (
+	"bepass/bufferpool"
+	"bepass/clock"
+	"bepass/dialer"
+	"bepass/endpoint"
+	"bepass/socks5"
+	"bepass/socks5/statute"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTunnelUDPControlClose(t *testing.T) {
+	// nothing listens on the proxy address, the tunnel keeps redialing
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	tunnel := &WSTunnel{
+		BindAddress:        proxyAddr,
+		Dialer:             &dialer.Dialer{},
+		LinkIdleTimeout:    60,
+		EstablishedTunnels: make(map[string]*EstablishedTunnel),
+	}
+	tr := &Transport{
+		WorkerAddress: "https://worker.example/dns-query",
+		UDPBind:       "127.0.0.1",
+		BufferPool:    bufferpool.NewPool(32 * 1024),
+		Tunnel:        tunnel,
+	}
+
+	client, control := net.Pipe()
+	req := &socks5.Request{
+		Reader:      control,
+		RawDestAddr: &statute.AddrSpec{IP: net.IPv4(1, 1, 1, 1), Port: 53},
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- tr.TunnelUDP(context.Background(), control, req) }()
+
+	rep, err := statute.ParseReply(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Response != statute.RepSuccess {
+		t.Fatalf("unexpected reply %d", rep.Response)
+	}
+	relay, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: rep.BndAddr.IP, Port: rep.BndAddr.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	dg, err := statute.NewDatagram("1.1.1.1:53", []byte("query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := relay.Write(dg.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the reply is sent before the tunnel is set up
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tunnel.tunnelsMu.Lock()
+		bound := len(tunnel.EstablishedTunnels)
+		tunnel.tunnelsMu.Unlock()
+		if bound == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one tunnel while associated, got %d", bound)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_ = client.Close()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("expected a clean end of the association, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("association outlived its control connection")
+	}
+
+	tunnel.tunnelsMu.Lock()
+	left := len(tunnel.EstablishedTunnels)
+	tunnel.tunnelsMu.Unlock()
+	if left != 0 {
+		t.Fatalf("expected the tunnel to be released, %d left", left)
+	}
+
+	// the relay socket is closed, so it can be bound again
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: rep.BndAddr.IP, Port: rep.BndAddr.Port})
+	if err != nil {
+		t.Fatalf("relay socket was not released: %v", err)
+	}
+	_ = l.Close()
+}
+
+func TestTunnelUDPInterceptDNS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	tr := &Transport{
+		WorkerAddress: "https://worker.example/dns-query",
+		UDPBind:       "127.0.0.1",
+		// relay buffers smaller than the datagrams must not truncate them
+		BufferPool: bufferpool.NewPool(512),
+		Tunnel: &WSTunnel{
+			BindAddress:        proxyAddr,
+			Dialer:             &dialer.Dialer{},
+			LinkIdleTimeout:    60,
+			EstablishedTunnels: make(map[string]*EstablishedTunnel),
+		},
+		DNS: func(ctx context.Context, query []byte) ([]byte, error) {
+			return append([]byte("reply to "), query...), nil
+		},
+	}
+
+	client, control := net.Pipe()
+	defer client.Close()
+	req := &socks5.Request{
+		Reader:      control,
+		RawDestAddr: &statute.AddrSpec{IP: net.IPv4zero, Port: 0},
+	}
+	go func() { _ = tr.TunnelUDP(context.Background(), control, req) }()
+
+	rep, err := statute.ParseReply(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: rep.BndAddr.IP, Port: rep.BndAddr.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	dg, err := statute.NewDatagram("9.9.9.9:53", []byte("query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := relay.Write(dg.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 512)
+	n, err := relay.Read(buf)
+	if err != nil {
+		t.Fatalf("expected the query to be answered locally, %v", err)
+	}
+	pk, err := statute.ParseDatagram(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk.DstAddr.String() != "9.9.9.9:53" || string(pk.Data) != "reply to query" {
+		t.Errorf("got %q from %s", pk.Data, pk.DstAddr.String())
+	}
+
+	query := strings.Repeat("q", 4000)
+	if dg, err = statute.NewDatagram("9.9.9.9:53", []byte(query)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := relay.Write(dg.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, 8192)
+	if n, err = relay.Read(buf); err != nil {
+		t.Fatalf("expected the large query to be answered, %v", err)
+	}
+	if pk, err = statute.ParseDatagram(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if string(pk.Data) != "reply to "+query {
+		t.Errorf("expected the whole query to be read, got a reply of %d bytes", len(pk.Data))
+	}
+}
+
+func TestUnbindSharedTunnel(t *testing.T) {
+	tunnel := &WSTunnel{
+		BindAddress:        "127.0.0.1:1",
+		Dialer:             &dialer.Dialer{},
+		LinkIdleTimeout:    60,
+		EstablishedTunnels: make(map[string]*EstablishedTunnel),
+	}
+	const endpoint = "wss://worker.example/connect?host=1.1.1.1&port=53&net=udp"
+	_, a, err := tunnel.PersistentDial(endpoint, make(chan UDPPacket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, b, err := tunnel.PersistentDial(endpoint, make(chan UDPPacket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatalf("bindings share channel %d", a)
+	}
+
+	tunnel.Unbind(endpoint, a)
+	tunnel.tunnelsMu.Lock()
+	et, ok := tunnel.EstablishedTunnels[endpoint]
+	if !ok || len(et.bindWriteChannels) != 1 {
+		t.Error("tunnel should stay up for the remaining binding")
+	}
+	tunnel.tunnelsMu.Unlock()
+
+	tunnel.Unbind(endpoint, b)
+	tunnel.tunnelsMu.Lock()
+	_, ok = tunnel.EstablishedTunnels[endpoint]
+	tunnel.tunnelsMu.Unlock()
+	if ok {
+		t.Error("tunnel should be released with its last binding")
+	}
+	select {
+	case <-et.stop:
+	default:
+		t.Error("tunnel was not stopped")
+	}
+}
+
+func TestMaxChannels(t *testing.T) {
+	tunnel := &WSTunnel{
+		BindAddress:        "127.0.0.1:1",
+		Dialer:             &dialer.Dialer{},
+		LinkIdleTimeout:    60,
+		EstablishedTunnels: make(map[string]*EstablishedTunnel),
+		MaxChannels:        2,
+	}
+	const endpoint = "wss://worker.example/connect?host=1.1.1.1&port=53&net=udp"
+	_, a, err := tunnel.PersistentDial(endpoint, make(chan UDPPacket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Unbind(endpoint, a)
+	_, b, err := tunnel.PersistentDial(endpoint, make(chan UDPPacket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tunnel.Channels(); got != 2 {
+		t.Errorf("expected 2 channels, got %d", got)
+	}
+	if _, _, err := tunnel.PersistentDial(endpoint, make(chan UDPPacket)); !errors.Is(err, ErrTooManyChannels) {
+		t.Fatalf("expected a bind past the cap to be rejected, got %v", err)
+	}
+
+	// a released channel makes room for another
+	tunnel.Unbind(endpoint, b)
+	_, c, err := tunnel.PersistentDial(endpoint, make(chan UDPPacket))
+	if err != nil {
+		t.Fatalf("expected a bind once a channel is released: %v", err)
+	}
+	tunnel.Unbind(endpoint, c)
+}
+
+func TestKeepAliveLowestLatency(t *testing.T) {
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyLn.Close()
+	proxy := socks5.NewServer(socks5.WithConnectHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
+		conn, err := net.Dial("tcp", req.RawDestAddr.String())
+		if err != nil {
+			return socks5.SendReply(w, statute.RepHostUnreachable, nil)
+		}
+		defer conn.Close()
+		return socks5.SendReply(w, statute.RepSuccess, conn.LocalAddr())
+	}))
+	go func() {
+		for {
+			conn, err := proxyLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = proxy.ServeConn(conn) }()
+		}
+	}()
+
+	worker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Close()
+	go func() {
+		for {
+			conn, err := worker.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	_ = dead.Close()
+
+	alive := "https://" + worker.Addr().String() + "/dns-query"
+	tr := &Transport{
+		Tunnel:            &WSTunnel{BindAddress: proxyLn.Addr().String(), Dialer: &dialer.Dialer{}},
+		Endpoints:         endpoint.NewPool("https://"+deadAddr+"/dns-query", alive),
+		SelectionStrategy: endpoint.StrategyLowestLatency,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tr.KeepAlive(ctx, time.Minute)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := tr.Endpoints.RTT(alive); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the worker to be measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		if got := tr.workerAddress("example.com:443"); got != alive {
+			t.Fatalf("expected the answering worker, got %s", got)
+		}
+	}
+}
+
+func TestKeepAliveFakeClock(t *testing.T) {
+	// every ping dials the proxy, counting the dials counts the rounds
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyLn.Close()
+	dials := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := proxyLn.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+			dials <- struct{}{}
+		}
+	}()
+
+	fake := clock.NewFake(time.Unix(0, 0))
+	tr := &Transport{
+		Tunnel:    &WSTunnel{BindAddress: proxyLn.Addr().String(), Dialer: &dialer.Dialer{}, Clock: fake},
+		Endpoints: endpoint.NewPool("https://worker.example/dns-query"),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tr.KeepAlive(ctx, time.Hour)
+
+	wait := func(round string) {
+		select {
+		case <-dials:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no ping %s", round)
+		}
+	}
+	wait("at start")
+	select {
+	case <-dials:
+		t.Fatal("pinged again before the interval elapsed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	fake.Advance(time.Hour)
+	wait("after the interval")
+}
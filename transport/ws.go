@@ -2,26 +2,59 @@
 package transport
 
 import (
+	"bepass/clock"
 	"bepass/dialer"
 	"bepass/logger"
+	"bepass/utils"
 	"bepass/wsconnadapter"
 	"context"
-	"encoding/binary"
+	"errors"
 	"net"
+	"net/url"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	tls "github.com/refraction-networking/utls"
 	"golang.org/x/net/proxy"
 )
 
 // EstablishedTunnel represents an established tunnel.
 type EstablishedTunnel struct {
 	tunnelWriteChannel chan UDPPacket
-	bindWriteChannels  map[uint16]chan UDPPacket
+	bindWriteChannels  map[uint16]*udpBinding
 	channelIndex       uint16
+	// queue takes turns between the channels feeding tunnelWriteChannel
+	queue *fairQueue
+	// stop is closed once the last binding is gone, which ends the tunnel
+	stop chan struct{}
+	// reset is closed by Reconnect to drop the current connection
+	reset chan struct{}
 }
 
+// udpBinding is a UDP association carried by a tunnel channel.
+type udpBinding struct {
+	recv chan UDPPacket
+	// send takes the packets of the association into the queue of the tunnel
+	send chan UDPPacket
+	// done is closed once the association is torn down
+	done chan struct{}
+}
+
+// ErrTooManyChannels is returned when a tunnel already carries
+// MaxChannels channels.
+var ErrTooManyChannels = errors.New("too many channels on the tunnel")
+
+// maxChannelIDs is the number of channel IDs of a tunnel, 0 is never used.
+const maxChannelIDs = 1<<16 - 1
+
+// tunnelRedialDelay is how long a persistent tunnel waits before dialing
+// again after a failed dial.
+const tunnelRedialDelay = time.Second
+
 // WSTunnel represents a WebSocket tunnel.
 type WSTunnel struct {
 	BindAddress        string
@@ -31,72 +64,338 @@ type WSTunnel struct {
 	LinkIdleTimeout    int64
 	EstablishedTunnels map[string]*EstablishedTunnel
 	ShortClientID      string
+	// tunnelsMu guards EstablishedTunnels and their bindings
+	tunnelsMu sync.Mutex
+	// HTTP2 carries the WebSocket over HTTP/2 (RFC 8441) when the worker
+	// supports it, falling back to HTTP/1.1 otherwise
+	HTTP2 bool
+	// MaxIdleConns is the number of HTTP/2 connections to a worker kept open
+	// without streams, so later WebSockets skip the TLS handshake. 0 opens a
+	// connection per WebSocket
+	MaxIdleConns int
+	// MaxConnLifetime is how long a pooled HTTP/2 connection takes new
+	// WebSockets, 0 for no limit
+	MaxConnLifetime time.Duration
+	// IdleConnTimeout is how long a pooled HTTP/2 connection without
+	// WebSockets is kept open, 0 for no limit
+	IdleConnTimeout time.Duration
+	// MaxChannels caps the channels a tunnel carries at once, the
+	// UDP associations of a UDP tunnel or the streams of the stream tunnel,
+	// the 65535 channel IDs if 0
+	MaxChannels int
+	// HandshakeTimeout bounds the opening of a WebSocket, from the TCP and
+	// TLS handshakes to the upgrade, 0 for no limit
+	HandshakeTimeout time.Duration
+	// VerifyTLS checks the worker certificate against the worker hostname (or
+	// TLSHostname), even though the connection goes to a clean IP
+	VerifyTLS bool
+	// TLSHostname is the name the worker certificate must be valid for, the
+	// hostname of the endpoint if empty
+	TLSHostname string
+	// ClientCert is presented to workers asking for a client certificate
+	ClientCert *tls.Certificate
+	// RetransmitBuffer is the number of recent packets per channel replayed
+	// once a dropped tunnel to a DNS server (port 53) reconnects, 0 disables
+	// replaying
+	RetransmitBuffer int
+	// RetransmitWindow is how old a written packet can be and still get
+	// replayed, defaultRetransmitWindow if 0
+	RetransmitWindow time.Duration
+	// OnReconnect is called with the endpoint when a dropped UDP tunnel is
+	// connected again
+	OnReconnect func(endpoint string)
+	// StandbyEndpoint, if set, returns the endpoint of the second connection
+	// a UDP tunnel to endpoint keeps open, idle but pinged, usually to
+	// another worker. When the first connection drops the channels switch
+	// to it at once, replaying their recent DNS packets, and a new standby is
+	// opened. "" keeps no standby
+	StandbyEndpoint func(endpoint string) string
+	// Clock times the idle links, redials and replays of the UDP tunnels and
+	// the keepalives, the real clock if nil. Socket deadlines stay on real time
+	Clock clock.Clock
+
+	malformedFrames atomic.Uint64
+	// h1Only remembers the hosts that failed the HTTP/2 upgrade
+	h1Only sync.Map
+
+	h2PoolOnce sync.Once
+	h2Pool     *h2Pool
+
+	streamsMu   sync.Mutex
+	streamMuxes map[string]*streamMux
+}
+
+// MalformedFrames returns the number of frames received from tunnels that were dropped as malformed.
+func (w *WSTunnel) MalformedFrames() uint64 {
+	return w.malformedFrames.Load()
 }
 
 // socks5TCPDial dials using SOCKS5 proxy.
-func (w *WSTunnel) socks5TCPDial(_ context.Context, network, addr string) (net.Conn, error) {
+func (w *WSTunnel) socks5TCPDial(ctx context.Context, network, addr string) (net.Conn, error) {
 	d, err := proxy.SOCKS5("tcp", w.BindAddress, nil, proxy.Direct)
 	if err != nil {
 		return nil, err
 	}
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
 	return d.Dial(network, addr)
 }
 
 // Dial establishes a WebSocket connection.
 func (w *WSTunnel) Dial(endpoint string) (*websocket.Conn, error) {
+	return w.DialContext(context.Background(), endpoint)
+}
+
+// DialContext establishes a WebSocket connection, giving up once ctx is done.
+func (w *WSTunnel) DialContext(ctx context.Context, endpoint string) (*websocket.Conn, error) {
+	if w.HTTP2 && strings.HasPrefix(endpoint, "wss://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := w.h1Only.Load(u.Host); !ok {
+			conn, err := w.dialHTTP2(ctx, endpoint)
+			if err == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			logger.Errorf("websocket over http2 to %s failed, falling back to http/1.1: %v", u.Host, err)
+			if errors.Is(err, errNoExtendedConnect) || errors.Is(err, errNoH2) {
+				w.h1Only.Store(u.Host, struct{}{})
+			}
+		}
+	}
+
 	d := websocket.Dialer{
+		HandshakeTimeout: w.HandshakeTimeout,
 		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			return w.socks5TCPDial(ctx, network, addr)
 		},
 
 		NetDialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return w.Dialer.TLSDial(func(network, addr, hostPort string) (net.Conn, error) {
+			return w.Dialer.TLSDialWithOptions(func(network, addr, hostPort string) (net.Conn, error) {
 				return w.socks5TCPDial(ctx, network, addr)
-			}, network, addr, "")
+			}, network, addr, "", w.tlsOptions(addr, nil))
 		},
 	}
-	conn, _, err := d.Dial(endpoint, nil)
+	conn, _, err := d.DialContext(ctx, endpoint, nil)
 	return conn, err
 }
 
-// PersistentDial establishes a persistent WebSocket connection.
+// tlsOptions returns the options of a TLS dial to the worker at addr. The
+// connection is relayed to a clean IP by the proxy, so the hostname of addr
+// is still the intended worker.
+func (w *WSTunnel) tlsOptions(addr string, alpn []string) dialer.TLSOptions {
+	opts := dialer.TLSOptions{ALPN: alpn, ClientCert: w.ClientCert}
+	if w.VerifyTLS {
+		opts.VerifyHostname = w.TLSHostname
+		if opts.VerifyHostname == "" {
+			opts.VerifyHostname, _, _ = net.SplitHostPort(addr)
+		}
+	}
+	return opts
+}
+
+// h2ALPN returns the protocols offered when dialing HTTP/2, the protocols set
+// on the dialer if they include h2.
+func (w *WSTunnel) h2ALPN() []string {
+	if slices.Contains(w.Dialer.ALPNProtocols, "h2") {
+		return w.Dialer.ALPNProtocols
+	}
+	return []string{"h2"}
+}
+
+// pool returns the pool of HTTP/2 connections to the workers.
+func (w *WSTunnel) pool() *h2Pool {
+	w.h2PoolOnce.Do(func() {
+		w.h2Pool = &h2Pool{
+			maxIdle:     w.MaxIdleConns,
+			maxLifetime: w.MaxConnLifetime,
+			idleTimeout: w.IdleConnTimeout,
+		}
+	})
+	return w.h2Pool
+}
+
+// dialHTTP2 opens the WebSocket as an extended CONNECT stream of an HTTP/2
+// connection, a pooled one if MaxIdleConns is set. gorilla still does the
+// handshake and framing, the upgrade request it writes is translated by
+// upgradeShim.
+func (w *WSTunnel) dialHTTP2(ctx context.Context, endpoint string) (*websocket.Conn, error) {
+	d := websocket.Dialer{
+		HandshakeTimeout: w.HandshakeTimeout,
+		NetDialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			session, err := w.h2Session(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			return newUpgradeShim(ctx, session), nil
+		},
+	}
+	conn, _, err := d.DialContext(ctx, endpoint, nil)
+	return conn, err
+}
+
+// h2Session returns an HTTP/2 connection to the worker at addr with a stream
+// reserved, from the pool or dialed through the proxy.
+func (w *WSTunnel) h2Session(ctx context.Context, addr string) (*h2Session, error) {
+	return w.pool().get(ctx, addr, func(ctx context.Context) (net.Conn, error) {
+		conn, err := w.Dialer.TLSDialWithOptions(func(network, addr, hostPort string) (net.Conn, error) {
+			return w.socks5TCPDial(ctx, network, addr)
+		}, "tcp", addr, "", w.tlsOptions(addr, w.h2ALPN()))
+		if err != nil {
+			return nil, err
+		}
+		if uc, ok := conn.(*tls.UConn); !ok || uc.ConnectionState().NegotiatedProtocol != "h2" {
+			_ = conn.Close()
+			return nil, errNoH2
+		}
+		return conn, nil
+	})
+}
+
+// workerHostPort returns the address of the worker at u, on port 443 unless
+// u has one.
+func workerHostPort(u *url.URL) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return u.Host
+}
+
+// PersistentDial establishes a persistent WebSocket connection. The channel it
+// returns must be released with Unbind once the association is over. The
+// packets sent on the returned send channel wait in the queue of the tunnel,
+// whose channels take turns on the connection.
 func (w *WSTunnel) PersistentDial(tunnelEndpoint string, bindWriteChannel chan UDPPacket) (chan UDPPacket, uint16, error) {
+	w.tunnelsMu.Lock()
+	defer w.tunnelsMu.Unlock()
+
+	binding := &udpBinding{recv: bindWriteChannel, send: make(chan UDPPacket), done: make(chan struct{})}
 	if tunnel, ok := w.EstablishedTunnels[tunnelEndpoint]; ok {
-		tunnel.channelIndex = tunnel.channelIndex + 1
-		tunnel.bindWriteChannels[tunnel.channelIndex] = bindWriteChannel
-		return tunnel.tunnelWriteChannel, tunnel.channelIndex, nil
+		if len(tunnel.bindWriteChannels) >= w.maxChannels() {
+			return nil, 0, ErrTooManyChannels
+		}
+		channel := tunnel.freeChannel()
+		tunnel.bindWriteChannels[channel] = binding
+		go tunnel.feed(channel, binding)
+		return binding.send, channel, nil
 	}
 
 	tunnelWriteChannel := make(chan UDPPacket)
 
-	w.EstablishedTunnels[tunnelEndpoint] = &EstablishedTunnel{
+	tunnel := &EstablishedTunnel{
 		tunnelWriteChannel: tunnelWriteChannel,
-		bindWriteChannels:  make(map[uint16]chan UDPPacket),
+		bindWriteChannels:  make(map[uint16]*udpBinding),
 		channelIndex:       1,
+		queue:              newFairQueue(),
+		stop:               make(chan struct{}),
 	}
+	tunnel.bindWriteChannels[1] = binding
+	w.EstablishedTunnels[tunnelEndpoint] = tunnel
+	go tunnel.feed(1, binding)
 
-	w.EstablishedTunnels[tunnelEndpoint].bindWriteChannels[1] = bindWriteChannel
+	clk := clock.Or(w.Clock)
+	var lastActivityStamp atomic.Int64
+	lastActivityStamp.Store(clk.Now().Unix())
+	var retransmit *retransmitBuffer
+	if replayable(tunnelEndpoint) {
+		retransmit = newRetransmitBuffer(w.RetransmitBuffer, w.RetransmitWindow)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-tunnel.stop:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
 
-	lastActivityStamp := time.Now().Unix()
+	go func() {
+		for {
+			pkt, ok := tunnel.queue.pop(ctx)
+			if !ok {
+				return
+			}
+			select {
+			case tunnelWriteChannel <- pkt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
 	go func() {
-		defer delete(w.EstablishedTunnels, tunnelEndpoint)
-		if time.Now().Unix()-lastActivityStamp > w.LinkIdleTimeout {
+		defer cancel()
+		defer func() {
+			w.tunnelsMu.Lock()
+			if w.EstablishedTunnels[tunnelEndpoint] == tunnel {
+				delete(w.EstablishedTunnels, tunnelEndpoint)
+			}
+			w.tunnelsMu.Unlock()
+		}()
+		if clk.Now().Unix()-lastActivityStamp.Load() > w.LinkIdleTimeout {
 			return
 		}
-		for {
+		var dropped time.Time
+		// current is the endpoint the channels are carried to, the one of
+		// the standby connection after it took over
+		current := tunnelEndpoint
+		var standby *standbyConn
+		var lastReset chan struct{}
+		for ctx.Err() == nil {
+			if standby != nil {
+				select {
+				case <-lastReset:
+					// the standby is on the dead link too
+					standby.close()
+					standby = nil
+				default:
+				}
+			}
 			done := make(chan struct{})
 			doneR := make(chan struct{})
+			reset := make(chan struct{})
+			lastReset = reset
+			w.tunnelsMu.Lock()
+			tunnel.reset = reset
+			w.tunnelsMu.Unlock()
 
-			logger.Infof("connecting to %s\r\n", tunnelEndpoint)
-
-			c, err := w.Dial(tunnelEndpoint)
+			var c *websocket.Conn
+			if standby != nil {
+				if c = standby.take(); c != nil {
+					logger.Infof("switching to the standby connection to %s\r\n", logger.Redact(standby.endpoint))
+					current = standby.endpoint
+				}
+			}
+			if c == nil {
+				logger.Infof("connecting to %s\r\n", logger.Redact(current))
+				var err error
+				if c, err = w.DialContext(ctx, current); err != nil {
+					logger.Errorf("error dialing udp over tcp tunnel: %v\r\n", err)
+					select {
+					case <-ctx.Done():
+					case <-clk.After(tunnelRedialDelay):
+					}
+					continue
+				}
+			}
+			if w.StandbyEndpoint != nil && (standby == nil || standby.done()) {
+				standby = nil
+				if endpoint := w.StandbyEndpoint(current); endpoint != "" {
+					standby = w.startStandby(ctx, endpoint)
+				}
+			}
 			conn := wsconnadapter.New(c)
-
-			if err != nil {
-				logger.Errorf("error dialing udp over tcp tunnel: %v\r\n", err)
-				continue
+			if !dropped.IsZero() && w.OnReconnect != nil {
+				w.OnReconnect(tunnelEndpoint)
 			}
+
+			replay := retransmit.replay(dropped)
 			// Write
 			go func() {
 				defer func() {
@@ -106,25 +405,39 @@ func (w *WSTunnel) PersistentDial(tunnelEndpoint string, bindWriteChannel chan U
 
 				defer logger.Info("write closed")
 
+				for i, rt := range replay {
+					if err := writeFrame(conn, w.ShortClientID, rt); err != nil {
+						logger.Info("replay:", err)
+						for _, pkt := range replay[i:] {
+							retransmit.failedPacket(pkt, clk.Now())
+						}
+						return
+					}
+					retransmit.sentPacket(rt, clk.Now())
+				}
+
 				for {
 					select {
 					case <-done:
 						return
+					case <-ctx.Done():
+						return
+					case <-reset:
+						return
 					case rt := <-tunnelWriteChannel:
 						err := conn.SetWriteDeadline(time.Now().Add(time.Duration(w.WriteTimeout) * time.Second))
 						if err != nil {
 							return
 						}
 
-						bs := make([]byte, 2)
-						binary.BigEndian.PutUint16(bs, rt.Channel)
-
-						_, err = conn.Write(append([]byte(w.ShortClientID), append(bs, rt.Data...)...))
-						if err != nil {
+						// any failure, including a short write, drops this connection and triggers a reconnect
+						if err := writeFrame(conn, w.ShortClientID, rt); err != nil {
 							logger.Info("write:", err)
+							retransmit.failedPacket(rt, clk.Now())
 							return
 						}
-						lastActivityStamp = time.Now().Unix()
+						retransmit.sentPacket(rt, clk.Now())
+						lastActivityStamp.Store(clk.Now().Unix())
 					}
 				}
 			}()
@@ -150,39 +463,165 @@ func (w *WSTunnel) PersistentDial(tunnelEndpoint string, bindWriteChannel chan U
 						// 1- unpack the message
 						// 2- find the channel that the message should write on
 						// 3- write the message on that channel
-						rawPacket := make([]byte, 32*1024)
-						n, err := conn.Read(rawPacket)
-						if n < 2 && err == nil {
-							continue
-						}
-
+						rawPacket, err := conn.ReadMessage()
 						if err != nil {
-							if strings.Contains(err.Error(), "websocket: close") ||
-								strings.Contains(err.Error(), "i/o") {
-								logger.Errorf("reading from udp over tcp error: %v\r\n", err)
+							select {
+							case <-doneR:
+								// closed by the writer
 								return
+							default:
 							}
-							logger.Errorf("reading from udp over TCP tunnel packet size error: %v\r\n", err)
-							continue
+							if errors.Is(err, wsconnadapter.ErrUnexpectedMessageType) {
+								w.malformedFrames.Add(1)
+								logger.Errorf("dropping tunnel message that is not binary\r\n")
+								continue
+							}
+							// the connection is done with, reading it again panics
+							logger.Errorf("reading from udp over tcp error: %v\r\n", err)
+							return
 						}
 
-						// The first 2 packets of response are channel ID
-						channelID := binary.BigEndian.Uint16(rawPacket[:2])
-
-						pkt := UDPPacket{
-							channelID,
-							rawPacket[2:n],
+						pkt, err := parseFrame(rawPacket)
+						if err != nil {
+							w.malformedFrames.Add(1)
+							logger.Errorf("dropping malformed tunnel frame: %v\r\n", err)
+							continue
 						}
 
-						if udpBindWriteChan, ok := w.EstablishedTunnels[tunnelEndpoint].bindWriteChannels[pkt.Channel]; ok {
-							udpBindWriteChan <- pkt
-							lastActivityStamp = time.Now().Unix()
+						w.tunnelsMu.Lock()
+						binding, ok := tunnel.bindWriteChannels[pkt.Channel]
+						w.tunnelsMu.Unlock()
+						if ok {
+							// a binding torn down meanwhile no longer reads its channel
+							select {
+							case binding.recv <- pkt:
+								lastActivityStamp.Store(clk.Now().Unix())
+							case <-binding.done:
+							}
 						}
 					}
 				}
 			}()
+			// let the writer settle so its last packets are buffered before the replay
+			<-doneR
+			dropped = clk.Now()
 		}
 	}()
 
-	return tunnelWriteChannel, 1, nil
+	return binding.send, 1, nil
+}
+
+// Reconnect drops the connections of the tunnels to the workers, after a
+// network change left them on a dead link. The UDP tunnels dial again at
+// once, those to DNS servers replaying their recent packets, and the stream
+// tunnels and pooled HTTP/2 connections are closed, so the next connections
+// dial new ones.
+func (w *WSTunnel) Reconnect() {
+	w.tunnelsMu.Lock()
+	for _, tunnel := range w.EstablishedTunnels {
+		if tunnel.reset != nil {
+			close(tunnel.reset)
+			tunnel.reset = nil
+		}
+	}
+	w.tunnelsMu.Unlock()
+
+	w.streamsMu.Lock()
+	for endpoint, mux := range w.streamMuxes {
+		_ = mux.conn.Close()
+		delete(w.streamMuxes, endpoint)
+	}
+	w.streamsMu.Unlock()
+
+	w.pool().closeAll()
+}
+
+// BindUDP binds an association to the persistent tunnel of the worker, see
+// UDPTunnel.
+func (w *WSTunnel) BindUDP(_ context.Context, workerAddress, destination string, recv chan UDPPacket) (chan UDPPacket, uint16, func(), error) {
+	tunnelEndpoint, err := utils.WSEndpointHelper(workerAddress, destination, "udp")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	send, channel, err := w.PersistentDial(tunnelEndpoint, recv)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return send, channel, func() { w.Unbind(tunnelEndpoint, channel) }, nil
+}
+
+// maxChannels returns the most channels a tunnel may carry.
+func (w *WSTunnel) maxChannels() int {
+	if w.MaxChannels <= 0 || w.MaxChannels > maxChannelIDs {
+		return maxChannelIDs
+	}
+	return w.MaxChannels
+}
+
+// Channels returns the number of channels the tunnels carry, the UDP
+// associations and the streams.
+func (w *WSTunnel) Channels() int {
+	w.tunnelsMu.Lock()
+	n := 0
+	for _, tunnel := range w.EstablishedTunnels {
+		n += len(tunnel.bindWriteChannels)
+	}
+	w.tunnelsMu.Unlock()
+	w.streamsMu.Lock()
+	defer w.streamsMu.Unlock()
+	for _, mux := range w.streamMuxes {
+		n += mux.len()
+	}
+	return n
+}
+
+// Unbind releases a channel obtained from PersistentDial. Packets still coming
+// for it are dropped, and the tunnel is closed once it carries no channel.
+func (w *WSTunnel) Unbind(tunnelEndpoint string, channel uint16) {
+	w.tunnelsMu.Lock()
+	defer w.tunnelsMu.Unlock()
+	tunnel, ok := w.EstablishedTunnels[tunnelEndpoint]
+	if !ok {
+		return
+	}
+	binding, ok := tunnel.bindWriteChannels[channel]
+	if !ok {
+		return
+	}
+	close(binding.done)
+	delete(tunnel.bindWriteChannels, channel)
+	tunnel.queue.drop(channel)
+	if len(tunnel.bindWriteChannels) == 0 {
+		delete(w.EstablishedTunnels, tunnelEndpoint)
+		close(tunnel.stop)
+	}
+}
+
+// feed queues the packets of the association bound to channel until it is
+// torn down.
+func (t *EstablishedTunnel) feed(channel uint16, b *udpBinding) {
+	for {
+		select {
+		case pkt := <-b.send:
+			pkt.Channel = channel
+			t.queue.push(pkt)
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// freeChannel picks the next unused channel ID, 0 is never used. The caller
+// must hold tunnelsMu.
+func (t *EstablishedTunnel) freeChannel() uint16 {
+	for i := 0; i < 1<<16; i++ {
+		t.channelIndex++
+		if t.channelIndex == 0 {
+			continue
+		}
+		if _, ok := t.bindWriteChannels[t.channelIndex]; !ok {
+			break
+		}
+	}
+	return t.channelIndex
 }
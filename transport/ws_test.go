@@ -0,0 +1,154 @@
+package transport
+
+import (
+	"bepass/dialer"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTunnelTLSOptions(t *testing.T) {
+	w := &WSTunnel{}
+	if opts := w.tlsOptions("worker.example.com:443", nil); opts.VerifyHostname != "" {
+		t.Errorf("expected no verification by default, got %q", opts.VerifyHostname)
+	}
+
+	w.VerifyTLS = true
+	if opts := w.tlsOptions("worker.example.com:443", nil); opts.VerifyHostname != "worker.example.com" {
+		t.Errorf("expected verification against the endpoint host, got %q", opts.VerifyHostname)
+	}
+
+	w.TLSHostname = "front.example.net"
+	opts := w.tlsOptions("worker.example.com:443", []string{"h2"})
+	if opts.VerifyHostname != "front.example.net" {
+		t.Errorf("expected verification against TLSHostname, got %q", opts.VerifyHostname)
+	}
+	if len(opts.ALPN) != 1 || opts.ALPN[0] != "h2" {
+		t.Errorf("expected the ALPN to be kept, got %v", opts.ALPN)
+	}
+}
+
+func TestTunnelH2ALPN(t *testing.T) {
+	w := &WSTunnel{Dialer: &dialer.Dialer{ALPNProtocols: []string{"http/1.1"}}}
+	if alpn := w.h2ALPN(); len(alpn) != 1 || alpn[0] != "h2" {
+		t.Errorf("expected h2 alone when the dialer does not offer it, got %v", alpn)
+	}
+	w.Dialer.ALPNProtocols = []string{"h2", "http/1.1"}
+	if alpn := w.h2ALPN(); len(alpn) != 2 || alpn[0] != "h2" {
+		t.Errorf("expected the dialer protocols, got %v", alpn)
+	}
+}
+
+func TestTunnelHandshakeTimeout(t *testing.T) {
+	// a proxy that accepts the connection and never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	w := &WSTunnel{BindAddress: ln.Addr().String(), Dialer: &dialer.Dialer{}, HandshakeTimeout: 100 * time.Millisecond}
+	begin := time.Now()
+	if _, err := w.Dial("wss://worker.example.com/link"); err == nil {
+		t.Fatal("expected the handshake to time out")
+	}
+	if elapsed := time.Since(begin); elapsed > 2*time.Second {
+		t.Errorf("expected the dial to give up after the handshake timeout, took %v", elapsed)
+	}
+}
+
+func TestTunnelBrokenFrame(t *testing.T) {
+	for name, frame := range map[string][]byte{
+		// the header of a 256 byte binary frame, and the link drops in its payload
+		"truncated": {0x82, 0x7e, 0x01, 0x00, 'p', 'a', 'r', 't'},
+		// reserved bits no extension was negotiated for
+		"reserved bits": {0xf2, 0x04, 'p', 'i', 'n', 'g'},
+	} {
+		t.Run(name, func(t *testing.T) { testTunnelBrokenFrame(t, frame) })
+	}
+}
+
+// testTunnelBrokenFrame has the worker answer the first frame of a tunnel
+// with frame and drop the connection, which the tunnel has to redial.
+func testTunnelBrokenFrame(t *testing.T, frame []byte) {
+	var accepted atomic.Int32
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		first := accepted.Add(1) == 1
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if first {
+				_, _ = conn.UnderlyingConn().Write(frame)
+				return
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	tunnel := &WSTunnel{
+		BindAddress:        relayProxy(t),
+		Dialer:             &dialer.Dialer{},
+		ReadTimeout:        60,
+		WriteTimeout:       60,
+		LinkIdleTimeout:    60,
+		EstablishedTunnels: make(map[string]*EstablishedTunnel),
+	}
+	endpoint := "ws://" + srv.Listener.Addr().String() + "/connect?host=1.1.1.1&port=53&net=udp"
+	recv := make(chan UDPPacket, 1)
+	send, channel, err := tunnel.PersistentDial(endpoint, recv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Unbind(endpoint, channel)
+
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case send <- UDPPacket{Channel: channel, Data: []byte("ping")}:
+		case <-deadline:
+			t.Fatal("could not send")
+		}
+		select {
+		case pkt := <-recv:
+			if string(pkt.Data) != "ping" {
+				t.Fatalf("unexpected reply %q", pkt.Data)
+			}
+			if accepted.Load() < 2 {
+				t.Fatal("expected the reply on a new connection")
+			}
+			if n := tunnel.MalformedFrames(); n != 0 {
+				t.Errorf("expected the dropped link not to count as malformed frames, got %d", n)
+			}
+			return
+		case <-time.After(200 * time.Millisecond):
+			// sent while the tunnel was reconnecting
+		case <-deadline:
+			t.Fatal("expected the tunnel to reconnect after the broken frame")
+		}
+	}
+}
@@ -2,12 +2,26 @@
 package utils
 
 import (
+	"bepass/clock"
 	"fmt"
+	"math/rand"
 	"runtime"
 	"sync"
 	"time"
 )
 
+// CacheStore is a key-value store for cached lookups. Cache is the in-memory
+// implementation, RedisCache lets several instances share one cache.
+type CacheStore interface {
+	Get(k string) (interface{}, bool)
+	Set(k string, x interface{})
+	SetWithExpiration(k string, x interface{}, d time.Duration)
+	Delete(k string)
+	// Flush removes every item
+	Flush()
+	Len() int
+}
+
 // Item represents an item in the cache.
 type Item struct {
 	Object     interface{}
@@ -54,28 +68,50 @@ type cache struct {
 	mu         sync.RWMutex
 	onExpired  func()
 	janitor    *janitor
+	// stale is how long an expired item may still be served while it is refreshed
+	stale time.Duration
+	// jitter is the most an item expires before its time, at random
+	jitter time.Duration
+	// refreshing holds the deadline of the caller currently refreshing a stale key
+	refreshing map[string]int64
+	// clock tells the time items expire on, the real one if nil
+	clock clock.Clock
 }
 
+// revalidateTimeout bounds how long other callers wait on a refresh before
+// another one is allowed to try.
+const revalidateTimeout = 10 * time.Second
+
 // Set add an item to the cache, replacing any existing item.
 func (c *cache) Set(k string, x interface{}) {
 	// "Inlining" of set
-	var e = time.Now().Add(c.expiration).UnixNano()
-
 	c.mu.Lock()
 	c.items[k] = Item{
 		Object:     x,
-		Expiration: e,
+		Expiration: c.expireAfter(c.expiration),
 	}
+	delete(c.refreshing, k)
 	// TODO: Calls to mu.Unlock are currently not deferred because defer
 	// adds ~200 ns (as of go1.)
 	c.mu.Unlock()
 }
 
+// SetWithExpiration adds an item to the cache that expires after d instead of
+// the default expiration, replacing any existing item.
+func (c *cache) SetWithExpiration(k string, x interface{}, d time.Duration) {
+	c.mu.Lock()
+	c.items[k] = Item{
+		Object:     x,
+		Expiration: c.expireAfter(d),
+	}
+	delete(c.refreshing, k)
+	c.mu.Unlock()
+}
+
 func (c *cache) set(k string, x interface{}) {
-	var e = time.Now().Add(c.expiration).UnixNano()
 	c.items[k] = Item{
 		Object:     x,
-		Expiration: e,
+		Expiration: c.expireAfter(c.expiration),
 	}
 }
 
@@ -93,7 +129,9 @@ func (c *cache) Replace(k string, x interface{}) error {
 }
 
 // Get an item from the cache. Returns the item or nil, and a bool indicating
-// whether the key was found.
+// whether the key was found. Expired items are reported as missing, unless they
+// expired less than the stale window ago: then the first caller gets a miss so
+// it refreshes the item while everyone else keeps getting the stale value.
 func (c *cache) Get(k string) (interface{}, bool) {
 	c.mu.RLock()
 	item, found := c.items[k]
@@ -102,7 +140,73 @@ func (c *cache) Get(k string) (interface{}, bool) {
 		return nil, false
 	}
 	c.mu.RUnlock()
-	return item.Object, true
+	if item.Expiration == 0 || c.now().UnixNano() <= item.Expiration {
+		return item.Object, true
+	}
+	return c.getStale(k, item)
+}
+
+func (c *cache) getStale(k string, item Item) (interface{}, bool) {
+	now := c.now().UnixNano()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now > item.Expiration+int64(c.stale) {
+		return nil, false
+	}
+	if deadline, ok := c.refreshing[k]; ok && now < deadline {
+		return item.Object, true
+	}
+	if c.refreshing == nil {
+		c.refreshing = make(map[string]int64)
+	}
+	c.refreshing[k] = now + int64(revalidateTimeout)
+	return nil, false
+}
+
+// SetStaleWindow sets how long expired items may still be served while a
+// single caller refreshes them, 0 disables serving stale items.
+func (c *cache) SetStaleWindow(d time.Duration) {
+	c.mu.Lock()
+	c.stale = d
+	c.mu.Unlock()
+}
+
+// SetJitter has the items expire up to d before their time, at random, and at
+// most half their lifetime early, so the names looked up all the time are not
+// asked for again at regular intervals. 0 disables it.
+func (c *cache) SetJitter(d time.Duration) {
+	c.mu.Lock()
+	c.jitter = d
+	c.mu.Unlock()
+}
+
+// expireAfter returns the expiration of an item living for d, 0 for never.
+// c.mu must be held.
+func (c *cache) expireAfter(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	jitter := c.jitter
+	if jitter > d/2 {
+		jitter = d / 2
+	}
+	if jitter > 0 {
+		d -= time.Duration(rand.Int63n(int64(jitter) + 1))
+	}
+	return c.now().Add(d).UnixNano()
+}
+
+// SetClock sets the clock the expirations are computed on, so tests can move
+// time forward, nil restores the real one. It is meant to be called before
+// the cache is used, the janitor keeps running on the real clock.
+func (c *cache) SetClock(clk clock.Clock) {
+	c.mu.Lock()
+	c.clock = clk
+	c.mu.Unlock()
+}
+
+func (c *cache) now() time.Time {
+	return clock.Or(c.clock).Now()
 }
 
 func (c *cache) get(k string) (interface{}, bool) {
@@ -133,16 +237,19 @@ func (c *cache) GetAll() map[string]interface{} {
 func (c *cache) Delete(k string) {
 	c.mu.Lock()
 	delete(c.items, k)
+	delete(c.refreshing, k)
 	c.mu.Unlock()
 }
 
-// DeleteExpired Delete all expired items from the cache.
+// DeleteExpired Delete all expired items from the cache, keeping the ones that
+// are still inside the stale window.
 func (c *cache) DeleteExpired() {
-	now := time.Now().UnixNano()
+	now := c.now().UnixNano()
 	c.mu.Lock()
 	for k, v := range c.items {
-		if v.Expiration > 0 && now > v.Expiration {
+		if v.Expiration > 0 && now > v.Expiration+int64(c.stale) {
 			delete(c.items, k)
+			delete(c.refreshing, k)
 		}
 	}
 	c.mu.Unlock()
@@ -166,10 +273,16 @@ func (c *cache) ItemCount() int {
 	return n
 }
 
+// Len returns the number of items in the cache, including expired items.
+func (c *cache) Len() int {
+	return c.ItemCount()
+}
+
 // Flush Delete all items from the cache.
 func (c *cache) Flush() {
 	c.mu.Lock()
 	c.items = map[string]Item{}
+	c.refreshing = nil
 	c.mu.Unlock()
 }
 
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"bepass/clock"
+	"testing"
+	"time"
+)
+
+func TestCacheExpiration(t *testing.T) {
+	c := NewCache(20 * time.Millisecond)
+	c.Set("k", "v")
+	if v, found := c.Get("k"); !found || v != "v" {
+		t.Fatalf("Get = %v, %v", v, found)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, found := c.Get("k"); found {
+		t.Fatal("expected expired item to be missing")
+	}
+
+	forever := NewCache(0)
+	forever.Set("k", "v")
+	if _, found := forever.Get("k"); !found {
+		t.Fatal("expected item without expiration to be found")
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	c := NewCache(20 * time.Millisecond)
+	c.SetStaleWindow(time.Minute)
+	c.Set("k", "old")
+	time.Sleep(30 * time.Millisecond)
+
+	// exactly one caller is sent upstream, the others keep the stale value
+	if _, found := c.Get("k"); found {
+		t.Fatal("first caller after expiry should refresh")
+	}
+	for i := 0; i < 3; i++ {
+		if v, found := c.Get("k"); !found || v != "old" {
+			t.Fatalf("Get = %v, %v, want stale value", v, found)
+		}
+	}
+
+	c.Set("k", "new")
+	if v, found := c.Get("k"); !found || v != "new" {
+		t.Fatalf("Get = %v, %v, want refreshed value", v, found)
+	}
+}
+
+func TestCacheStaleWindowElapsed(t *testing.T) {
+	c := NewCache(10 * time.Millisecond)
+	c.SetStaleWindow(10 * time.Millisecond)
+	c.Set("k", "v")
+	time.Sleep(30 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if _, found := c.Get("k"); found {
+			t.Fatal("expected item past the stale window to be missing")
+		}
+	}
+}
+
+func TestCacheFakeClock(t *testing.T) {
+	f := clock.NewFake(time.Unix(1000, 0))
+	c := NewCache(time.Minute)
+	c.SetClock(f)
+	c.SetStaleWindow(30 * time.Second)
+	c.SetWithExpiration("short", "v", time.Second)
+	c.Set("k", "v")
+
+	f.Advance(59 * time.Second)
+	if _, found := c.Get("k"); !found {
+		t.Fatal("expected the item found before its expiration")
+	}
+	f.Advance(2 * time.Second)
+	if _, found := c.Get("k"); found {
+		t.Fatal("first caller after expiry should refresh")
+	}
+	if v, found := c.Get("k"); !found || v != "v" {
+		t.Fatalf("Get = %v, %v, want stale value", v, found)
+	}
+	f.Advance(30 * time.Second)
+	c.DeleteExpired()
+	if c.Len() != 0 {
+		t.Errorf("expected the items past the stale window deleted, %d left", c.Len())
+	}
+}
+
+func TestCacheJitter(t *testing.T) {
+	c := NewCache(time.Minute)
+	f := clock.NewFake(time.Unix(1000, 0))
+	c.SetClock(f)
+	c.SetJitter(20 * time.Second)
+	expirations := map[int64]bool{}
+	for i := 0; i < 50; i++ {
+		c.Set("k", "v")
+		e := c.items["k"].Expiration
+		if d := time.Duration(e - f.Now().UnixNano()); d < 40*time.Second || d > time.Minute {
+			t.Fatalf("expected the item to expire 40s to 1m from now, got %v", d)
+		}
+		expirations[e] = true
+	}
+	if len(expirations) < 2 {
+		t.Error("expected the expirations to vary")
+	}
+
+	// never more than half the lifetime early
+	c.SetWithExpiration("short", "v", 10*time.Second)
+	if d := time.Duration(c.items["short"].Expiration - f.Now().UnixNano()); d < 5*time.Second {
+		t.Errorf("expected at most half of 10s taken off, got %v", d)
+	}
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	c := NewCache(time.Minute)
+	c.Set("example.com.", "93.184.216.34")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Get("example.com.")
+	}
+}
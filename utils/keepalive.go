@@ -0,0 +1,31 @@
+// Package utils provides utility functions for the application.
+package utils
+
+import (
+	"net"
+	"time"
+)
+
+// KeepAlive holds TCP keepalive settings in seconds. When Idle is zero the
+// operating system defaults are left untouched.
+type KeepAlive struct {
+	Idle     int // Idle time before the first keepalive probe is sent
+	Interval int // Interval between probes, only honored where the platform allows it
+}
+
+// SetKeepAlive applies the keepalive settings to a TCP connection.
+func SetKeepAlive(conn *net.TCPConn, ka KeepAlive) error {
+	if ka.Idle <= 0 {
+		return nil
+	}
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if err := conn.SetKeepAlivePeriod(time.Duration(ka.Idle) * time.Second); err != nil {
+		return err
+	}
+	if ka.Interval > 0 {
+		return setKeepAliveInterval(conn, ka.Interval)
+	}
+	return nil
+}
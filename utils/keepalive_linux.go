@@ -0,0 +1,22 @@
+// Package utils provides utility functions for the application.
+package utils
+
+import (
+	"net"
+	"syscall"
+)
+
+func setKeepAliveInterval(conn *net.TCPConn, interval int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockOptErr error
+	controlErr := raw.Control(func(fd uintptr) {
+		sockOptErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, interval)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return sockOptErr
+}
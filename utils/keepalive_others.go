@@ -0,0 +1,11 @@
+//go:build !linux
+
+// Package utils provides utility functions for the application.
+package utils
+
+import "net"
+
+// setKeepAliveInterval is a no-op here, SetKeepAlivePeriod already controls the probe timing.
+func setKeepAliveInterval(_ *net.TCPConn, _ int) error {
+	return nil
+}
@@ -0,0 +1,175 @@
+// Package utils provides utility functions for the application.
+package utils
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket that caps throughput to a number of bytes per second.
+// It is safe for concurrent use, so a single Limiter can be shared between
+// connections to enforce a global cap.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a token bucket that allows bytesPerSecond bytes per second
+// with a burst of one second worth of traffic. It returns nil if bytesPerSecond
+// is not positive, meaning no limit.
+func NewLimiter(bytesPerSecond int) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   float64(bytesPerSecond),
+		burst:  bytesPerSecond,
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// WaitN blocks until n bytes can pass through the limiter or ctx is done, in
+// which case the reserved bytes are given back and ctx.Err() is returned.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	// Reserve the tokens up front so concurrent callers queue up behind each other
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func activeLimiters(limiters []*Limiter) []*Limiter {
+	var active []*Limiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	return active
+}
+
+func maxChunk(limiters []*Limiter) int {
+	chunk := limiters[0].burst
+	for _, l := range limiters[1:] {
+		if l.burst < chunk {
+			chunk = l.burst
+		}
+	}
+	return chunk
+}
+
+// RateLimitedReader is an io.Reader that throttles reads through one or more limiters.
+type RateLimitedReader struct {
+	Reader   io.Reader
+	Limiters []*Limiter
+	// Context stops a throttled read from waiting any longer once it is done
+	Context context.Context
+}
+
+// NewRateLimitedReader wraps r with the given limiters. Nil limiters are ignored
+// and r is returned unchanged if none are left, so a disabled limit costs nothing.
+// Reads stop waiting for the limiters and fail with ctx.Err() once ctx is done.
+func NewRateLimitedReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	active := activeLimiters(limiters)
+	if len(active) == 0 {
+		return r
+	}
+	return &RateLimitedReader{Reader: r, Limiters: active, Context: ctx}
+}
+
+// Read implements io.Reader.
+func (r *RateLimitedReader) Read(p []byte) (int, error) {
+	if chunk := maxChunk(r.Limiters); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.Reader.Read(p)
+	for _, l := range r.Limiters {
+		if werr := l.WaitN(r.Context, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// RateLimitedWriter is an io.Writer that throttles writes through one or more limiters.
+type RateLimitedWriter struct {
+	Writer   io.Writer
+	Limiters []*Limiter
+	// Context stops a throttled write from waiting any longer once it is done
+	Context context.Context
+}
+
+// NewRateLimitedWriter wraps w with the given limiters. Nil limiters are ignored
+// and w is returned unchanged if none are left, so a disabled limit costs nothing.
+// Writes stop waiting for the limiters and fail with ctx.Err() once ctx is done.
+func NewRateLimitedWriter(ctx context.Context, w io.Writer, limiters ...*Limiter) io.Writer {
+	active := activeLimiters(limiters)
+	if len(active) == 0 {
+		return w
+	}
+	return &RateLimitedWriter{Writer: w, Limiters: active, Context: ctx}
+}
+
+// Write implements io.Writer.
+func (w *RateLimitedWriter) Write(p []byte) (int, error) {
+	chunk := maxChunk(w.Limiters)
+	written := 0
+	for written < len(p) {
+		end := written + chunk
+		if end > len(p) {
+			end = len(p)
+		}
+		for _, l := range w.Limiters {
+			if err := l.WaitN(w.Context, end-written); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.Writer.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the underlying writer if it supports it.
+func (w *RateLimitedWriter) CloseWrite() error {
+	if cw, ok := w.Writer.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLimiterWaitN(t *testing.T) {
+	if NewLimiter(0) != nil {
+		t.Fatal("expected no limiter without a rate")
+	}
+
+	// the first second worth of bytes is the burst, the rest is paced
+	l := NewLimiter(40000)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.WaitN(context.Background(), 10000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected 10000 bytes over the burst to take about 250ms, took %v", elapsed)
+	}
+}
+
+func TestLimiterWaitNCancel(t *testing.T) {
+	l := NewLimiter(1000)
+	if err := l.WaitN(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.WaitN(ctx, 1000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to be cut short, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the wait to end with ctx, took %v", elapsed)
+	}
+	// the abandoned reservation must not hold back the next caller
+	l.mu.Lock()
+	tokens := l.tokens
+	l.mu.Unlock()
+	if tokens < -100 {
+		t.Errorf("expected the cancelled bytes to be given back, %v tokens left", tokens)
+	}
+
+	if err := l.WaitN(ctx, 1000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a done ctx to fail right away, got %v", err)
+	}
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	src := bytes.NewReader(make([]byte, 50000))
+	if NewRateLimitedReader(context.Background(), src, nil, nil) != io.Reader(src) {
+		t.Fatal("expected the reader unchanged without limiters")
+	}
+
+	start := time.Now()
+	r := NewRateLimitedReader(context.Background(), src, NewLimiter(40000), nil)
+	n, err := io.Copy(io.Discard, r)
+	if err != nil || n != 50000 {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected 50000 bytes at 40000 bytes/s to take about 250ms, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r = NewRateLimitedReader(ctx, bytes.NewReader(make([]byte, 5000)), NewLimiter(1000))
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start = time.Now()
+	n, err = io.Copy(io.Discard, r)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the read to be cancelled, got %d bytes, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the read to end with ctx, took %v", elapsed)
+	}
+}
+
+func TestRateLimitedWriter(t *testing.T) {
+	var dst bytes.Buffer
+	if NewRateLimitedWriter(context.Background(), &dst) != io.Writer(&dst) {
+		t.Fatal("expected the writer unchanged without limiters")
+	}
+
+	// the slower of the limiters sets the pace
+	start := time.Now()
+	w := NewRateLimitedWriter(context.Background(), &dst, NewLimiter(1000000), NewLimiter(40000))
+	if n, err := w.Write(make([]byte, 50000)); err != nil || n != 50000 {
+		t.Fatalf("wrote %d bytes, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected 50000 bytes at 40000 bytes/s to take about 250ms, took %v", elapsed)
+	}
+	if dst.Len() != 50000 {
+		t.Errorf("expected every byte written, got %d", dst.Len())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w = NewRateLimitedWriter(ctx, io.Discard, NewLimiter(1000))
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start = time.Now()
+	n, err := w.Write(make([]byte, 5000))
+	if !errors.Is(err, context.Canceled) || n != 1000 {
+		t.Fatalf("expected the write to stop after the burst, got %d bytes, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the write to end with ctx, took %v", elapsed)
+	}
+}
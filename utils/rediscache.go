@@ -0,0 +1,334 @@
+// Package utils provides utility functions including a cache implementation.
+package utils
+
+import (
+	"bepass/logger"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redisMaxIdleConns = 4
+
+// RedisCache is a CacheStore backed by a Redis server, so several bepass
+// instances can share (and warm up) one DNS cache. Values are stored as strings.
+// Failures are logged and reported as cache misses so the caller falls back to
+// a fresh lookup.
+type RedisCache struct {
+	// Address is the host:port of the Redis server
+	Address string
+	// Password is sent with AUTH when not empty
+	Password string
+	// DB is the database selected on every new connection
+	DB int
+	// Prefix is prepended to every key
+	Prefix string
+	// Expiration is the TTL of stored items, 0 means no expiry
+	Expiration time.Duration
+	// Timeout bounds dialing and every command round trip
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+var errRedisNil = errors.New("redis: nil reply")
+
+// NewRedisCache returns a RedisCache talking to the server at address.
+func NewRedisCache(address, password string, db int, expiration time.Duration) *RedisCache {
+	return &RedisCache{
+		Address:    address,
+		Password:   password,
+		DB:         db,
+		Prefix:     "bepass:",
+		Expiration: expiration,
+		Timeout:    2 * time.Second,
+	}
+}
+
+// Get returns the value stored for k.
+func (c *RedisCache) Get(k string) (interface{}, bool) {
+	v, err := c.do("GET", c.Prefix+k)
+	if err != nil {
+		if !errors.Is(err, errRedisNil) {
+			logger.Errorf("redis get %s failed: %v", logger.Redact(k), err)
+		}
+		return nil, false
+	}
+	return v, true
+}
+
+// Set stores x under k using the configured expiration.
+func (c *RedisCache) Set(k string, x interface{}) {
+	c.SetWithExpiration(k, x, c.Expiration)
+}
+
+// SetWithExpiration stores x under k for d, 0 means no expiry.
+func (c *RedisCache) SetWithExpiration(k string, x interface{}, d time.Duration) {
+	args := []string{"SET", c.Prefix + k, fmt.Sprint(x)}
+	if d > 0 {
+		args = append(args, "PX", strconv.FormatInt(d.Milliseconds(), 10))
+	}
+	if _, err := c.do(args...); err != nil {
+		logger.Errorf("redis set %s failed: %v", logger.Redact(k), err)
+	}
+}
+
+// Delete removes k from the cache.
+func (c *RedisCache) Delete(k string) {
+	if _, err := c.do("DEL", c.Prefix+k); err != nil && !errors.Is(err, errRedisNil) {
+		logger.Errorf("redis del %s failed: %v", logger.Redact(k), err)
+	}
+}
+
+// Len returns the number of keys in the selected database, including keys
+// that were not written by bepass.
+func (c *RedisCache) Len() int {
+	v, err := c.do("DBSIZE")
+	if err != nil {
+		logger.Errorf("redis dbsize failed: %v", err)
+		return 0
+	}
+	n, _ := strconv.Atoi(v)
+	return n
+}
+
+// Flush removes the keys under Prefix, the keys other applications store in
+// the database are kept.
+func (c *RedisCache) Flush() {
+	cursor := "0"
+	for {
+		var keys []string
+		err := c.exec([]string{"SCAN", cursor, "MATCH", redisGlobEscape(c.Prefix) + "*", "COUNT", "500"}, func(rc *redisConn) error {
+			var err error
+			cursor, keys, err = rc.readScanReply()
+			return err
+		})
+		if err != nil {
+			logger.Errorf("redis scan failed: %v", err)
+			return
+		}
+		if len(keys) > 0 {
+			if _, err := c.do(append([]string{"DEL"}, keys...)...); err != nil && !errors.Is(err, errRedisNil) {
+				logger.Errorf("redis del failed: %v", err)
+				return
+			}
+		}
+		if cursor == "0" {
+			return
+		}
+	}
+}
+
+// do runs a single command and returns its reply as a string.
+func (c *RedisCache) do(args ...string) (string, error) {
+	var reply string
+	err := c.exec(args, func(rc *redisConn) error {
+		var err error
+		reply, err = rc.readReply()
+		return err
+	})
+	return reply, err
+}
+
+// exec sends a command on a pooled connection and reads its reply with read.
+func (c *RedisCache) exec(args []string, read func(*redisConn) error) error {
+	rc, err := c.getConn()
+	if err != nil {
+		return err
+	}
+	err = rc.write(c.Timeout, args)
+	if err == nil {
+		err = read(rc)
+	}
+	if err != nil && !errors.Is(err, errRedisNil) && !isRedisError(err) {
+		// the connection state is unknown after an I/O error
+		_ = rc.conn.Close()
+		return err
+	}
+	c.putConn(rc)
+	return err
+}
+
+func (c *RedisCache) getConn() (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		rc := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return rc, nil
+	}
+	c.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", c.Address, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if c.Password != "" {
+		if _, err := rc.roundTrip(c.Timeout, []string{"AUTH", c.Password}); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if c.DB != 0 {
+		if _, err := rc.roundTrip(c.Timeout, []string{"SELECT", strconv.Itoa(c.DB)}); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+func (c *RedisCache) putConn(rc *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= redisMaxIdleConns {
+		_ = rc.conn.Close()
+		return
+	}
+	c.idle = append(c.idle, rc)
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func isRedisError(err error) bool {
+	var re redisError
+	return errors.As(err, &re)
+}
+
+func (rc *redisConn) roundTrip(timeout time.Duration, args []string) (string, error) {
+	if err := rc.write(timeout, args); err != nil {
+		return "", err
+	}
+	return rc.readReply()
+}
+
+func (rc *redisConn) write(timeout time.Duration, args []string) error {
+	if timeout > 0 {
+		_ = rc.conn.SetDeadline(time.Now().Add(timeout))
+	}
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, a := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(a)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, a...)
+		buf = append(buf, '\r', '\n')
+	}
+	_, err := rc.conn.Write(buf)
+	return err
+}
+
+// readReply parses a RESP reply. Only the reply types produced by the commands
+// used above (simple strings, errors, integers and bulk strings) are supported,
+// SCAN is read by readScanReply.
+func (rc *redisConn) readReply() (string, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("redis: malformed bulk length %q", line)
+		}
+		if n < 0 {
+			return "", errRedisNil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, b); err != nil {
+			return "", err
+		}
+		return string(b[:n]), nil
+	default:
+		return "", fmt.Errorf("redis: unsupported reply type %q", line[0])
+	}
+}
+
+// readScanReply parses the reply of SCAN, the next cursor and an array of keys.
+func (rc *redisConn) readScanReply() (string, []string, error) {
+	if n, err := rc.readArrayHeader(); err != nil {
+		return "", nil, err
+	} else if n != 2 {
+		return "", nil, fmt.Errorf("redis: unexpected scan reply of %d elements", n)
+	}
+	cursor, err := rc.readReply()
+	if err != nil {
+		return "", nil, err
+	}
+	n, err := rc.readArrayHeader()
+	if err != nil {
+		return "", nil, err
+	}
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		k, err := rc.readReply()
+		if err != nil {
+			return "", nil, err
+		}
+		keys = append(keys, k)
+	}
+	return cursor, keys, nil
+}
+
+func (rc *redisConn) readArrayHeader() (int, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return 0, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '-':
+		return 0, redisError(line[1:])
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return 0, fmt.Errorf("redis: malformed array length %q", line)
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("redis: unexpected reply type %q", line[0])
+	}
+}
+
+// redisGlobEscape escapes the characters of s special in a MATCH pattern.
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
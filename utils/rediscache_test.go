@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the handful of commands used by RedisCache from a map.
+func fakeRedis(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	data := map[string]string{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					var reply string
+					switch args[0] {
+					case "SET":
+						data[args[1]] = args[2]
+						reply = "+OK\r\n"
+					case "GET":
+						if v, ok := data[args[1]]; ok {
+							reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+						} else {
+							reply = "$-1\r\n"
+						}
+					case "DEL":
+						for _, k := range args[1:] {
+							delete(data, k)
+						}
+						reply = fmt.Sprintf(":%d\r\n", len(args)-1)
+					case "SCAN":
+						// one pass over the keys, the pattern being a prefix
+						prefix := strings.ReplaceAll(strings.TrimSuffix(args[3], "*"), "\\", "")
+						var keys []string
+						for k := range data {
+							if strings.HasPrefix(k, prefix) {
+								keys = append(keys, fmt.Sprintf("$%d\r\n%s\r\n", len(k), k))
+							}
+						}
+						reply = fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n%s", len(keys), strings.Join(keys, ""))
+					case "DBSIZE":
+						reply = fmt.Sprintf(":%d\r\n", len(data))
+					default:
+						reply = "-ERR unknown command\r\n"
+					}
+					mu.Unlock()
+					if _, err := io.WriteString(conn, reply); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		var l int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &l); err != nil {
+			return nil, err
+		}
+		b := make([]byte, l+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:l])
+	}
+	return args, nil
+}
+
+func TestRedisCache(t *testing.T) {
+	var c CacheStore = NewRedisCache(fakeRedis(t), "", 0, time.Minute)
+
+	if _, found := c.Get("example.com."); found {
+		t.Fatal("expected a miss on an empty cache")
+	}
+	c.Set("example.com.", "93.184.216.34")
+	v, found := c.Get("example.com.")
+	if !found || v != "93.184.216.34" {
+		t.Fatalf("Get = %v, %v", v, found)
+	}
+	if n := c.Len(); n != 1 {
+		t.Fatalf("Len = %d, want 1", n)
+	}
+	c.Delete("example.com.")
+	if _, found := c.Get("example.com."); found {
+		t.Fatal("expected a miss after Delete")
+	}
+}
+
+func TestRedisCacheFlush(t *testing.T) {
+	addr := fakeRedis(t)
+	c := NewRedisCache(addr, "", 0, time.Minute)
+	other := NewRedisCache(addr, "", 0, time.Minute)
+	other.Prefix = "other:"
+
+	c.Set("a.example.com.", "1.1.1.1")
+	c.Set("b.example.com.", "2.2.2.2")
+	other.Set("a.example.com.", "3.3.3.3")
+	c.Flush()
+	for _, k := range []string{"a.example.com.", "b.example.com."} {
+		if _, found := c.Get(k); found {
+			t.Errorf("expected %s to be flushed", k)
+		}
+	}
+	if _, found := other.Get("a.example.com."); !found {
+		t.Error("expected the keys of another prefix to be kept")
+	}
+}
+
+func TestRedisCacheUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := NewRedisCache(addr, "", 0, 0)
+	c.Set("k", strconv.Itoa(1))
+	if _, found := c.Get("k"); found {
+		t.Fatal("expected a miss when redis is down")
+	}
+}
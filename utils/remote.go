@@ -0,0 +1,85 @@
+// Package utils provides utility functions for the application.
+package utils
+
+import (
+	"bepass/logger"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// remoteRetryInterval is used instead of the refresh interval after a failed
+// fetch, so a list that could not be loaded at startup shows up soon after.
+const remoteRetryInterval = 30 * time.Second
+
+// RemoteFile periodically downloads a file and hands every new version to
+// OnUpdate. Unchanged files are detected with ETag so they are neither
+// transferred nor parsed again.
+type RemoteFile struct {
+	URL      string
+	Interval time.Duration
+	Client   *http.Client
+	OnUpdate func(data []byte) error
+
+	etag string
+}
+
+// Run fetches the file right away and then every Interval until ctx is done.
+func (f *RemoteFile) Run(ctx context.Context) {
+	for {
+		wait := f.Interval
+		if err := f.Fetch(ctx); err != nil {
+			logger.Errorf("failed to fetch %s: %v", f.URL, err)
+			if wait <= 0 || wait > remoteRetryInterval {
+				wait = remoteRetryInterval
+			}
+		}
+		if wait <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Fetch downloads the file once and calls OnUpdate if it changed.
+func (f *RemoteFile) Fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+	if err != nil {
+		return err
+	}
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := f.OnUpdate(data); err != nil {
+		return err
+	}
+	f.etag = resp.Header.Get("ETag")
+	return nil
+}
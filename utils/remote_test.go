@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteFileETag(t *testing.T) {
+	var served int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		served++
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("93.184.216.34 example.com"))
+	}))
+	defer srv.Close()
+
+	var updates []string
+	f := &RemoteFile{
+		URL:    srv.URL,
+		Client: srv.Client(),
+		OnUpdate: func(data []byte) error {
+			updates = append(updates, string(data))
+			return nil
+		},
+	}
+	for i := 0; i < 3; i++ {
+		if err := f.Fetch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if served != 1 || len(updates) != 1 {
+		t.Fatalf("served %d times with %d updates, want 1 and 1", served, len(updates))
+	}
+}
@@ -0,0 +1,28 @@
+// Package utils provides utility functions for the application.
+package utils
+
+import (
+	"net"
+	"os"
+)
+
+// SdNotify sends state (e.g. "READY=1") to the service manager over the socket
+// in NOTIFY_SOCKET, as systemd expects from Type=notify services. It does
+// nothing when the variable is not set.
+func SdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
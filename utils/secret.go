@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ResolveSecret returns the secret s refers to, so the config does not hold
+// it in plaintext: "env:NAME" is the value of the environment variable NAME
+// and "file:PATH" the content of the file at PATH, without its trailing
+// newline. Any other value is the secret itself.
+func ResolveSecret(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "env:"):
+		name := strings.TrimPrefix(s, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(s, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return s, nil
+}
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("BEPASS_TEST_SECRET", "from-env")
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for s, want := range map[string]string{
+		"plain":                  "plain",
+		"env:BEPASS_TEST_SECRET": "from-env",
+		"file:" + path:           "from-file",
+	} {
+		got, err := ResolveSecret(s)
+		if err != nil {
+			t.Errorf("ResolveSecret(%s) failed: %v", s, err)
+		} else if got != want {
+			t.Errorf("ResolveSecret(%s) = %q, want %q", s, got, want)
+		}
+	}
+	for _, s := range []string{"env:BEPASS_TEST_UNSET", "file:" + filepath.Join(t.TempDir(), "missing")} {
+		if _, err := ResolveSecret(s); err == nil {
+			t.Errorf("expected an error for %s", s)
+		}
+	}
+}
@@ -11,6 +11,10 @@ import (
 	"time"
 )
 
+// ErrUnexpectedMessageType is returned for a message that is not binary, the
+// connection can still be read from after it.
+var ErrUnexpectedMessageType = errors.New("unexpected websocket message type")
+
 // Adapter represents an adapter for representing WebSocket connection as a net.Conn.
 // Some caveats apply: https://github.com/gorilla/websocket/issues/441
 type Adapter struct {
@@ -40,7 +44,7 @@ func (a *Adapter) Read(b []byte) (int, error) {
 		}
 
 		if messageType != websocket.BinaryMessage {
-			return 0, errors.New("unexpected websocket message type")
+			return 0, ErrUnexpectedMessageType
 		}
 
 		a.reader = reader
@@ -60,6 +64,22 @@ func (a *Adapter) Read(b []byte) (int, error) {
 	return bytesRead, err
 }
 
+// ReadMessage reads a whole binary message from the WebSocket connection. Unlike Read
+// it keeps message boundaries, so it must not be mixed with Read on the same connection.
+func (a *Adapter) ReadMessage() ([]byte, error) {
+	a.readMutex.Lock()
+	defer a.readMutex.Unlock()
+
+	messageType, data, err := a.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if messageType != websocket.BinaryMessage {
+		return nil, ErrUnexpectedMessageType
+	}
+	return data, nil
+}
+
 // Write writes data to the WebSocket connection.
 func (a *Adapter) Write(b []byte) (int, error) {
 	a.writeMutex.Lock()